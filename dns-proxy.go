@@ -0,0 +1,520 @@
+package point_c
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/trymoose/point-c/pkg/configvalues"
+	"go.mrchanchal.com/zaphandler"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	_ caddy.Provisioner     = (*DNSProxies)(nil)
+	_ caddy.CleanerUpper    = (*DNSProxies)(nil)
+	_ caddy.Module          = (*DNSProxies)(nil)
+	_ caddy.App             = (*DNSProxies)(nil)
+	_ caddyfile.Unmarshaler = (*DNSProxies)(nil)
+)
+
+const (
+	// dnsPort is the port queries are answered on.
+	dnsPort = 53
+	// dnsUpstreamTimeout is how long an upstream resolver has to answer.
+	dnsUpstreamTimeout = 5 * time.Second
+	// dnsIdleTimeout is how long a TCP connection may wait for a query.
+	dnsIdleTimeout = 10 * time.Second
+	// dnsMaxQueries is how many UDP queries a proxy answers at once. Further queries wait in the socket's buffer,
+	// so a peer flooding the proxy cannot start an unbounded number of upstream exchanges.
+	dnsMaxQueries = 64
+	// defaultDNSCacheSize is how many answers are cached if the size is not set.
+	defaultDNSCacheSize = 1000
+	// resolvConf lists the resolvers of the host.
+	resolvConf = "/etc/resolv.conf"
+)
+
+type (
+	// DNSProxies answers DNS queries inside point-c nets by forwarding them to resolvers of the host,
+	// so peers routing all traffic through the tunnel can use the host as their resolver.
+	DNSProxies struct {
+		Proxies []*DNSProxy `json:"proxies,omitempty"`
+		proxies []*dnsProxy
+		pointc  *Pointc
+		stop    []func() error
+		logger  *slog.Logger
+	}
+	DNSProxy struct {
+		// Name is the net queries are answered on, on port 53 of its address.
+		Name configvalues.Hostname `json:"name"`
+		// Upstreams are the resolvers queries are forwarded to as host[:port]. The resolvers in /etc/resolv.conf are used if empty.
+		Upstreams []string `json:"upstreams,omitempty"`
+		// CacheSize is how many answers are cached. Defaults to 1000, negative disables the cache.
+		CacheSize int `json:"cache_size,omitempty"`
+		// LogQueries logs every query with the peer it came from.
+		LogQueries bool `json:"log_queries,omitempty"`
+	}
+)
+
+// dnsProxy answers queries on one net.
+type dnsProxy struct {
+	net        Net
+	upstreams  []string
+	cache      *dnsCache     // cache is nil if disabled.
+	queries    chan struct{} // queries holds a value for each UDP query being answered.
+	logQueries bool
+	pointc     *Pointc
+	logger     *slog.Logger
+}
+
+func (*DNSProxies) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "dns-proxy",
+		New: func() caddy.Module { return new(DNSProxies) },
+	}
+}
+
+func (p *DNSProxies) Provision(ctx caddy.Context) error {
+	p.logger = slog.New(zaphandler.New(ctx.Logger()))
+	v, err := ctx.App("point-c")
+	if err != nil {
+		return err
+	}
+	p.pointc = v.(*Pointc)
+
+	for _, proxy := range p.Proxies {
+		n, ok := p.pointc.Lookup(proxy.Name.Value())
+		if !ok {
+			return fmt.Errorf("network %q not found", proxy.Name.Value())
+		} else if n.LocalAddr() == nil {
+			return fmt.Errorf("network %q has no address to listen on", proxy.Name.Value())
+		}
+
+		upstreams := proxy.Upstreams
+		if len(upstreams) == 0 {
+			if upstreams, err = hostResolvers(resolvConf); err != nil {
+				return err
+			}
+		}
+		dp := &dnsProxy{net: n, queries: make(chan struct{}, dnsMaxQueries), logQueries: proxy.LogQueries, pointc: p.pointc, logger: p.logger.With("network", proxy.Name.Value())}
+		for _, u := range upstreams {
+			if _, _, err := net.SplitHostPort(u); err != nil {
+				u = net.JoinHostPort(strings.Trim(u, "[]"), strconv.Itoa(dnsPort))
+			}
+			dp.upstreams = append(dp.upstreams, u)
+		}
+		if size := proxy.CacheSize; size >= 0 {
+			if size == 0 {
+				size = defaultDNSCacheSize
+			}
+			dp.cache = newDNSCache(size)
+		}
+		p.proxies = append(p.proxies, dp)
+	}
+
+	p.Proxies = nil
+	return nil
+}
+
+// hostResolvers gets the nameservers of a resolv.conf file.
+func hostResolvers(path string) ([]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read host resolvers: %w", err)
+	}
+	var resolvers []string
+	for s := bufio.NewScanner(bytes.NewReader(b)); s.Scan(); {
+		if fields := strings.Fields(s.Text()); len(fields) >= 2 && fields[0] == "nameserver" {
+			resolvers = append(resolvers, net.JoinHostPort(fields[1], strconv.Itoa(dnsPort)))
+		}
+	}
+	if len(resolvers) == 0 {
+		return nil, fmt.Errorf("no nameservers in %s", path)
+	}
+	return resolvers, nil
+}
+
+func (p *DNSProxies) Start() error {
+	if err := p.pointc.Start(); err != nil {
+		return err
+	}
+	for _, dp := range p.proxies {
+		ip := dp.net.LocalAddr()
+		pc, err := dp.net.ListenPacket(&net.UDPAddr{IP: ip, Port: dnsPort})
+		if err != nil {
+			return err
+		}
+		p.stop = append(p.stop, pc.Close)
+		ln, err := dp.net.Listen(&net.TCPAddr{IP: ip, Port: dnsPort})
+		if err != nil {
+			return err
+		}
+		p.stop = append(p.stop, ln.Close)
+
+		go dp.serveUDP(pc)
+		go dp.serveTCP(ln)
+	}
+	return nil
+}
+
+func (p *DNSProxies) Stop() error {
+	return p.stopAll()
+}
+
+func (p *DNSProxies) Cleanup() error {
+	p.proxies = nil
+	return p.stopAll()
+}
+
+func (p *DNSProxies) stopAll() (err error) {
+	slices.Reverse(p.stop)
+	for _, fn := range p.stop {
+		err = errors.Join(err, fn())
+	}
+	p.stop = nil
+	return
+}
+
+// serveUDP answers queries on a packet conn until it is closed. At most [dnsMaxQueries] are answered at once.
+func (p *dnsProxy) serveUDP(pc net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		p.queries <- struct{}{}
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			<-p.queries
+			return
+		}
+		query := bytes.Clone(buf[:n])
+		go func() {
+			defer func() { <-p.queries }()
+			resp, err := p.answer(context.Background(), query, addr, "udp")
+			if err != nil {
+				p.logger.Debug("failed to answer dns query", "remote", addr, "error", err)
+				return
+			}
+			_, _ = pc.WriteTo(resp, addr)
+		}()
+	}
+}
+
+// serveTCP answers queries on connections from a listener until it is closed.
+func (p *dnsProxy) serveTCP(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go p.serveConn(c)
+	}
+}
+
+// serveConn answers length prefixed queries on a connection until it is idle for [dnsIdleTimeout].
+func (p *dnsProxy) serveConn(c net.Conn) {
+	defer c.Close()
+	for {
+		if err := c.SetDeadline(time.Now().Add(dnsIdleTimeout)); err != nil {
+			return
+		}
+		query, err := readDNSMessage(c)
+		if err != nil {
+			return
+		}
+		resp, err := p.answer(context.Background(), query, c.RemoteAddr(), "tcp")
+		if err != nil {
+			p.logger.Debug("failed to answer dns query", "remote", c.RemoteAddr(), "error", err)
+			return
+		}
+		if _, err := c.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...)); err != nil {
+			return
+		}
+	}
+}
+
+// readDNSMessage reads a length prefixed message from a TCP connection.
+func readDNSMessage(r io.Reader) ([]byte, error) {
+	var size uint16
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// answer answers a query from the cache or the upstream resolvers. If every resolver fails the answer is a server failure.
+// Queries are forwarded with the protocol they were received with, so a truncated UDP answer makes the peer retry with TCP.
+func (p *dnsProxy) answer(ctx context.Context, query []byte, remote net.Addr, network string) ([]byte, error) {
+	var parser dnsmessage.Parser
+	h, err := parser.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := parser.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, cached := p.cache.get(q, h.ID, time.Now())
+	if !cached {
+		for _, upstream := range p.upstreams {
+			if resp, err = exchangeDNS(ctx, network, upstream, query); err == nil {
+				break
+			}
+			p.logger.Debug("dns upstream failed", "upstream", upstream, "error", err)
+		}
+		if err != nil {
+			resp, err = dnsFailure(h, q)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			p.cache.put(q, resp, time.Now())
+		}
+	}
+
+	if p.logQueries {
+		attrs := []any{"remote", remote, "name", q.Name.String(), "type", q.Type.String(), "cached", cached}
+		if ip := addrIP(remote); ip != nil {
+			if peer, ok := p.pointc.nameOf(ip); ok {
+				attrs = append(attrs, "peer", peer)
+			}
+		}
+		if len(resp) >= 4 {
+			attrs = append(attrs, "rcode", dnsmessage.RCode(resp[3]&0xf).String())
+		}
+		p.logger.Info("dns query", attrs...)
+	}
+	return resp, nil
+}
+
+// addrIP gets the ip of a TCP or UDP address.
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+// dnsFailure builds a server failure answer to a query.
+func dnsFailure(h dnsmessage.Header, q dnsmessage.Question) ([]byte, error) {
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true, OpCode: h.OpCode, RecursionDesired: h.RecursionDesired, RecursionAvailable: true, RCode: dnsmessage.RCodeServerFailure})
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	} else if err := b.Question(q); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// exchangeDNS sends a query to a resolver and reads its answer.
+func exchangeDNS(ctx context.Context, network, addr string, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, dnsUpstreamTimeout)
+	defer cancel()
+	var d net.Dialer
+	c, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := c.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+
+	var resp []byte
+	if network == "tcp" {
+		if _, err := c.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)); err != nil {
+			return nil, err
+		} else if resp, err = readDNSMessage(c); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := c.Write(query); err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 65535)
+		n, err := c.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		resp = buf[:n]
+	}
+
+	if len(resp) < 2 || !bytes.Equal(resp[:2], query[:2]) {
+		return nil, errors.New("answer does not match the query")
+	}
+	return resp, nil
+}
+
+// dnsCache holds answers until their records expire.
+type dnsCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[dnsmessage.Question]dnsCacheEntry
+}
+
+type dnsCacheEntry struct {
+	msg     dnsmessage.Message
+	stored  time.Time
+	expires time.Time
+}
+
+// newDNSCache creates a cache holding up to size answers.
+func newDNSCache(size int) *dnsCache {
+	return &dnsCache{size: size, entries: map[dnsmessage.Question]dnsCacheEntry{}}
+}
+
+// cacheKey is the question with its name in lowercase, since names are not case sensitive.
+func cacheKey(q dnsmessage.Question) dnsmessage.Question {
+	if name, err := dnsmessage.NewName(strings.ToLower(q.Name.String())); err == nil {
+		q.Name = name
+	}
+	return q
+}
+
+// get gets the cached answer to a question with the id of the query. The ttls are lowered by the time the answer was cached for.
+func (c *dnsCache) get(q dnsmessage.Question, id uint16, now time.Time) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	e, ok := c.entries[cacheKey(q)]
+	if ok && !now.Before(e.expires) {
+		delete(c.entries, cacheKey(q))
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	// The resources are copied so the cached answer keeps its ttls.
+	msg := e.msg
+	msg.ID = id
+	msg.Questions = []dnsmessage.Question{q}
+	msg.Answers, msg.Authorities, msg.Additionals = slices.Clone(msg.Answers), slices.Clone(msg.Authorities), slices.Clone(msg.Additionals)
+	elapsed := uint32(now.Sub(e.stored) / time.Second)
+	for _, rrs := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities, msg.Additionals} {
+		for i := range rrs {
+			if rrs[i].Header.Type != dnsmessage.TypeOPT {
+				rrs[i].Header.TTL -= min(rrs[i].Header.TTL, elapsed)
+			}
+		}
+	}
+	b, err := msg.Pack()
+	if err != nil {
+		return nil, false
+	}
+	return b, true
+}
+
+// put caches an answer until its first record expires. Answers without records, failures, and truncated answers are not cached.
+func (c *dnsCache) put(q dnsmessage.Question, resp []byte, now time.Time) {
+	if c == nil {
+		return
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil || msg.Truncated || (msg.RCode != dnsmessage.RCodeSuccess && msg.RCode != dnsmessage.RCodeNameError) {
+		return
+	}
+	ttl := uint32(0)
+	found := false
+	for _, rrs := range [][]dnsmessage.Resource{msg.Answers, msg.Authorities, msg.Additionals} {
+		for _, rr := range rrs {
+			if rr.Header.Type == dnsmessage.TypeOPT {
+				continue
+			}
+			if !found || rr.Header.TTL < ttl {
+				ttl, found = rr.Header.TTL, true
+			}
+		}
+	}
+	if ttl == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.size {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		// Without expired answers an arbitrary one makes room.
+		for k := range c.entries {
+			if len(c.entries) < c.size {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[cacheKey(q)] = dnsCacheEntry{msg: msg, stored: now, expires: now.Add(time.Duration(ttl) * time.Second)}
+}
+
+// UnmarshalCaddyfile unmarshals a submodules from a caddyfile.
+//
+//	{
+//	  dns-proxy <net name> {
+//	    [upstream <host[:port]>...]
+//	    [cache_size <size>]
+//	    [log_queries]
+//	  }
+//	}
+func (p *DNSProxies) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		var proxy DNSProxy
+		if !d.NextArg() {
+			return d.ArgErr()
+		} else if err := proxy.Name.UnmarshalText([]byte(d.Val())); err != nil {
+			return err
+		}
+
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "upstream":
+				upstreams := d.RemainingArgs()
+				if len(upstreams) == 0 {
+					return d.ArgErr()
+				}
+				proxy.Upstreams = append(proxy.Upstreams, upstreams...)
+			case "cache_size":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				size, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid cache size %q: %v", d.Val(), err)
+				}
+				proxy.CacheSize = size
+			case "log_queries":
+				proxy.LogQueries = true
+			default:
+				return d.Errf("unrecognized subdirective %q", d.Val())
+			}
+		}
+
+		p.Proxies = append(p.Proxies, &proxy)
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package point_c
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/stretchr/testify/require"
+	"github.com/trymoose/point-c/internal/test_helpers"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testDNSQuery packs a query for the name.
+func testDNSQuery(t *testing.T, id uint16, name string) []byte {
+	t.Helper()
+	b, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	require.NoError(t, err)
+	return b
+}
+
+// testDNSAnswer packs an answer to a query with an A record.
+func testDNSAnswer(t *testing.T, query []byte, rcode dnsmessage.RCode, ttl uint32) []byte {
+	t.Helper()
+	var msg dnsmessage.Message
+	require.NoError(t, msg.Unpack(query))
+	msg.Response, msg.RCode = true, rcode
+	if rcode == dnsmessage.RCodeSuccess {
+		msg.Answers = []dnsmessage.Resource{{
+			Header: dnsmessage.ResourceHeader{Name: msg.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: ttl},
+			Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+		}}
+	}
+	b, err := msg.Pack()
+	require.NoError(t, err)
+	return b
+}
+
+// testDNSUpstream answers A queries on a local UDP port, counting the queries.
+func testDNSUpstream(t *testing.T) (string, *atomic.Int32) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { pc.Close() })
+	var queries atomic.Int32
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			queries.Add(1)
+			_, _ = pc.WriteTo(testDNSAnswer(t, buf[:n], dnsmessage.RCodeSuccess, 60), addr)
+		}
+	}()
+	return pc.LocalAddr().String(), &queries
+}
+
+func TestHostResolvers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	require.NoError(t, os.WriteFile(path, []byte("# comment\nsearch example.com\nnameserver 192.0.2.53\nnameserver 2001:db8::53\n"), 0o600))
+	resolvers, err := hostResolvers(path)
+	require.NoError(t, err)
+	require.Equal(t, []string{"192.0.2.53:53", "[2001:db8::53]:53"}, resolvers)
+
+	require.NoError(t, os.WriteFile(path, []byte("search example.com\n"), 0o600))
+	_, err = hostResolvers(path)
+	require.Error(t, err)
+	_, err = hostResolvers(filepath.Join(t.TempDir(), "missing"))
+	require.Error(t, err)
+}
+
+func TestDNSCache(t *testing.T) {
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName("example.com."), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}
+	now := time.Now()
+
+	t.Run("ttl", func(t *testing.T) {
+		c := newDNSCache(10)
+		c.put(q, testDNSAnswer(t, testDNSQuery(t, 1, "example.com."), dnsmessage.RCodeSuccess, 60), now)
+
+		upper := q
+		upper.Name = dnsmessage.MustNewName("EXAMPLE.com.")
+		b, ok := c.get(upper, 2, now.Add(time.Second*10))
+		require.True(t, ok)
+		var msg dnsmessage.Message
+		require.NoError(t, msg.Unpack(b))
+		require.Equal(t, uint16(2), msg.ID)
+		require.Equal(t, upper, msg.Questions[0])
+		require.Equal(t, uint32(50), msg.Answers[0].Header.TTL)
+
+		// The cached answer keeps its ttl.
+		b, ok = c.get(q, 3, now.Add(time.Second*20))
+		require.True(t, ok)
+		require.NoError(t, msg.Unpack(b))
+		require.Equal(t, uint32(40), msg.Answers[0].Header.TTL)
+
+		_, ok = c.get(q, 4, now.Add(time.Minute))
+		require.False(t, ok)
+	})
+
+	t.Run("not cached", func(t *testing.T) {
+		c := newDNSCache(10)
+		c.put(q, testDNSAnswer(t, testDNSQuery(t, 1, "example.com."), dnsmessage.RCodeServerFailure, 60), now)
+		c.put(q, testDNSAnswer(t, testDNSQuery(t, 1, "example.com."), dnsmessage.RCodeNameError, 60), now)
+		c.put(q, testDNSAnswer(t, testDNSQuery(t, 1, "example.com."), dnsmessage.RCodeSuccess, 0), now)
+		_, ok := c.get(q, 1, now)
+		require.False(t, ok)
+	})
+
+	t.Run("size", func(t *testing.T) {
+		c := newDNSCache(2)
+		for _, name := range []string{"a.example.", "b.example.", "c.example."} {
+			q := q
+			q.Name = dnsmessage.MustNewName(name)
+			c.put(q, testDNSAnswer(t, testDNSQuery(t, 1, name), dnsmessage.RCodeSuccess, 60), now)
+		}
+		require.Len(t, c.entries, 2)
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		var c *dnsCache
+		c.put(q, testDNSAnswer(t, testDNSQuery(t, 1, "example.com."), dnsmessage.RCodeSuccess, 60), now)
+		_, ok := c.get(q, 1, now)
+		require.False(t, ok)
+	})
+}
+
+func TestDNSProxy_answer(t *testing.T) {
+	upstream, queries := testDNSUpstream(t)
+	// Nothing listens on the first upstream, so the query is sent to the next.
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, closed.Close())
+
+	p := &dnsProxy{
+		upstreams:  []string{closed.LocalAddr().String(), upstream},
+		cache:      newDNSCache(10),
+		logQueries: true,
+		pointc:     &Pointc{},
+		logger:     slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	remote := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 5353}
+
+	for id := uint16(1); id <= 2; id++ {
+		b, err := p.answer(context.Background(), testDNSQuery(t, id, "example.com."), remote, "udp")
+		require.NoError(t, err)
+		var msg dnsmessage.Message
+		require.NoError(t, msg.Unpack(b))
+		require.Equal(t, id, msg.ID)
+		require.Len(t, msg.Answers, 1)
+	}
+	require.Equal(t, int32(1), queries.Load(), "second query not answered from the cache")
+
+	p.upstreams = p.upstreams[:1]
+	b, err := p.answer(context.Background(), testDNSQuery(t, 3, "other.example."), remote, "udp")
+	require.NoError(t, err)
+	var msg dnsmessage.Message
+	require.NoError(t, msg.Unpack(b))
+	require.Equal(t, dnsmessage.RCodeServerFailure, msg.RCode)
+
+	_, err = p.answer(context.Background(), []byte{1}, remote, "udp")
+	require.Error(t, err)
+}
+
+func TestDNSProxy_serveUDP(t *testing.T) {
+	// The upstream holds every answer until released, so the queries being answered pile up.
+	upstream, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer upstream.Close()
+	var received atomic.Int32
+	release := make(chan struct{})
+	go func() {
+		for {
+			buf := make([]byte, 512)
+			n, addr, err := upstream.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			received.Add(1)
+			go func() {
+				<-release
+				_, _ = upstream.WriteTo(testDNSAnswer(t, buf[:n], dnsmessage.RCodeSuccess, 60), addr)
+			}()
+		}
+	}()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+	p := &dnsProxy{
+		upstreams: []string{upstream.LocalAddr().String()},
+		queries:   make(chan struct{}, dnsMaxQueries),
+		pointc:    &Pointc{},
+		logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	go p.serveUDP(pc)
+
+	client, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer client.Close()
+	const queries = dnsMaxQueries * 2
+	for id := uint16(1); id <= queries; id++ {
+		_, err := client.WriteTo(testDNSQuery(t, id, "example.com."), pc.LocalAddr())
+		require.NoError(t, err)
+	}
+	require.Eventually(t, func() bool { return received.Load() == dnsMaxQueries }, time.Second*5, time.Millisecond*10)
+	time.Sleep(time.Millisecond * 50)
+	require.Equal(t, int32(dnsMaxQueries), received.Load(), "more queries answered at once than allowed")
+
+	close(release)
+	require.NoError(t, client.SetReadDeadline(time.Now().Add(time.Second*5)))
+	buf := make([]byte, 512)
+	for i := 0; i < queries; i++ {
+		_, _, err := client.ReadFrom(buf)
+		require.NoError(t, err)
+	}
+}
+
+func TestDNSProxies_UnmarshalCaddyfile(t *testing.T) {
+	t.Run("options", func(t *testing.T) {
+		var p DNSProxies
+		require.NoError(t, p.UnmarshalCaddyfile(caddyfile.NewTestDispenser("dns-proxy server {\n upstream 1.1.1.1 9.9.9.9:53\n cache_size 10\n log_queries\n}")))
+		require.Len(t, p.Proxies, 1)
+		require.Equal(t, "server", p.Proxies[0].Name.Value())
+		require.Equal(t, []string{"1.1.1.1", "9.9.9.9:53"}, p.Proxies[0].Upstreams)
+		require.Equal(t, 10, p.Proxies[0].CacheSize)
+		require.True(t, p.Proxies[0].LogQueries)
+
+		var keys map[string]any
+		require.NoError(t, json.Unmarshal(test_helpers.JSONMarshal[[]byte](t, p.Proxies[0]), &keys))
+		require.Equal(t, map[string]any{"name": "server", "upstreams": []any{"1.1.1.1", "9.9.9.9:53"}, "cache_size": 10.0, "log_queries": true}, keys)
+	})
+
+	t.Run("defaults", func(t *testing.T) {
+		var p DNSProxies
+		require.NoError(t, p.UnmarshalCaddyfile(caddyfile.NewTestDispenser("dns-proxy server")))
+		require.Len(t, p.Proxies, 1)
+		require.Empty(t, p.Proxies[0].Upstreams)
+		require.Zero(t, p.Proxies[0].CacheSize)
+	})
+
+	for _, cfg := range []string{"dns-proxy", "dns-proxy server {\n upstream\n}", "dns-proxy server {\n cache_size many\n}", "dns-proxy server {\n foo\n}"} {
+		t.Run("invalid "+cfg, func(t *testing.T) {
+			var p DNSProxies
+			require.Error(t, p.UnmarshalCaddyfile(caddyfile.NewTestDispenser(cfg)))
+		})
+	}
+}
@@ -16,6 +16,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 var (
@@ -30,12 +31,15 @@ type (
 	Forwards struct {
 		Forwards   []*Forward `json:"forwards,omitempty"`
 		forwarders []*Forwarder
+		pointc     caddy.App // pointc is started before forwarding, so the networks are up.
 		stop       []func() error
 		logger     *slog.Logger
 	}
 	Forward struct {
 		Name  configvalues.Hostname
 		Ports []*configvalues.CaddyTextUnmarshaler[*PortPair, PortPair, *PortPair]
+		// WaitReady is how long a connection waits for the network to be [Ready] before dialing. 0 does not wait.
+		WaitReady caddy.Duration `json:",omitempty"`
 	}
 )
 
@@ -93,6 +97,9 @@ func (pp *PortPair) UnmarshalText(b []byte) error {
 func (pp *PortPair) Value() *PortPair { return pp }
 
 func (p *Forwards) Start() error {
+	if err := p.pointc.Start(); err != nil {
+		return err
+	}
 	for _, f := range p.forwarders {
 		anyLn, err := f.Addr.Listen(f.Ctx, 0, net.ListenConfig{})
 		if err != nil {
@@ -121,6 +128,9 @@ func (f *Forwarder) forwardListener(ctx context.Context, cancel context.CancelFu
 		go func() {
 			defer cancel()
 			remote := c.RemoteAddr().(*net.TCPAddr).IP
+			if err := WaitReady(ctx, f.Net, f.Wait); err != nil {
+				logger.Warn("network not ready, dialing anyway", "remote", f.Net.LocalAddr(), "error", err)
+			}
 			d := f.Net.Dialer(remote, 0)
 
 			rc, err := d.Dial(ctx, &net.TCPAddr{IP: f.Net.LocalAddr(), Port: int(f.Dst)})
@@ -177,6 +187,7 @@ type Forwarder struct {
 	Dst  uint16
 	Addr caddy.NetworkAddress
 	Ctx  caddy.Context
+	Wait time.Duration // Wait is how long to wait for [Net] to be ready before dialing.
 }
 
 func (p *Forwards) Provision(ctx caddy.Context) error {
@@ -186,6 +197,7 @@ func (p *Forwards) Provision(ctx caddy.Context) error {
 		return err
 	}
 	pc := v.(NetLookup)
+	p.pointc = v.(caddy.App)
 
 	var addrStr strings.Builder
 	for _, fwd := range p.Forwards {
@@ -202,6 +214,7 @@ func (p *Forwards) Provision(ctx caddy.Context) error {
 				if err != nil {
 					return err
 				}
+				f.Wait = time.Duration(fwd.WaitReady)
 				p.forwarders = append(p.forwarders, f)
 			}
 		}
@@ -246,6 +259,7 @@ func tcpForwarder(ctx caddy.Context, n Net, pp *PortPair, addrStr *strings.Build
 //	{
 //	  forward <net name> {
 //	    [<host>:]<src>:<dst>[/<tcp|udp>]
+//	    [wait_ready <duration>]
 //	  }
 //	}
 func (p *Forwards) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
@@ -258,12 +272,22 @@ func (p *Forwards) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 		}
 
 		for nesting := d.Nesting(); d.NextBlock(nesting); {
-			if !d.NextArg() {
+			if d.Val() == "wait_ready" {
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return err
+				}
+				f.WaitReady = caddy.Duration(dur)
 				continue
 			}
 			var pp configvalues.CaddyTextUnmarshaler[*PortPair, PortPair, *PortPair]
 			if err := pp.UnmarshalText([]byte(d.Val())); err != nil {
 				return err
+			} else if d.NextArg() {
+				return d.ArgErr()
 			}
 			f.Ports = append(f.Ports, &pp)
 		}
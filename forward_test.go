@@ -0,0 +1,40 @@
+package point_c
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestForwards_UnmarshalCaddyfile(t *testing.T) {
+	t.Run("ports", func(t *testing.T) {
+		var f Forwards
+		require.NoError(t, f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("forward remote {\n 80:8080\n 127.0.0.1:443:8443/tcp\n}")))
+		require.Len(t, f.Forwards, 1)
+		require.Equal(t, "remote", f.Forwards[0].Name.Value())
+		require.Len(t, f.Forwards[0].Ports, 2)
+		require.Equal(t, uint16(80), f.Forwards[0].Ports[0].Value().Src())
+		require.Equal(t, uint16(8443), f.Forwards[0].Ports[1].Value().Dst())
+		require.Zero(t, f.Forwards[0].WaitReady)
+	})
+
+	t.Run("wait ready", func(t *testing.T) {
+		var f Forwards
+		require.NoError(t, f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("forward remote {\n 80:8080\n wait_ready 5s\n}")))
+		require.Len(t, f.Forwards, 1)
+		require.Len(t, f.Forwards[0].Ports, 1)
+		require.Equal(t, caddy.Duration(time.Second*5), f.Forwards[0].WaitReady)
+	})
+
+	t.Run("extra port argument", func(t *testing.T) {
+		var f Forwards
+		require.Error(t, f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("forward remote {\n 80:8080 443:8443\n}")))
+	})
+
+	t.Run("wait ready missing duration", func(t *testing.T) {
+		var f Forwards
+		require.Error(t, f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("forward remote {\n wait_ready\n}")))
+	})
+}
@@ -9,6 +9,7 @@ require (
 	github.com/tidwall/gjson v1.17.0
 	go.mrchanchal.com/zaphandler v0.0.0-20230611140024-bd4fd80897ad
 	golang.org/x/exp v0.0.0-20230725093048-515e97ebf090
+	golang.org/x/net v0.17.0
 )
 
 require (
@@ -137,7 +138,6 @@ require (
 	go.uber.org/zap v1.25.0 // indirect
 	golang.org/x/crypto v0.14.0 // indirect
 	golang.org/x/mod v0.13.0 // indirect
-	golang.org/x/net v0.17.0 // indirect
 	golang.org/x/sync v0.4.0 // indirect
 	golang.org/x/sys v0.13.0 // indirect
 	golang.org/x/term v0.13.0 // indirect
@@ -0,0 +1,36 @@
+package test_helpers
+
+import (
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Echo echoes back on every connection accepted until the listener is closed.
+func Echo(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer c.Close()
+			_, _ = io.Copy(c, c)
+		}()
+	}
+}
+
+// RequireEcho sends a message on the conn and reads it back, closing the conn.
+func RequireEcho(t testing.TB, c net.Conn) {
+	t.Helper()
+	defer c.Close()
+	require.NoError(t, c.SetDeadline(time.Now().Add(time.Second*5)))
+	_, err := c.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(c, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+}
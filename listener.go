@@ -1,12 +1,15 @@
 package point_c
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/trymoose/point-c/pkg/configvalues"
 	"net"
+	"sync"
+	"time"
 )
 
 var (
@@ -17,10 +20,20 @@ var (
 )
 
 // Listener allows a caddy server to listen on a point-c network.
+// It listens once caddy first accepts a connection, after the point-c app is started, so the network is up.
 type Listener struct {
 	Name configvalues.Hostname `json:"name"`
 	Port configvalues.Port     `json:"port"`
-	ln   net.Listener
+	// WaitReady is how long [Listener.Accept] waits for the network to be [Ready] after it is started. 0 does not wait.
+	WaitReady caddy.Duration `json:"wait_ready,omitempty"`
+	net       Net
+	pointc    caddy.App
+	ctx       context.Context
+	cancel    context.CancelFunc
+	open      *sync.Once
+	ln        net.Listener
+	err       error         // err is the error listening, or [net.ErrClosed] if closed before listening.
+	ready     chan struct{} // ready is closed once the network is ready or the wait is over.
 }
 
 func (p *Listener) Provision(ctx caddy.Context) error {
@@ -32,18 +45,61 @@ func (p *Listener) Provision(ctx caddy.Context) error {
 	if !ok {
 		return fmt.Errorf("point-c net %q does not exist", p.Name.Value())
 	}
+	p.net, p.pointc = n, m.(caddy.App)
+	p.ctx, p.cancel = context.WithCancel(ctx)
+	p.open = new(sync.Once)
+	return nil
+}
 
-	ln, err := n.Listen(&net.TCPAddr{IP: n.LocalAddr(), Port: int(p.Port.Value())})
-	if err != nil {
-		return err
+// listen starts the point-c app and listens on the network the first time it is called.
+func (p *Listener) listen() error {
+	p.open.Do(func() {
+		if p.err = p.pointc.Start(); p.err != nil {
+			return
+		}
+		if p.ln, p.err = p.net.Listen(p.addr()); p.err != nil {
+			return
+		}
+
+		p.ready = make(chan struct{})
+		go func() {
+			defer close(p.ready)
+			_ = WaitReady(p.ctx, p.net, time.Duration(p.WaitReady))
+		}()
+	})
+	return p.err
+}
+
+func (p *Listener) Accept() (net.Conn, error) {
+	if err := p.listen(); err != nil {
+		return nil, err
 	}
-	p.ln = ln
-	return nil
+	<-p.ready
+	return p.ln.Accept()
 }
 
-func (p *Listener) Accept() (net.Conn, error) { return p.ln.Accept() }
-func (p *Listener) Close() error              { return p.ln.Close() }
-func (p *Listener) Addr() net.Addr            { return p.ln.Addr() }
+func (p *Listener) Close() error {
+	if p.open == nil {
+		return nil
+	}
+	p.cancel()
+	p.open.Do(func() { p.err = net.ErrClosed })
+	if p.ln == nil {
+		return nil
+	}
+	return p.ln.Close()
+}
+
+func (p *Listener) Addr() net.Addr { return p.addr() }
+
+// addr is the address listened on.
+func (p *Listener) addr() *net.TCPAddr {
+	var ip net.IP
+	if p.net != nil {
+		ip = p.net.LocalAddr()
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p.Port.Value())}
+}
 
 func (*Listener) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
@@ -58,7 +114,9 @@ func (*Listener) CaddyModule() caddy.ModuleInfo {
 //	  servers :443 {
 //	    listener_wrappers {
 //	      merge {
-//	        point-c <network name> <port to expose>
+//	        point-c <network name> <port to expose> {
+//	          wait_ready <duration>
+//	        }
 //	      }
 //	      tls
 //	    }
@@ -76,6 +134,23 @@ func (p *Listener) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 		); err != nil {
 			return err
 		}
+
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "wait_ready":
+				var dur string
+				if !d.Args(&dur) {
+					return d.ArgErr()
+				}
+				v, err := caddy.ParseDuration(dur)
+				if err != nil {
+					return err
+				}
+				p.WaitReady = caddy.Duration(v)
+			default:
+				return d.Errf("unrecognized subdirective %q", d.Val())
+			}
+		}
 	}
 	return nil
 }
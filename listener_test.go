@@ -19,6 +19,17 @@ func TestListener_UnmarshalCaddyfile(t *testing.T) {
 			caddyfile: "point-c remote 80",
 			json:      `{"name": "remote", "port": 80}`,
 		},
+		{
+			name:      "wait ready",
+			caddyfile: "point-c remote 80 {\n wait_ready 5s\n}",
+			json:      `{"name": "remote", "port": 80, "wait_ready": 5000000000}`,
+		},
+		{
+			name:      "unknown subdirective",
+			caddyfile: "point-c remote 80 {\n foo\n}",
+			json:      `{"name": "remote", "port": 80}`,
+			wantErr:   true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
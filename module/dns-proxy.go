@@ -0,0 +1,15 @@
+package module
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	pointc "github.com/trymoose/point-c"
+	"github.com/trymoose/point-c/module/internal"
+)
+
+const CaddyfileDNSProxyName = "dns-proxy"
+
+func init() {
+	caddy.RegisterModule(new(pointc.DNSProxies))
+	httpcaddyfile.RegisterGlobalOption(CaddyfileDNSProxyName, internal.Unmarshaler[pointc.DNSProxies, *pointc.DNSProxies](CaddyfileDNSProxyName))
+}
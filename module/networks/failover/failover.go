@@ -0,0 +1,408 @@
+// Package failover is a point-c network grouping other nets, such as redundant tunnels to the same site, into one.
+// Dials go through the first healthy member and listeners listen on every member, so losing one member does not take services down.
+package failover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	pointc "github.com/trymoose/point-c"
+	"github.com/trymoose/point-c/pkg/configvalues"
+	"go.mrchanchal.com/zaphandler"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	_ caddy.Module          = (*Failover)(nil)
+	_ caddy.Provisioner     = (*Failover)(nil)
+	_ caddyfile.Unmarshaler = (*Failover)(nil)
+	_ pointc.Network        = (*Failover)(nil)
+	_ pointc.Composite      = (*Failover)(nil)
+	_ pointc.Net            = (*groupNet)(nil)
+	_ pointc.Ready          = (*groupNet)(nil)
+	_ pointc.Dialer         = (*groupDialer)(nil)
+)
+
+func init() {
+	caddy.RegisterModule(new(Failover))
+}
+
+func (*Failover) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "point-c.net.failover",
+		New: func() caddy.Module { return new(Failover) },
+	}
+}
+
+const (
+	// DefaultFailAfter is how many dials in a row fail before a member is unhealthy if not set.
+	DefaultFailAfter = 1
+	// DefaultRetryAfter is how long an unhealthy member is skipped if not set.
+	DefaultRetryAfter = 30 * time.Second
+	// DefaultDialTimeout is how long a dial through a member may take if not set.
+	DefaultDialTimeout = 10 * time.Second
+	// MaxHandshakeAge is how old the last handshake of a [pointc.Handshaker] member with keepalive may be before it is unhealthy.
+	// It is the time after which wireguard rejects the keys of a handshake, so the tunnel cannot carry traffic without a new one.
+	MaxHandshakeAge = 3 * time.Minute
+)
+
+// ErrNoMembers is returned when every member of a group failed to dial.
+var ErrNoMembers = errors.New("no member of the group could be dialed")
+
+// Failover is a group of nets declared by other networks of the point-c app.
+//
+// The group's address is the address of its first member. Dialing or listening on it uses the address of whichever member is used,
+// so members may be the same service reached through different tunnels. Other addresses are passed to the members as they are.
+//
+// A member is unhealthy after dials through it fail [Failover.FailAfter] times in a row.
+// Members implementing [pointc.Handshaker] are also unhealthy if their last handshake was given up on,
+// or if they have keepalive and their last handshake is older than [MaxHandshakeAge], other members if they are not [pointc.Ready].
+// Healthy members are dialed in order, unhealthy ones are only tried once they all failed.
+type Failover struct {
+	Name configvalues.Hostname `json:"name"`
+	// Members are the names of the nets in the group, in the order they are dialed.
+	Members []configvalues.Hostname `json:"members"`
+	// FailAfter is how many dials in a row fail before a member is unhealthy. Defaults to 1.
+	FailAfter int `json:"fail_after,omitempty"`
+	// RetryAfter is how long an unhealthy member is skipped before it is tried first again. Defaults to 30s.
+	RetryAfter caddy.Duration `json:"retry_after,omitempty"`
+	// DialTimeout is how long a dial through a member may take before the next member is tried. Defaults to 10s.
+	DialTimeout caddy.Duration `json:"dial_timeout,omitempty"`
+	net         *groupNet
+}
+
+func (f *Failover) Provision(ctx caddy.Context) error {
+	if len(f.Members) == 0 {
+		return fmt.Errorf("group %q has no members", f.Name.Value())
+	} else if f.FailAfter < 0 {
+		return fmt.Errorf("group %q fail after must not be negative", f.Name.Value())
+	}
+
+	f.net = &groupNet{
+		name:        f.Name.Value(),
+		failAfter:   f.FailAfter,
+		retryAfter:  time.Duration(f.RetryAfter),
+		dialTimeout: time.Duration(f.DialTimeout),
+		logger:      slog.New(zaphandler.New(ctx.Logger())).With("group", f.Name.Value()),
+		now:         time.Now,
+	}
+	if f.net.failAfter == 0 {
+		f.net.failAfter = DefaultFailAfter
+	}
+	if f.net.retryAfter <= 0 {
+		f.net.retryAfter = DefaultRetryAfter
+	}
+	if f.net.dialTimeout <= 0 {
+		f.net.dialTimeout = DefaultDialTimeout
+	}
+
+	seen := map[string]bool{}
+	for _, m := range f.Members {
+		if seen[m.Value()] {
+			return fmt.Errorf("group %q has member %q more than once", f.Name.Value(), m.Value())
+		}
+		seen[m.Value()] = true
+	}
+	return nil
+}
+
+// LookupMembers looks up the members of the group. Members may be groups themselves, but not ones containing the group.
+func (f *Failover) LookupMembers(lookup pointc.NetLookup) error {
+	members := make([]*member, len(f.Members))
+	for i, name := range f.Members {
+		n, ok := lookup.Lookup(name.Value())
+		if !ok {
+			return fmt.Errorf("member %q of group %q does not exist", name.Value(), f.Name.Value())
+		} else if f.net.contains(n) {
+			return fmt.Errorf("member %q of group %q contains the group", name.Value(), f.Name.Value())
+		}
+		members[i] = &member{name: name.Value(), net: n}
+	}
+	f.net.members = members
+	return nil
+}
+
+func (f *Failover) Networks() map[string]pointc.Net {
+	return map[string]pointc.Net{f.Name.Value(): f.net}
+}
+
+// UnmarshalCaddyfile unmarshals the group from a caddyfile.
+//
+//	point-c {
+//	  failover <name> {
+//	    member <net name>...
+//	    [fail_after <dials>]
+//	    [retry_after <duration>]
+//	    [dial_timeout <duration>]
+//	  }
+//	}
+func (f *Failover) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if !d.NextArg() {
+			return d.ArgErr()
+		} else if err := f.Name.UnmarshalText([]byte(d.Val())); err != nil {
+			return err
+		}
+
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			switch d.Val() {
+			case "member":
+				names := d.RemainingArgs()
+				if len(names) == 0 {
+					return d.ArgErr()
+				}
+				for _, name := range names {
+					var m configvalues.Hostname
+					if err := m.UnmarshalText([]byte(name)); err != nil {
+						return err
+					}
+					f.Members = append(f.Members, m)
+				}
+			case "fail_after":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				n, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid fail after %q: %v", d.Val(), err)
+				}
+				f.FailAfter = n
+			case "retry_after", "dial_timeout":
+				key := d.Val()
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid %s %q: %v", key, d.Val(), err)
+				}
+				if key == "retry_after" {
+					f.RetryAfter = caddy.Duration(dur)
+				} else {
+					f.DialTimeout = caddy.Duration(dur)
+				}
+			default:
+				return d.Errf("unrecognized subdirective %q", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+type (
+	// groupNet is the net of a group.
+	groupNet struct {
+		name        string
+		members     []*member
+		failAfter   int
+		retryAfter  time.Duration
+		dialTimeout time.Duration
+		logger      *slog.Logger
+		now         func() time.Time
+	}
+	// member is a net in a group and its health.
+	member struct {
+		name  string
+		net   pointc.Net
+		mu    sync.Mutex
+		fails int       // fails is how many dials in a row failed.
+		retry time.Time // retry is when an unhealthy member is tried first again.
+	}
+	groupDialer struct {
+		net   *groupNet
+		laddr net.IP
+		port  uint16
+	}
+)
+
+// contains reports whether the net is the group or a group containing it.
+func (g *groupNet) contains(n pointc.Net) bool {
+	other, ok := n.(*groupNet)
+	if !ok {
+		return false
+	} else if other == g {
+		return true
+	}
+	for _, m := range other.members {
+		if g.contains(m.net) {
+			return true
+		}
+	}
+	return false
+}
+
+// LocalAddr is the address of the first member.
+func (g *groupNet) LocalAddr() net.IP { return g.members[0].net.LocalAddr() }
+
+// translate replaces the address of the group with the address of the member.
+func (g *groupNet) translate(ip net.IP, m *member) net.IP {
+	if ip != nil && ip.Equal(g.LocalAddr()) {
+		return m.net.LocalAddr()
+	}
+	return ip
+}
+
+// WaitReady blocks until any member is ready.
+func (g *groupNet) WaitReady(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make(chan error, len(g.members))
+	for _, m := range g.members {
+		go func(n pointc.Net) {
+			if r, ok := n.(pointc.Ready); ok {
+				errs <- r.WaitReady(ctx)
+			} else {
+				errs <- nil
+			}
+		}(m.net)
+	}
+
+	var err error
+	for range g.members {
+		if err = <-errs; err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// order gets the members in the order they are dialed, healthy ones first.
+func (g *groupNet) order() []*member {
+	now := g.now()
+	healthy := make([]*member, 0, len(g.members))
+	var unhealthy []*member
+	for _, m := range g.members {
+		if m.healthy(now, g.failAfter) {
+			healthy = append(healthy, m)
+		} else {
+			unhealthy = append(unhealthy, m)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// healthy reports whether the member has not failed too often recently, and its handshakes work or it is ready.
+func (m *member) healthy(now time.Time, failAfter int) bool {
+	m.mu.Lock()
+	failed := m.fails >= failAfter && now.Before(m.retry)
+	m.mu.Unlock()
+	if failed {
+		return false
+	}
+	if h, ok := m.net.(pointc.Handshaker); ok {
+		if hs, ok := h.LastHandshake(); ok {
+			// An idle tunnel without keepalive does not handshake, it is only unhealthy once a handshake is given up on.
+			return !hs.Failed && (!hs.Keepalive || !hs.Last.IsZero() && now.Sub(hs.Last) <= MaxHandshakeAge)
+		}
+	}
+	r, ok := m.net.(pointc.Ready)
+	if !ok {
+		return true
+	}
+	// A done context only checks if it is ready without waiting.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return r.WaitReady(ctx) == nil
+}
+
+// result records the result of a dial through the member.
+func (g *groupNet) result(m *member, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err == nil {
+		if m.fails >= g.failAfter {
+			g.logger.Info("group member healthy again", "member", m.name)
+		}
+		m.fails = 0
+		return
+	}
+
+	m.fails++
+	if m.fails >= g.failAfter {
+		m.retry = g.now().Add(g.retryAfter)
+		if m.fails == g.failAfter {
+			g.logger.Warn("group member unhealthy", "member", m.name, "error", err, "retry_after", g.retryAfter)
+		}
+	}
+}
+
+// Listen listens on every member, accepting connections from any of them.
+func (g *groupNet) Listen(addr *net.TCPAddr) (net.Listener, error) {
+	lns := make([]net.Listener, 0, len(g.members))
+	for _, m := range g.members {
+		ln, err := m.net.Listen(&net.TCPAddr{IP: g.translate(addr.IP, m), Port: addr.Port, Zone: addr.Zone})
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, fmt.Errorf("failed to listen on group member %q: %w", m.name, err)
+		}
+		lns = append(lns, ln)
+	}
+	return newGroupListener(lns, addr, g.logger), nil
+}
+
+// ListenPacket listens on every member, reading packets from any of them. Replies are written through the member the address was last read from.
+func (g *groupNet) ListenPacket(addr *net.UDPAddr) (net.PacketConn, error) {
+	pcs := make([]net.PacketConn, 0, len(g.members))
+	for _, m := range g.members {
+		pc, err := m.net.ListenPacket(&net.UDPAddr{IP: g.translate(addr.IP, m), Port: addr.Port, Zone: addr.Zone})
+		if err != nil {
+			for _, pc := range pcs {
+				pc.Close()
+			}
+			return nil, fmt.Errorf("failed to listen on group member %q: %w", m.name, err)
+		}
+		pcs = append(pcs, pc)
+	}
+	return newGroupPacketConn(pcs, addr), nil
+}
+
+func (g *groupNet) Dialer(laddr net.IP, port uint16) pointc.Dialer {
+	return &groupDialer{net: g, laddr: laddr, port: port}
+}
+
+// Dial dials through the first member that connects.
+func (d *groupDialer) Dial(ctx context.Context, addr *net.TCPAddr) (net.Conn, error) {
+	var errs error
+	for _, m := range d.net.order() {
+		dctx, cancel := context.WithTimeout(ctx, d.net.dialTimeout)
+		raddr := &net.TCPAddr{IP: d.net.translate(addr.IP, m), Port: addr.Port, Zone: addr.Zone}
+		c, err := m.net.Dialer(d.net.translate(d.laddr, m), d.port).Dial(dctx, raddr)
+		cancel()
+		if ctx.Err() != nil {
+			// The dial was canceled, that says nothing about the member.
+			if c != nil {
+				c.Close()
+			}
+			return nil, errors.Join(errs, ctx.Err())
+		}
+		d.net.result(m, err)
+		if err == nil {
+			return c, nil
+		}
+		errs = errors.Join(errs, fmt.Errorf("member %q: %w", m.name, err))
+	}
+	return nil, fmt.Errorf("dial group %q: %w", d.net.name, errors.Join(ErrNoMembers, errs))
+}
+
+// DialPacket dials through the first member that does not fail. Since UDP does not connect, only local failures such as a member not routing the address are noticed.
+func (d *groupDialer) DialPacket(addr *net.UDPAddr) (net.PacketConn, error) {
+	var errs error
+	for _, m := range d.net.order() {
+		raddr := &net.UDPAddr{IP: d.net.translate(addr.IP, m), Port: addr.Port, Zone: addr.Zone}
+		pc, err := m.net.Dialer(d.net.translate(d.laddr, m), d.port).DialPacket(raddr)
+		d.net.result(m, err)
+		if err == nil {
+			return pc, nil
+		}
+		errs = errors.Join(errs, fmt.Errorf("member %q: %w", m.name, err))
+	}
+	return nil, fmt.Errorf("dial group %q: %w", d.net.name, errors.Join(ErrNoMembers, errs))
+}
@@ -0,0 +1,411 @@
+package failover
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/stretchr/testify/require"
+	pointc "github.com/trymoose/point-c"
+	_ "github.com/trymoose/point-c/module"
+	"github.com/trymoose/point-c/module/networks/memory"
+	"io"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// lookup is a [pointc.NetLookup] of nets by name.
+type lookup map[string]pointc.Net
+
+func (l lookup) Lookup(name string) (pointc.Net, bool) {
+	n, ok := l[name]
+	return n, ok
+}
+
+// readyNet is a net that is ready if ready is set.
+type readyNet struct {
+	pointc.Net
+	ready atomic.Bool
+}
+
+func (n *readyNet) WaitReady(ctx context.Context) error {
+	if n.ready.Load() {
+		return nil
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+// handshakeNet is a net reporting the set handshake.
+type handshakeNet struct {
+	pointc.Net
+	pointc.Handshake
+	ok bool
+}
+
+func (n *handshakeNet) LastHandshake() (pointc.Handshake, bool) { return n.Handshake, n.ok }
+
+// newTestNets gets the hosts a, b, and client on a memory network.
+func newTestNets(t *testing.T) lookup {
+	t.Helper()
+	var m memory.Memory
+	require.NoError(t, m.UnmarshalCaddyfile(caddyfile.NewTestDispenser("memory {\n a 10.0.0.1\n b 10.1.0.1\n client 10.2.0.1\n}")))
+	require.NoError(t, m.Provision(caddy.Context{}))
+	t.Cleanup(func() { require.NoError(t, m.Cleanup()) })
+	return m.Networks()
+}
+
+// newTestGroup gets a group of the members.
+func newTestGroup(t *testing.T, nets lookup, members ...string) *groupNet {
+	t.Helper()
+	f := newTestFailover(t, "group", members...)
+	require.NoError(t, f.LookupMembers(nets))
+	return f.net
+}
+
+func newTestFailover(t *testing.T, name string, members ...string) *Failover {
+	t.Helper()
+	var f Failover
+	require.NoError(t, f.Name.UnmarshalText([]byte(name)))
+	for _, name := range members {
+		var m = f.Name
+		require.NoError(t, m.UnmarshalText([]byte(name)))
+		f.Members = append(f.Members, m)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	require.NoError(t, f.Provision(ctx))
+	return &f
+}
+
+// serveName writes the name to every connection accepted.
+func serveName(ln net.Listener, name string) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = io.WriteString(c, name)
+		c.Close()
+	}
+}
+
+// dialName dials the group and reads the name of the member that answered.
+func dialName(t *testing.T, g *groupNet) string {
+	t.Helper()
+	c, err := g.Dialer(nil, 0).Dial(context.Background(), &net.TCPAddr{IP: g.LocalAddr(), Port: 80})
+	require.NoError(t, err)
+	defer c.Close()
+	b, err := io.ReadAll(c)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestGroupNet_Dial(t *testing.T) {
+	nets := newTestNets(t)
+	g := newTestGroup(t, nets, "a", "b")
+	require.Equal(t, nets["a"].LocalAddr(), g.LocalAddr())
+	now := time.Now()
+	g.now = func() time.Time { return now }
+
+	listen := func(name string) net.Listener {
+		ln, err := nets[name].Listen(&net.TCPAddr{IP: nets[name].LocalAddr(), Port: 80})
+		require.NoError(t, err)
+		go serveName(ln, name)
+		return ln
+	}
+	a, b := listen("a"), listen("b")
+	defer b.Close()
+	require.Equal(t, "a", dialName(t, g))
+
+	// a is down, so b is dialed and a is skipped until it is retried.
+	require.NoError(t, a.Close())
+	require.Equal(t, "b", dialName(t, g))
+	require.Equal(t, []*member{g.members[1], g.members[0]}, g.order())
+	a = listen("a")
+	defer a.Close()
+	require.Equal(t, "b", dialName(t, g))
+
+	now = now.Add(DefaultRetryAfter)
+	require.Equal(t, "a", dialName(t, g))
+	require.Zero(t, g.members[0].fails)
+
+	t.Run("all down", func(t *testing.T) {
+		_, err := g.Dialer(nil, 0).Dial(context.Background(), &net.TCPAddr{IP: g.LocalAddr(), Port: 81})
+		require.ErrorIs(t, err, ErrNoMembers)
+		require.ErrorIs(t, err, syscall.ECONNREFUSED)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		fails := g.members[0].fails
+		_, err := g.Dialer(nil, 0).Dial(ctx, &net.TCPAddr{IP: g.LocalAddr(), Port: 80})
+		require.ErrorIs(t, err, context.Canceled)
+		require.Equal(t, fails, g.members[0].fails, "canceled dial counted as failure")
+	})
+
+	t.Run("other address", func(t *testing.T) {
+		// Addresses that are not the group's are dialed as they are.
+		c, err := g.Dialer(nil, 0).Dial(context.Background(), &net.TCPAddr{IP: nets["b"].LocalAddr(), Port: 80})
+		require.NoError(t, err)
+		defer c.Close()
+		require.Equal(t, nets["b"].LocalAddr().To4(), c.RemoteAddr().(*net.TCPAddr).IP)
+	})
+}
+
+func TestGroupNet_FailAfter(t *testing.T) {
+	nets := newTestNets(t)
+	g := newTestGroup(t, nets, "a", "b")
+	g.failAfter = 2
+	g.result(g.members[0], syscall.ECONNREFUSED)
+	require.Equal(t, g.members, g.order())
+	g.result(g.members[0], syscall.ECONNREFUSED)
+	require.Equal(t, []*member{g.members[1], g.members[0]}, g.order())
+	g.result(g.members[0], nil)
+	require.Equal(t, g.members, g.order())
+}
+
+func TestGroupNet_Ready(t *testing.T) {
+	nets := newTestNets(t)
+	a, b := &readyNet{Net: nets["a"]}, &readyNet{Net: nets["b"]}
+	b.ready.Store(true)
+	g := newTestGroup(t, lookup{"a": a, "b": b}, "a", "b")
+	require.Equal(t, []*member{g.members[1], g.members[0]}, g.order())
+	require.NoError(t, g.WaitReady(context.Background()))
+
+	b.ready.Store(false)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	require.ErrorIs(t, g.WaitReady(ctx), context.DeadlineExceeded)
+	a.ready.Store(true)
+	require.Equal(t, g.members, g.order())
+}
+
+func TestGroupNet_LastHandshake(t *testing.T) {
+	nets := newTestNets(t)
+	now := time.Now()
+	a := &handshakeNet{Net: nets["a"], Handshake: pointc.Handshake{Keepalive: true}, ok: true}
+	b := &handshakeNet{Net: nets["b"], Handshake: pointc.Handshake{Last: now, Keepalive: true}, ok: true}
+	g := newTestGroup(t, lookup{"a": a, "b": b}, "a", "b")
+	g.now = func() time.Time { return now }
+	require.Equal(t, []*member{g.members[1], g.members[0]}, g.order(), "a never completed a handshake")
+
+	a.Last = now
+	require.Equal(t, g.members, g.order())
+	a.Failed = true
+	require.Equal(t, []*member{g.members[1], g.members[0]}, g.order(), "a gave up a handshake")
+
+	a.Failed = false
+	now = now.Add(MaxHandshakeAge + time.Second)
+	b.Last = now
+	require.Equal(t, []*member{g.members[1], g.members[0]}, g.order(), "the handshake of a is too old")
+
+	// An idle tunnel without keepalive does not handshake, only a given up handshake makes it unhealthy.
+	a.Keepalive = false
+	require.Equal(t, g.members, g.order())
+	a.Last = time.Time{}
+	require.Equal(t, g.members, g.order(), "a is idle")
+	a.Failed = true
+	require.Equal(t, []*member{g.members[1], g.members[0]}, g.order(), "a gave up a handshake")
+
+	// Nets that do not handshake are healthy.
+	a.ok = false
+	require.Equal(t, g.members, g.order())
+}
+
+func TestGroupNet_Listen(t *testing.T) {
+	nets := newTestNets(t)
+	g := newTestGroup(t, nets, "a", "b")
+	ln, err := g.Listen(&net.TCPAddr{IP: g.LocalAddr(), Port: 80})
+	require.NoError(t, err)
+	go serveName(ln, "group")
+	require.Equal(t, &net.TCPAddr{IP: g.LocalAddr(), Port: 80}, ln.Addr())
+
+	dial := func(name string) {
+		t.Helper()
+		c, err := nets["client"].Dialer(nil, 0).Dial(context.Background(), &net.TCPAddr{IP: nets[name].LocalAddr(), Port: 80})
+		require.NoError(t, err)
+		defer c.Close()
+		b, err := io.ReadAll(c)
+		require.NoError(t, err)
+		require.Equal(t, "group", string(b))
+	}
+	dial("a")
+	dial("b")
+
+	require.NoError(t, ln.Close())
+	_, err = ln.Accept()
+	require.ErrorIs(t, err, net.ErrClosed)
+	_, err = nets["client"].Dialer(nil, 0).Dial(context.Background(), &net.TCPAddr{IP: nets["b"].LocalAddr(), Port: 80})
+	require.ErrorIs(t, err, syscall.ECONNREFUSED)
+
+	t.Run("in use", func(t *testing.T) {
+		ln, err := nets["b"].Listen(&net.TCPAddr{IP: nets["b"].LocalAddr(), Port: 81})
+		require.NoError(t, err)
+		defer ln.Close()
+		_, err = g.Listen(&net.TCPAddr{IP: g.LocalAddr(), Port: 81})
+		require.ErrorIs(t, err, syscall.EADDRINUSE)
+		// The member listened on first is closed again.
+		ln, err = nets["a"].Listen(&net.TCPAddr{IP: nets["a"].LocalAddr(), Port: 81})
+		require.NoError(t, err)
+		require.NoError(t, ln.Close())
+	})
+}
+
+func TestGroupNet_ListenPacket(t *testing.T) {
+	nets := newTestNets(t)
+	g := newTestGroup(t, nets, "a", "b")
+	pc, err := g.ListenPacket(&net.UDPAddr{IP: g.LocalAddr(), Port: 53})
+	require.NoError(t, err)
+	defer pc.Close()
+
+	// Replies are written through the member the query was read on.
+	c, err := nets["client"].Dialer(nil, 0).DialPacket(&net.UDPAddr{IP: nets["b"].LocalAddr(), Port: 53})
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.(net.Conn).Write([]byte("query"))
+	require.NoError(t, err)
+	buf := make([]byte, 16)
+	n, from, err := pc.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, "query", string(buf[:n]))
+	_, err = pc.WriteTo([]byte("answer"), from)
+	require.NoError(t, err)
+	n, err = c.(net.Conn).Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "answer", string(buf[:n]))
+
+	require.NoError(t, pc.SetReadDeadline(time.Now()))
+	_, _, err = pc.ReadFrom(buf)
+	require.Error(t, err)
+	require.NoError(t, pc.Close())
+	_, _, err = pc.ReadFrom(buf)
+	require.ErrorIs(t, err, net.ErrClosed)
+}
+
+func TestGroupNet_DialPacket(t *testing.T) {
+	nets := newTestNets(t)
+	g := newTestGroup(t, nets, "a", "b")
+	pc, err := nets["a"].ListenPacket(&net.UDPAddr{IP: nets["a"].LocalAddr(), Port: 53})
+	require.NoError(t, err)
+	defer pc.Close()
+
+	c, err := g.Dialer(nil, 0).DialPacket(&net.UDPAddr{IP: g.LocalAddr(), Port: 53})
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.(net.Conn).Write([]byte("query"))
+	require.NoError(t, err)
+	buf := make([]byte, 16)
+	n, _, err := pc.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, "query", string(buf[:n]))
+}
+
+func TestFailover_LookupMembers(t *testing.T) {
+	nets := newTestNets(t)
+	t.Run("missing", func(t *testing.T) {
+		require.Error(t, newTestFailover(t, "group", "a", "missing").LookupMembers(nets))
+	})
+
+	t.Run("self", func(t *testing.T) {
+		f := newTestFailover(t, "group", "a", "group")
+		nets := lookup{"a": nets["a"], "group": f.net}
+		require.Error(t, f.LookupMembers(nets))
+	})
+
+	t.Run("cycle", func(t *testing.T) {
+		f1, f2 := newTestFailover(t, "one", "a", "two"), newTestFailover(t, "two", "b", "one")
+		nets := lookup{"a": nets["a"], "b": nets["b"], "one": f1.net, "two": f2.net}
+		require.NoError(t, f1.LookupMembers(nets))
+		require.Error(t, f2.LookupMembers(nets))
+	})
+
+	t.Run("nested", func(t *testing.T) {
+		inner := newTestGroup(t, nets, "a", "b")
+		f := newTestFailover(t, "outer", "group", "client")
+		require.NoError(t, f.LookupMembers(lookup{"group": inner, "client": nets["client"]}))
+		require.Equal(t, nets["a"].LocalAddr(), f.net.LocalAddr())
+	})
+}
+
+func TestFailover_Provision(t *testing.T) {
+	members := newTestFailover(t, "group", "a", "b").Members
+	for name, f := range map[string]*Failover{
+		"no members":          {},
+		"duplicate member":    {Members: append(members[:1:1], members[0])},
+		"negative fail after": {Members: members, FailAfter: -1},
+	} {
+		t.Run(name, func(t *testing.T) {
+			require.Error(t, f.Provision(caddy.Context{}))
+		})
+	}
+}
+
+func TestFailover_UnmarshalCaddyfile(t *testing.T) {
+	t.Run("options", func(t *testing.T) {
+		var f Failover
+		require.NoError(t, f.UnmarshalCaddyfile(caddyfile.NewTestDispenser("failover dc {\n member dc-a dc-b\n member dc-c\n fail_after 3\n retry_after 1m\n dial_timeout 5s\n}")))
+		require.Equal(t, "dc", f.Name.Value())
+		require.Len(t, f.Members, 3)
+		require.Equal(t, "dc-c", f.Members[2].Value())
+		require.Equal(t, 3, f.FailAfter)
+		require.Equal(t, caddy.Duration(time.Minute), f.RetryAfter)
+		require.Equal(t, caddy.Duration(time.Second*5), f.DialTimeout)
+	})
+
+	for _, cfg := range []string{"failover", "failover dc {\n member\n}", "failover dc {\n fail_after x\n}", "failover dc {\n retry_after\n}", "failover dc {\n dial_timeout x\n}", "failover dc {\n foo\n}"} {
+		t.Run("invalid "+cfg, func(t *testing.T) {
+			var f Failover
+			require.Error(t, f.UnmarshalCaddyfile(caddyfile.NewTestDispenser(cfg)))
+		})
+	}
+}
+
+func TestFailover_Forward(t *testing.T) {
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := free.Addr().(*net.TCPAddr).Port
+	require.NoError(t, free.Close())
+
+	b, err := json.Marshal(map[string]any{
+		"admin": map[string]any{"disabled": true, "config": map[string]any{"persist": false}},
+		"apps": map[string]any{
+			"point-c": map[string]any{"networks": []any{
+				map[string]any{"type": "failover", "name": "dc", "members": []string{"dc-a", "dc-b"}},
+				map[string]any{"type": "memory", "hosts": []any{
+					map[string]string{"name": "dc-a", "ip": "10.0.0.1"},
+					map[string]string{"name": "dc-b", "ip": "10.1.0.1"},
+				}},
+			}},
+			"forward": map[string]any{"forwards": []any{
+				map[string]any{"Name": "dc", "Ports": []string{fmt.Sprintf("127.0.0.1:%d:80", port)}},
+			}},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, caddy.Load(b, true))
+	defer func() { require.NoError(t, caddy.Stop()) }()
+
+	app, err := caddy.ActiveContext().App("point-c")
+	require.NoError(t, err)
+	dcb, ok := app.(pointc.NetLookup).Lookup("dc-b")
+	require.True(t, ok)
+	// Only dc-b is up, so connections are forwarded through it.
+	ln, err := dcb.Listen(&net.TCPAddr{IP: dcb.LocalAddr(), Port: 80})
+	require.NoError(t, err)
+	defer ln.Close()
+	go serveName(ln, "dc-b")
+
+	c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.SetDeadline(time.Now().Add(time.Second*5)))
+	got, err := io.ReadAll(c)
+	require.NoError(t, err)
+	require.Equal(t, "dc-b", string(got))
+}
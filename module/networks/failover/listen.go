@@ -0,0 +1,220 @@
+package failover
+
+import (
+	"errors"
+	channel_listener "github.com/trymoose/point-c/pkg/channel-listener"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	_ net.Listener   = (*groupListener)(nil)
+	_ net.PacketConn = (*groupPacketConn)(nil)
+)
+
+// groupListener accepts connections from the listeners of every member.
+// A member whose listener fails is dropped, the group listener only fails once every member's has.
+type groupListener struct {
+	*channel_listener.Listener
+	lns []net.Listener
+}
+
+func newGroupListener(lns []net.Listener, addr *net.TCPAddr, logger *slog.Logger) *groupListener {
+	conns := make(chan net.Conn)
+	if addr.Port == 0 {
+		addr = &net.TCPAddr{IP: addr.IP, Port: lns[0].Addr().(*net.TCPAddr).Port, Zone: addr.Zone}
+	}
+	ln := &groupListener{Listener: channel_listener.New(conns, addr), lns: lns}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(lns))
+	for i, mln := range lns {
+		wg.Add(1)
+		go func(i int, mln net.Listener) {
+			defer wg.Done()
+			for {
+				c, err := mln.Accept()
+				if err != nil {
+					select {
+					case <-ln.Done():
+					default:
+						logger.Warn("group member stopped listening", "addr", mln.Addr(), "error", err)
+					}
+					errs[i] = err
+					return
+				}
+				select {
+				case <-ln.Done():
+					c.Close()
+				case conns <- c:
+				}
+			}
+		}(i, mln)
+	}
+	go func() {
+		wg.Wait()
+		ln.CloseWithErr(errors.Join(errs...))
+	}()
+	return ln
+}
+
+func (l *groupListener) Close() error {
+	err := l.Listener.Close()
+	for _, ln := range l.lns {
+		err = errors.Join(err, ln.Close())
+	}
+	return err
+}
+
+type (
+	// groupPacketConn reads packets from the packet conns of every member.
+	groupPacketConn struct {
+		pcs      []net.PacketConn
+		addr     *net.UDPAddr
+		in       chan packet
+		done     chan struct{}
+		close    sync.Once
+		routes   sync.Map // routes maps the address a packet was read from to the member conn it was read on.
+		deadline deadline
+	}
+	packet struct {
+		from net.Addr
+		pc   net.PacketConn
+		b    []byte
+	}
+)
+
+func newGroupPacketConn(pcs []net.PacketConn, addr *net.UDPAddr) *groupPacketConn {
+	if addr.Port == 0 {
+		addr = &net.UDPAddr{IP: addr.IP, Port: pcs[0].LocalAddr().(*net.UDPAddr).Port, Zone: addr.Zone}
+	}
+	c := &groupPacketConn{pcs: pcs, addr: addr, in: make(chan packet), done: make(chan struct{})}
+	for _, pc := range pcs {
+		go c.read(pc)
+	}
+	return c
+}
+
+// read passes packets read on a member to [groupPacketConn.ReadFrom].
+func (c *groupPacketConn) read(pc net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		select {
+		case c.in <- packet{from: from, pc: pc, b: append([]byte(nil), buf[:n]...)}:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *groupPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case <-c.done:
+		return 0, nil, &net.OpError{Op: "read", Net: "udp", Addr: c.addr, Err: net.ErrClosed}
+	default:
+	}
+	select {
+	case p := <-c.in:
+		c.routes.Store(p.from.String(), p.pc)
+		return copy(b, p.b), p.from, nil
+	case <-c.done:
+		return 0, nil, &net.OpError{Op: "read", Net: "udp", Addr: c.addr, Err: net.ErrClosed}
+	case <-c.deadline.wait():
+		return 0, nil, &net.OpError{Op: "read", Net: "udp", Addr: c.addr, Err: os.ErrDeadlineExceeded}
+	}
+}
+
+// WriteTo writes through the member the address was last read from, or the first member if it was never read from.
+func (c *groupPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	pc := c.pcs[0]
+	if v, ok := c.routes.Load(addr.String()); ok {
+		pc = v.(net.PacketConn)
+	}
+	return pc.WriteTo(b, addr)
+}
+
+func (c *groupPacketConn) Close() (err error) {
+	c.close.Do(func() {
+		close(c.done)
+		for _, pc := range c.pcs {
+			err = errors.Join(err, pc.Close())
+		}
+	})
+	return
+}
+
+func (c *groupPacketConn) LocalAddr() net.Addr { return c.addr }
+
+func (c *groupPacketConn) SetDeadline(t time.Time) error {
+	return errors.Join(c.SetReadDeadline(t), c.SetWriteDeadline(t))
+}
+
+func (c *groupPacketConn) SetReadDeadline(t time.Time) error { c.deadline.set(t); return nil }
+
+func (c *groupPacketConn) SetWriteDeadline(t time.Time) (err error) {
+	for _, pc := range c.pcs {
+		err = errors.Join(err, pc.SetWriteDeadline(t))
+	}
+	return
+}
+
+// deadline is a channel closed once a deadline passes.
+type deadline struct {
+	mu    sync.Mutex
+	timer *time.Timer
+	ch    chan struct{}
+}
+
+// set changes the deadline, the zero time never passes.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	if d.ch == nil || isClosed(d.ch) {
+		d.ch = make(chan struct{})
+	}
+	if t.IsZero() {
+		return
+	}
+	ch := d.ch
+	if wait := time.Until(t); wait <= 0 {
+		close(ch)
+	} else {
+		d.timer = time.AfterFunc(wait, func() {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			if !isClosed(ch) {
+				close(ch)
+			}
+		})
+	}
+}
+
+// wait gets a channel closed once the deadline passes.
+func (d *deadline) wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.ch == nil {
+		d.ch = make(chan struct{})
+	}
+	return d.ch
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,344 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// firstEphemeralPort is where ports are allocated from when listening or dialing on port 0.
+	firstEphemeralPort = 49152
+	// packetQueue is how many packets a packet conn holds before dropping new ones, like a socket buffer.
+	packetQueue = 64
+)
+
+// fabric connects the hosts of a [Memory] network. Any address can be listened on and dialed from, like a tunnel that does not check source addresses.
+type fabric struct {
+	mu        sync.Mutex
+	listeners map[netip.AddrPort]*listener
+	packets   map[netip.AddrPort]*packetConn
+	next      uint16 // next is the next ephemeral port to try.
+	closed    bool
+}
+
+func newFabric() *fabric {
+	return &fabric{listeners: map[netip.AddrPort]*listener{}, packets: map[netip.AddrPort]*packetConn{}, next: firstEphemeralPort}
+}
+
+// addrPort converts an ip and port, 0 means a free port is allocated.
+func addrPort(ip net.IP, port int) netip.AddrPort {
+	addr, _ := netip.AddrFromSlice(ip)
+	return netip.AddrPortFrom(addr.Unmap(), uint16(port))
+}
+
+// bind allocates a free port if the port is 0. Must be called with mu held.
+func (f *fabric) bind(ap netip.AddrPort, used func(netip.AddrPort) bool) (netip.AddrPort, error) {
+	if f.closed {
+		return netip.AddrPort{}, net.ErrClosed
+	} else if ap.Port() != 0 {
+		if used(ap) {
+			return netip.AddrPort{}, syscall.EADDRINUSE
+		}
+		return ap, nil
+	}
+	for i := 0; i < 65536-firstEphemeralPort; i++ {
+		port := f.next
+		if f.next++; f.next == 0 {
+			f.next = firstEphemeralPort
+		}
+		if next := netip.AddrPortFrom(ap.Addr(), port); !used(next) {
+			return next, nil
+		}
+	}
+	return netip.AddrPort{}, syscall.EADDRINUSE
+}
+
+// lookup finds what is bound to an address, or to the unspecified address on the same port.
+func lookup[V any](m map[netip.AddrPort]V, ap netip.AddrPort) (V, bool) {
+	if v, ok := m[ap]; ok {
+		return v, true
+	}
+	unspecified := netip.IPv4Unspecified()
+	if ap.Addr().Is6() {
+		unspecified = netip.IPv6Unspecified()
+	}
+	v, ok := m[netip.AddrPortFrom(unspecified, ap.Port())]
+	return v, ok
+}
+
+// listen listens for TCP connections on an address.
+func (f *fabric) listen(ap netip.AddrPort) (*listener, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ap, err := f.bind(ap, func(ap netip.AddrPort) bool { _, ok := f.listeners[ap]; return ok })
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: "tcp", Addr: net.TCPAddrFromAddrPort(ap), Err: err}
+	}
+	ln := &listener{fabric: f, addr: ap, conns: make(chan net.Conn), done: make(chan struct{})}
+	f.listeners[ap] = ln
+	return ln, nil
+}
+
+// dial connects to a TCP listener from the local address.
+func (f *fabric) dial(ctx context.Context, local, remote netip.AddrPort) (net.Conn, error) {
+	f.mu.Lock()
+	ln, ok := lookup(f.listeners, remote)
+	var err error
+	if !ok {
+		err = syscall.ECONNREFUSED
+	} else {
+		local, err = f.bind(local, func(netip.AddrPort) bool { return false })
+	}
+	f.mu.Unlock()
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Addr: net.TCPAddrFromAddrPort(remote), Err: err}
+	}
+
+	client, server := net.Pipe()
+	laddr, raddr := net.TCPAddrFromAddrPort(local), net.TCPAddrFromAddrPort(remote)
+	select {
+	case ln.conns <- &conn{Conn: server, local: raddr, remote: laddr}:
+		return &conn{Conn: client, local: laddr, remote: raddr}, nil
+	case <-ln.done:
+		err = syscall.ECONNREFUSED
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	client.Close()
+	server.Close()
+	return nil, &net.OpError{Op: "dial", Net: "tcp", Addr: raddr, Err: err}
+}
+
+// listenPacket opens a UDP packet conn on an address.
+func (f *fabric) listenPacket(ap netip.AddrPort, remote *net.UDPAddr) (*packetConn, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ap, err := f.bind(ap, func(ap netip.AddrPort) bool { _, ok := f.packets[ap]; return ok })
+	if err != nil {
+		return nil, &net.OpError{Op: "listen", Net: "udp", Addr: net.UDPAddrFromAddrPort(ap), Err: err}
+	}
+	pc := &packetConn{fabric: f, addr: ap, remote: remote, in: make(chan packet, packetQueue), done: make(chan struct{})}
+	f.packets[ap] = pc
+	return pc, nil
+}
+
+// send delivers a packet. Like UDP, packets to an address nothing listens on, or to a full queue, are dropped.
+func (f *fabric) send(from, to netip.AddrPort, b []byte) {
+	f.mu.Lock()
+	pc, ok := lookup(f.packets, to)
+	f.mu.Unlock()
+	if !ok {
+		return
+	}
+	select {
+	case pc.in <- packet{from: net.UDPAddrFromAddrPort(from), b: append([]byte(nil), b...)}:
+	default:
+	}
+}
+
+// close closes every listener and packet conn.
+func (f *fabric) close() error {
+	f.mu.Lock()
+	f.closed = true
+	var closers []func() error
+	for _, ln := range f.listeners {
+		closers = append(closers, ln.Close)
+	}
+	for _, pc := range f.packets {
+		closers = append(closers, pc.Close)
+	}
+	f.mu.Unlock()
+
+	var err error
+	for _, c := range closers {
+		err = errors.Join(err, c())
+	}
+	return err
+}
+
+type (
+	// listener accepts TCP connections dialed on the fabric.
+	listener struct {
+		fabric *fabric
+		addr   netip.AddrPort
+		conns  chan net.Conn
+		done   chan struct{}
+		once   sync.Once
+	}
+	// conn is a TCP connection on the fabric.
+	conn struct {
+		net.Conn
+		local, remote *net.TCPAddr
+	}
+)
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Addr: l.Addr(), Err: net.ErrClosed}
+	}
+}
+
+func (l *listener) Close() error {
+	l.once.Do(func() {
+		l.fabric.mu.Lock()
+		delete(l.fabric.listeners, l.addr)
+		l.fabric.mu.Unlock()
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *listener) Addr() net.Addr { return net.TCPAddrFromAddrPort(l.addr) }
+
+func (c *conn) LocalAddr() net.Addr  { return c.local }
+func (c *conn) RemoteAddr() net.Addr { return c.remote }
+
+type (
+	// packetConn is a UDP conn on the fabric. If dialed it is connected to the remote, and Read and Write work like a [net.UDPConn].
+	packetConn struct {
+		fabric   *fabric
+		addr     netip.AddrPort
+		remote   *net.UDPAddr // remote is the address the conn is connected to, nil if it is not.
+		in       chan packet
+		done     chan struct{}
+		once     sync.Once
+		deadline deadline
+	}
+	packet struct {
+		from *net.UDPAddr
+		b    []byte
+	}
+)
+
+func (c *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		select {
+		case p := <-c.in:
+			// A connected conn only receives from its remote.
+			if c.remote != nil && p.from.AddrPort() != c.remote.AddrPort() {
+				continue
+			}
+			return copy(b, p.b), p.from, nil
+		case <-c.done:
+			return 0, nil, &net.OpError{Op: "read", Net: "udp", Addr: c.LocalAddr(), Err: net.ErrClosed}
+		case <-c.deadline.wait():
+			return 0, nil, &net.OpError{Op: "read", Net: "udp", Addr: c.LocalAddr(), Err: os.ErrDeadlineExceeded}
+		}
+	}
+}
+
+func (c *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.done:
+		return 0, &net.OpError{Op: "write", Net: "udp", Addr: c.LocalAddr(), Err: net.ErrClosed}
+	default:
+	}
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, &net.OpError{Op: "write", Net: "udp", Addr: addr, Err: syscall.EINVAL}
+	}
+	c.fabric.send(c.addr, addrPort(ua.IP, ua.Port), b)
+	return len(b), nil
+}
+
+func (c *packetConn) Read(b []byte) (int, error) {
+	n, _, err := c.ReadFrom(b)
+	return n, err
+}
+
+func (c *packetConn) Write(b []byte) (int, error) {
+	if c.remote == nil {
+		return 0, &net.OpError{Op: "write", Net: "udp", Addr: c.LocalAddr(), Err: syscall.EDESTADDRREQ}
+	}
+	return c.WriteTo(b, c.remote)
+}
+
+func (c *packetConn) Close() error {
+	c.once.Do(func() {
+		c.fabric.mu.Lock()
+		delete(c.fabric.packets, c.addr)
+		c.fabric.mu.Unlock()
+		close(c.done)
+	})
+	return nil
+}
+
+func (c *packetConn) LocalAddr() net.Addr { return net.UDPAddrFromAddrPort(c.addr) }
+
+// RemoteAddr is the address the conn is connected to. It is nil if the conn was not dialed.
+func (c *packetConn) RemoteAddr() net.Addr {
+	if c.remote == nil {
+		return nil
+	}
+	return c.remote
+}
+
+func (c *packetConn) SetDeadline(t time.Time) error     { return c.SetReadDeadline(t) }
+func (c *packetConn) SetReadDeadline(t time.Time) error { c.deadline.set(t); return nil }
+
+// SetWriteDeadline does nothing, writes never block.
+func (c *packetConn) SetWriteDeadline(time.Time) error { return nil }
+
+// deadline is a channel closed once a deadline passes.
+type deadline struct {
+	mu    sync.Mutex
+	timer *time.Timer
+	ch    chan struct{}
+}
+
+// set changes the deadline, the zero time never passes.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	// A new channel is needed if the old one was closed by a passed deadline.
+	if d.ch == nil || isClosed(d.ch) {
+		d.ch = make(chan struct{})
+	}
+	if t.IsZero() {
+		return
+	}
+	ch := d.ch
+	if wait := time.Until(t); wait <= 0 {
+		close(ch)
+	} else {
+		d.timer = time.AfterFunc(wait, func() {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			if !isClosed(ch) {
+				close(ch)
+			}
+		})
+	}
+}
+
+// wait gets a channel closed once the deadline passes.
+func (d *deadline) wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.ch == nil {
+		d.ch = make(chan struct{})
+	}
+	return d.ch
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,145 @@
+// Package memory is a point-c network that never leaves the process.
+// Hosts on it can reach each other like peers of a tunnel, which lets modules talk to each other, and lets configs be tested without a wireguard device.
+package memory
+
+import (
+	"context"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	pointc "github.com/trymoose/point-c"
+	"github.com/trymoose/point-c/pkg/configvalues"
+	"net"
+	"net/netip"
+)
+
+var (
+	_ caddy.Module          = (*Memory)(nil)
+	_ caddy.Provisioner     = (*Memory)(nil)
+	_ caddy.CleanerUpper    = (*Memory)(nil)
+	_ caddyfile.Unmarshaler = (*Memory)(nil)
+	_ pointc.Network        = (*Memory)(nil)
+	_ pointc.Net            = (*hostNet)(nil)
+	_ pointc.Dialer         = (*hostDialer)(nil)
+)
+
+func init() {
+	caddy.RegisterModule(new(Memory))
+}
+
+func (*Memory) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "point-c.net.memory",
+		New: func() caddy.Module { return new(Memory) },
+	}
+}
+
+type (
+	// Memory is an in-process network of named hosts. TCP and UDP between the hosts work like they would through a tunnel.
+	Memory struct {
+		Hosts  []*Host `json:"hosts"`
+		fabric *fabric
+		nets   map[string]pointc.Net
+	}
+	// Host is a net on a [Memory] network.
+	Host struct {
+		Name configvalues.Hostname `json:"name"`
+		IP   configvalues.IP       `json:"ip"`
+	}
+)
+
+func (m *Memory) Provision(caddy.Context) error {
+	m.fabric = newFabric()
+	m.nets = map[string]pointc.Net{}
+	ips := map[netip.Addr]string{}
+	for _, h := range m.Hosts {
+		name, ip := h.Name.Value(), h.IP.Value()
+		addr, ok := netip.AddrFromSlice(ip)
+		if !ok {
+			return fmt.Errorf("host %q has no ip", name)
+		} else if _, ok := m.nets[name]; ok {
+			return fmt.Errorf("host %q is declared more than once", name)
+		} else if other, ok := ips[addr.Unmap()]; ok {
+			return fmt.Errorf("host %q has the same ip as %q", name, other)
+		}
+		ips[addr.Unmap()] = name
+		m.nets[name] = &hostNet{fabric: m.fabric, ip: ip}
+	}
+	return nil
+}
+
+func (m *Memory) Cleanup() error {
+	if m.fabric == nil {
+		return nil
+	}
+	return m.fabric.close()
+}
+
+func (m *Memory) Networks() map[string]pointc.Net { return m.nets }
+
+// UnmarshalCaddyfile unmarshals the hosts from a caddyfile.
+//
+//	point-c {
+//	  memory {
+//	    <name> <ip>
+//	  }
+//	}
+func (m *Memory) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		for nesting := d.Nesting(); d.NextBlock(nesting); {
+			var h Host
+			if err := h.Name.UnmarshalText([]byte(d.Val())); err != nil {
+				return err
+			} else if !d.NextArg() {
+				return d.ArgErr()
+			} else if err := h.IP.UnmarshalText([]byte(d.Val())); err != nil {
+				return err
+			} else if d.NextArg() {
+				return d.ArgErr()
+			}
+			m.Hosts = append(m.Hosts, &h)
+		}
+	}
+	return nil
+}
+
+type (
+	// hostNet is a host on the network.
+	hostNet struct {
+		fabric *fabric
+		ip     net.IP
+	}
+	// hostDialer dials from a local address on the network.
+	hostDialer struct {
+		fabric *fabric
+		local  netip.AddrPort
+	}
+)
+
+func (n *hostNet) LocalAddr() net.IP { return n.ip }
+
+func (n *hostNet) Listen(addr *net.TCPAddr) (net.Listener, error) {
+	return n.fabric.listen(addrPort(addr.IP, addr.Port))
+}
+
+func (n *hostNet) ListenPacket(addr *net.UDPAddr) (net.PacketConn, error) {
+	return n.fabric.listenPacket(addrPort(addr.IP, addr.Port), nil)
+}
+
+// Dialer dials from the local address, the host's address is used if it is nil.
+func (n *hostNet) Dialer(laddr net.IP, port uint16) pointc.Dialer {
+	if laddr == nil {
+		laddr = n.ip
+	}
+	return &hostDialer{fabric: n.fabric, local: addrPort(laddr, int(port))}
+}
+
+func (d *hostDialer) Dial(ctx context.Context, addr *net.TCPAddr) (net.Conn, error) {
+	return d.fabric.dial(ctx, d.local, addrPort(addr.IP, addr.Port))
+}
+
+// DialPacket opens a packet conn connected to the address. It also implements [net.Conn].
+func (d *hostDialer) DialPacket(addr *net.UDPAddr) (net.PacketConn, error) {
+	remote := addrPort(addr.IP, addr.Port)
+	return d.fabric.listenPacket(d.local, net.UDPAddrFromAddrPort(remote))
+}
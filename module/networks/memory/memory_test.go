@@ -0,0 +1,226 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/stretchr/testify/require"
+	pointc "github.com/trymoose/point-c"
+	"github.com/trymoose/point-c/internal/test_helpers"
+	_ "github.com/trymoose/point-c/module"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+var (
+	serverIP = net.IPv4(10, 0, 0, 1)
+	clientIP = net.IPv4(10, 0, 0, 2)
+)
+
+// newTestNets gets a server and client host on a new network.
+func newTestNets(t *testing.T) (server, client pointc.Net) {
+	t.Helper()
+	m := &Memory{Hosts: []*Host{newTestHost(t, "server", serverIP.String()), newTestHost(t, "client", clientIP.String())}}
+	require.NoError(t, m.Provision(caddy.Context{}))
+	t.Cleanup(func() { require.NoError(t, m.Cleanup()) })
+	return m.Networks()["server"], m.Networks()["client"]
+}
+
+func newTestHost(t *testing.T, name, ip string) *Host {
+	t.Helper()
+	var h Host
+	require.NoError(t, h.Name.UnmarshalText([]byte(name)))
+	require.NoError(t, h.IP.UnmarshalText([]byte(ip)))
+	return &h
+}
+
+func TestMemory_Provision(t *testing.T) {
+	for name, hosts := range map[string][]*Host{
+		"duplicate name": {newTestHost(t, "a", "10.0.0.1"), newTestHost(t, "a", "10.0.0.2")},
+		"duplicate ip":   {newTestHost(t, "a", "10.0.0.1"), newTestHost(t, "b", "::ffff:10.0.0.1")},
+	} {
+		t.Run(name, func(t *testing.T) {
+			require.Error(t, (&Memory{Hosts: hosts}).Provision(caddy.Context{}))
+		})
+	}
+}
+
+func TestMemory_UnmarshalCaddyfile(t *testing.T) {
+	var m Memory
+	require.NoError(t, m.UnmarshalCaddyfile(caddyfile.NewTestDispenser("memory {\n server 10.0.0.1\n client fd00::2\n}")))
+	require.Len(t, m.Hosts, 2)
+	require.Equal(t, "server", m.Hosts[0].Name.Value())
+	require.Equal(t, "fd00::2", m.Hosts[1].IP.Value().String())
+
+	for _, cfg := range []string{"memory {\n server\n}", "memory {\n server 10.0.0.1 extra\n}", "memory {\n server ip\n}"} {
+		t.Run("invalid "+cfg, func(t *testing.T) {
+			var m Memory
+			require.Error(t, m.UnmarshalCaddyfile(caddyfile.NewTestDispenser(cfg)))
+		})
+	}
+}
+
+func TestHostNet_TCP(t *testing.T) {
+	server, client := newTestNets(t)
+	ln, err := server.Listen(&net.TCPAddr{IP: server.LocalAddr(), Port: 80})
+	require.NoError(t, err)
+	defer ln.Close()
+	_, err = server.Listen(&net.TCPAddr{IP: server.LocalAddr(), Port: 80})
+	require.ErrorIs(t, err, syscall.EADDRINUSE)
+
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_, _ = fmt.Fprintf(c, "%s", c.RemoteAddr())
+	}()
+
+	c, err := client.Dialer(nil, 0).Dial(context.Background(), &net.TCPAddr{IP: serverIP, Port: 80})
+	require.NoError(t, err)
+	defer c.Close()
+	require.Equal(t, &net.TCPAddr{IP: serverIP.To4(), Port: 80}, c.RemoteAddr())
+	b, err := io.ReadAll(c)
+	require.NoError(t, err)
+	require.Equal(t, c.LocalAddr().String(), string(b))
+	require.Equal(t, clientIP.To4(), c.LocalAddr().(*net.TCPAddr).IP)
+
+	t.Run("refused", func(t *testing.T) {
+		_, err := client.Dialer(nil, 0).Dial(context.Background(), &net.TCPAddr{IP: serverIP, Port: 81})
+		require.ErrorIs(t, err, syscall.ECONNREFUSED)
+	})
+
+	t.Run("not accepted", func(t *testing.T) {
+		ln, err := server.Listen(&net.TCPAddr{IP: server.LocalAddr(), Port: 82})
+		require.NoError(t, err)
+		defer ln.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+		defer cancel()
+		_, err = client.Dialer(nil, 0).Dial(ctx, &net.TCPAddr{IP: serverIP, Port: 82})
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		ln, err := server.Listen(&net.TCPAddr{IP: net.IPv4zero, Port: 83})
+		require.NoError(t, err)
+		require.NoError(t, ln.Close())
+		_, err = ln.Accept()
+		require.ErrorIs(t, err, net.ErrClosed)
+		_, err = client.Dialer(nil, 0).Dial(context.Background(), &net.TCPAddr{IP: serverIP, Port: 83})
+		require.ErrorIs(t, err, syscall.ECONNREFUSED)
+	})
+}
+
+func TestHostNet_UDP(t *testing.T) {
+	server, client := newTestNets(t)
+	pc, err := server.ListenPacket(&net.UDPAddr{IP: server.LocalAddr(), Port: 53})
+	require.NoError(t, err)
+	defer pc.Close()
+
+	dialed, err := client.Dialer(nil, 5353).DialPacket(&net.UDPAddr{IP: serverIP, Port: 53})
+	require.NoError(t, err)
+	defer dialed.Close()
+	c := dialed.(net.Conn)
+	_, err = c.Write([]byte("query"))
+	require.NoError(t, err)
+
+	buf := make([]byte, 16)
+	n, from, err := pc.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, "query", string(buf[:n]))
+	require.Equal(t, &net.UDPAddr{IP: clientIP.To4(), Port: 5353}, from)
+
+	// Packets not from the remote are not read by a dialed conn.
+	other, err := server.ListenPacket(&net.UDPAddr{IP: server.LocalAddr(), Port: 54})
+	require.NoError(t, err)
+	defer other.Close()
+	_, err = other.WriteTo([]byte("spoof"), from)
+	require.NoError(t, err)
+	_, err = pc.WriteTo([]byte("answer"), from)
+	require.NoError(t, err)
+	n, err = c.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "answer", string(buf[:n]))
+
+	require.NoError(t, pc.SetReadDeadline(time.Now().Add(time.Millisecond*10)))
+	_, _, err = pc.ReadFrom(buf)
+	require.ErrorIs(t, err, os.ErrDeadlineExceeded)
+	require.NoError(t, pc.SetReadDeadline(time.Time{}))
+	_, err = c.Write([]byte("again"))
+	require.NoError(t, err)
+	n, _, err = pc.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, "again", string(buf[:n]))
+
+	require.NoError(t, pc.Close())
+	_, _, err = pc.ReadFrom(buf)
+	require.ErrorIs(t, err, net.ErrClosed)
+}
+
+// loadConfig runs caddy with the point-c app on a memory network with a server and client host.
+func loadConfig(t *testing.T, apps map[string]any) caddy.Context {
+	t.Helper()
+	apps["point-c"] = map[string]any{"networks": []any{map[string]any{"type": "memory", "hosts": []any{
+		map[string]string{"name": "server", "ip": serverIP.String()},
+		map[string]string{"name": "client", "ip": clientIP.String()},
+	}}}}
+	b, err := json.Marshal(map[string]any{"admin": map[string]any{"disabled": true, "config": map[string]any{"persist": false}}, "apps": apps})
+	require.NoError(t, err)
+	require.NoError(t, caddy.Load(b, true))
+	t.Cleanup(func() { require.NoError(t, caddy.Stop()) })
+	return caddy.ActiveContext()
+}
+
+// hostPort gets a free port on the host.
+func hostPort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestMemory_Forward(t *testing.T) {
+	port := hostPort(t)
+	ctx := loadConfig(t, map[string]any{"forward": map[string]any{"forwards": []any{
+		map[string]any{"Name": "server", "Ports": []string{fmt.Sprintf("127.0.0.1:%d:80", port)}},
+	}}})
+	app, err := ctx.App("point-c")
+	require.NoError(t, err)
+	server, ok := app.(pointc.NetLookup).Lookup("server")
+	require.True(t, ok)
+	ln, err := server.Listen(&net.TCPAddr{IP: server.LocalAddr(), Port: 80})
+	require.NoError(t, err)
+	defer ln.Close()
+	go test_helpers.Echo(ln)
+
+	c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	require.NoError(t, err)
+	test_helpers.RequireEcho(t, c)
+}
+
+func TestMemory_Listener(t *testing.T) {
+	ctx := loadConfig(t, map[string]any{})
+	v, err := ctx.LoadModuleByID("caddy.listeners.merge.listeners.point-c", json.RawMessage(`{"name": "server", "port": 80}`))
+	require.NoError(t, err)
+	ln := v.(net.Listener)
+	defer ln.Close()
+	go test_helpers.Echo(ln)
+
+	app, err := ctx.App("point-c")
+	require.NoError(t, err)
+	// The listener listens once it is first accepted on.
+	var c net.Conn
+	require.Eventually(t, func() bool {
+		c, err = app.(pointc.Resolver).DialContext(context.Background(), "tcp", "server.pointc:80")
+		return err == nil
+	}, time.Second*5, time.Millisecond*10)
+	test_helpers.RequireEcho(t, c)
+}
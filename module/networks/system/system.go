@@ -0,0 +1,138 @@
+// Package system is a point-c network on the host's own network stack.
+// It lets configs swap a tunnel for the host by name, and lets the forward app forward to ports on the host.
+package system
+
+import (
+	"context"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	pointc "github.com/trymoose/point-c"
+	"github.com/trymoose/point-c/pkg/configvalues"
+	"net"
+)
+
+var (
+	_ caddy.Module          = (*System)(nil)
+	_ caddy.Provisioner     = (*System)(nil)
+	_ caddyfile.Unmarshaler = (*System)(nil)
+	_ pointc.Network        = (*System)(nil)
+	_ pointc.Net            = (*systemNet)(nil)
+	_ pointc.Dialer         = (*systemDialer)(nil)
+)
+
+func init() {
+	caddy.RegisterModule(new(System))
+}
+
+func (*System) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "point-c.net.system",
+		New: func() caddy.Module { return new(System) },
+	}
+}
+
+// System is the network of the host.
+type System struct {
+	Name configvalues.Hostname `json:"name"`
+	// IP is the address of the host on the net, where it is dialed and resolved to. Defaults to 127.0.0.1.
+	IP  *configvalues.IP `json:"ip,omitempty"`
+	net *systemNet
+}
+
+func (s *System) Provision(caddy.Context) error {
+	s.net = &systemNet{ip: net.IPv4(127, 0, 0, 1)}
+	if s.IP != nil {
+		s.net.ip = s.IP.Value()
+	}
+	return nil
+}
+
+func (s *System) Networks() map[string]pointc.Net {
+	return map[string]pointc.Net{s.Name.Value(): s.net}
+}
+
+// UnmarshalCaddyfile unmarshals the net from a caddyfile.
+//
+//	point-c {
+//	  system <name> [<ip>]
+//	}
+func (s *System) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		if !d.NextArg() {
+			return d.ArgErr()
+		} else if err := s.Name.UnmarshalText([]byte(d.Val())); err != nil {
+			return err
+		}
+
+		if d.NextArg() {
+			s.IP = new(configvalues.IP)
+			if err := s.IP.UnmarshalText([]byte(d.Val())); err != nil {
+				return err
+			}
+		}
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+	}
+	return nil
+}
+
+type (
+	systemNet    struct{ ip net.IP }
+	systemDialer struct {
+		laddr net.IP
+		port  uint16
+	}
+)
+
+func (n *systemNet) LocalAddr() net.IP { return n.ip }
+
+func (n *systemNet) Listen(addr *net.TCPAddr) (net.Listener, error) {
+	return net.ListenTCP("tcp", addr)
+}
+
+func (n *systemNet) ListenPacket(addr *net.UDPAddr) (net.PacketConn, error) {
+	return net.ListenUDP("udp", addr)
+}
+
+// Dialer dials from the local address. Addresses the host does not have, such as the address of a peer a
+// connection is forwarded for, cannot be bound, so those connections are dialed from an address chosen by the host.
+func (n *systemNet) Dialer(laddr net.IP, port uint16) pointc.Dialer {
+	if laddr != nil && !isLocal(laddr) {
+		laddr, port = nil, 0
+	}
+	return &systemDialer{laddr: laddr, port: port}
+}
+
+func (d *systemDialer) Dial(ctx context.Context, addr *net.TCPAddr) (net.Conn, error) {
+	var dialer net.Dialer
+	if d.laddr != nil || d.port != 0 {
+		dialer.LocalAddr = &net.TCPAddr{IP: d.laddr, Port: int(d.port)}
+	}
+	return dialer.DialContext(ctx, "tcp", addr.String())
+}
+
+func (d *systemDialer) DialPacket(addr *net.UDPAddr) (net.PacketConn, error) {
+	var laddr *net.UDPAddr
+	if d.laddr != nil || d.port != 0 {
+		laddr = &net.UDPAddr{IP: d.laddr, Port: int(d.port)}
+	}
+	return net.DialUDP("udp", laddr, addr)
+}
+
+// isLocal reports whether the host has the address, so it can be bound.
+func isLocal(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if n, ok := addr.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package system
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/stretchr/testify/require"
+	"github.com/trymoose/point-c/internal/test_helpers"
+	_ "github.com/trymoose/point-c/module"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestNet(t *testing.T) *systemNet {
+	t.Helper()
+	var s System
+	require.NoError(t, s.Name.UnmarshalText([]byte("host")))
+	require.NoError(t, s.Provision(caddy.Context{}))
+	n, ok := s.Networks()["host"]
+	require.True(t, ok)
+	return n.(*systemNet)
+}
+
+func TestSystem_Provision(t *testing.T) {
+	require.Equal(t, net.IPv4(127, 0, 0, 1), newTestNet(t).LocalAddr())
+}
+
+func TestSystem_UnmarshalCaddyfile(t *testing.T) {
+	t.Run("ip", func(t *testing.T) {
+		var s System
+		require.NoError(t, s.UnmarshalCaddyfile(caddyfile.NewTestDispenser("system host 192.0.2.1")))
+		require.Equal(t, "host", s.Name.Value())
+		require.Equal(t, "192.0.2.1", s.IP.Value().String())
+	})
+
+	t.Run("default ip", func(t *testing.T) {
+		var s System
+		require.NoError(t, s.UnmarshalCaddyfile(caddyfile.NewTestDispenser("system host")))
+		require.Nil(t, s.IP)
+	})
+
+	for _, cfg := range []string{"system", "system host ip", "system host 192.0.2.1 extra"} {
+		t.Run("invalid "+cfg, func(t *testing.T) {
+			var s System
+			require.Error(t, s.UnmarshalCaddyfile(caddyfile.NewTestDispenser(cfg)))
+		})
+	}
+}
+
+func TestSystemNet_TCP(t *testing.T) {
+	n := newTestNet(t)
+	ln, err := n.Listen(&net.TCPAddr{IP: n.LocalAddr()})
+	require.NoError(t, err)
+	defer ln.Close()
+	go test_helpers.Echo(ln)
+	addr := ln.Addr().(*net.TCPAddr)
+
+	t.Run("bound", func(t *testing.T) {
+		c, err := n.Dialer(n.LocalAddr(), 0).Dial(context.Background(), addr)
+		require.NoError(t, err)
+		require.True(t, c.LocalAddr().(*net.TCPAddr).IP.Equal(n.LocalAddr()))
+		test_helpers.RequireEcho(t, c)
+	})
+
+	t.Run("not local", func(t *testing.T) {
+		// 192.0.2.0/24 is reserved for documentation, so the host does not have it.
+		c, err := n.Dialer(net.IPv4(192, 0, 2, 1), 1).Dial(context.Background(), addr)
+		require.NoError(t, err)
+		test_helpers.RequireEcho(t, c)
+	})
+}
+
+func TestSystemNet_UDP(t *testing.T) {
+	n := newTestNet(t)
+	pc, err := n.ListenPacket(&net.UDPAddr{IP: n.LocalAddr()})
+	require.NoError(t, err)
+	defer pc.Close()
+
+	dialed, err := n.Dialer(nil, 0).DialPacket(pc.LocalAddr().(*net.UDPAddr))
+	require.NoError(t, err)
+	defer dialed.Close()
+	_, err = dialed.(net.Conn).Write([]byte("query"))
+	require.NoError(t, err)
+
+	require.NoError(t, pc.SetReadDeadline(time.Now().Add(time.Second*5)))
+	buf := make([]byte, 16)
+	count, from, err := pc.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, "query", string(buf[:count]))
+	require.Equal(t, dialed.LocalAddr().String(), from.String())
+}
+
+func TestSystem_Forward(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go test_helpers.Echo(ln)
+
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := free.Addr().(*net.TCPAddr).Port
+	require.NoError(t, free.Close())
+
+	b, err := json.Marshal(map[string]any{
+		"admin": map[string]any{"disabled": true, "config": map[string]any{"persist": false}},
+		"apps": map[string]any{
+			"point-c": map[string]any{"networks": []any{map[string]any{"type": "system", "name": "host"}}},
+			"forward": map[string]any{"forwards": []any{
+				map[string]any{"Name": "host", "Ports": []string{fmt.Sprintf("127.0.0.1:%d:%d", port, ln.Addr().(*net.TCPAddr).Port)}},
+			}},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, caddy.Load(b, true))
+	defer func() { require.NoError(t, caddy.Stop()) }()
+
+	c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	require.NoError(t, err)
+	test_helpers.RequireEcho(t, c)
+}
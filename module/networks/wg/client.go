@@ -3,15 +3,21 @@ package wg
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/caddyserver/caddy/v2"
 	pointc "github.com/trymoose/point-c"
 	"github.com/trymoose/point-c/pkg/configvalues"
 	"github.com/trymoose/point-c/pkg/wg"
+	"github.com/trymoose/point-c/pkg/wg/wgapi"
 	"github.com/trymoose/point-c/pkg/wg/wgapi/wgconfig"
-	"github.com/trymoose/point-c/wglog/wgevents"
+	"github.com/trymoose/point-c/pkg/wg/wglog/wgevents"
 	"go.mrchanchal.com/zaphandler"
 	"log/slog"
 	"net"
+	"net/netip"
+	"slices"
+	"time"
 )
 
 var (
@@ -19,8 +25,13 @@ var (
 	_ caddy.Provisioner  = (*Client)(nil)
 	_ caddy.CleanerUpper = (*Client)(nil)
 	_ pointc.Network     = (*Client)(nil)
+	_ pointc.Lifecycle   = (*Client)(nil)
+	_ pointc.Ready       = (*Client)(nil)
+	_ pointc.Ready       = (*clientNet)(nil)
+	_ pointc.Handshaker  = (*clientNet)(nil)
 	_ json.Marshaler     = (*Client)(nil)
 	_ json.Unmarshaler   = (*Client)(nil)
+	_ wg.Resolver        = resolvers(nil)
 )
 
 func init() {
@@ -29,11 +40,14 @@ func init() {
 
 func (*Client) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
-		ID:  "proxy.net.wireguard-client",
+		ID:  "point-c.net.wireguard-client",
 		New: func() caddy.Module { return new(Client) },
 	}
 }
 
+// ErrNotAllowed is returned when dialing an address that is not in the allowed ips of any peer, so it would not be routed through the tunnel.
+var ErrNotAllowed = errors.New("address is not in the allowed ips of the tunnel")
+
 // Client is a basic wireguard client.
 type Client struct {
 	json struct {
@@ -43,12 +57,56 @@ type Client struct {
 		Private   PrivateKey
 		Public    PublicKey
 		Preshared PresharedKey
+		// ResolveInterval is how often a hostname endpoint is resolved again. It is always resolved again after failed handshakes.
+		ResolveInterval caddy.Duration `json:",omitempty"`
+		// Resolvers are the DNS servers hostname endpoints are resolved again with, as an ip or ip:port with port 53 if not set.
+		// The system resolver is used if empty. Endpoints are always resolved by the system resolver when the config is parsed.
+		Resolvers []string `json:"resolvers,omitempty"`
+		// AllowedIPs are the subnets routed to the server. All addresses are routed to the server if empty.
+		AllowedIPs []configvalues.CIDR `json:"allowed_ips,omitempty"`
+		// PersistentKeepalive is the keepalive interval of the server. [wgapi.DefaultPersistentKeepalive] is used if it is not set.
+		PersistentKeepalive *configvalues.Keepalive `json:"persistent_keepalive,omitempty"`
+		// Peers are additional servers. Each server must route a different set of subnets, so AllowedIPs must be set to use them.
+		Peers []*clientPeer `json:"peers,omitempty"`
+		// PresharedRotation periodically replaces the preshared key with the server. The server must have rotation enabled.
+		// Rotated keys are kept in Caddy's storage under point-c/preshared, encrypted with a key derived from Private.
+		PresharedRotation *presharedRotation `json:"preshared_rotation,omitempty"`
 	}
-	name   string
-	ip     net.IP
-	net    *wg.Net
-	logger *slog.Logger
-	wg     *wg.Wireguard
+	name       string
+	ip         net.IP
+	net        *wg.Net
+	logger     *slog.Logger
+	wg         *wg.Wireguard
+	key        string // key is the key of the device in the pool.
+	dev        *sharedDevice
+	state      *deviceState                // state is applied to the device once the client is brought up.
+	up         bool                        // up reports whether the module brought the device up.
+	ctx        context.Context             // ctx is done once the config is unloaded.
+	run        []func(ctx context.Context) // run are started when the client is brought up, ctx is done once it is brought down.
+	stop       context.CancelFunc          // stop stops the functions started by [Client.Up].
+	unregister func()                      // unregister removes the device from the admin status.
+	preshared  *presharedKeys              // preshared keeps the rotated preshared key with the server, nil if rotation is disabled.
+	resolver   wg.Resolver                 // resolver resolves hostname endpoints again, nil for the system resolver.
+	peers      []wgapi.PublicKey
+	allowed    []net.IPNet
+	keepalive  bool // keepalive reports whether every server is sent keepalives.
+}
+
+// clientPeer is an additional server of a [Client].
+type clientPeer struct {
+	Endpoint            configvalues.UDPAddr
+	Public              PublicKey
+	Preshared           PresharedKey
+	AllowedIPs          []configvalues.CIDR     `json:"allowed_ips"`
+	PersistentKeepalive *configvalues.Keepalive `json:"persistent_keepalive,omitempty"`
+}
+
+// presharedRotation configures rotation of the preshared key with the server.
+type presharedRotation struct {
+	// Address is the ip:port in the tunnel the server answers rotations on.
+	Address string `json:"address"`
+	// Interval is the time between rotations.
+	Interval caddy.Duration `json:"interval"`
 }
 
 func (c *Client) UnmarshalJSON(bytes []byte) error { return json.Unmarshal(bytes, &c.json) }
@@ -60,25 +118,119 @@ func (c *Client) Networks() map[string]pointc.Net {
 
 type (
 	clientNet    Client
-	clientDialer struct{ d *wg.Dialer }
+	clientDialer struct {
+		d       *wg.Dialer
+		self    *wg.Dialer // self dials the client's own address from it, so the replies are delivered back to the stack too.
+		ip      net.IP
+		allowed []net.IPNet
+	}
 )
 
 func (c *clientDialer) Dial(ctx context.Context, addr *net.TCPAddr) (net.Conn, error) {
-	return c.d.DialTCP(ctx, addr)
+	d, err := c.dialer(addr.IP)
+	if err != nil {
+		return nil, err
+	}
+	return d.DialTCP(ctx, addr)
 }
 func (c *clientDialer) DialPacket(addr *net.UDPAddr) (net.PacketConn, error) {
-	return c.d.DialUDP(addr)
+	d, err := c.dialer(addr.IP)
+	if err != nil {
+		return nil, err
+	}
+	return d.DialUDP(addr)
 }
+
+// dialer gets the dialer for the address. The client's own address is always allowed, so forwards and listeners can reach the client net.
+// Other addresses return [ErrNotAllowed] if they would not be routed to a server.
+func (c *clientDialer) dialer(ip net.IP) (*wg.Dialer, error) {
+	if c.ip != nil && ip.Equal(c.ip) {
+		return c.self, nil
+	} else if slices.ContainsFunc(c.allowed, func(n net.IPNet) bool { return n.Contains(ip) }) {
+		return c.d, nil
+	}
+	return nil, fmt.Errorf("dial %s: %w", ip, ErrNotAllowed)
+}
+
 func (c *clientNet) Listen(addr *net.TCPAddr) (net.Listener, error) { return c.net.Listen(addr) }
 func (c *clientNet) LocalAddr() net.IP                              { return c.ip }
 func (c *clientNet) ListenPacket(addr *net.UDPAddr) (net.PacketConn, error) {
 	return c.net.ListenPacket(addr)
 }
 func (c *clientNet) Dialer(laddr net.IP, port uint16) pointc.Dialer {
-	return &clientDialer{d: c.net.Dialer(laddr, port)}
+	return &clientDialer{d: c.net.Dialer(laddr, port), self: c.net.Dialer(c.ip, port), ip: c.ip, allowed: c.allowed}
+}
+
+func (c *clientNet) WaitReady(ctx context.Context) error { return (*Client)(c).WaitReady(ctx) }
+
+// LastHandshake gets the last handshake with any of the servers. It only failed if the handshakes with every server were given up on.
+func (c *clientNet) LastHandshake() (pointc.Handshake, bool) {
+	h := pointc.Handshake{Failed: len(c.peers) > 0, Keepalive: c.keepalive}
+	for _, peer := range c.peers {
+		if t, ok := c.wg.LastHandshake(peer); ok && t.After(h.Last) {
+			h.Last = t
+		}
+		h.Failed = h.Failed && c.wg.LastHandshakeFailed(peer)
+	}
+	return h, true
 }
 
-func (c *Client) Cleanup() error { return c.wg.Close() }
+// WaitReady blocks until the first handshake with any of the servers has completed.
+func (c *Client) WaitReady(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errs := make(chan error, len(c.peers))
+	for _, peer := range c.peers {
+		go func(peer wgapi.PublicKey) { errs <- c.wg.WaitHandshake(ctx, peer) }(peer)
+	}
+
+	var err error
+	for range c.peers {
+		if err = <-errs; err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// Up brings the device up, connecting to the servers.
+func (c *Client) Up() error {
+	if c.up {
+		return nil
+	}
+	if err := c.dev.up(c.state); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(c.ctx)
+	for _, fn := range c.run {
+		go fn(ctx)
+	}
+	c.up, c.stop = true, cancel
+	return nil
+}
+
+// Down brings the device down, unless a newer config is using it.
+// If no newer config was brought up, the device is changed back to the config that was running before.
+func (c *Client) Down() error {
+	if !c.up {
+		return nil
+	}
+	c.up = false
+	c.stop()
+	return c.dev.down(c.state)
+}
+
+func (c *Client) Cleanup() error {
+	if c.unregister != nil {
+		c.unregister()
+	}
+	if c.key == "" {
+		return nil
+	}
+	err := c.Down()
+	_, derr := devicePool.Delete(c.key)
+	return errors.Join(err, derr)
+}
 
 func (c *Client) Provision(ctx caddy.Context) (err error) {
 	*c = Client{
@@ -86,21 +238,170 @@ func (c *Client) Provision(ctx caddy.Context) (err error) {
 		name:   c.json.Name.Value(),
 		ip:     c.json.IP.Value(),
 		logger: slog.New(zaphandler.New(ctx.Logger())),
+		ctx:    ctx,
 	}
 
 	cfg := wgconfig.Client{
-		Private:   c.json.Private.Value(),
-		Public:    c.json.Public.Value(),
-		PreShared: c.json.Preshared.Value(),
-		Endpoint:  *c.json.Endpoint.Value(),
-	}
-	cfg.DefaultPersistentKeepAlive()
-	cfg.AllowAllIPs()
-	// Hostname is a unique hostname.
-	c.wg, err = wg.New(
-		wg.OptionConfig(&cfg),
-		wg.OptionLogger(wgevents.Events(func(e wgevents.Event) { e.Slog(c.logger) })),
-		wg.OptionNetDevice(&c.net),
-	)
-	return
+		Private:             c.json.Private.Value(),
+		Public:              c.json.Public.Value(),
+		PreShared:           c.json.Preshared.Value(),
+		Endpoint:            *c.json.Endpoint.Value(),
+		PersistentKeepalive: keepalive(c.json.PersistentKeepalive),
+		AllowedIPs:          subnets(c.json.AllowedIPs),
+	}
+	if len(cfg.AllowedIPs) == 0 {
+		cfg.AllowAllIPs()
+	}
+	if c.resolver, err = newResolver(c.json.Resolvers); err != nil {
+		return err
+	}
+	if c.json.PresharedRotation != nil {
+		c.preshared = newPresharedKeys(ctx.Storage(), c.name, cfg.Private, c.logger)
+		cfg.PreShared, _ = c.preshared.load(ctx, cfg.Public, cfg.PreShared)
+	}
+	c.peers = append(c.peers, cfg.Public)
+	c.allowed = append(c.allowed, cfg.AllowedIPs...)
+	c.keepalive = *cfg.PersistentKeepalive != 0
+
+	for _, peer := range c.json.Peers {
+		if len(peer.AllowedIPs) == 0 {
+			return fmt.Errorf("peer %s has no allowed ips", peer.Public.Value())
+		}
+		p := &wgconfig.ClientPeer{
+			Public:              peer.Public.Value(),
+			PreShared:           peer.Preshared.Value(),
+			Endpoint:            *peer.Endpoint.Value(),
+			PersistentKeepalive: keepalive(peer.PersistentKeepalive),
+			AllowedIPs:          subnets(peer.AllowedIPs),
+		}
+		cfg.Peers = append(cfg.Peers, p)
+		c.peers = append(c.peers, p.Public)
+		c.allowed = append(c.allowed, p.AllowedIPs...)
+		c.keepalive = c.keepalive && *p.PersistentKeepalive != 0
+	}
+	if err := cfg.CheckAllowedIPs(); err != nil {
+		return err
+	}
+
+	key := deviceKey(cfg.Private, 0)
+	dev, _, err := loadDevice(key, func(n **wg.Net) (*wg.Wireguard, error) {
+		return wg.New(
+			wg.OptionConfig(&cfg),
+			wg.OptionLogger(wgevents.Events(func(e wgevents.Event) { e.Slog(c.logger) })),
+			wg.OptionNetDevice(n),
+			wg.OptionDown(),
+		)
+	})
+	if err != nil {
+		return err
+	}
+	c.key, c.dev, c.wg, c.net = key, dev, dev.wg, dev.net
+	c.unregister = register(c.wg, c.name, "wireguard-client")
+	// A running device is only changed once the client is brought up, see [deviceState].
+	c.state = &deviceState{cfg: &cfg, rotating: c.json.PresharedRotation != nil, local: c.ip}
+
+	// The endpoint is resolved once when parsed, keep following the hostname in case its address changes.
+	c.resolve(c.json.Public.Value(), &c.json.Endpoint)
+	for _, peer := range c.json.Peers {
+		c.resolve(peer.Public.Value(), &peer.Endpoint)
+	}
+	return c.rotate(ctx)
+}
+
+// rotate rotates the preshared key with the server while the client is up.
+func (c *Client) rotate(ctx caddy.Context) error {
+	r := c.json.PresharedRotation
+	if r == nil {
+		return nil
+	}
+	addr, err := netip.ParseAddrPort(r.Address)
+	if err != nil {
+		return fmt.Errorf("invalid preshared rotation address %q: %w", r.Address, err)
+	} else if r.Interval <= 0 {
+		return errors.New("preshared rotation interval must be positive")
+	}
+
+	control := net.TCPAddrFromAddrPort(addr)
+	peer, configured := c.json.Public.Value(), c.json.Preshared.Value()
+	_, fallback := c.preshared.load(ctx, peer, configured)
+	rotation := wg.PresharedRotation{
+		Peer:     peer,
+		Interval: time.Duration(r.Interval),
+		Dial:     func(ctx context.Context) (net.Conn, error) { return c.net.Dialer(c.ip, 0).DialTCP(ctx, control) },
+		OnError:  func(err error) { c.logger.Warn("failed to rotate preshared key", "error", err) },
+		Fallback: fallback,
+		OnKeys: func(current wgapi.PresharedKey, fallback *wgapi.PresharedKey) {
+			c.preshared.initiated(context.Background(), peer, configured, current, fallback)
+		},
+	}
+	c.run = append(c.run, func(ctx context.Context) { c.wg.RotatePresharedKey(ctx, rotation) })
+	return nil
+}
+
+// resolve keeps the endpoint of the peer up to date while the client is up.
+func (c *Client) resolve(peer wgapi.PublicKey, endpoint *configvalues.UDPAddr) {
+	text, _ := endpoint.MarshalText()
+	r := wg.EndpointResolver{
+		Peer:     peer,
+		Endpoint: caddy.NewReplacer().ReplaceAll(string(text), ""),
+		Interval: time.Duration(c.json.ResolveInterval),
+		Resolver: c.resolver,
+		OnError:  func(err error) { c.logger.Warn("failed to update endpoint", "peer", peer, "error", err) },
+	}
+	c.run = append(c.run, func(ctx context.Context) { c.wg.ResolveEndpoint(ctx, r) })
+}
+
+// resolvers asks each resolver in turn until one of them answers.
+type resolvers []*net.Resolver
+
+func (r resolvers) LookupNetIP(ctx context.Context, network, host string) (addrs []netip.Addr, err error) {
+	for _, rr := range r {
+		if addrs, err = rr.LookupNetIP(ctx, network, host); err == nil {
+			return addrs, nil
+		}
+	}
+	return nil, err
+}
+
+// newResolver creates a resolver asking the DNS servers in turn. It is nil if there are no servers, so the system resolver is used.
+func newResolver(servers []string) (wg.Resolver, error) {
+	if len(servers) == 0 {
+		return nil, nil
+	}
+	r := make(resolvers, len(servers))
+	for i, s := range servers {
+		addr, err := netip.ParseAddrPort(s)
+		if ip, ierr := netip.ParseAddr(s); ierr == nil {
+			addr, err = netip.AddrPortFrom(ip, 53), nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid resolver %q, expected ip or ip:port", s)
+		}
+		r[i] = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr.String())
+			},
+		}
+	}
+	return r, nil
+}
+
+// keepalive gets the keepalive interval, using [wgapi.DefaultPersistentKeepalive] if it is not set.
+func keepalive(k *configvalues.Keepalive) *uint16 {
+	v := uint16(wgapi.DefaultPersistentKeepalive)
+	if k != nil {
+		v = k.Value()
+	}
+	return &v
+}
+
+// subnets converts the configured subnets.
+func subnets(cidrs []configvalues.CIDR) []net.IPNet {
+	nets := make([]net.IPNet, len(cidrs))
+	for i := range cidrs {
+		nets[i] = *cidrs[i].Value()
+	}
+	return nets
 }
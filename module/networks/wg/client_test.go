@@ -0,0 +1,109 @@
+package wg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/require"
+	"github.com/trymoose/point-c/pkg/wg"
+	"github.com/trymoose/point-c/pkg/wg/wgapi"
+	"golang.org/x/net/dns/dnsmessage"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestClientDialer_dialer(t *testing.T) {
+	d := clientDialer{d: new(wg.Dialer), self: new(wg.Dialer), ip: net.IPv4(192, 168, 0, 2), allowed: []net.IPNet{
+		{IP: net.IPv4(10, 0, 0, 0).To4(), Mask: net.CIDRMask(24, 32)},
+		{IP: net.ParseIP("fd00::"), Mask: net.CIDRMask(64, 128)},
+	}}
+	for _, ip := range []net.IP{net.IPv4(10, 0, 0, 5), net.ParseIP("fd00::5")} {
+		got, err := d.dialer(ip)
+		require.NoError(t, err)
+		require.Same(t, d.d, got)
+	}
+
+	// The client's own address is not routed to a server but is always allowed.
+	got, err := d.dialer(net.IPv4(192, 168, 0, 2))
+	require.NoError(t, err)
+	require.Same(t, d.self, got)
+
+	_, err = d.dialer(net.IPv4(10, 0, 1, 5))
+	require.True(t, errors.Is(err, ErrNotAllowed))
+	require.ErrorContains(t, err, "10.0.1.5")
+}
+
+func TestClient_Provision_overlap(t *testing.T) {
+	key := func() string {
+		_, public, err := wgapi.NewPrivatePublic()
+		require.NoError(t, err)
+		text, err := public.MarshalText()
+		require.NoError(t, err)
+		return string(text)
+	}
+	private, err := wgapi.NewPrivate()
+	require.NoError(t, err)
+	privateText, err := private.MarshalText()
+	require.NoError(t, err)
+
+	for _, allowed := range []string{``, `, "allowed_ips": ["10.1.0.0/16"]`} {
+		var c Client
+		require.NoError(t, json.Unmarshal([]byte(fmt.Sprintf(`{"Name": "client", "IP": "10.0.0.2", "Endpoint": "127.0.0.1:51820", "Private": %q, "Public": %q%s,
+			"peers": [{"Endpoint": "127.0.0.1:51821", "Public": %q, "allowed_ips": ["10.1.2.0/24"]}]}`, privateText, key(), allowed, key())), &c))
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+		require.ErrorContains(t, c.Provision(ctx), "overlaps", allowed)
+		cancel()
+	}
+}
+
+func TestNewResolver(t *testing.T) {
+	r, err := newResolver(nil)
+	require.NoError(t, err)
+	require.Nil(t, r, "system resolver not used")
+	_, err = newResolver([]string{"dns.example"})
+	require.Error(t, err)
+
+	// The server answers every A query with 192.0.2.1.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var msg dnsmessage.Message
+			if msg.Unpack(buf[:n]) != nil || len(msg.Questions) != 1 {
+				continue
+			}
+			msg.Response = true
+			if msg.Questions[0].Type == dnsmessage.TypeA {
+				msg.Answers = []dnsmessage.Resource{{
+					Header: dnsmessage.ResourceHeader{Name: msg.Questions[0].Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+					Body:   &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+				}}
+			}
+			if b, err := msg.Pack(); err == nil {
+				_, _ = pc.WriteTo(b, addr)
+			}
+		}
+	}()
+
+	// Nothing answers on the first server, so the second is asked.
+	closed, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, closed.Close())
+	r, err = newResolver([]string{closed.LocalAddr().String(), pc.LocalAddr().String()})
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	addrs, err := r.LookupNetIP(ctx, "ip4", "wg.example")
+	require.NoError(t, err)
+	require.Equal(t, []netip.Addr{netip.MustParseAddr("192.0.2.1")}, addrs)
+}
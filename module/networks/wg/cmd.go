@@ -0,0 +1,378 @@
+package wg
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+	"github.com/trymoose/point-c/pkg/wg/wgapi"
+	"github.com/trymoose/point-c/pkg/wg/wgapi/wgconfig"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "point-c",
+		Usage: "<genkey|pubkey|genpsk|genpeer|status|validate>",
+		Short: "Manages wireguard keys, peers and configs of point-c",
+		Long: `
+Manages wireguard keys, peers and configs of point-c without needing the wg tool.
+
+Keys are printed in base64, the same format as wg and the point-c config.`,
+		CobraFunc: func(cmd *cobra.Command) {
+			cmd.AddCommand(genkeyCommand(), pubkeyCommand(), genpskCommand(), genpeerCommand(), statusCommand(), validateCommand())
+		},
+	})
+}
+
+func genkeyCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "genkey",
+		Short: "Generates a private key",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			private, err := wgapi.NewPrivate()
+			if err != nil {
+				return err
+			}
+			return printKey(cmd.OutOrStdout(), private)
+		},
+	}
+}
+
+func pubkeyCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "pubkey",
+		Short: "Reads a private key from stdin and prints its public key",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			line, err := bufio.NewReader(cmd.InOrStdin()).ReadString('\n')
+			if err != nil && !errors.Is(err, io.EOF) {
+				return err
+			}
+			var private wgapi.PrivateKey
+			if err := private.UnmarshalText([]byte(strings.TrimSpace(line))); err != nil {
+				return fmt.Errorf("invalid private key: %w", err)
+			}
+			public, err := private.Public()
+			if err != nil {
+				return err
+			}
+			return printKey(cmd.OutOrStdout(), wgapi.PublicKey(public))
+		},
+	}
+}
+
+func genpskCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "genpsk",
+		Short: "Generates a preshared key",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			preshared, err := wgapi.NewPreshared()
+			if err != nil {
+				return err
+			}
+			return printKey(cmd.OutOrStdout(), preshared)
+		},
+	}
+}
+
+// printKey prints a key in base64.
+func printKey(w io.Writer, key interface{ MarshalText() ([]byte, error) }) error {
+	b, err := key.MarshalText()
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", b)
+	return err
+}
+
+type (
+	// peerSnippets are the networks of a generated client and server pair.
+	peerSnippets struct {
+		Client clientSnippet `json:"client"`
+		Server serverSnippet `json:"server"`
+	}
+	// clientSnippet is the config of a [Client].
+	clientSnippet struct {
+		Type      string             `json:"type"`
+		Name      string             `json:"Name"`
+		Endpoint  string             `json:"Endpoint"`
+		IP        net.IP             `json:"IP"`
+		Private   wgapi.PrivateKey   `json:"Private"`
+		Public    wgapi.PublicKey    `json:"Public"`
+		Preshared wgapi.PresharedKey `json:"Preshared"`
+	}
+	// serverSnippet is the config of a [Server].
+	serverSnippet struct {
+		Type       string               `json:"type"`
+		Name       string               `json:"Name"`
+		IP         net.IP               `json:"IP"`
+		ListenPort uint16               `json:"ListenPort"`
+		Private    wgapi.PrivateKey     `json:"Private"`
+		Peers      []serverPeerSnippets `json:"Peers"`
+	}
+	// serverPeerSnippets is a peer of a [Server].
+	serverPeerSnippets struct {
+		Name         string             `json:"Name"`
+		Public       wgapi.PublicKey    `json:"Public"`
+		PresharedKey wgapi.PresharedKey `json:"PresharedKey"`
+		IP           net.IP             `json:"IP"`
+	}
+)
+
+func genpeerCommand() *cobra.Command {
+	var endpoint, clientName, clientIP, serverName, serverIP string
+	cmd := &cobra.Command{
+		Use:   "genpeer --endpoint <host:port> --ip <client ip> --server-ip <server ip>",
+		Short: "Generates the networks of a new client and its server",
+		Long: `
+Generates keys for a new client and server, and prints the point-c networks of both as JSON.
+The client connects to the server at the endpoint, the server listens on the port of the endpoint.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			snippets, err := generatePeer(endpoint, clientName, clientIP, serverName, serverIP)
+			if err != nil {
+				return err
+			}
+			enc := json.NewEncoder(cmd.OutOrStdout())
+			enc.SetIndent("", "\t")
+			return enc.Encode(snippets)
+		},
+	}
+	cmd.Flags().StringVar(&endpoint, "endpoint", "", "Public host:port of the server")
+	cmd.Flags().StringVar(&clientName, "name", "client", "Name of the client network")
+	cmd.Flags().StringVar(&clientIP, "ip", "", "Address of the client in the tunnel")
+	cmd.Flags().StringVar(&serverName, "server-name", "server", "Name of the server network")
+	cmd.Flags().StringVar(&serverIP, "server-ip", "", "Address of the server in the tunnel")
+	for _, flag := range []string{"endpoint", "ip", "server-ip"} {
+		_ = cmd.MarkFlagRequired(flag)
+	}
+	return cmd
+}
+
+// generatePeer generates a client and server with [wgconfig.GenerateConfigPair].
+func generatePeer(endpoint, clientName, clientIP, serverName, serverIP string) (*peerSnippets, error) {
+	_, p, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint %q: %w", endpoint, err)
+	}
+	port, err := strconv.ParseUint(p, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint port %q: %w", p, err)
+	}
+	cip, sip := net.ParseIP(clientIP), net.ParseIP(serverIP)
+	if cip == nil {
+		return nil, fmt.Errorf("invalid client ip %q", clientIP)
+	} else if sip == nil {
+		return nil, fmt.Errorf("invalid server ip %q", serverIP)
+	}
+
+	// The endpoint may be a hostname, only the port is used by the server.
+	client, server, err := wgconfig.GenerateConfigPair(&net.UDPAddr{Port: int(port)}, cip)
+	if err != nil {
+		return nil, err
+	}
+	return &peerSnippets{
+		Client: clientSnippet{
+			Type:      "wireguard-client",
+			Name:      clientName,
+			Endpoint:  endpoint,
+			IP:        cip,
+			Private:   client.Private,
+			Public:    client.Public,
+			Preshared: client.PreShared,
+		},
+		Server: serverSnippet{
+			Type:       "wireguard-server",
+			Name:       serverName,
+			IP:         sip,
+			ListenPort: server.ListenPort,
+			Private:    server.Private,
+			Peers: []serverPeerSnippets{{
+				Name:         clientName,
+				Public:       server.Peers[0].Public,
+				PresharedKey: server.Peers[0].PreShared,
+				IP:           cip,
+			}},
+		},
+	}, nil
+}
+
+func statusCommand() *cobra.Command {
+	var address, config, adapter string
+	var raw bool
+	cmd := &cobra.Command{
+		Use:   "status [--address <admin address>] [--config <path> [--adapter <name>]] [--json]",
+		Short: "Prints the peers of the wireguard devices of a running instance",
+		Long: `
+Prints the peers of the wireguard devices of a running instance, using its admin API.
+The admin address is found the same way as caddy stop and caddy reload.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			addr, err := caddycmd.DetermineAdminAPIAddress(address, nil, config, adapter)
+			if err != nil {
+				return err
+			}
+			resp, err := caddycmd.AdminAPIRequest(addr, http.MethodGet, statusPath, nil, nil)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			if raw {
+				_, err := io.Copy(cmd.OutOrStdout(), resp.Body)
+				return err
+			}
+
+			var status []deviceStatus
+			if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+				return fmt.Errorf("invalid status response: %w", err)
+			}
+			return printStatus(cmd.OutOrStdout(), status, time.Now())
+		},
+	}
+	cmd.Flags().StringVarP(&address, "address", "", "", "The address of the admin API")
+	cmd.Flags().StringVarP(&config, "config", "c", "", "Configuration file to find the admin API address in")
+	cmd.Flags().StringVarP(&adapter, "adapter", "a", "", "Name of config adapter to apply")
+	cmd.Flags().BoolVar(&raw, "json", false, "Print the status as JSON")
+	return cmd
+}
+
+// printStatus prints the status of every device as a table of its peers.
+func printStatus(w io.Writer, status []deviceStatus, now time.Time) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for i, dev := range status {
+		if i > 0 {
+			fmt.Fprintln(tw)
+		}
+		fmt.Fprintf(tw, "%s (%s)", dev.Name, dev.Type)
+		if dev.ListenPort != 0 {
+			fmt.Fprintf(tw, " listening on %d", dev.ListenPort)
+		}
+		fmt.Fprintln(tw)
+		fmt.Fprintln(tw, "  PEER\tENDPOINT\tALLOWED IPS\tLAST HANDSHAKE\tRX\tTX")
+		for _, peer := range dev.Peers {
+			public, _ := peer.Public.MarshalText()
+			handshake := "never"
+			if peer.LastHandshake != nil {
+				handshake = now.Sub(*peer.LastHandshake).Truncate(time.Second).String() + " ago"
+			}
+			endpoint := peer.Endpoint
+			if endpoint == "" {
+				endpoint = "-"
+			}
+			fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\t%d\t%d\n", public, endpoint, strings.Join(peer.AllowedIPs, ","), handshake, peer.RX, peer.TX)
+		}
+	}
+	return tw.Flush()
+}
+
+func validateCommand() *cobra.Command {
+	var config, adapter string
+	cmd := &cobra.Command{
+		Use:   "validate --config <path> [--adapter <name>]",
+		Short: "Checks the point-c networks of a config for duplicate names, addresses and keys",
+		Long: `
+Checks the point-c networks of a config for duplicate names, addresses and keys.
+No devices are started, use caddy validate to provision the whole config.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			b, _, err := caddycmd.LoadConfig(config, adapter)
+			if err != nil {
+				return err
+			}
+			if err := validateConfig(b); err != nil {
+				return err
+			}
+			_, err = fmt.Fprintln(cmd.OutOrStdout(), "Valid point-c networks")
+			return err
+		},
+	}
+	cmd.Flags().StringVarP(&config, "config", "c", "", "Input configuration file")
+	cmd.Flags().StringVarP(&adapter, "adapter", "a", "", "Name of config adapter to apply")
+	return cmd
+}
+
+type (
+	// validateNetwork is the part of a network checked by validate.
+	validateNetwork struct {
+		Type    string `json:"type"`
+		Name    string
+		IP      string
+		Private string
+		Public  string
+		Peers   []validatePeer
+	}
+	// validatePeer is the part of a server's peer or a client's additional server checked by validate.
+	validatePeer struct {
+		Name   string
+		IP     string
+		Public string
+	}
+)
+
+// validateConfig checks the networks of the point-c app for duplicates. All problems are returned.
+func validateConfig(config []byte) error {
+	var cfg struct {
+		Apps struct {
+			Pointc struct {
+				Networks []json.RawMessage `json:"networks"`
+			} `json:"point-c"`
+		} `json:"apps"`
+	}
+	if err := json.Unmarshal(config, &cfg); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+
+	var errs []error
+	names, privates := map[string]string{}, map[string]string{}
+	seen := func(m map[string]string, kind, value, owner string) {
+		if value == "" {
+			return
+		} else if other, ok := m[value]; ok {
+			errs = append(errs, fmt.Errorf("%s %s of %q is already used by %q", kind, value, owner, other))
+			return
+		}
+		m[value] = owner
+	}
+
+	for i, raw := range cfg.Apps.Pointc.Networks {
+		var n validateNetwork
+		if err := json.Unmarshal(raw, &n); err != nil {
+			errs = append(errs, fmt.Errorf("invalid network %d: %w", i, err))
+			continue
+		}
+		seen(privates, "private key", n.Private, n.Name)
+
+		// Addresses and keys only need to be unique within a device.
+		ips, publics := map[string]string{}, map[string]string{}
+		switch n.Type {
+		case "wireguard-server":
+			seen(names, "name", n.Name, n.Name)
+			seen(ips, "ip", n.IP, n.Name)
+			for _, peer := range n.Peers {
+				seen(names, "name", peer.Name, peer.Name)
+				seen(ips, "ip", peer.IP, peer.Name)
+				seen(publics, "public key", peer.Public, peer.Name)
+			}
+		case "wireguard-client":
+			seen(names, "name", n.Name, n.Name)
+			seen(publics, "public key", n.Public, n.Name)
+			for _, peer := range n.Peers {
+				seen(publics, "public key", peer.Public, n.Name)
+			}
+		default:
+			seen(names, "name", n.Name, n.Name)
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,118 @@
+package wg
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"github.com/trymoose/point-c/pkg/wg/wgapi"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPubkeyCommand(t *testing.T) {
+	private, err := wgapi.NewPrivate()
+	require.NoError(t, err)
+	text, err := private.MarshalText()
+	require.NoError(t, err)
+	public, err := private.Public()
+	require.NoError(t, err)
+	expected, err := public.MarshalText()
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	cmd := pubkeyCommand()
+	cmd.SetIn(strings.NewReader(string(text) + "\n"))
+	cmd.SetOut(&out)
+	cmd.SetArgs([]string{})
+	require.NoError(t, cmd.Execute())
+	require.Equal(t, string(expected)+"\n", out.String())
+
+	cmd = pubkeyCommand()
+	cmd.SetIn(strings.NewReader("invalid"))
+	cmd.SetOut(&out)
+	cmd.SetErr(&out)
+	cmd.SetArgs([]string{})
+	require.Error(t, cmd.Execute())
+}
+
+func TestGeneratePeer(t *testing.T) {
+	snippets, err := generatePeer("vpn.example:51820", "laptop", "10.0.0.2", "server", "10.0.0.1")
+	require.NoError(t, err)
+	require.Equal(t, uint16(51820), snippets.Server.ListenPort)
+	require.Equal(t, "vpn.example:51820", snippets.Client.Endpoint)
+
+	serverPublic, err := snippets.Server.Private.Public()
+	require.NoError(t, err)
+	require.Equal(t, wgapi.PublicKey(serverPublic), snippets.Client.Public)
+	clientPublic, err := snippets.Client.Private.Public()
+	require.NoError(t, err)
+	require.Equal(t, wgapi.PublicKey(clientPublic), snippets.Server.Peers[0].Public)
+	require.Equal(t, snippets.Client.Preshared, snippets.Server.Peers[0].PresharedKey)
+
+	// The server snippet can be loaded by the server module.
+	b, err := json.Marshal(snippets.Server)
+	require.NoError(t, err)
+	var srv Server
+	require.NoError(t, json.Unmarshal(b, &srv))
+	require.Equal(t, "server", srv.json.Name.Value())
+	require.Equal(t, "laptop", srv.json.Peers[0].Name.Value())
+	require.Equal(t, snippets.Client.Preshared, srv.json.Peers[0].PresharedKey.Value())
+
+	for _, args := range [][5]string{
+		{"vpn.example", "laptop", "10.0.0.2", "server", "10.0.0.1"},
+		{"vpn.example:port", "laptop", "10.0.0.2", "server", "10.0.0.1"},
+		{"vpn.example:51820", "laptop", "", "server", "10.0.0.1"},
+		{"vpn.example:51820", "laptop", "10.0.0.2", "server", "invalid"},
+	} {
+		_, err := generatePeer(args[0], args[1], args[2], args[3], args[4])
+		require.Error(t, err, args)
+	}
+}
+
+func TestPrintStatus(t *testing.T) {
+	now := time.Unix(1000, 0)
+	handshake := now.Add(-time.Second * 5)
+	var public wgapi.PublicKey
+	var out bytes.Buffer
+	require.NoError(t, printStatus(&out, []deviceStatus{{
+		Name:       "server",
+		Type:       "wireguard-server",
+		ListenPort: 51820,
+		Peers: []peerStatus{
+			{Public: public, Endpoint: "127.0.0.1:1234", AllowedIPs: []string{"10.0.0.2/32"}, LastHandshake: &handshake, RX: 1, TX: 2},
+			{Public: public, AllowedIPs: []string{"10.0.0.3/32"}},
+		},
+	}}, now))
+	lines := strings.Split(out.String(), "\n")
+	require.Equal(t, "server (wireguard-server) listening on 51820", lines[0])
+	require.Regexp(t, `^  PEER\s+ENDPOINT\s+ALLOWED IPS\s+LAST HANDSHAKE\s+RX\s+TX$`, lines[1])
+	require.Regexp(t, `127\.0\.0\.1:1234\s+10\.0\.0\.2/32\s+5s ago\s+1\s+2$`, lines[2])
+	require.Regexp(t, `-\s+10\.0\.0\.3/32\s+never\s+0\s+0$`, lines[3])
+}
+
+func TestValidateConfig(t *testing.T) {
+	config := func(networks ...string) []byte {
+		return []byte(`{"apps":{"point-c":{"networks":[` + strings.Join(networks, ",") + `]}}}`)
+	}
+	const server = `{"type":"wireguard-server","Name":"server","IP":"10.0.0.1","Private":"a","Peers":[{"Name":"laptop","IP":"10.0.0.2","Public":"b"}]}`
+
+	require.NoError(t, validateConfig(config(server, `{"type":"wireguard-client","Name":"client","IP":"10.0.0.2","Private":"c","Public":"d"}`)))
+	require.NoError(t, validateConfig([]byte(`{}`)))
+	require.Error(t, validateConfig([]byte(`{`)))
+
+	for name, tt := range map[string]struct {
+		networks []string
+		err      string
+	}{
+		"name":           {networks: []string{server, `{"type":"wireguard-client","Name":"laptop","Private":"c"}`}, err: `name laptop of "laptop" is already used by "laptop"`},
+		"peer ip":        {networks: []string{`{"type":"wireguard-server","Name":"server","IP":"10.0.0.1","Peers":[{"Name":"laptop","IP":"10.0.0.1"}]}`}, err: `ip 10.0.0.1 of "laptop" is already used by "server"`},
+		"private key":    {networks: []string{server, `{"type":"wireguard-client","Name":"client","Private":"a"}`}, err: `private key a of "client" is already used by "server"`},
+		"peer key":       {networks: []string{`{"type":"wireguard-server","Name":"server","Peers":[{"Name":"a","Public":"b"},{"Name":"c","Public":"b"}]}`}, err: `public key b of "c" is already used by "a"`},
+		"client servers": {networks: []string{`{"type":"wireguard-client","Name":"client","Public":"b","Peers":[{"Public":"b"}]}`}, err: `public key b of "client"`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			require.ErrorContains(t, validateConfig(config(tt.networks...)), tt.err)
+		})
+	}
+}
@@ -0,0 +1,292 @@
+package wg
+
+import (
+	"encoding/binary"
+	"errors"
+	pointc "github.com/trymoose/point-c"
+	"github.com/trymoose/point-c/pkg/configvalues"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// dnsPort is the port DNS queries are answered on.
+	dnsPort = 53
+	// dnsTTL is how long answers may be cached. It is short since peers come and go.
+	dnsTTL = 30
+	// dnsTimeout is how long a TCP connection may wait for a query.
+	dnsTimeout = 10 * time.Second
+)
+
+// serverDNS configures the DNS service of a [Server].
+type serverDNS struct {
+	// Zone is the domain the names are answered under, build-box is answered as build-box.<zone>. Defaults to pointc.
+	// Names are answered in lowercase, nets whose names are not valid hostnames are not answered.
+	Zone string `json:"zone,omitempty"`
+}
+
+// dnsZone answers for the names of a server's nets.
+type dnsZone struct {
+	zone   string // zone is the fully qualified lowercase zone, ending in a dot.
+	nets   func() map[string]pointc.Net
+	logger *slog.Logger
+}
+
+// newDNSZone answers queries under zone with the nets.
+func newDNSZone(zone string, nets func() map[string]pointc.Net, logger *slog.Logger) *dnsZone {
+	if zone = strings.Trim(zone, "."); zone == "" {
+		zone = pointc.Domain
+	}
+	return &dnsZone{zone: strings.ToLower(zone) + ".", nets: nets, logger: logger}
+}
+
+// answer builds the response to a query.
+func (z *dnsZone) answer(query []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := dnsmessage.Header{ID: h.ID, Response: true, OpCode: h.OpCode, RecursionDesired: h.RecursionDesired}
+	var answers []dnsmessage.Resource
+	if h.OpCode != 0 {
+		resp.RCode = dnsmessage.RCodeNotImplemented
+	} else {
+		answers, resp.RCode = z.lookup(q)
+		resp.Authoritative = resp.RCode != dnsmessage.RCodeRefused
+	}
+
+	b := dnsmessage.NewBuilder(make([]byte, 0, 512), resp)
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	} else if err := b.Question(q); err != nil {
+		return nil, err
+	} else if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+	for _, a := range answers {
+		switch body := a.Body.(type) {
+		case *dnsmessage.AResource:
+			err = b.AResource(a.Header, *body)
+		case *dnsmessage.AAAAResource:
+			err = b.AAAAResource(a.Header, *body)
+		case *dnsmessage.PTRResource:
+			err = b.PTRResource(a.Header, *body)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+// lookup gets the answers to a question. Names outside the zone and the reverse zones are refused.
+func (z *dnsZone) lookup(q dnsmessage.Question) ([]dnsmessage.Resource, dnsmessage.RCode) {
+	name := strings.ToLower(q.Name.String())
+	if ip, ok := reverseAddr(name); ok {
+		return z.lookupPTR(q, ip)
+	} else if strings.HasSuffix(name, ".in-addr.arpa.") || strings.HasSuffix(name, ".ip6.arpa.") {
+		return nil, dnsmessage.RCodeNameError
+	} else if name == z.zone {
+		return nil, dnsmessage.RCodeSuccess
+	}
+
+	host, ok := strings.CutSuffix(name, "."+z.zone)
+	if !ok {
+		return nil, dnsmessage.RCodeRefused
+	}
+	for n, nn := range z.nets() {
+		if h, ok := dnsHost(n); !ok || h != host || nn.LocalAddr() == nil {
+			continue
+		}
+		ip, _ := netip.AddrFromSlice(nn.LocalAddr())
+		ip = ip.Unmap()
+		hdr := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: dnsTTL}
+		switch {
+		case ip.Is4() && (q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeALL):
+			hdr.Type = dnsmessage.TypeA
+			return []dnsmessage.Resource{{Header: hdr, Body: &dnsmessage.AResource{A: ip.As4()}}}, dnsmessage.RCodeSuccess
+		case ip.Is6() && (q.Type == dnsmessage.TypeAAAA || q.Type == dnsmessage.TypeALL):
+			hdr.Type = dnsmessage.TypeAAAA
+			return []dnsmessage.Resource{{Header: hdr, Body: &dnsmessage.AAAAResource{AAAA: ip.As16()}}}, dnsmessage.RCodeSuccess
+		}
+		// The name exists but has no record of the type.
+		return nil, dnsmessage.RCodeSuccess
+	}
+	return nil, dnsmessage.RCodeNameError
+}
+
+// lookupPTR answers a reverse query for the address.
+func (z *dnsZone) lookupPTR(q dnsmessage.Question, ip netip.Addr) ([]dnsmessage.Resource, dnsmessage.RCode) {
+	for n, nn := range z.nets() {
+		h, ok := dnsHost(n)
+		if addr, aok := netip.AddrFromSlice(nn.LocalAddr()); !ok || !aok || addr.Unmap() != ip {
+			continue
+		}
+		if q.Type != dnsmessage.TypePTR && q.Type != dnsmessage.TypeALL {
+			return nil, dnsmessage.RCodeSuccess
+		}
+		target, err := dnsmessage.NewName(h + "." + z.zone)
+		if err != nil {
+			return nil, dnsmessage.RCodeServerFailure
+		}
+		hdr := dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: dnsTTL}
+		return []dnsmessage.Resource{{Header: hdr, Body: &dnsmessage.PTRResource{PTR: target}}}, dnsmessage.RCodeSuccess
+	}
+	return nil, dnsmessage.RCodeNameError
+}
+
+// dnsHost gets the lowercase name a net is answered as. Nets whose names are not valid hostnames, like my_laptop, are not answered.
+func dnsHost(name string) (string, bool) {
+	var h configvalues.ValueHostname
+	if err := h.UnmarshalText([]byte(strings.ToLower(name))); err != nil {
+		return "", false
+	}
+	return h.Value(), true
+}
+
+// reverseAddr gets the address of a fully qualified in-addr.arpa or ip6.arpa name.
+func reverseAddr(name string) (netip.Addr, bool) {
+	if v4, ok := strings.CutSuffix(name, ".in-addr.arpa."); ok {
+		labels := strings.Split(v4, ".")
+		if len(labels) != 4 {
+			return netip.Addr{}, false
+		}
+		var ip [4]byte
+		for i, l := range labels {
+			b, err := strconv.ParseUint(l, 10, 8)
+			if err != nil {
+				return netip.Addr{}, false
+			}
+			ip[3-i] = byte(b)
+		}
+		return netip.AddrFrom4(ip), true
+	} else if v6, ok := strings.CutSuffix(name, ".ip6.arpa."); ok {
+		labels := strings.Split(v6, ".")
+		if len(labels) != 32 {
+			return netip.Addr{}, false
+		}
+		var ip [16]byte
+		for i, l := range labels {
+			b, err := strconv.ParseUint(l, 16, 4)
+			if err != nil || len(l) != 1 {
+				return netip.Addr{}, false
+			}
+			// Labels are nibbles starting with the lowest.
+			ip[15-i/2] |= byte(b) << (4 * (i % 2))
+		}
+		return netip.AddrFrom16(ip), true
+	}
+	return netip.Addr{}, false
+}
+
+// dnsServer answers DNS queries for a zone on a device. The zone is replaced when a config reload changes it.
+type dnsServer struct {
+	ip    string
+	zone  atomic.Pointer[dnsZone]
+	close func() error
+}
+
+// serveUDP answers queries on a packet conn until it is closed.
+func (s *dnsServer) serveUDP(pc net.PacketConn) {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		resp, err := s.zone.Load().answer(buf[:n])
+		if err != nil {
+			s.zone.Load().logger.Debug("invalid dns query", "remote", addr, "error", err)
+			continue
+		}
+		_, _ = pc.WriteTo(resp, addr)
+	}
+}
+
+// serveTCP answers queries on connections from a listener until it is closed.
+func (s *dnsServer) serveTCP(ln net.Listener) {
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveConn(c)
+	}
+}
+
+// serveConn answers length prefixed queries on a connection until it is idle for [dnsTimeout].
+func (s *dnsServer) serveConn(c net.Conn) {
+	defer c.Close()
+	for {
+		if err := c.SetDeadline(time.Now().Add(dnsTimeout)); err != nil {
+			return
+		}
+		var size uint16
+		if err := binary.Read(c, binary.BigEndian, &size); err != nil {
+			return
+		}
+		query := make([]byte, size)
+		if _, err := io.ReadFull(c, query); err != nil {
+			return
+		}
+		resp, err := s.zone.Load().answer(query)
+		if err != nil {
+			s.zone.Load().logger.Debug("invalid dns query", "remote", c.RemoteAddr(), "error", err)
+			return
+		}
+		if _, err := c.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...)); err != nil {
+			return
+		}
+	}
+}
+
+// serveDNS answers DNS queries for the zone on port 53 of the ip, replacing the zone answered for before.
+// DNS is stopped if zone is nil. The listeners live as long as the device, not the config that started them.
+// It is called with d.mu held.
+func (d *sharedDevice) serveDNS(ip net.IP, zone *dnsZone) error {
+	if d.dns != nil && zone != nil && d.dns.ip == ip.String() {
+		d.dns.zone.Store(zone)
+		return nil
+	}
+
+	if d.dns != nil {
+		err := d.dns.close()
+		d.dns = nil
+		if err != nil {
+			return err
+		}
+	}
+	if zone == nil {
+		return nil
+	}
+
+	pc, err := d.net.ListenPacket(&net.UDPAddr{IP: ip, Port: dnsPort})
+	if err != nil {
+		return err
+	}
+	ln, err := d.net.Listen(&net.TCPAddr{IP: ip, Port: dnsPort})
+	if err != nil {
+		return errors.Join(err, pc.Close())
+	}
+
+	srv := &dnsServer{ip: ip.String(), close: func() error { return errors.Join(pc.Close(), ln.Close()) }}
+	srv.zone.Store(zone)
+	go srv.serveUDP(pc)
+	go srv.serveTCP(ln)
+	d.dns = srv
+	return nil
+}
@@ -0,0 +1,116 @@
+package wg
+
+import (
+	"github.com/stretchr/testify/require"
+	pointc "github.com/trymoose/point-c"
+	"github.com/trymoose/point-c/pkg/wg/wgapi"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+func newTestDNSZone(zone string) *dnsZone {
+	nets := map[string]pointc.Net{
+		"server":    &serverNet{ip: net.IPv4(10, 0, 0, 1)},
+		"Build-Box": &serverNet{ip: net.IPv4(10, 0, 0, 2)},
+		"v6":        &serverNet{ip: net.ParseIP("fd00::2")},
+		"my_box":    &serverNet{ip: net.IPv4(10, 0, 0, 3)},
+	}
+	return newDNSZone(zone, func() map[string]pointc.Net { return nets }, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+// dnsQuery packs a query for the name.
+func dnsQuery(t *testing.T, name string, typ dnsmessage.Type) []byte {
+	t.Helper()
+	b, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 7, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: dnsmessage.MustNewName(name), Type: typ, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	require.NoError(t, err)
+	return b
+}
+
+func TestDNSZone_answer(t *testing.T) {
+	z := newTestDNSZone(".VPN.")
+	for _, tt := range []struct {
+		name   string
+		typ    dnsmessage.Type
+		rcode  dnsmessage.RCode
+		answer string
+	}{
+		{name: "build-box.vpn.", typ: dnsmessage.TypeA, answer: "10.0.0.2"},
+		{name: "BUILD-BOX.vpn.", typ: dnsmessage.TypeA, answer: "10.0.0.2"},
+		{name: "server.vpn.", typ: dnsmessage.TypeA, answer: "10.0.0.1"},
+		{name: "server.vpn.", typ: dnsmessage.TypeAAAA},
+		{name: "v6.vpn.", typ: dnsmessage.TypeAAAA, answer: "fd00::2"},
+		{name: "missing.vpn.", typ: dnsmessage.TypeA, rcode: dnsmessage.RCodeNameError},
+		{name: "vpn.", typ: dnsmessage.TypeA},
+		{name: "example.com.", typ: dnsmessage.TypeA, rcode: dnsmessage.RCodeRefused},
+		{name: "2.0.0.10.in-addr.arpa.", typ: dnsmessage.TypePTR, answer: "build-box.vpn."},
+		{name: "2.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa.", typ: dnsmessage.TypePTR, answer: "v6.vpn."},
+		{name: "9.0.0.10.in-addr.arpa.", typ: dnsmessage.TypePTR, rcode: dnsmessage.RCodeNameError},
+		// Names that are not valid hostnames are not answered.
+		{name: "my_box.vpn.", typ: dnsmessage.TypeA, rcode: dnsmessage.RCodeNameError},
+		{name: "3.0.0.10.in-addr.arpa.", typ: dnsmessage.TypePTR, rcode: dnsmessage.RCodeNameError},
+	} {
+		t.Run(tt.name+" "+tt.typ.String(), func(t *testing.T) {
+			b, err := z.answer(dnsQuery(t, tt.name, tt.typ))
+			require.NoError(t, err)
+			var resp dnsmessage.Message
+			require.NoError(t, resp.Unpack(b))
+			require.Equal(t, uint16(7), resp.ID)
+			require.True(t, resp.Response)
+			require.Equal(t, tt.rcode, resp.RCode)
+			require.Len(t, resp.Questions, 1)
+			if tt.answer == "" {
+				require.Empty(t, resp.Answers)
+				return
+			}
+			require.Len(t, resp.Answers, 1)
+			switch body := resp.Answers[0].Body.(type) {
+			case *dnsmessage.AResource:
+				require.Equal(t, tt.answer, netip.AddrFrom4(body.A).String())
+			case *dnsmessage.AAAAResource:
+				require.Equal(t, tt.answer, netip.AddrFrom16(body.AAAA).String())
+			case *dnsmessage.PTRResource:
+				require.Equal(t, tt.answer, body.PTR.String())
+			default:
+				t.Fatalf("unexpected answer %T", body)
+			}
+		})
+	}
+
+	_, err := z.answer([]byte{1, 2, 3})
+	require.Error(t, err)
+}
+
+func TestNewDNSZone(t *testing.T) {
+	require.Equal(t, pointc.Domain+".", newTestDNSZone("").zone)
+	require.Equal(t, "vpn.example.", newTestDNSZone("VPN.example").zone)
+}
+
+func TestSharedDevice_serveDNS(t *testing.T) {
+	dev, _ := newTestDevice(t, wgapi.IPC{})
+	ip := net.IPv4(10, 0, 0, 1)
+	require.NoError(t, dev.serveDNS(ip, newTestDNSZone("vpn")))
+	srv := dev.dns
+	require.NotNil(t, srv)
+
+	// The zone is replaced without listening again.
+	next := newTestDNSZone("other")
+	require.NoError(t, dev.serveDNS(ip, next))
+	require.Same(t, srv, dev.dns)
+	require.Same(t, next, srv.zone.Load())
+
+	require.NoError(t, dev.serveDNS(nil, nil))
+	require.Nil(t, dev.dns)
+	pc, err := dev.net.ListenPacket(&net.UDPAddr{IP: ip, Port: dnsPort})
+	require.NoError(t, err, "dns port still in use")
+	require.NoError(t, pc.Close())
+	ln, err := dev.net.Listen(&net.TCPAddr{IP: ip, Port: dnsPort})
+	require.NoError(t, err, "dns port still in use")
+	require.NoError(t, ln.Close())
+}
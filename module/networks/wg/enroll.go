@@ -0,0 +1,336 @@
+package wg
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	pointc "github.com/trymoose/point-c"
+	"github.com/trymoose/point-c/pkg/configvalues"
+	"github.com/trymoose/point-c/pkg/wg/wgapi"
+	"go.mrchanchal.com/zaphandler"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+)
+
+var (
+	_ caddy.Module                = (*Enroll)(nil)
+	_ caddy.Provisioner           = (*Enroll)(nil)
+	_ caddyhttp.MiddlewareHandler = (*Enroll)(nil)
+)
+
+func init() {
+	caddy.RegisterModule(new(Enroll))
+}
+
+func (*Enroll) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.wireguard_enroll",
+		New: func() caddy.Module { return new(Enroll) },
+	}
+}
+
+// maxEnrollBody limits the size of enrollment requests.
+const maxEnrollBody = 1 << 16
+
+// Enroll adds peers to a running wireguard server in exchange for one-time invite tokens.
+// The keys and address of the peer are generated and the client configuration is returned.
+// Enroll does no authentication of its own, place it after an authentication handler.
+//
+// Requests are a POST with a JSON body:
+//
+//	{"token": "<invite token>", "name": "<hostname of the peer>"}
+type Enroll struct {
+	// Network is the name of the wireguard server. The server must have a subnet to assign addresses from.
+	Network string `json:"network"`
+	// Endpoint is the public host:port clients connect to.
+	Endpoint string `json:"endpoint"`
+	// Tokens are the invite tokens. Each token can only be used once, used tokens are remembered in storage.
+	// A token is either the token itself, which is shown by the admin API like the rest of the config, or its hex encoded SHA-256 as "sha256:<hash>".
+	Tokens []string `json:"tokens,omitempty"`
+
+	srv     *Server
+	public  wgapi.PublicKey
+	tokens  map[string]struct{} // tokens are the hashes of the invite tokens.
+	storage enrollStorage
+	logger  *slog.Logger
+	mu      sync.Mutex
+}
+
+// enrollStorage remembers used tokens and enrolled peers. [certmagic.Storage] is an enrollStorage.
+type enrollStorage interface {
+	Exists(ctx context.Context, key string) bool
+	Store(ctx context.Context, key string, value []byte) error
+}
+
+// enrolledStorage loads enrolled peers. [certmagic.Storage] is an enrolledStorage.
+type enrolledStorage interface {
+	List(ctx context.Context, path string, recursive bool) ([]string, error)
+	Load(ctx context.Context, key string) ([]byte, error)
+}
+
+// tokenHashPrefix marks a token given as its hash.
+const tokenHashPrefix = "sha256:"
+
+type (
+	// enrollRequest is the body of an enrollment request.
+	enrollRequest struct {
+		Token string `json:"token"`
+		Name  string `json:"name"`
+	}
+	// enrolledPeer is a peer added by [Enroll]. It is kept in storage and loaded by the [Server], so it outlives the config that enrolled it.
+	// The record holds the preshared key of the peer, so it is sealed with the private key of the server, see [storageSealer].
+	enrolledPeer struct {
+		Name      string             `json:"name"`
+		Public    wgapi.PublicKey    `json:"public"`
+		Preshared wgapi.PresharedKey `json:"preshared"`
+		IP        net.IP             `json:"ip"`
+	}
+	// enrollment is the response to an enrollment request.
+	enrollment struct {
+		Name    string           `json:"name"`
+		IP      net.IP           `json:"ip"`
+		WGQuick string           `json:"wg_quick"`
+		Pointc  enrollmentClient `json:"point_c"`
+	}
+	// enrollmentClient is the config of a [Client] for the peer.
+	enrollmentClient struct {
+		Type       string             `json:"type"`
+		Name       string             `json:"name"`
+		Endpoint   string             `json:"endpoint"`
+		IP         net.IP             `json:"ip"`
+		Private    wgapi.PrivateKey   `json:"private"`
+		Public     wgapi.PublicKey    `json:"public"`
+		Preshared  wgapi.PresharedKey `json:"preshared"`
+		AllowedIPs []string           `json:"allowed_ips"`
+	}
+)
+
+func (e *Enroll) Provision(ctx caddy.Context) error {
+	e.logger = slog.New(zaphandler.New(ctx.Logger()))
+	if _, _, err := net.SplitHostPort(e.Endpoint); err != nil {
+		return fmt.Errorf("invalid endpoint %q: %w", e.Endpoint, err)
+	}
+
+	m, err := ctx.App("point-c")
+	if err != nil {
+		return err
+	}
+	n, ok := m.(pointc.NetLookup).Lookup(e.Network)
+	if !ok {
+		return fmt.Errorf("network %q does not exist", e.Network)
+	}
+	sn, ok := n.(*serverNet)
+	if !ok || sn.peer != nil {
+		return fmt.Errorf("network %q is not a wireguard server", e.Network)
+	} else if !sn.srv.ipam.subnet.IsValid() {
+		return fmt.Errorf("wireguard server %q has no subnet", e.Network)
+	}
+	e.srv = sn.srv
+
+	public, err := e.srv.json.Private.Value().Public()
+	if err != nil {
+		return err
+	}
+	e.public = wgapi.PublicKey(public)
+
+	if e.tokens, err = hashTokens(e.Tokens); err != nil {
+		return err
+	}
+	e.storage = ctx.Storage()
+	return nil
+}
+
+func (e *Enroll) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		return caddyhttp.Error(http.StatusMethodNotAllowed, nil)
+	}
+
+	var req enrollRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxEnrollBody)).Decode(&req); err != nil {
+		return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("invalid enrollment request: %w", err))
+	} else if err := new(configvalues.ValueHostname).UnmarshalText([]byte(req.Name)); err != nil {
+		// Names are checked like configured ones, without replacing placeholders since the name comes from the client.
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+
+	resp, err := e.enroll(r.Context(), req)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(resp)
+}
+
+// enroll uses the token to add a new peer to the server.
+func (e *Enroll) enroll(ctx context.Context, req enrollRequest) (*enrollment, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	hash := hashToken(req.Token)
+	key := path.Join("point-c", "enroll", e.Network, hash)
+	if _, ok := e.tokens[hash]; !ok {
+		return nil, caddyhttp.Error(http.StatusForbidden, errors.New("invalid invite token"))
+	} else if e.storage.Exists(ctx, key) {
+		return nil, caddyhttp.Error(http.StatusForbidden, errors.New("invite token already used"))
+	} else if nameTaken(e.srv.Networks(), req.Name) {
+		return nil, caddyhttp.Error(http.StatusConflict, fmt.Errorf("hostname %q already in use", req.Name))
+	}
+
+	private, public, err := wgapi.NewPrivatePublic()
+	if err != nil {
+		return nil, caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	preshared, err := wgapi.NewPreshared()
+	if err != nil {
+		return nil, caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+
+	// The token is spent once the peer exists, even if the client never receives its config.
+	delete(e.tokens, hash)
+	ip, err := e.srv.addPeer(ctx, req.Name, public, preshared)
+	if err != nil {
+		e.tokens[hash] = struct{}{}
+		return nil, caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("failed to add peer: %w", err))
+	}
+	// A peer that is not stored would be removed by the next reload, so it is not kept.
+	if err := e.store(ctx, &enrolledPeer{Name: req.Name, Public: public, Preshared: preshared, IP: ip}); err != nil {
+		e.tokens[hash] = struct{}{}
+		if rerr := e.srv.removePeer(req.Name, public); rerr != nil {
+			err = errors.Join(err, rerr)
+		}
+		return nil, caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("failed to store peer: %w", err))
+	}
+	if err := e.storage.Store(ctx, key, []byte(req.Name)); err != nil {
+		e.logger.Error("failed to store used invite token", "peer", req.Name, "error", err)
+	}
+	e.logger.Info("enrolled peer", "peer", req.Name, "ip", ip)
+
+	client := enrollmentClient{
+		Type:       "wireguard-client",
+		Name:       req.Name,
+		Endpoint:   e.Endpoint,
+		IP:         ip,
+		Private:    private,
+		Public:     e.public,
+		Preshared:  preshared,
+		AllowedIPs: e.allowedIPs(),
+	}
+	return &enrollment{Name: req.Name, IP: ip, WGQuick: client.wgQuick(e.srv.ipam.subnet.Bits()), Pointc: client}, nil
+}
+
+// store saves an enrolled peer so the server adds it again when it is provisioned.
+func (e *Enroll) store(ctx context.Context, peer *enrolledPeer) error {
+	b, err := json.Marshal(peer)
+	if err != nil {
+		return err
+	}
+	key := enrolledKey(e.Network, peer.Name)
+	if b, err = enrolledSealer(e.srv.json.Private.Value()).seal(key, b); err != nil {
+		return err
+	}
+	return e.storage.Store(ctx, key, b)
+}
+
+// enrolledSealer seals the enrolled peers of the server with the private key.
+func enrolledSealer(private wgapi.PrivateKey) storageSealer {
+	return newStorageSealer(private, "enroll")
+}
+
+// loadEnrolled loads the peers enrolled with a server, opening them with the server's private key.
+func loadEnrolled(ctx context.Context, storage enrolledStorage, server string, private wgapi.PrivateKey) ([]*enrolledPeer, error) {
+	keys, err := storage.List(ctx, enrolledKey(server, ""), false)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	slices.Sort(keys)
+
+	var peers []*enrolledPeer
+	for _, key := range keys {
+		b, err := storage.Load(ctx, key)
+		if err != nil {
+			return nil, err
+		} else if b, err = enrolledSealer(private).open(key, b); err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		var peer enrolledPeer
+		if err := json.Unmarshal(b, &peer); err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		peers = append(peers, &peer)
+	}
+	return peers, nil
+}
+
+// enrolledKey is the storage key of a peer enrolled with a server. Removing the key removes the peer on the next reload.
+func enrolledKey(server, name string) string {
+	return path.Join("point-c", "enroll", server, "peers", name)
+}
+
+// allowedIPs are the subnets a client routes to the server: the server's subnet, and the server's own address if it is outside the subnet.
+func (e *Enroll) allowedIPs() []string {
+	subnet := e.srv.ipam.subnet
+	allowed := []string{subnet.String()}
+	if addr, ok := netip.AddrFromSlice(e.srv.json.IP.Value()); ok && !subnet.Contains(addr.Unmap()) {
+		allowed = append(allowed, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()).String())
+	}
+	return allowed
+}
+
+// wgQuick formats the client as a wg-quick config. The address is given the prefix length of the server's subnet.
+func (c *enrollmentClient) wgQuick(bits int) string {
+	private, _ := c.Private.MarshalText()
+	public, _ := c.Public.MarshalText()
+	preshared, _ := c.Preshared.MarshalText()
+
+	var b strings.Builder
+	b.WriteString("[Interface]\n")
+	fmt.Fprintf(&b, "PrivateKey = %s\n", private)
+	fmt.Fprintf(&b, "Address = %s/%d\n", c.IP, bits)
+	b.WriteString("\n[Peer]\n")
+	fmt.Fprintf(&b, "PublicKey = %s\n", public)
+	fmt.Fprintf(&b, "PresharedKey = %s\n", preshared)
+	fmt.Fprintf(&b, "Endpoint = %s\n", c.Endpoint)
+	fmt.Fprintf(&b, "AllowedIPs = %s\n", strings.Join(c.AllowedIPs, ", "))
+	fmt.Fprintf(&b, "PersistentKeepalive = %d\n", wgapi.DefaultPersistentKeepalive)
+	return b.String()
+}
+
+// hashTokens gets the hashes of the invite tokens, tokens may be given as their hash.
+func hashTokens(tokens []string) (map[string]struct{}, error) {
+	repl := caddy.NewReplacer()
+	hashes := map[string]struct{}{}
+	for _, token := range tokens {
+		if token = repl.ReplaceAll(token, ""); token == "" {
+			return nil, errors.New("invite token is empty")
+		} else if hash, ok := strings.CutPrefix(token, tokenHashPrefix); ok {
+			if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("invalid invite token hash %q", hash)
+			}
+			hashes[strings.ToLower(hash)] = struct{}{}
+		} else {
+			hashes[hashToken(token)] = struct{}{}
+		}
+	}
+	return hashes, nil
+}
+
+// hashToken hashes invite tokens so they are not kept in storage.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,193 @@
+package wg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/require"
+	pointc "github.com/trymoose/point-c"
+	"github.com/trymoose/point-c/pkg/wg"
+	"github.com/trymoose/point-c/pkg/wg/wgapi"
+	"github.com/trymoose/point-c/pkg/wg/wgapi/wgconfig"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestServer creates a running server named "server" with the subnet 10.0.0.0/24.
+func newTestServer(t *testing.T, serverIP string) (*Server, wgapi.PublicKey) {
+	t.Helper()
+	private, err := wgapi.NewPrivate()
+	require.NoError(t, err)
+	text, err := private.MarshalText()
+	require.NoError(t, err)
+
+	srv := &Server{logger: slog.New(slog.NewTextHandler(io.Discard, nil)), nets: map[string]pointc.Net{}, routes: map[string][]net.IPNet{}}
+	require.NoError(t, srv.json.Private.UnmarshalText(text))
+	require.NoError(t, srv.json.IP.UnmarshalText([]byte(serverIP)))
+	srv.ipam = newTestIPAM(t, "10.0.0.0/24", nil)
+	srv.nets["server"] = &serverNet{srv: srv, ip: srv.json.IP.Value()}
+	srv.key = deviceKey(private, 0)
+	dev, loaded, err := loadDevice(srv.key, func(n **wg.Net) (*wg.Wireguard, error) {
+		return wg.New(wg.OptionConfig(&wgconfig.Server{Private: private}), wg.OptionNetDevice(n))
+	})
+	require.NoError(t, err)
+	require.False(t, loaded)
+	srv.wg, srv.net = dev.wg, dev.net
+	srv.net.AddLocal(srv.json.IP.Value())
+	t.Cleanup(func() { srv.Cleanup() })
+
+	public, err := private.Public()
+	require.NoError(t, err)
+	return srv, wgapi.PublicKey(public)
+}
+
+// newTestEnroll creates an enrollment handler for a running server with the subnet 10.0.0.0/24.
+func newTestEnroll(t *testing.T, serverIP string, tokens ...string) (*Enroll, memStorage) {
+	t.Helper()
+	srv, public := newTestServer(t, serverIP)
+	storage := memStorage{}
+	hashes, err := hashTokens(tokens)
+	require.NoError(t, err)
+	e := &Enroll{Network: "server", Endpoint: "127.0.0.1:51820", srv: srv, public: public, tokens: hashes, storage: storage, logger: srv.logger}
+	return e, storage
+}
+
+func enrollRequestFor(t *testing.T, e *Enroll, token, name string) (*httptest.ResponseRecorder, error) {
+	t.Helper()
+	b, err := json.Marshal(enrollRequest{Token: token, Name: name})
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	return w, e.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(b)), nil)
+}
+
+func requireStatus(t *testing.T, err error, status int) {
+	t.Helper()
+	var herr caddyhttp.HandlerError
+	require.ErrorAs(t, err, &herr)
+	require.Equal(t, status, herr.StatusCode)
+}
+
+func TestHashTokens(t *testing.T) {
+	hashes, err := hashTokens([]string{"invite", tokenHashPrefix + strings.ToUpper(hashToken("other"))})
+	require.NoError(t, err)
+	require.Equal(t, map[string]struct{}{hashToken("invite"): {}, hashToken("other"): {}}, hashes)
+
+	for _, token := range []string{"", tokenHashPrefix + "abc", tokenHashPrefix + strings.Repeat("z", 64)} {
+		_, err := hashTokens([]string{token})
+		require.Error(t, err, token)
+	}
+}
+
+func TestEnroll_ServeHTTP(t *testing.T) {
+	t.Run("enroll", func(t *testing.T) {
+		e, storage := newTestEnroll(t, "10.0.0.1", "invite")
+		w, err := enrollRequestFor(t, e, "invite", "laptop")
+		require.NoError(t, err)
+		require.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+		var resp struct {
+			Name    string          `json:"name"`
+			IP      net.IP          `json:"ip"`
+			WGQuick string          `json:"wg_quick"`
+			Pointc  json.RawMessage `json:"point_c"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		require.Equal(t, "laptop", resp.Name)
+		require.True(t, (&net.IPNet{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(24, 32)}).Contains(resp.IP))
+		require.Contains(t, resp.WGQuick, "Address = "+resp.IP.String()+"/24\n")
+		require.Contains(t, resp.WGQuick, "AllowedIPs = 10.0.0.0/24\n")
+		require.Contains(t, resp.WGQuick, "Endpoint = 127.0.0.1:51820\n")
+
+		// The returned client config can be loaded by the client module.
+		var c Client
+		require.NoError(t, json.Unmarshal(resp.Pointc, &c))
+		require.Equal(t, "laptop", c.json.Name.Value())
+		require.Equal(t, e.public, c.json.Public.Value())
+		require.Equal(t, resp.IP.String(), c.json.IP.Value().String())
+		require.Len(t, c.json.AllowedIPs, 1)
+
+		// The peer was added to the device and the server's networks.
+		n, ok := e.srv.Networks()["laptop"]
+		require.True(t, ok)
+		require.Equal(t, resp.IP.String(), n.LocalAddr().String())
+		ipc, err := e.srv.wg.GetConfig()
+		require.NoError(t, err)
+		private := c.json.Private.Value()
+		public, err := private.Public()
+		require.NoError(t, err)
+		require.Contains(t, ipc, wgapi.PublicKey(public))
+
+		// The peer is stored so the server adds it again after a reload.
+		peers, err := loadEnrolled(context.Background(), storage, "server", e.srv.json.Private.Value())
+		require.NoError(t, err)
+		require.Equal(t, []*enrolledPeer{{Name: "laptop", Public: wgapi.PublicKey(public), Preshared: c.json.Preshared.Value(), IP: resp.IP}}, peers)
+		presharedText, err := c.json.Preshared.Value().MarshalText()
+		require.NoError(t, err)
+		require.NotContains(t, string(storage[enrolledKey("server", "laptop")]), string(presharedText), "preshared key stored in the clear")
+		_, err = loadEnrolled(context.Background(), storage, "server", private)
+		require.Error(t, err, "opened with another private key")
+	})
+
+	t.Run("hashed token", func(t *testing.T) {
+		e, _ := newTestEnroll(t, "10.0.0.1", tokenHashPrefix+hashToken("invite"))
+		_, err := enrollRequestFor(t, e, "invite", "laptop")
+		require.NoError(t, err)
+	})
+
+	t.Run("one time tokens", func(t *testing.T) {
+		e, storage := newTestEnroll(t, "10.0.0.1", "invite")
+		_, err := enrollRequestFor(t, e, "invite", "laptop")
+		require.NoError(t, err)
+		_, err = enrollRequestFor(t, e, "invite", "phone")
+		requireStatus(t, err, http.StatusForbidden)
+
+		// Tokens used before a reload stay used.
+		e, _ = newTestEnroll(t, "10.0.0.1", "invite")
+		e.storage = storage
+		_, err = enrollRequestFor(t, e, "invite", "phone")
+		requireStatus(t, err, http.StatusForbidden)
+	})
+
+	t.Run("invalid token", func(t *testing.T) {
+		e, _ := newTestEnroll(t, "10.0.0.1", "invite")
+		_, err := enrollRequestFor(t, e, "other", "laptop")
+		requireStatus(t, err, http.StatusForbidden)
+	})
+
+	t.Run("duplicate name", func(t *testing.T) {
+		e, _ := newTestEnroll(t, "10.0.0.1", "invite")
+		_, err := enrollRequestFor(t, e, "invite", "server")
+		requireStatus(t, err, http.StatusConflict)
+		// Names differing only in case would share a DNS record.
+		e.srv.nets["Desktop"] = &serverNet{srv: e.srv, ip: net.IPv4(10, 0, 0, 9)}
+		_, err = enrollRequestFor(t, e, "invite", "desktop")
+		requireStatus(t, err, http.StatusConflict)
+		_, err = enrollRequestFor(t, e, "invite", "laptop")
+		require.NoError(t, err, "token is not spent by a failed enrollment")
+	})
+
+	t.Run("invalid request", func(t *testing.T) {
+		e, _ := newTestEnroll(t, "10.0.0.1", "invite")
+		for _, name := range []string{"", ".", "..", "a..b", "Laptop", "my_laptop", "{env.HOME}"} {
+			_, err := enrollRequestFor(t, e, "invite", name)
+			requireStatus(t, err, http.StatusBadRequest)
+		}
+		err := e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", strings.NewReader("{")), nil)
+		requireStatus(t, err, http.StatusBadRequest)
+		err = e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), nil)
+		requireStatus(t, err, http.StatusMethodNotAllowed)
+	})
+
+	t.Run("server outside subnet", func(t *testing.T) {
+		e, _ := newTestEnroll(t, "192.168.0.1", "invite")
+		w, err := enrollRequestFor(t, e, "invite", "laptop")
+		require.NoError(t, err)
+		require.Contains(t, w.Body.String(), "AllowedIPs = 10.0.0.0/24, 192.168.0.1/32")
+	})
+}
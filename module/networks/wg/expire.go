@@ -0,0 +1,211 @@
+package wg
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/trymoose/point-c/pkg/wg/wgapi"
+	"io/fs"
+	"net"
+	"path"
+	"slices"
+	"time"
+)
+
+// expireInterval is how often peers are checked for expiry.
+const expireInterval = time.Second
+
+// expiry is when a peer of a [Server] is removed.
+type expiry struct {
+	name  string
+	peer  wgapi.PublicKey
+	ip    net.IP
+	at    time.Time     // at is the deadline of the peer, zero if it has none.
+	idle  time.Duration // idle is how long the peer may go without a handshake, zero if it never idles out.
+	added time.Time     // added is when the peer was added, counted as its last handshake until it has one.
+}
+
+// expiryStorage remembers when peers were added and which of them idled out, so a reload does not reset either.
+// [certmagic.Storage] is an expiryStorage.
+type expiryStorage interface {
+	Load(ctx context.Context, key string) ([]byte, error)
+	Store(ctx context.Context, key string, value []byte) error
+}
+
+// expiryRecord is what is remembered about a peer with an idle timeout.
+type expiryRecord struct {
+	Added time.Time  `json:"added"`
+	Idled *time.Time `json:"idled,omitempty"` // Idled is when the peer was removed for being idle.
+}
+
+// expired gets the reason the peer expired before it was added, or an empty string if it has not expired.
+// A peer that idled out stays expired for good, it is only added again once its record is removed from storage.
+func (c *Server) expired(ctx context.Context, p *serverPeer, now time.Time) string {
+	if p.ExpiresAt != nil && !now.Before(*p.ExpiresAt) {
+		return "deadline passed"
+	} else if p.IdleTimeout > 0 {
+		if r := c.loadExpiry(ctx, p.Public.Value()); r != nil && r.Idled != nil {
+			return "idle timeout"
+		}
+	}
+	return ""
+}
+
+// expiry gets when the peer with the address expires, or nil if it never does.
+// The time a peer with an idle timeout was first added is remembered, so reloads do not restart its timeout.
+func (c *Server) expiry(ctx context.Context, p *serverPeer, ip net.IP, now time.Time) *expiry {
+	if p.ExpiresAt == nil && p.IdleTimeout <= 0 {
+		return nil
+	}
+	e := &expiry{name: p.Name.Value(), peer: p.Public.Value(), ip: ip, idle: time.Duration(p.IdleTimeout), added: now}
+	if p.ExpiresAt != nil {
+		e.at = *p.ExpiresAt
+	}
+	if e.idle > 0 {
+		if r := c.loadExpiry(ctx, e.peer); r != nil {
+			e.added = r.Added
+		} else {
+			c.storeExpiry(ctx, e.peer, &expiryRecord{Added: now})
+		}
+	}
+	return e
+}
+
+// logExpired logs that a peer expired. Peers that idled out are told apart, since they stay removed until the logged storage key is deleted.
+func (c *Server) logExpired(name string, peer wgapi.PublicKey, reason string, args ...any) {
+	args = append([]any{"peer", name, "reason", reason}, args...)
+	if reason == "idle timeout" {
+		c.logger.Info("peer expired, delete its storage key to add it again", append(args, "key", c.expiryKey(peer))...)
+		return
+	}
+	c.logger.Info("peer expired", args...)
+}
+
+// expiryKey is the storage key of the [expiryRecord] of a peer.
+func (c *Server) expiryKey(peer wgapi.PublicKey) string {
+	return path.Join("point-c", "expire", c.json.Name.Value(), hex.EncodeToString(peer[:]))
+}
+
+// loadExpiry loads the record of a peer, or nil if there is none.
+func (c *Server) loadExpiry(ctx context.Context, peer wgapi.PublicKey) *expiryRecord {
+	if c.expiries == nil {
+		return nil
+	}
+	b, err := c.expiries.Load(ctx, c.expiryKey(peer))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			c.logger.Warn("failed to load peer expiry", "peer", peer, "error", err)
+		}
+		return nil
+	}
+	var r expiryRecord
+	if err := json.Unmarshal(b, &r); err != nil {
+		c.logger.Warn("invalid peer expiry", "peer", peer, "error", err)
+		return nil
+	}
+	return &r
+}
+
+// storeExpiry saves the record of a peer.
+func (c *Server) storeExpiry(ctx context.Context, peer wgapi.PublicKey, r *expiryRecord) {
+	if c.expiries == nil {
+		return
+	}
+	b, err := json.Marshal(r)
+	if err == nil {
+		err = c.expiries.Store(ctx, c.expiryKey(peer), b)
+	}
+	if err != nil {
+		c.logger.Warn("failed to store peer expiry", "peer", peer, "error", err)
+	}
+}
+
+// expired gets the reason the peer expired given the time of its last handshake, or an empty string if it has not expired.
+func (e *expiry) expired(now, handshake time.Time) string {
+	if !e.at.IsZero() && !now.Before(e.at) {
+		return "deadline passed"
+	} else if e.idle <= 0 {
+		return ""
+	}
+	if handshake.Before(e.added) {
+		handshake = e.added
+	}
+	if now.Sub(handshake) >= e.idle {
+		return "idle timeout"
+	}
+	return ""
+}
+
+// expire removes peers once they expire, until ctx is done or all peers are removed.
+func (c *Server) expire(ctx context.Context, peers []*expiry) {
+	t := time.NewTicker(expireInterval)
+	defer t.Stop()
+	for len(peers) > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			peers = c.expirePeers(now, peers)
+		}
+	}
+}
+
+// expirePeers removes the expired peers, returning the peers that remain.
+func (c *Server) expirePeers(now time.Time, peers []*expiry) []*expiry {
+	var handshakes map[wgapi.PublicKey]time.Time
+	if slices.ContainsFunc(peers, func(e *expiry) bool { return e.idle > 0 }) {
+		var err error
+		if handshakes, err = c.handshakes(); err != nil {
+			c.logger.Warn("failed to get last handshakes", "error", err)
+			return peers
+		}
+	}
+
+	return slices.DeleteFunc(peers, func(e *expiry) bool {
+		reason := e.expired(now, handshakes[e.peer])
+		if reason == "" {
+			return false
+		}
+		if err := c.removePeer(e.name, e.peer); err != nil {
+			c.logger.Warn("failed to remove expired peer", "peer", e.name, "error", err)
+			return false
+		}
+		if reason == "idle timeout" {
+			c.storeExpiry(context.Background(), e.peer, &expiryRecord{Added: e.added, Idled: &now})
+		}
+		c.logExpired(e.name, e.peer, reason, "ip", e.ip)
+		return true
+	})
+}
+
+// handshakes gets the time of the last handshake of each peer. Peers without a handshake are not included.
+func (c *Server) handshakes() (map[wgapi.PublicKey]time.Time, error) {
+	ipc, err := c.wg.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	handshakes := map[wgapi.PublicKey]time.Time{}
+	var peer wgapi.PublicKey
+	var sec, nsec int64
+	flush := func() {
+		if sec != 0 || nsec != 0 {
+			handshakes[peer] = time.Unix(sec, nsec)
+		}
+		sec, nsec = 0, 0
+	}
+	for _, kv := range ipc {
+		switch kv := kv.(type) {
+		case wgapi.PublicKey:
+			flush()
+			peer = kv
+		case wgapi.LastHandshakeTimeSec:
+			sec = int64(kv)
+		case wgapi.LastHandshakeTimeNSec:
+			nsec = int64(kv)
+		}
+	}
+	flush()
+	return handshakes, nil
+}
@@ -0,0 +1,115 @@
+package wg
+
+import (
+	"context"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/require"
+	"github.com/trymoose/point-c/pkg/wg/wgapi"
+	"testing"
+	"time"
+)
+
+func TestExpiry_expired(t *testing.T) {
+	added := time.Unix(1000, 0)
+	for _, tt := range []struct {
+		name      string
+		expiry    expiry
+		now       time.Time
+		handshake time.Time
+		reason    string
+	}{
+		{name: "no limits", expiry: expiry{added: added}, now: added.Add(time.Hour)},
+		{name: "before deadline", expiry: expiry{at: added.Add(time.Minute), added: added}, now: added.Add(time.Second)},
+		{name: "deadline", expiry: expiry{at: added.Add(time.Minute), added: added}, now: added.Add(time.Minute), reason: "deadline passed"},
+		{name: "idle without handshake", expiry: expiry{idle: time.Minute, added: added}, now: added.Add(time.Minute), reason: "idle timeout"},
+		{name: "not idle without handshake", expiry: expiry{idle: time.Minute, added: added}, now: added.Add(time.Second)},
+		{name: "recent handshake", expiry: expiry{idle: time.Minute, added: added}, now: added.Add(time.Hour), handshake: added.Add(time.Hour - time.Second)},
+		{name: "old handshake", expiry: expiry{idle: time.Minute, added: added}, now: added.Add(time.Hour), handshake: added.Add(time.Minute), reason: "idle timeout"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.reason, tt.expiry.expired(tt.now, tt.handshake))
+		})
+	}
+}
+
+func TestServer_expiry(t *testing.T) {
+	srv, _ := newTestServer(t, "10.0.0.1")
+	srv.expiries = memStorage{}
+	added := time.Unix(1000, 0)
+	text, err := newTestKey(t).MarshalText()
+	require.NoError(t, err)
+	peer := serverPeer{IdleTimeout: caddy.Duration(time.Minute)}
+	require.NoError(t, peer.Public.UnmarshalText(text))
+
+	// A reload keeps the time the peer was first added.
+	require.Equal(t, added, srv.expiry(context.Background(), &peer, nil, added).added)
+	require.Equal(t, added.Unix(), srv.expiry(context.Background(), &peer, nil, added.Add(time.Hour)).added.Unix())
+	require.Empty(t, srv.expired(context.Background(), &peer, added.Add(time.Hour)))
+
+	// A peer that idled out stays expired.
+	idled := added.Add(time.Minute)
+	srv.storeExpiry(context.Background(), peer.Public.Value(), &expiryRecord{Added: added, Idled: &idled})
+	require.Equal(t, "idle timeout", srv.expired(context.Background(), &peer, added.Add(time.Hour)))
+	peer.IdleTimeout = 0
+	require.Empty(t, srv.expired(context.Background(), &peer, added.Add(time.Hour)))
+
+	deadline := added.Add(time.Minute)
+	peer.ExpiresAt = &deadline
+	require.Equal(t, "deadline passed", srv.expired(context.Background(), &peer, deadline))
+}
+
+func TestServer_expirePeers(t *testing.T) {
+	srv, _ := newTestServer(t, "10.0.0.1")
+	storage := memStorage{}
+	srv.expiries = storage
+	now := time.Now()
+	var peers []*expiry
+	for _, name := range []string{"ci", "idle", "kept"} {
+		_, public, err := wgapi.NewPrivatePublic()
+		require.NoError(t, err)
+		ip, err := srv.addPeer(context.Background(), name, public, wgapi.PresharedKey{})
+		require.NoError(t, err)
+		peers = append(peers, &expiry{name: name, peer: public, ip: ip, added: now})
+	}
+	peers[0].at = now.Add(time.Minute)
+	peers[1].idle = time.Second * 30
+	peers[2].idle = time.Hour
+	idle, err := peers[1].peer.MarshalText()
+	require.NoError(t, err)
+
+	peers = srv.expirePeers(now.Add(time.Second), peers)
+	require.Len(t, peers, 3)
+	peers = srv.expirePeers(now.Add(time.Second*30), peers)
+	require.Len(t, peers, 2)
+	peers = srv.expirePeers(now.Add(time.Minute), peers)
+	require.Len(t, peers, 1)
+	require.Equal(t, "kept", peers[0].name)
+
+	// Only the peer that idled out is remembered.
+	require.Len(t, storage, 1)
+	peer := serverPeer{IdleTimeout: caddy.Duration(time.Hour)}
+	require.NoError(t, peer.Public.UnmarshalText(idle))
+	require.Equal(t, "idle timeout", srv.expired(context.Background(), &peer, now))
+	// It is only added again once its record is deleted.
+	delete(storage, srv.expiryKey(peer.Public.Value()))
+	require.Empty(t, srv.expired(context.Background(), &peer, now))
+
+	nets := srv.Networks()
+	require.Contains(t, nets, "kept")
+	require.NotContains(t, nets, "ci")
+	require.NotContains(t, nets, "idle")
+
+	handshakes, err := srv.handshakes()
+	require.NoError(t, err)
+	require.Empty(t, handshakes)
+	ipc, err := srv.wg.GetConfig()
+	require.NoError(t, err)
+	require.Contains(t, ipc, peers[0].peer)
+	var keys int
+	for _, kv := range ipc {
+		if _, ok := kv.(wgapi.PublicKey); ok {
+			keys++
+		}
+	}
+	require.Equal(t, 1, keys)
+}
@@ -4,9 +4,13 @@ go 1.21.3
 
 require (
 	github.com/caddyserver/caddy/v2 v2.7.5
+	github.com/spf13/cobra v1.7.0
+	github.com/stretchr/testify v1.8.4
 	github.com/trymoose/point-c v0.0.4-0.20231122005956-2f42edbf6ca1
-	github.com/trymoose/point-c/wglog/wgevents v0.0.1
+	github.com/trymoose/point-c/pkg/wg v0.0.0-20231122005956-2f42edbf6ca1
+	github.com/trymoose/point-c/pkg/wg/wglog/wgevents v0.0.0-20231122005956-2f42edbf6ca1
 	go.mrchanchal.com/zaphandler v0.0.0-20230611140024-bd4fd80897ad
+	golang.org/x/net v0.17.0
 )
 
 require (
@@ -24,6 +28,7 @@ require (
 	github.com/cespare/xxhash/v2 v2.2.0 // indirect
 	github.com/chzyer/readline v1.5.1 // indirect
 	github.com/cpuguy83/go-md2man/v2 v2.0.2 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/dgraph-io/badger v1.6.2 // indirect
 	github.com/dgraph-io/badger/v2 v2.2007.4 // indirect
 	github.com/dgraph-io/ristretto v0.1.0 // indirect
@@ -67,6 +72,7 @@ require (
 	github.com/mitchellh/reflectwalk v1.0.2 // indirect
 	github.com/onsi/ginkgo/v2 v2.9.5 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/prometheus/client_golang v1.15.1 // indirect
 	github.com/prometheus/client_model v0.4.0 // indirect
 	github.com/prometheus/common v0.42.0 // indirect
@@ -82,15 +88,12 @@ require (
 	github.com/smallstep/nosql v0.6.0 // indirect
 	github.com/smallstep/truststore v0.12.1 // indirect
 	github.com/spf13/cast v1.4.1 // indirect
-	github.com/spf13/cobra v1.7.0 // indirect
 	github.com/spf13/pflag v1.0.5 // indirect
 	github.com/stoewer/go-strcase v1.2.0 // indirect
 	github.com/tailscale/tscert v0.0.0-20230806124524-28a91b69a046 // indirect
 	github.com/tidwall/gjson v1.17.0 // indirect
 	github.com/tidwall/match v1.1.1 // indirect
 	github.com/tidwall/pretty v1.2.0 // indirect
-	github.com/trymoose/point-c/pkg/wg v0.0.0-20231122005956-2f42edbf6ca1 // indirect
-	github.com/trymoose/point-c/pkg/wg/wglog/wgevents v0.0.0-20231122005956-2f42edbf6ca1 // indirect
 	github.com/urfave/cli v1.22.14 // indirect
 	github.com/zeebo/blake3 v0.2.3 // indirect
 	go.etcd.io/bbolt v1.3.7 // indirect
@@ -104,7 +107,6 @@ require (
 	golang.org/x/crypto v0.14.0 // indirect
 	golang.org/x/exp v0.0.0-20230725093048-515e97ebf090 // indirect
 	golang.org/x/mod v0.13.0 // indirect
-	golang.org/x/net v0.17.0 // indirect
 	golang.org/x/sys v0.13.0 // indirect
 	golang.org/x/term v0.13.0 // indirect
 	golang.org/x/text v0.13.0 // indirect
@@ -122,3 +124,9 @@ require (
 	gvisor.dev/gvisor v0.0.0-20231104011432-48a6d7d5bd0b // indirect
 	howett.net/plist v1.0.0 // indirect
 )
+
+// The module is built against the root module and pkg/wg of the same commit until both are tagged.
+replace (
+	github.com/trymoose/point-c => ../../..
+	github.com/trymoose/point-c/pkg/wg => ../../../pkg/wg
+)
@@ -0,0 +1,158 @@
+package wg
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/trymoose/point-c/pkg/wg/wgapi"
+	"io/fs"
+	"net"
+	"net/netip"
+	"path"
+)
+
+// maxProbes limits how many addresses are tried when the address derived from a key is taken.
+const maxProbes = 1 << 16
+
+type (
+	// ipam assigns the addresses of peers in a subnet.
+	// Addresses are derived from the peer's public key, and remembered in storage so a peer keeps its address when other peers change.
+	ipam struct {
+		subnet  netip.Prefix
+		storage ipamStorage // storage may be nil, in which case addresses are only derived.
+		prefix  string      // prefix is the storage key prefix for this subnet.
+		used    map[netip.Addr]string
+	}
+	// ipamStorage persists assignments. [certmagic.Storage] is an ipamStorage.
+	ipamStorage interface {
+		Load(ctx context.Context, key string) ([]byte, error)
+		Store(ctx context.Context, key string, value []byte) error
+	}
+)
+
+// newIPAM creates an address manager for the subnet. Assignments are stored under the given name.
+// Without a subnet addresses can only be reserved.
+func newIPAM(subnet *net.IPNet, storage ipamStorage, name string) (*ipam, error) {
+	if subnet == nil {
+		return &ipam{used: map[netip.Addr]string{}}, nil
+	}
+	addr, ok := netip.AddrFromSlice(subnet.IP)
+	if !ok {
+		return nil, fmt.Errorf("invalid subnet %s", subnet)
+	}
+	ones, _ := subnet.Mask.Size()
+	prefix := netip.PrefixFrom(addr.Unmap(), ones).Masked()
+	if prefix.Bits() < 0 || prefix.Addr().BitLen()-prefix.Bits() < 2 {
+		return nil, fmt.Errorf("subnet %s is too small", subnet)
+	}
+	return &ipam{
+		subnet:  prefix,
+		storage: storage,
+		prefix:  path.Join("point-c", "ipam", name, prefix.String()),
+		used:    map[netip.Addr]string{},
+	}, nil
+}
+
+// reserve marks an address as used by owner, failing if it is already used.
+func (a *ipam) reserve(ip net.IP, owner string) error {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return fmt.Errorf("invalid address %q for %q", ip, owner)
+	}
+	addr = addr.Unmap()
+	if other, ok := a.used[addr]; ok {
+		return fmt.Errorf("address %s of %q is already used by %q", addr, owner, other)
+	}
+	a.used[addr] = owner
+	return nil
+}
+
+// release frees an address so it can be assigned again.
+func (a *ipam) release(ip net.IP) {
+	if addr, ok := netip.AddrFromSlice(ip); ok {
+		delete(a.used, addr.Unmap())
+	}
+}
+
+// allocate assigns an address in the subnet to the peer.
+// A stored address is used if it is still free, otherwise an address is derived from the key and stored.
+func (a *ipam) allocate(ctx context.Context, peer wgapi.PublicKey, owner string) (net.IP, error) {
+	if !a.subnet.IsValid() {
+		return nil, fmt.Errorf("%q has no address and there is no subnet to assign one from", owner)
+	}
+	key := path.Join(a.prefix, peer.String())
+	if a.storage != nil {
+		b, err := a.storage.Load(ctx, key)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("failed to load address of %q: %w", owner, err)
+		}
+		if addr, err := netip.ParseAddr(string(b)); err == nil && a.free(addr) {
+			a.used[addr] = owner
+			return addr.AsSlice(), nil
+		}
+	}
+
+	addr, err := a.derive(peer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to assign address to %q: %w", owner, err)
+	}
+	if a.storage != nil {
+		if err := a.storage.Store(ctx, key, []byte(addr.String())); err != nil {
+			return nil, fmt.Errorf("failed to store address of %q: %w", owner, err)
+		}
+	}
+	a.used[addr] = owner
+	return addr.AsSlice(), nil
+}
+
+// derive finds the first free address starting at the position given by the hash of the key.
+func (a *ipam) derive(peer wgapi.PublicKey) (netip.Addr, error) {
+	size := a.size()
+	sum := sha256.Sum256(peer[:])
+	start := binary.BigEndian.Uint64(sum[:8]) % size
+	for i := uint64(0); i < min(size, maxProbes); i++ {
+		if addr := a.addr((start + i) % size); a.free(addr) {
+			return addr, nil
+		}
+	}
+	return netip.Addr{}, fmt.Errorf("no free address in %s", a.subnet)
+}
+
+// free reports whether the address is an unused host address of the subnet.
+func (a *ipam) free(addr netip.Addr) bool {
+	if !a.subnet.Contains(addr) || addr == a.subnet.Addr() {
+		return false
+	} else if addr.Is4() && addr == a.addr(a.size()) {
+		// The broadcast address.
+		return false
+	}
+	_, used := a.used[addr]
+	return !used
+}
+
+// size is the number of assignable addresses, without the network and IPv4 broadcast addresses.
+func (a *ipam) size() uint64 {
+	bits := a.subnet.Addr().BitLen() - a.subnet.Bits()
+	if bits > 63 {
+		bits = 63
+	}
+	size := uint64(1)<<bits - 1
+	if a.subnet.Addr().Is4() {
+		size--
+	}
+	return size
+}
+
+// addr gets the nth host address of the subnet, starting at 0 for the address after the network address.
+func (a *ipam) addr(n uint64) netip.Addr {
+	b := a.subnet.Addr().As16()
+	lo := binary.BigEndian.Uint64(b[8:]) + n + 1
+	binary.BigEndian.PutUint64(b[8:], lo)
+	addr := netip.AddrFrom16(b)
+	if a.subnet.Addr().Is4() {
+		addr = addr.Unmap()
+	}
+	return addr
+}
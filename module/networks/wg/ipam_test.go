@@ -0,0 +1,146 @@
+package wg
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"github.com/trymoose/point-c/pkg/wg/wgapi"
+	"io/fs"
+	"net"
+	"strings"
+	"testing"
+)
+
+// memStorage is an in memory [ipamStorage], [enrollStorage] and [enrolledStorage].
+type memStorage map[string][]byte
+
+func (m memStorage) Load(_ context.Context, key string) ([]byte, error) {
+	b, ok := m[key]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return b, nil
+}
+
+func (m memStorage) Store(_ context.Context, key string, value []byte) error {
+	m[key] = value
+	return nil
+}
+
+func (m memStorage) Exists(_ context.Context, key string) bool {
+	_, ok := m[key]
+	return ok
+}
+
+func (m memStorage) List(_ context.Context, prefix string, _ bool) ([]string, error) {
+	var keys []string
+	for key := range m {
+		if strings.HasPrefix(key, prefix+"/") {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fs.ErrNotExist
+	}
+	return keys, nil
+}
+
+func newTestIPAM(t *testing.T, cidr string, storage ipamStorage) *ipam {
+	t.Helper()
+	_, subnet, err := net.ParseCIDR(cidr)
+	require.NoError(t, err)
+	a, err := newIPAM(subnet, storage, "server")
+	require.NoError(t, err)
+	return a
+}
+
+func newTestKey(t *testing.T) wgapi.PublicKey {
+	t.Helper()
+	_, pk, err := wgapi.NewPrivatePublic()
+	require.NoError(t, err)
+	return pk
+}
+
+func TestIPAM(t *testing.T) {
+	t.Run("stable", func(t *testing.T) {
+		pk := newTestKey(t)
+		ip1, err := newTestIPAM(t, "10.0.0.0/16", nil).allocate(context.Background(), pk, "peer")
+		require.NoError(t, err)
+		ip2, err := newTestIPAM(t, "10.0.0.0/16", nil).allocate(context.Background(), pk, "peer")
+		require.NoError(t, err)
+		require.Equal(t, ip1, ip2)
+		require.True(t, (&net.IPNet{IP: net.IPv4(10, 0, 0, 0), Mask: net.CIDRMask(16, 32)}).Contains(ip1))
+	})
+
+	t.Run("stored", func(t *testing.T) {
+		storage := memStorage{}
+		pk1, pk2 := newTestKey(t), newTestKey(t)
+		a := newTestIPAM(t, "10.0.0.0/24", storage)
+		ip, err := a.allocate(context.Background(), pk1, "peer1")
+		require.NoError(t, err)
+		require.Len(t, storage, 1)
+
+		// The stored address is kept even if it is what the other peer would be assigned.
+		a = newTestIPAM(t, "10.0.0.0/24", storage)
+		derived, err := a.derive(pk2)
+		require.NoError(t, err)
+		storage[a.prefix+"/"+pk1.String()] = []byte(derived.String())
+		got, err := a.allocate(context.Background(), pk1, "peer1")
+		require.NoError(t, err)
+		require.Equal(t, net.IP(derived.AsSlice()), got)
+		got, err = a.allocate(context.Background(), pk2, "peer2")
+		require.NoError(t, err)
+		require.NotEqual(t, net.IP(derived.AsSlice()), got)
+		require.NotNil(t, ip)
+	})
+
+	t.Run("reserved address is skipped", func(t *testing.T) {
+		pk := newTestKey(t)
+		a := newTestIPAM(t, "10.0.0.0/24", nil)
+		derived, err := a.derive(pk)
+		require.NoError(t, err)
+		require.NoError(t, a.reserve(derived.AsSlice(), "server"))
+		got, err := a.allocate(context.Background(), pk, "peer")
+		require.NoError(t, err)
+		require.NotEqual(t, net.IP(derived.AsSlice()), got)
+	})
+
+	t.Run("conflict", func(t *testing.T) {
+		a := newTestIPAM(t, "10.0.0.0/24", nil)
+		require.NoError(t, a.reserve(net.IPv4(10, 0, 0, 1), "server"))
+		require.ErrorContains(t, a.reserve(net.IPv4(10, 0, 0, 1), "peer"), `already used by "server"`)
+	})
+
+	t.Run("full", func(t *testing.T) {
+		a := newTestIPAM(t, "10.0.0.0/30", nil)
+		for i := 0; i < 2; i++ {
+			ip, err := a.allocate(context.Background(), newTestKey(t), "peer")
+			require.NoError(t, err)
+			require.NotEqual(t, net.IPv4(10, 0, 0, 0).To4(), ip)
+			require.NotEqual(t, net.IPv4(10, 0, 0, 3).To4(), ip)
+		}
+		_, err := a.allocate(context.Background(), newTestKey(t), "peer")
+		require.ErrorContains(t, err, "no free address")
+	})
+
+	t.Run("ipv6", func(t *testing.T) {
+		ip, err := newTestIPAM(t, "fd00::/64", nil).allocate(context.Background(), newTestKey(t), "peer")
+		require.NoError(t, err)
+		require.Len(t, ip, net.IPv6len)
+		require.True(t, (&net.IPNet{IP: net.ParseIP("fd00::"), Mask: net.CIDRMask(64, 128)}).Contains(ip))
+	})
+
+	t.Run("no subnet", func(t *testing.T) {
+		a, err := newIPAM(nil, nil, "server")
+		require.NoError(t, err)
+		require.NoError(t, a.reserve(net.IPv4(10, 0, 0, 1), "server"))
+		_, err = a.allocate(context.Background(), newTestKey(t), "peer")
+		require.Error(t, err)
+	})
+
+	t.Run("too small", func(t *testing.T) {
+		_, subnet, err := net.ParseCIDR("10.0.0.0/31")
+		require.NoError(t, err)
+		_, err = newIPAM(subnet, nil, "server")
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,252 @@
+package wg
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/trymoose/point-c/pkg/wg/wgapi"
+	"github.com/trymoose/point-c/pkg/wg/wgapi/wgconfig"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// peersDirInterval is how often the peers directory is checked for changes by default.
+const peersDirInterval = 5 * time.Second
+
+// peerFile is a file in the peers directory of a [Server].
+type peerFile struct {
+	sum    [sha256.Size]byte  // sum is the hash of the contents last read, so unchanged files are skipped.
+	name   string             // name is the name of the peer loaded from the file, empty if none is loaded.
+	public wgapi.PublicKey    // public is the key of the loaded peer.
+	cancel context.CancelFunc // cancel stops the expiry of the loaded peer, nil if it does not expire.
+}
+
+// openPeersDir loads the peers in the peers directory and keeps watching it for changes until ctx is done.
+// It is started when the server is brought up, the peers loaded before are kept if it is brought up again.
+func (c *Server) openPeersDir(ctx context.Context) {
+	if c.peerFiles == nil {
+		c.peerFiles = map[string]*peerFile{}
+	}
+	c.loadPeers(ctx)
+	interval := time.Duration(c.json.PeersDirInterval)
+	if interval <= 0 {
+		interval = peersDirInterval
+	}
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				c.loadPeers(ctx)
+			}
+		}
+	}()
+}
+
+// checkPeersDir checks the peers directory exists when the server is provisioned.
+func (c *Server) checkPeersDir() error {
+	if fi, err := os.Stat(c.json.PeersDir); err != nil {
+		return fmt.Errorf("failed to open peers directory: %w", err)
+	} else if !fi.IsDir() {
+		return fmt.Errorf("peers directory %q is not a directory", c.json.PeersDir)
+	}
+	return nil
+}
+
+// loadPeers applies the changes to the peers directory since it was last loaded.
+// Peers are added for new and changed files, and removed for changed and deleted files.
+// Hidden files and files without a .conf or .json extension are ignored.
+func (c *Server) loadPeers(ctx context.Context) {
+	entries, err := os.ReadDir(c.json.PeersDir)
+	if err != nil {
+		c.logger.Warn("failed to read peers directory", "dir", c.json.PeersDir, "error", err)
+		return
+	}
+
+	seen := map[string]bool{}
+	for _, e := range entries {
+		if ext := filepath.Ext(e.Name()); e.IsDir() || strings.HasPrefix(e.Name(), ".") || (ext != ".conf" && ext != ".json") {
+			continue
+		}
+		seen[e.Name()] = true
+		c.loadPeerFile(ctx, e.Name())
+	}
+	for name, f := range c.peerFiles {
+		if !seen[name] {
+			c.unloadPeerFile(f)
+			delete(c.peerFiles, name)
+		}
+	}
+}
+
+// loadPeerFile loads the peer of a file in the peers directory if the file changed.
+// Errors are logged once per change of the file. A file that can not be parsed keeps its previous peer.
+func (c *Server) loadPeerFile(ctx context.Context, name string) {
+	filename := filepath.Join(c.json.PeersDir, name)
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		c.logger.Warn("failed to read peer file", "file", filename, "error", err)
+		return
+	}
+
+	f, ok := c.peerFiles[name]
+	if !ok {
+		f = &peerFile{}
+		c.peerFiles[name] = f
+	}
+	sum := sha256.Sum256(b)
+	if ok && f.sum == sum {
+		return
+	}
+	f.sum = sum
+
+	peer, warnings, err := parsePeerFile(filename, b)
+	for _, w := range warnings {
+		c.logger.Warn(w.Message, "file", w.File, "line", w.Line)
+	}
+	if err != nil {
+		c.logger.Error("invalid peer file", "file", filename, "error", err)
+		return
+	}
+
+	c.unloadPeerFile(f)
+	now := time.Now()
+	if reason := c.expired(ctx, peer, now); reason != "" {
+		c.logExpired(peer.Name.Value(), peer.Public.Value(), reason)
+		return
+	}
+	ip, err := c.insertPeer(ctx, peer.Name.Value(), &wgconfig.Peer{
+		Public:     peer.Public.Value(),
+		PreShared:  peer.PresharedKey.Value(),
+		AllowedIPs: subnets(peer.Routes),
+	}, peer.IP.Value())
+	if err != nil {
+		c.logger.Error("failed to add peer", "file", filename, "error", err)
+		return
+	}
+	f.name, f.public = peer.Name.Value(), peer.Public.Value()
+	if e := c.expiry(ctx, peer, ip, now); e != nil {
+		ctx, f.cancel = context.WithCancel(ctx)
+		go c.expire(ctx, []*expiry{e})
+	}
+}
+
+// unloadPeerFile removes the peer loaded from a file.
+func (c *Server) unloadPeerFile(f *peerFile) {
+	if f.cancel != nil {
+		f.cancel()
+	}
+	if f.name != "" {
+		if err := c.removePeer(f.name, f.public); err != nil {
+			c.logger.Error("failed to remove peer", "peer", f.name, "error", err)
+		} else {
+			c.logger.Info("removed peer", "peer", f.name)
+		}
+	}
+	f.name, f.public, f.cancel = "", wgapi.PublicKey{}, nil
+}
+
+// parsePeerFile parses a peer from a file in the peers directory. Peers without a name are named after the file.
+func parsePeerFile(filename string, body []byte) (*serverPeer, []caddyconfig.Warning, error) {
+	var peer serverPeer
+	var warnings []caddyconfig.Warning
+	name := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	switch filepath.Ext(filename) {
+	case ".json":
+		if err := json.Unmarshal(body, &peer); err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", filename, err)
+		}
+	case ".conf":
+		p, w, err := parsePeerConf(filename, body)
+		if err != nil {
+			return nil, w, err
+		}
+		warnings = w
+
+		sp := wgquickServerPeer{Name: p.name, Public: p.public, PresharedKey: p.preshared}
+		if err := p.addresses(&sp); err != nil {
+			return nil, warnings, fmt.Errorf("%s: %w", filename, err)
+		}
+		b, err := json.Marshal(sp)
+		if err != nil {
+			return nil, warnings, err
+		} else if err := json.Unmarshal(b, &peer); err != nil {
+			return nil, warnings, fmt.Errorf("%s: %w", filename, err)
+		}
+	default:
+		return nil, nil, fmt.Errorf("%s: unknown peer file type", filename)
+	}
+
+	if peer.Name.Value() == "" {
+		if err := peer.Name.UnmarshalText([]byte(name)); err != nil {
+			return nil, warnings, fmt.Errorf("%s: %w", filename, err)
+		}
+	}
+	if peer.Public.Value() == (wgapi.PublicKey{}) {
+		return nil, warnings, fmt.Errorf("%s: peer %q has no public key", filename, peer.Name.Value())
+	}
+	return &peer, warnings, nil
+}
+
+// parsePeerConf parses a wg-quick file with a single [Peer] section. Only the name directive is allowed.
+func parsePeerConf(filename string, body []byte) (*wgquickPeer, []caddyconfig.Warning, error) {
+	var p wgquickParser
+	var peer *wgquickPeer
+	s := bufio.NewScanner(bytes.NewReader(body))
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		switch {
+		case text == "":
+			continue
+		case strings.HasPrefix(text, "#"):
+			if fields := strings.Fields(strings.TrimPrefix(text, "#")); len(fields) > 1 && fields[0] == wgquickDirective && fields[1] != "name" {
+				return nil, p.warnings, fmt.Errorf("%s:%d: directive %q is not allowed in peer files", filename, line, fields[1])
+			} else if err := p.directive(filename, line, text, nil, peer); err != nil {
+				return nil, p.warnings, err
+			}
+			continue
+		case strings.EqualFold(text, "[peer]"):
+			if peer != nil {
+				return nil, p.warnings, fmt.Errorf("%s:%d: more than one [Peer]", filename, line)
+			}
+			peer = &wgquickPeer{line: line}
+			continue
+		case strings.HasPrefix(text, "["):
+			return nil, p.warnings, fmt.Errorf("%s:%d: unexpected section %s", filename, line, text)
+		}
+
+		key, value, ok := strings.Cut(text, "=")
+		if !ok {
+			return nil, p.warnings, fmt.Errorf("%s:%d: invalid line %q", filename, line, text)
+		} else if peer == nil {
+			return nil, p.warnings, fmt.Errorf("%s:%d: %s outside of [Peer]", filename, line, strings.TrimSpace(key))
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if err := p.set(filename, line, key, value, nil, peer); err != nil {
+			return nil, p.warnings, fmt.Errorf("%s:%d: %w", filename, line, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, p.warnings, err
+	} else if peer == nil {
+		return nil, p.warnings, errors.New(filename + ": no [Peer] section")
+	}
+
+	if peer.endpoint != "" {
+		p.warn(filename, peer.line, "Endpoint", "Endpoint of server peers is not supported and was ignored")
+	}
+	if peer.keepalive != "" {
+		p.warn(filename, peer.line, "PersistentKeepalive", "PersistentKeepalive of server peers is not supported and was ignored")
+	}
+	return peer, p.warnings, nil
+}
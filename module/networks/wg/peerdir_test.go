@@ -0,0 +1,136 @@
+package wg
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"github.com/trymoose/point-c/pkg/wg/wgapi"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestPublic(t *testing.T) string {
+	t.Helper()
+	_, public, err := wgapi.NewPrivatePublic()
+	require.NoError(t, err)
+	text, err := public.MarshalText()
+	require.NoError(t, err)
+	return string(text)
+}
+
+func TestParsePeerFile(t *testing.T) {
+	public := newTestPublic(t)
+	t.Run("conf", func(t *testing.T) {
+		peer, warnings, err := parsePeerFile("/peers/office.conf", []byte(fmt.Sprintf("[Peer]\nPublicKey = %s\nAllowedIPs = 10.0.1.5/32, 192.168.1.0/24\nEndpoint = 1.2.3.4:51820\n", public)))
+		require.NoError(t, err)
+		require.Len(t, warnings, 1)
+		require.Equal(t, "office", peer.Name.Value())
+		require.Equal(t, "10.0.1.5", peer.IP.Value().String())
+		require.Len(t, peer.Routes, 1)
+		require.Equal(t, "192.168.1.0/24", peer.Routes[0].Value().String())
+	})
+	t.Run("conf name", func(t *testing.T) {
+		peer, _, err := parsePeerFile("/peers/1.conf", []byte(fmt.Sprintf("[Peer]\n# point-c name laptop\nPublicKey = %s\n", public)))
+		require.NoError(t, err)
+		require.Equal(t, "laptop", peer.Name.Value())
+		require.Nil(t, peer.IP.Value())
+	})
+	t.Run("json", func(t *testing.T) {
+		peer, _, err := parsePeerFile("/peers/phone.json", []byte(fmt.Sprintf(`{"Public": %q, "IP": "10.0.0.9", "idle_timeout": "1h"}`, public)))
+		require.NoError(t, err)
+		require.Equal(t, "phone", peer.Name.Value())
+		require.Equal(t, "10.0.0.9", peer.IP.Value().String())
+		require.NotZero(t, peer.IdleTimeout)
+	})
+	for name, body := range map[string]string{
+		"a.conf":  "[Peer]\nAllowedIPs = 10.0.1.5/32\n",
+		"b.conf":  "PublicKey = " + public + "\n",
+		"c.conf":  "[Interface]\nPrivateKey = " + public + "\n",
+		"d.conf":  "[Peer]\nPublicKey = " + public + "\n[Peer]\nPublicKey = " + public + "\n",
+		"e.conf":  "[Peer]\n# point-c include *.conf\n",
+		"f.conf":  "[Peer]\nPublicKey = nope\n",
+		"g.json":  `{"Public": "nope"}`,
+		"h.json":  `{`,
+		"i.other": "",
+	} {
+		t.Run("invalid "+name, func(t *testing.T) {
+			_, _, err := parsePeerFile(filepath.Join("/peers", name), []byte(body))
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestServer_loadPeers(t *testing.T) {
+	srv, _ := newTestServer(t, "10.0.0.1")
+	srv.json.PeersDir = t.TempDir()
+	srv.peerFiles = map[string]*peerFile{}
+	write := func(name, body string) {
+		require.NoError(t, os.WriteFile(filepath.Join(srv.json.PeersDir, name), []byte(body), 0o600))
+	}
+	peerCount := func() (n int) {
+		ipc, err := srv.wg.GetConfig()
+		require.NoError(t, err)
+		for _, kv := range ipc {
+			if _, ok := kv.(wgapi.PublicKey); ok {
+				n++
+			}
+		}
+		return
+	}
+
+	// Static addresses are outside the subnet so they can not collide with assigned ones.
+	write("alice.conf", fmt.Sprintf("[Peer]\nPublicKey = %s\nAllowedIPs = 10.0.1.5/32\n", newTestPublic(t)))
+	write("bob.json", fmt.Sprintf(`{"Public": %q}`, newTestPublic(t)))
+	write("broken.conf", "[Peer]\nPublicKey = nope\n")
+	write("taken.json", fmt.Sprintf(`{"Public": %q, "IP": "10.0.1.5"}`, newTestPublic(t)))
+	write(".hidden.conf", fmt.Sprintf("[Peer]\nPublicKey = %s\n", newTestPublic(t)))
+	write("notes.txt", "not a peer")
+	srv.loadPeers(context.Background())
+
+	nets := srv.Networks()
+	require.Contains(t, nets, "alice")
+	require.Contains(t, nets, "bob")
+	require.NotContains(t, nets, "broken")
+	require.NotContains(t, nets, "taken")
+	require.Equal(t, "10.0.1.5", nets["alice"].LocalAddr().String())
+	require.Equal(t, 2, peerCount())
+
+	t.Run("unchanged", func(t *testing.T) {
+		before := nets["bob"]
+		srv.loadPeers(context.Background())
+		require.Same(t, before, srv.Networks()["bob"])
+	})
+
+	t.Run("changed", func(t *testing.T) {
+		write("alice.conf", fmt.Sprintf("[Peer]\nPublicKey = %s\nAllowedIPs = 10.0.1.6/32, 192.168.1.0/24\n", newTestPublic(t)))
+		srv.loadPeers(context.Background())
+		nets := srv.Networks()
+		require.Equal(t, "10.0.1.6", nets["alice"].LocalAddr().String())
+		require.True(t, srv.routed(net.ParseIP("192.168.1.1")))
+		require.Equal(t, 2, peerCount())
+	})
+
+	t.Run("broken keeps peer", func(t *testing.T) {
+		write("bob.json", `{"Public": "nope"}`)
+		srv.loadPeers(context.Background())
+		require.Contains(t, srv.Networks(), "bob")
+	})
+
+	t.Run("fixed", func(t *testing.T) {
+		write("broken.conf", fmt.Sprintf("[Peer]\nPublicKey = %s\n", newTestPublic(t)))
+		srv.loadPeers(context.Background())
+		require.Contains(t, srv.Networks(), "broken")
+		require.Equal(t, 3, peerCount())
+	})
+
+	t.Run("removed", func(t *testing.T) {
+		require.NoError(t, os.Remove(filepath.Join(srv.json.PeersDir, "alice.conf")))
+		srv.loadPeers(context.Background())
+		nets := srv.Networks()
+		require.NotContains(t, nets, "alice")
+		require.False(t, srv.routed(net.ParseIP("192.168.1.1")))
+		require.Equal(t, 2, peerCount())
+	})
+}
@@ -0,0 +1,260 @@
+package wg
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/trymoose/point-c/pkg/wg"
+	"github.com/trymoose/point-c/pkg/wg/wgapi"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+)
+
+var _ caddy.Destructor = (*sharedDevice)(nil)
+
+// devicePool holds the running devices, so a device stays up while a config reload replaces the modules using it.
+var devicePool = caddy.NewUsagePool()
+
+type (
+	// sharedDevice is a wireguard device shared by the modules of every config generation with the same private key and listen port.
+	sharedDevice struct {
+		wg  *wg.Wireguard
+		net *wg.Net
+
+		mu           sync.Mutex
+		states       []*deviceState     // states are the states of the modules that brought the device up, in order. The last one is applied.
+		local        net.IP             // local is the address of the device itself added by the applied state, nil if it has none.
+		rotation     string             // rotation is the address preshared key rotations are answered on, empty if they are not.
+		stopRotation context.CancelFunc // stopRotation stops answering preshared key rotations.
+		onRotation   atomic.Pointer[rotationCallbacks]
+		dns          *dnsServer // dns answers DNS queries, nil if they are not.
+	}
+	// deviceState is what the config of a module wants of a [sharedDevice]. It is only applied once the module is brought up,
+	// so a config that fails to load does not change the device the running config is using.
+	deviceState struct {
+		listen     []netip.AddrPort           // listen is the host addresses the device listens on, see [sharedDevice.listen].
+		cfg        wgapi.Configurable         // cfg is the configuration of the device, see [sharedDevice.reconcile].
+		keep       func(wgapi.PublicKey) bool // keep reports whether a peer that is not in cfg is kept. It may be nil.
+		rotating   bool                       // rotating keeps the rotated preshared keys of the peers.
+		local      net.IP                     // local is the address of the device itself, nil if it has none.
+		rotation   *net.TCPAddr               // rotation is the address preshared key rotations are answered on, nil if they are not.
+		onRotation rotationCallbacks
+		dns        *dnsZone // dns is answered on port 53 of local, nil if DNS queries are not answered.
+	}
+)
+
+// deviceKey is the key of a device in the pool. The private key is hashed so it is not kept in the pool.
+func deviceKey(private wgapi.PrivateKey, port uint16) string {
+	h := sha256.New()
+	h.Write(private[:])
+	_ = binary.Write(h, binary.BigEndian, port)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// loadDevice gets the device with the key, creating it if no config is using it.
+// Loaded reports whether the device was already running, in which case it has to be reconciled with the new config.
+func loadDevice(key string, create func(n **wg.Net) (*wg.Wireguard, error)) (dev *sharedDevice, loaded bool, err error) {
+	v, loaded, err := devicePool.LoadOrNew(key, func() (caddy.Destructor, error) {
+		d := &sharedDevice{}
+		var err error
+		if d.wg, err = create(&d.net); err != nil {
+			return nil, err
+		}
+		return d, nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return v.(*sharedDevice), loaded, nil
+}
+
+// up applies the state of a module and brings the device up for it. The device stays up until every module that brought it up brought it down,
+// so stopping the config replaced by a reload does not take down the device the new config is using.
+// If the state can not be applied, the state applied before it is applied again.
+func (d *sharedDevice) up(s *deviceState) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.apply(s); err != nil {
+		return errors.Join(err, d.restore())
+	}
+	if len(d.states) == 0 {
+		if err := d.wg.Up(); err != nil {
+			return err
+		}
+	}
+	d.states = append(d.states, s)
+	return nil
+}
+
+// down brings the device down for a module once no other module needs it.
+// If the state of the module is the one applied, the state of the module that brought the device up before it is applied again,
+// so a config that fails to start after bringing the device up gives the device back to the running config.
+func (d *sharedDevice) down(s *deviceState) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	i := slices.Index(d.states, s)
+	if i < 0 {
+		return nil
+	}
+	d.states = slices.Delete(d.states, i, i+1)
+	if len(d.states) == 0 {
+		return d.wg.Down()
+	} else if i == len(d.states) {
+		return d.restore()
+	}
+	return nil
+}
+
+// restore applies the last state again. It is called with d.mu held.
+func (d *sharedDevice) restore() error {
+	if len(d.states) == 0 {
+		return nil
+	}
+	return d.apply(d.states[len(d.states)-1])
+}
+
+// apply changes the device to the state. It is called with d.mu held.
+func (d *sharedDevice) apply(s *deviceState) error {
+	if err := d.listen(s.listen); err != nil {
+		return fmt.Errorf("failed to change listen addresses: %w", err)
+	} else if err := d.reconcile(s.cfg, s.keep, s.rotating); err != nil {
+		return fmt.Errorf("failed to update device: %w", err)
+	}
+	if d.local != nil && !d.local.Equal(s.local) {
+		d.net.RemoveLocal(d.local)
+	}
+	if d.local = s.local; d.local != nil {
+		d.net.AddLocal(d.local)
+	}
+	if err := d.serveRotation(s.rotation, s.onRotation.onError, s.onRotation.onRotate); err != nil {
+		return fmt.Errorf("failed to listen for preshared key rotations: %w", err)
+	} else if err := d.serveDNS(s.local, s.dns); err != nil {
+		return fmt.Errorf("failed to listen for dns queries: %w", err)
+	}
+	return nil
+}
+
+// listen changes the host addresses the device listens on. Peers reconnect if they changed.
+func (d *sharedDevice) listen(addrs []netip.AddrPort) error {
+	bind, ok := d.wg.Bind().(*wg.AddrBind)
+	if !ok {
+		if len(addrs) == 0 {
+			return nil
+		}
+		return errors.New("device was not started with listen addresses")
+	} else if slices.Equal(bind.Addrs(), addrs) {
+		return nil
+	}
+	bind.SetAddrs(addrs...)
+	return d.wg.UpdateBind()
+}
+
+// Destruct closes the device once no config uses it.
+func (d *sharedDevice) Destruct() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return errors.Join(d.serveRotation(nil, nil, nil), d.serveDNS(nil, nil), d.wg.Close())
+}
+
+// reconcile changes the running device to cfg with the smallest change possible, so peers that did not change stay connected.
+// Peers on the device that are not in cfg are removed unless keep reports true for them.
+// If rotating, preshared keys changed by rotation are kept instead of being reset to the configured ones.
+func (d *sharedDevice) reconcile(cfg wgapi.Configurable, keep func(wgapi.PublicKey) bool, rotating bool) error {
+	current, err := d.wg.GetConfig()
+	if err != nil {
+		return err
+	}
+	desired, err := wgapi.Validate(cfg)
+	if err != nil {
+		return err
+	}
+
+	preshared := map[wgapi.PublicKey]wgapi.PresharedKey{}
+	var peer wgapi.PublicKey
+	for _, kv := range desired {
+		switch kv := kv.(type) {
+		case wgapi.PublicKey:
+			peer = kv
+			preshared[peer] = wgapi.PresharedKey{}
+		case wgapi.PresharedKey:
+			preshared[peer] = kv
+		}
+	}
+
+	// The diff is taken from the device as it would be without the kept peers,
+	// and with the configured preshared keys of rotating peers, so neither is changed.
+	var old wgapi.IPC
+	var skip bool
+	for _, kv := range current {
+		switch v := kv.(type) {
+		case wgapi.PublicKey:
+			peer = v
+			_, configured := preshared[peer]
+			skip = !configured && keep != nil && keep(peer)
+		case wgapi.PresharedKey:
+			if psk, configured := preshared[peer]; rotating && configured {
+				kv = psk
+			}
+		}
+		if !skip {
+			old = append(old, kv)
+		}
+	}
+
+	ipc, err := wgapi.Diff(old, desired)
+	if err != nil || len(ipc) == 0 {
+		return err
+	}
+	return d.wg.SetConfig(ipc)
+}
+
+// rotationCallbacks are the callbacks of the config that last served rotations on a [sharedDevice].
+type rotationCallbacks struct {
+	onError  func(error)
+	onRotate func(peer wgapi.PublicKey, old, next wgapi.PresharedKey)
+}
+
+// serveRotation answers preshared key rotations on the address, replacing the address rotations were answered on before.
+// Rotations are stopped if addr is nil. The listener lives as long as the device, not the config that started it,
+// so the callbacks are replaced on every call and rotations are reported to the config using the device. It is called with d.mu held.
+func (d *sharedDevice) serveRotation(addr *net.TCPAddr, onError func(error), onRotate func(peer wgapi.PublicKey, old, next wgapi.PresharedKey)) error {
+	d.onRotation.Store(&rotationCallbacks{onError: onError, onRotate: onRotate})
+	var next string
+	if addr != nil {
+		next = addr.String()
+	}
+	if next == d.rotation {
+		return nil
+	}
+
+	if d.stopRotation != nil {
+		d.stopRotation()
+		d.rotation, d.stopRotation = "", nil
+	}
+	if addr == nil {
+		return nil
+	}
+	ln, err := d.net.Listen(addr)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d.rotation, d.stopRotation = next, cancel
+	go d.wg.ServePresharedRotation(ctx, ln, func(err error) {
+		if cb := d.onRotation.Load(); cb.onError != nil {
+			cb.onError(err)
+		}
+	}, func(peer wgapi.PublicKey, old, next wgapi.PresharedKey) {
+		if cb := d.onRotation.Load(); cb.onRotate != nil {
+			cb.onRotate(peer, old, next)
+		}
+	})
+	return nil
+}
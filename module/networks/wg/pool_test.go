@@ -0,0 +1,223 @@
+package wg
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"github.com/trymoose/point-c/pkg/wg"
+	"github.com/trymoose/point-c/pkg/wg/wgapi"
+	"github.com/trymoose/point-c/pkg/wg/wgapi/wgconfig"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func newTestDevice(t *testing.T, cfg wgapi.IPC) (*sharedDevice, string) {
+	t.Helper()
+	private, err := wgapi.NewPrivate()
+	require.NoError(t, err)
+	key := deviceKey(private, 0)
+	dev, loaded, err := loadDevice(key, func(n **wg.Net) (*wg.Wireguard, error) {
+		return wg.New(wg.OptionConfig(append(wgapi.IPC{private}, cfg...)), wg.OptionNetDevice(n))
+	})
+	require.NoError(t, err)
+	require.False(t, loaded)
+	t.Cleanup(func() { devicePool.Delete(key) })
+	return dev, key
+}
+
+func TestLoadDevice(t *testing.T) {
+	dev, key := newTestDevice(t, wgapi.IPC{})
+	again, loaded, err := loadDevice(key, func(**wg.Net) (*wg.Wireguard, error) {
+		t.Fatal("device created twice")
+		return nil, nil
+	})
+	require.NoError(t, err)
+	require.True(t, loaded)
+	require.Same(t, dev, again)
+
+	deleted, err := devicePool.Delete(key)
+	require.NoError(t, err)
+	require.False(t, deleted)
+	_, err = dev.wg.GetConfig()
+	require.NoError(t, err)
+}
+
+func TestSharedDevice_reconcile(t *testing.T) {
+	keys := make([]wgapi.PublicKey, 4)
+	for i := range keys {
+		var err error
+		_, keys[i], err = wgapi.NewPrivatePublic()
+		require.NoError(t, err)
+	}
+	psk1, err := wgapi.NewPreshared()
+	require.NoError(t, err)
+	psk2, err := wgapi.NewPreshared()
+	require.NoError(t, err)
+	allowed := func(s string) net.IPNet {
+		_, n, err := net.ParseCIDR(s)
+		require.NoError(t, err)
+		return *n
+	}
+
+	for _, rotating := range []bool{false, true} {
+		name := "configured keys"
+		if rotating {
+			name = "rotated keys"
+		}
+		t.Run(name, func(t *testing.T) {
+			dev, _ := newTestDevice(t, wgapi.IPC{
+				keys[0], psk1, wgapi.AllowedIP(allowed("10.0.0.2/32")),
+				keys[1], wgapi.AllowedIP(allowed("10.0.0.3/32")),
+				keys[2], wgapi.AllowedIP(allowed("10.0.0.4/32")),
+			})
+			var cfg wgconfig.Server
+			cfg.AddPeer(keys[0], psk2, net.ParseIP("10.0.0.2"))
+			cfg.AddPeer(keys[3], wgapi.PresharedKey{}, net.ParseIP("10.0.0.5"))
+			require.NoError(t, dev.reconcile(&cfg, func(k wgapi.PublicKey) bool { return k == keys[2] }, rotating))
+
+			ipc, err := dev.wg.GetConfig()
+			require.NoError(t, err)
+			require.Contains(t, ipc, keys[0])
+			require.NotContains(t, ipc, keys[1])
+			require.Contains(t, ipc, keys[2])
+			require.Contains(t, ipc, keys[3])
+			if rotating {
+				require.Contains(t, ipc, psk1)
+			} else {
+				require.Contains(t, ipc, psk2)
+			}
+		})
+	}
+}
+
+func TestRegister(t *testing.T) {
+	dev, _ := newTestDevice(t, wgapi.IPC{})
+	unregisterOld := register(dev.wg, "old", "wireguard-server")
+	unregisterNew := register(dev.wg, "new", "wireguard-server")
+	unregisterOld()
+	devices.Lock()
+	require.Equal(t, "new", devices.m[dev.wg].name)
+	devices.Unlock()
+	unregisterNew()
+	devices.Lock()
+	require.NotContains(t, devices.m, dev.wg)
+	devices.Unlock()
+}
+
+func TestSharedDevice_listen(t *testing.T) {
+	private, err := wgapi.NewPrivate()
+	require.NoError(t, err)
+	key := deviceKey(private, 0)
+	bind := wg.NewAddrBind(netip.MustParseAddrPort("127.0.0.1:0"))
+	dev, _, err := loadDevice(key, func(n **wg.Net) (*wg.Wireguard, error) {
+		return wg.New(wg.OptionConfig(wgapi.IPC{private}), wg.OptionNetDevice(n), wg.OptionBind(bind))
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { devicePool.Delete(key) })
+
+	addrs := []netip.AddrPort{netip.MustParseAddrPort("127.0.0.2:0")}
+	require.NoError(t, dev.listen(addrs))
+	require.Equal(t, addrs, bind.Addrs())
+
+	other, _ := newTestDevice(t, wgapi.IPC{})
+	require.NoError(t, other.listen(nil))
+	require.Error(t, other.listen(addrs))
+}
+
+func TestSharedDevice_up(t *testing.T) {
+	private, err := wgapi.NewPrivate()
+	require.NoError(t, err)
+	free, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	addr := free.LocalAddr().(*net.UDPAddr).AddrPort()
+	require.NoError(t, free.Close())
+
+	key := deviceKey(private, addr.Port())
+	dev, _, err := loadDevice(key, func(n **wg.Net) (*wg.Wireguard, error) {
+		return wg.New(wg.OptionConfig(wgapi.IPC{private}), wg.OptionNetDevice(n), wg.OptionBind(wg.NewAddrBind(addr)), wg.OptionDown())
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { devicePool.Delete(key) })
+
+	// bound reports whether the device is listening on the address.
+	bound := func() bool {
+		t.Helper()
+		c, err := net.ListenUDP("udp4", net.UDPAddrFromAddrPort(addr))
+		if err != nil {
+			return true
+		}
+		require.NoError(t, c.Close())
+		return false
+	}
+
+	// peers gets the peers of the device.
+	peers := func() []wgapi.PublicKey {
+		t.Helper()
+		ipc, err := dev.wg.GetConfig()
+		require.NoError(t, err)
+		var peers []wgapi.PublicKey
+		for _, kv := range ipc {
+			if k, ok := kv.(wgapi.PublicKey); ok {
+				peers = append(peers, k)
+			}
+		}
+		return peers
+	}
+	state := func(ip string) (*deviceState, wgapi.PublicKey) {
+		t.Helper()
+		_, peer, err := wgapi.NewPrivatePublic()
+		require.NoError(t, err)
+		cfg := wgapi.IPC{private, peer, wgapi.IdentitySubnet(net.ParseIP(ip))}
+		return &deviceState{listen: []netip.AddrPort{addr}, cfg: cfg, local: net.ParseIP(ip)}, peer
+	}
+	running, runningPeer := state("10.0.0.1")
+	reloaded, reloadedPeer := state("10.0.0.2")
+
+	require.False(t, bound(), "device listens before it is up")
+	require.NoError(t, dev.up(running))
+	require.Equal(t, []wgapi.PublicKey{runningPeer}, peers())
+	require.NoError(t, dev.up(reloaded))
+	require.True(t, bound(), "device does not listen once up")
+	require.Equal(t, []wgapi.PublicKey{reloadedPeer}, peers())
+
+	// A config that fails to start after being brought up gives the device back to the running config.
+	require.NoError(t, dev.down(reloaded))
+	require.True(t, bound(), "device brought down while still used")
+	require.Equal(t, []wgapi.PublicKey{runningPeer}, peers())
+	require.True(t, dev.local.Equal(net.ParseIP("10.0.0.1")))
+
+	// The replaced config is brought down once the new config is up, the device keeps the new config.
+	require.NoError(t, dev.up(reloaded))
+	require.NoError(t, dev.down(running))
+	require.Equal(t, []wgapi.PublicKey{reloadedPeer}, peers())
+	require.NoError(t, dev.down(reloaded))
+	require.False(t, bound(), "device listens once no longer used")
+	require.NoError(t, dev.down(reloaded))
+}
+
+func TestSharedDevice_serveRotation(t *testing.T) {
+	dev, _ := newTestDevice(t, wgapi.IPC{})
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}
+	dev.net.AddLocal(addr.IP)
+
+	first, second := make(chan error, 1), make(chan error, 1)
+	require.NoError(t, dev.serveRotation(addr, func(err error) { first <- err }, nil))
+	// A reload serving on the same address keeps the listener but gets the errors.
+	require.NoError(t, dev.serveRotation(addr, func(err error) { second <- err }, nil))
+	defer dev.serveRotation(nil, nil, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	c, err := dev.net.Dialer(addr.IP, 0).DialTCP(ctx, addr)
+	require.NoError(t, err)
+	defer c.Close()
+	select {
+	case err := <-second:
+		require.ErrorContains(t, err, "no peer")
+	case <-first:
+		t.Fatal("error reported to the replaced config")
+	case <-ctx.Done():
+		t.Fatal("no error reported")
+	}
+}
@@ -0,0 +1,112 @@
+package wg
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/trymoose/point-c/pkg/wg/wgapi"
+	"io/fs"
+	"log/slog"
+	"path"
+)
+
+type (
+	// presharedStorage keeps rotated preshared keys. [certmagic.Storage] is a presharedStorage.
+	presharedStorage interface {
+		Load(ctx context.Context, key string) ([]byte, error)
+		Store(ctx context.Context, key string, value []byte) error
+	}
+	// presharedKeys keeps the rotated preshared keys of the peers of a device, so a restart of either side does not lose the key the other has.
+	// The records are sealed with the private key of the device, see [storageSealer].
+	presharedKeys struct {
+		storage presharedStorage
+		sealer  storageSealer
+		prefix  string // prefix is the storage key prefix of the device's peers.
+		logger  *slog.Logger
+	}
+	// presharedRecord is the rotated preshared key of a peer.
+	presharedRecord struct {
+		// Configured is the hash of the configured key the rotations started from. The record is ignored once a different key is configured.
+		Configured string              `json:"configured"`
+		Current    wgapi.PresharedKey  `json:"current"`
+		Fallback   *wgapi.PresharedKey `json:"fallback,omitempty"` // Fallback is the other key the responder may have, only kept by the initiator.
+	}
+)
+
+// newPresharedKeys keeps the rotated keys of the peers of the named network, sealed with the private key of its device.
+func newPresharedKeys(storage presharedStorage, name string, private wgapi.PrivateKey, logger *slog.Logger) *presharedKeys {
+	return &presharedKeys{storage: storage, sealer: newStorageSealer(private, "preshared"), prefix: path.Join("point-c", "preshared", name), logger: logger}
+}
+
+// load gets the current and fallback key of the peer.
+// The configured key is current if the peer was never rotated, or the rotations started from another configured key.
+func (p *presharedKeys) load(ctx context.Context, peer wgapi.PublicKey, configured wgapi.PresharedKey) (wgapi.PresharedKey, *wgapi.PresharedKey) {
+	r := p.record(ctx, peer)
+	if r == nil || r.Configured != hashPreshared(configured) {
+		return configured, nil
+	}
+	return r.Current, r.Fallback
+}
+
+// initiated stores the keys of a peer after a rotation started by the device.
+func (p *presharedKeys) initiated(ctx context.Context, peer wgapi.PublicKey, configured, current wgapi.PresharedKey, fallback *wgapi.PresharedKey) {
+	p.store(ctx, peer, &presharedRecord{Configured: hashPreshared(configured), Current: current, Fallback: fallback})
+}
+
+// responded stores the key of a peer after a rotation started by the peer.
+// The configured key is carried over from the record of the old key, or is the old key if there is none.
+func (p *presharedKeys) responded(ctx context.Context, peer wgapi.PublicKey, old, next wgapi.PresharedKey) {
+	configured := hashPreshared(old)
+	if r := p.record(ctx, peer); r != nil && r.Current == old {
+		configured = r.Configured
+	}
+	p.store(ctx, peer, &presharedRecord{Configured: configured, Current: next})
+}
+
+// key is the storage key of the record of a peer.
+func (p *presharedKeys) key(peer wgapi.PublicKey) string {
+	return path.Join(p.prefix, hex.EncodeToString(peer[:]))
+}
+
+// record loads the record of a peer, or nil if there is none.
+func (p *presharedKeys) record(ctx context.Context, peer wgapi.PublicKey) *presharedRecord {
+	b, err := p.storage.Load(ctx, p.key(peer))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			p.logger.Warn("failed to load rotated preshared key", "peer", peer, "error", err)
+		}
+		return nil
+	}
+	if b, err = p.sealer.open(p.key(peer), b); err != nil {
+		p.logger.Warn("failed to open rotated preshared key, it was stored with another private key", "peer", peer, "error", err)
+		return nil
+	}
+	var r presharedRecord
+	if err := json.Unmarshal(b, &r); err != nil {
+		p.logger.Warn("invalid rotated preshared key", "peer", peer, "error", err)
+		return nil
+	}
+	return &r
+}
+
+// store saves the record of a peer.
+func (p *presharedKeys) store(ctx context.Context, peer wgapi.PublicKey, r *presharedRecord) {
+	b, err := json.Marshal(r)
+	if err == nil {
+		b, err = p.sealer.seal(p.key(peer), b)
+	}
+	if err == nil {
+		err = p.storage.Store(ctx, p.key(peer), b)
+	}
+	if err != nil {
+		p.logger.Warn("failed to store rotated preshared key", "peer", peer, "error", err)
+	}
+}
+
+// hashPreshared hashes a configured key, so it can be recognized without being stored.
+func hashPreshared(key wgapi.PresharedKey) string {
+	sum := sha256.Sum256(key[:])
+	return hex.EncodeToString(sum[:])
+}
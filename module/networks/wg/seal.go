@@ -0,0 +1,49 @@
+package wg
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"github.com/trymoose/point-c/pkg/wg/wgapi"
+)
+
+// storageSealer encrypts records holding keys before they are kept in Caddy's storage.
+// Storage may be shared between instances and backed by anything from files to a database, so keys in it are never kept in the clear.
+// The encryption key is derived from the private key of the device, so anyone able to read the records must also have the device's private key.
+// Records can only be read back with the same private key, replacing it loses them.
+type storageSealer struct {
+	aead cipher.AEAD
+}
+
+// errSealedRecord is returned for records that are too short to be sealed.
+var errSealedRecord = errors.New("record is not sealed")
+
+// newStorageSealer derives the key of the records of the given purpose from the private key of the device.
+func newStorageSealer(private wgapi.PrivateKey, purpose string) storageSealer {
+	mac := hmac.New(sha256.New, private[:])
+	mac.Write([]byte("point-c storage " + purpose))
+	// A 32 byte key always makes a valid AES-256 block, which always supports GCM.
+	block, _ := aes.NewCipher(mac.Sum(nil))
+	aead, _ := cipher.NewGCM(block)
+	return storageSealer{aead: aead}
+}
+
+// seal encrypts the record stored under key. The record can not be moved to another key.
+func (s storageSealer) seal(key string, record []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nonce, nonce, record, []byte(key)), nil
+}
+
+// open decrypts the record stored under key.
+func (s storageSealer) open(key string, sealed []byte) ([]byte, error) {
+	if len(sealed) < s.aead.NonceSize() {
+		return nil, errSealedRecord
+	}
+	return s.aead.Open(nil, sealed[:s.aead.NonceSize()], sealed[s.aead.NonceSize():], []byte(key))
+}
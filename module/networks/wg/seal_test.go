@@ -0,0 +1,33 @@
+package wg
+
+import (
+	"github.com/stretchr/testify/require"
+	"github.com/trymoose/point-c/pkg/wg/wgapi"
+	"testing"
+)
+
+func TestStorageSealer(t *testing.T) {
+	private, err := wgapi.NewPrivate()
+	require.NoError(t, err)
+	other, err := wgapi.NewPrivate()
+	require.NoError(t, err)
+
+	s := newStorageSealer(private, "test")
+	sealed, err := s.seal("point-c/test/a", []byte("secret"))
+	require.NoError(t, err)
+	require.NotContains(t, string(sealed), "secret")
+
+	b, err := s.open("point-c/test/a", sealed)
+	require.NoError(t, err)
+	require.Equal(t, "secret", string(b))
+
+	// The record can only be opened under its own key, with the same private key and purpose.
+	_, err = s.open("point-c/test/b", sealed)
+	require.Error(t, err)
+	_, err = newStorageSealer(other, "test").open("point-c/test/a", sealed)
+	require.Error(t, err)
+	_, err = newStorageSealer(private, "other").open("point-c/test/a", sealed)
+	require.Error(t, err)
+	_, err = s.open("point-c/test/a", []byte("short"))
+	require.ErrorIs(t, err, errSealedRecord)
+}
@@ -3,17 +3,24 @@ package wg
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/caddyserver/caddy/v2"
 	pointc "github.com/trymoose/point-c"
 	"github.com/trymoose/point-c/pkg/configvalues"
 	"github.com/trymoose/point-c/pkg/wg"
+	"github.com/trymoose/point-c/pkg/wg/wgapi"
 	"github.com/trymoose/point-c/pkg/wg/wgapi/wgconfig"
 	"github.com/trymoose/point-c/pkg/wg/wglog/wgevents"
 	"go.mrchanchal.com/zaphandler"
 	"log/slog"
 	"maps"
 	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 )
 
 var (
@@ -21,6 +28,7 @@ var (
 	_ caddy.Provisioner  = (*Server)(nil)
 	_ caddy.CleanerUpper = (*Server)(nil)
 	_ pointc.Network     = (*Server)(nil)
+	_ pointc.Lifecycle   = (*Server)(nil)
 	_ json.Marshaler     = (*Server)(nil)
 	_ json.Unmarshaler   = (*Server)(nil)
 )
@@ -31,11 +39,27 @@ func init() {
 
 func (*Server) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
-		ID:  "proxy.net.wireguard-server",
+		ID:  "point-c.net.wireguard-server",
 		New: func() caddy.Module { return new(Server) },
 	}
 }
 
+// serverPeer is a peer of a [Server].
+type serverPeer struct {
+	Name         configvalues.Hostname
+	Public       PublicKey
+	PresharedKey PresharedKey
+	IP           configvalues.IP
+	// Routes are subnets behind the peer, such as the LAN of an office gateway. Dialing an address in them goes through the peer.
+	Routes []configvalues.CIDR `json:"routes,omitempty"`
+	// ExpiresAt is when the peer is removed.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// IdleTimeout removes the peer once it has gone this long without a handshake. The timeout is not restarted by a reload.
+	// Removal for being idle is permanent: the peer can not handshake to come back, and stays removed across reloads and restarts
+	// until its record under point-c/expire/<server name> in storage is deleted, the key is logged when it is removed.
+	IdleTimeout caddy.Duration `json:"idle_timeout,omitempty"`
+}
+
 // Server is a basic wireguard server.
 type Server struct {
 	json struct {
@@ -43,66 +67,434 @@ type Server struct {
 		IP         configvalues.IP
 		ListenPort configvalues.Port
 		Private    PrivateKey
-		Peers      []struct {
-			Name         configvalues.Hostname
-			Public       PublicKey
-			PresharedKey PresharedKey
-			IP           configvalues.IP
-		}
+		// Listen are the host addresses to listen on, such as 203.0.113.5:51820 or [2001:db8::1]. Addresses without a port use ListenPort.
+		// Every address is listened on if empty.
+		Listen []string `json:"listen,omitempty"`
+		// Subnet is the subnet addresses are assigned from for peers without an IP.
+		Subnet *configvalues.CIDR `json:"subnet,omitempty"`
+		Peers  []serverPeer
+		// PresharedRotationPort is the port on the server's IP that peers rotate their preshared keys through. Rotation is disabled if not set.
+		// Rotated keys are kept in Caddy's storage under point-c/preshared, encrypted with a key derived from Private. Enrolled peers are kept the same way.
+		PresharedRotationPort *configvalues.Port `json:"preshared_rotation_port,omitempty"`
+		// PeersDir is a directory of more peers, one per file. Files are either a wg-quick [Peer] section ending in .conf, or a peer as JSON ending in .json.
+		// The directory is watched while the server runs, peers are added and removed as their files are.
+		PeersDir string `json:"peers_dir,omitempty"`
+		// PeersDirInterval is how often the peers directory is checked for changes. Defaults to 5s.
+		PeersDirInterval caddy.Duration `json:"peers_dir_interval,omitempty"`
+		// DNS answers A, AAAA, and PTR queries for the names of the server and its peers on port 53 of the server's IP. Disabled if not set.
+		DNS *serverDNS `json:"dns,omitempty"`
 	}
-	net    *wg.Net
-	logger *slog.Logger
-	wg     *wg.Wireguard
-	nets   map[string]pointc.Net
+	net        *wg.Net
+	logger     *slog.Logger
+	wg         *wg.Wireguard
+	key        string // key is the key of the device in the pool.
+	dev        *sharedDevice
+	state      *deviceState       // state is applied to the device once the server is brought up.
+	up         bool               // up reports whether the module brought the device up.
+	ctx        context.Context    // ctx is done once the config is unloaded.
+	stop       context.CancelFunc // stop stops the goroutines started by [Server.Up].
+	expiring   []*expiry          // expiring are the peers with an idle timeout or expiry, watched once the server is up.
+	unregister func()             // unregister removes the device from the admin status.
+	nets       map[string]pointc.Net
+	ipam       *ipam
+	routes     map[string][]net.IPNet // routes are the allowed ips of each peer by name.
+	mu         sync.Mutex             // mu guards nets, ipam, and routes once the server is running.
+	peerFiles  map[string]*peerFile   // peerFiles are the files of the peers directory by name, only used by the goroutine watching it.
+	expiries   expiryStorage          // expiries remembers the expiry of peers with an idle timeout, nil if none can have one.
+	preshared  *presharedKeys         // preshared keeps the rotated preshared keys of peers, nil if rotation is disabled.
 }
 
 func (c *Server) UnmarshalJSON(bytes []byte) error { return json.Unmarshal(bytes, &c.json) }
 func (c *Server) MarshalJSON() ([]byte, error)     { return json.Marshal(c.json) }
 
-func (c *Server) Networks() map[string]pointc.Net { return maps.Clone(c.nets) }
+func (c *Server) Networks() map[string]pointc.Net {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return maps.Clone(c.nets)
+}
 
-func (c *Server) Cleanup() error { return c.wg.Close() }
+// addPeer assigns an address to a new peer and adds it to the running device.
+func (c *Server) addPeer(ctx context.Context, name string, public wgapi.PublicKey, preshared wgapi.PresharedKey) (net.IP, error) {
+	return c.insertPeer(ctx, name, &wgconfig.Peer{Public: public, PreShared: preshared}, nil)
+}
+
+// insertPeer adds a peer to the running device. The peer's address is ip, or one assigned from the subnet if ip is nil.
+// The allowed ips of the peer are its routes, the address is added in front of them.
+func (c *Server) insertPeer(ctx context.Context, name string, peer *wgconfig.Peer, ip net.IP) (net.IP, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if nameTaken(c.nets, name) {
+		return nil, fmt.Errorf("hostname %q already declared in config", name)
+	}
+	for other, n := range c.nets {
+		if n, ok := n.(*serverNet); ok && n.peer != nil && *n.peer == peer.Public {
+			return nil, fmt.Errorf("public key of %q is already used by %q", name, other)
+		}
+	}
+	if err := c.checkRoutes(name, peer.AllowedIPs); err != nil {
+		return nil, err
+	}
+	peer.PreShared = c.presharedKey(ctx, peer.Public, peer.PreShared)
+
+	if ip == nil {
+		var err error
+		if ip, err = c.ipam.allocate(ctx, peer.Public, name); err != nil {
+			return nil, err
+		}
+	} else if err := c.ipam.reserve(ip, name); err != nil {
+		return nil, err
+	}
+	peer.AllowedIPs = append([]net.IPNet{net.IPNet(wgapi.IdentitySubnet(ip))}, peer.AllowedIPs...)
+	for other, routes := range c.routes {
+		for _, a := range peer.AllowedIPs {
+			for _, b := range routes {
+				if a.Contains(b.IP) || b.Contains(a.IP) {
+					c.ipam.release(ip)
+					return nil, fmt.Errorf("allowed ip %s of %q overlaps %s of %q", &a, name, &b, other)
+				}
+			}
+		}
+	}
+
+	if err := c.wg.SetConfig(peer); err != nil {
+		c.ipam.release(ip)
+		return nil, err
+	}
+	public := peer.Public
+	c.nets[name] = &serverNet{srv: c, ip: ip, peer: &public}
+	c.routes[name] = peer.AllowedIPs
+	c.logger.Info("added peer", "peer", name, "ip", ip)
+	return ip, nil
+}
+
+// nameTaken reports whether one of the nets has the name. Names are compared ignoring case, since DNS answers them ignoring case.
+func nameTaken(nets map[string]pointc.Net, name string) bool {
+	for n := range nets {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// removePeer removes a peer from the running device and frees its address.
+// Nothing is done if the peer was already removed, or the name now belongs to another peer.
+func (c *Server) removePeer(name string, public wgapi.PublicKey) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, ok := c.nets[name].(*serverNet)
+	if !ok || n.peer == nil || *n.peer != public {
+		return nil
+	}
+	if err := c.wg.SetConfig(wgapi.IPC{public, wgapi.Remove{}}); err != nil {
+		return err
+	}
+	c.ipam.release(n.ip)
+	delete(c.nets, name)
+	delete(c.routes, name)
+	return nil
+}
+
+// Up brings the device up, listening for peers.
+func (c *Server) Up() error {
+	if c.up {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(c.ctx)
+	// Peers from the directory are added before the config is applied, so a running device keeps them instead of removing and adding them again.
+	if c.json.PeersDir != "" {
+		c.openPeersDir(ctx)
+	}
+	if err := c.dev.up(c.state); err != nil {
+		cancel()
+		return err
+	}
+	if len(c.expiring) > 0 {
+		go c.expire(ctx, c.expiring)
+	}
+	c.up, c.stop = true, cancel
+	return nil
+}
+
+// Down brings the device down, unless a newer config is using it.
+// If no newer config was brought up, the device is changed back to the config that was running before.
+func (c *Server) Down() error {
+	if !c.up {
+		return nil
+	}
+	c.up = false
+	c.stop()
+	return c.dev.down(c.state)
+}
+
+func (c *Server) Cleanup() error {
+	if c.unregister != nil {
+		c.unregister()
+	}
+	if c.key == "" {
+		return nil
+	}
+	err := c.Down()
+	_, derr := devicePool.Delete(c.key)
+	return errors.Join(err, derr)
+}
 
 func (c *Server) Provision(ctx caddy.Context) (err error) {
 	*c = Server{
 		json:   c.json,
 		logger: slog.New(zaphandler.New(ctx.Logger())),
+		ctx:    ctx,
 		nets:   map[string]pointc.Net{},
+		routes: map[string][]net.IPNet{},
 	}
 	c.nets[c.json.Name.Value()] = &serverNet{srv: c, ip: c.json.IP.Value()}
 
+	var enrolled []*enrolledPeer
+	if c.json.Subnet != nil {
+		if enrolled, err = loadEnrolled(ctx, ctx.Storage(), c.json.Name.Value(), c.json.Private.Value()); err != nil {
+			return fmt.Errorf("failed to load enrolled peers: %w", err)
+		}
+	}
+	if c.json.PresharedRotationPort != nil {
+		c.preshared = newPresharedKeys(ctx.Storage(), c.json.Name.Value(), c.json.Private.Value(), c.logger)
+	}
+	if c.json.PeersDir != "" || slices.ContainsFunc(c.json.Peers, func(p serverPeer) bool { return p.IdleTimeout > 0 }) {
+		c.expiries = ctx.Storage()
+	}
+	now := time.Now()
+	expired := make([]string, len(c.json.Peers))
+	for i := range c.json.Peers {
+		expired[i] = c.expired(ctx, &c.json.Peers[i], now)
+	}
+	ips, err := c.assign(ctx, expired, enrolled)
+	if err != nil {
+		return err
+	}
+
 	cfg := wgconfig.Server{
 		Private:    c.json.Private.Value(),
 		ListenPort: c.json.ListenPort.Value(),
 	}
-	for _, peer := range c.json.Peers {
-		cfg.AddPeer(peer.Public.Value(), peer.PresharedKey.Value(), peer.IP.Value())
+	for i, peer := range c.json.Peers {
+		if expired[i] != "" {
+			c.logExpired(peer.Name.Value(), peer.Public.Value(), expired[i])
+			continue
+		}
+		routes := subnets(peer.Routes)
+		if err := c.checkRoutes(peer.Name.Value(), routes); err != nil {
+			return err
+		}
+		cfg.AddPeer(peer.Public.Value(), c.presharedKey(ctx, peer.Public.Value(), peer.PresharedKey.Value()), ips[i], routes...)
 		if _, ok := c.nets[peer.Name.Value()]; ok {
 			return fmt.Errorf("hostname %q already declared in config", peer.Name.Value())
 		}
-		c.nets[c.json.Name.Value()] = &serverNet{srv: c, ip: peer.IP.Value()}
+		public := peer.Public.Value()
+		c.nets[peer.Name.Value()] = &serverNet{srv: c, ip: ips[i], peer: &public}
+		c.routes[peer.Name.Value()] = cfg.Peers[len(cfg.Peers)-1].AllowedIPs
+		if e := c.expiry(ctx, &peer, ips[i], now); e != nil {
+			c.expiring = append(c.expiring, e)
+		}
+	}
+	for _, peer := range enrolled {
+		if peer != nil {
+			cfg.AddPeer(peer.Public, c.presharedKey(ctx, peer.Public, peer.Preshared), peer.IP)
+			public := peer.Public
+			c.nets[peer.Name] = &serverNet{srv: c, ip: peer.IP, peer: &public}
+			c.routes[peer.Name] = cfg.Peers[len(cfg.Peers)-1].AllowedIPs
+		}
+	}
+
+	if err := cfg.CheckAllowedIPs(); err != nil {
+		return err
+	}
+
+	listen, err := listenAddrs(c.json.Listen)
+	if err != nil {
+		return err
+	}
+	key := deviceKey(cfg.Private, cfg.ListenPort)
+	dev, _, err := loadDevice(key, func(n **wg.Net) (*wg.Wireguard, error) {
+		return wg.New(
+			wg.OptionConfig(&cfg),
+			wg.OptionLogger(wgevents.Events(func(e wgevents.Event) { e.Slog(c.logger) })),
+			wg.OptionNetDevice(n),
+			wg.OptionDown(),
+			wg.OptionBind(wg.NewAddrBind(listen...)),
+		)
+	})
+	if err != nil {
+		return err
+	}
+	c.key, c.dev, c.wg, c.net = key, dev, dev.wg, dev.net
+	c.unregister = register(c.wg, c.json.Name.Value(), "wireguard-server")
+	if c.json.PeersDir != "" {
+		if err := c.checkPeersDir(); err != nil {
+			return err
+		}
+	}
+
+	// A running device is only changed once the server is brought up, see [deviceState].
+	c.state = &deviceState{
+		listen:   listen,
+		cfg:      &cfg,
+		keep:     c.known,
+		rotating: c.json.PresharedRotationPort != nil,
+		local:    c.json.IP.Value(),
+		onRotation: rotationCallbacks{
+			onError: func(err error) { c.logger.Warn("failed to rotate preshared key", "error", err) },
+			onRotate: func(peer wgapi.PublicKey, old, next wgapi.PresharedKey) {
+				c.preshared.responded(context.Background(), peer, old, next)
+			},
+		},
+	}
+	if c.json.PresharedRotationPort != nil {
+		c.state.rotation = &net.TCPAddr{IP: c.json.IP.Value(), Port: int(c.json.PresharedRotationPort.Value())}
 	}
 
-	c.wg, err = wg.New(
-		wg.OptionConfig(&cfg),
-		wg.OptionLogger(wgevents.Events(func(e wgevents.Event) { e.Slog(c.logger) })),
-		wg.OptionNetDevice(&c.net),
-	)
-	return
+	if c.json.DNS != nil {
+		c.state.dns = newDNSZone(c.json.DNS.Zone, c.Networks, c.logger)
+	}
+	return nil
+}
+
+// presharedKey gets the key a peer is added with, its rotated key if it has one.
+func (c *Server) presharedKey(ctx context.Context, peer wgapi.PublicKey, configured wgapi.PresharedKey) wgapi.PresharedKey {
+	if c.preshared == nil {
+		return configured
+	}
+	current, _ := c.preshared.load(ctx, peer, configured)
+	return current
+}
+
+// listenAddrs parses the addresses to listen on.
+func listenAddrs(addrs []string) ([]netip.AddrPort, error) {
+	listen := make([]netip.AddrPort, len(addrs))
+	for i, addr := range addrs {
+		if ap, err := netip.ParseAddrPort(addr); err == nil {
+			listen[i] = ap
+		} else if a, err := netip.ParseAddr(strings.Trim(addr, "[]")); err == nil {
+			listen[i] = netip.AddrPortFrom(a, 0)
+		} else {
+			return nil, fmt.Errorf("invalid listen address %q", addr)
+		}
+	}
+	return listen, nil
+}
+
+// known reports whether the peer belongs to the server.
+func (c *Server) known(public wgapi.PublicKey) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, n := range c.nets {
+		if n, ok := n.(*serverNet); ok && n.peer != nil && *n.peer == public {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRoutes checks the routes of a peer do not contain the server's address or overlap the subnet addresses are assigned from.
+func (c *Server) checkRoutes(name string, routes []net.IPNet) error {
+	for _, route := range routes {
+		if ip := c.json.IP.Value(); ip != nil && route.Contains(ip) {
+			return fmt.Errorf("route %s of %q contains the server address %s", &route, name, ip)
+		}
+		if c.ipam.subnet.IsValid() {
+			subnet := net.IPNet{IP: c.ipam.subnet.Addr().AsSlice(), Mask: net.CIDRMask(c.ipam.subnet.Bits(), c.ipam.subnet.Addr().BitLen())}
+			if route.Contains(subnet.IP) || subnet.Contains(route.IP) {
+				return fmt.Errorf("route %s of %q overlaps the subnet %s", &route, name, &subnet)
+			}
+		}
+	}
+	return nil
+}
+
+// routed reports whether traffic to the address is routed to a peer.
+func (c *Server) routed(ip net.IP) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, routes := range c.routes {
+		if slices.ContainsFunc(routes, func(n net.IPNet) bool { return n.Contains(ip) }) {
+			return true
+		}
+	}
+	return false
+}
+
+// assign gets the address of every peer. Peers without an IP are assigned one from the subnet.
+// The server and peers can not share an address. Peers with a reason they expired are not given an address, so they do not hold one.
+// Enrolled peers keep the address they were enrolled with, an enrolled peer that clashes with the server or a configured peer is set to nil and not added.
+// Names clash ignoring case, since DNS answers them ignoring case.
+func (c *Server) assign(ctx caddy.Context, expired []string, enrolled []*enrolledPeer) ([]net.IP, error) {
+	var subnet *net.IPNet
+	var storage ipamStorage
+	if c.json.Subnet != nil {
+		subnet = c.json.Subnet.Value()
+		storage = ctx.Storage()
+	}
+	a, err := newIPAM(subnet, storage, c.json.Name.Value())
+	if err != nil {
+		return nil, err
+	}
+	c.ipam = a
+
+	if ip := c.json.IP.Value(); ip != nil {
+		if err := a.reserve(ip, c.json.Name.Value()); err != nil {
+			return nil, err
+		}
+	}
+	ips := make([]net.IP, len(c.json.Peers))
+	for i, peer := range c.json.Peers {
+		if expired[i] != "" {
+			continue
+		} else if ips[i] = peer.IP.Value(); ips[i] != nil {
+			if err := a.reserve(ips[i], peer.Name.Value()); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for i, peer := range enrolled {
+		if strings.EqualFold(peer.Name, c.json.Name.Value()) {
+			c.logger.Warn("enrolled peer has the name of the server and was not added", "peer", peer.Name)
+			enrolled[i] = nil
+		} else if slices.ContainsFunc(c.json.Peers, func(p serverPeer) bool {
+			return strings.EqualFold(p.Name.Value(), peer.Name) || p.Public.Value() == peer.Public
+		}) {
+			c.logger.Warn("enrolled peer has the name or key of a configured peer and was not added", "peer", peer.Name)
+			enrolled[i] = nil
+		} else if err := a.reserve(peer.IP, peer.Name); err != nil {
+			c.logger.Warn("enrolled peer was not added", "peer", peer.Name, "error", err)
+			enrolled[i] = nil
+		}
+	}
+	for i, peer := range c.json.Peers {
+		if ips[i] == nil && expired[i] == "" {
+			if ips[i], err = a.allocate(ctx, peer.Public.Value(), peer.Name.Value()); err != nil {
+				return nil, err
+			}
+			c.logger.Info("assigned address", "peer", peer.Name.Value(), "ip", ips[i])
+		}
+	}
+	return ips, nil
 }
 
 var (
-	_ pointc.Net    = (*serverNet)(nil)
-	_ pointc.Dialer = (*serverDialer)(nil)
+	_ pointc.Net        = (*serverNet)(nil)
+	_ pointc.Ready      = (*serverNet)(nil)
+	_ pointc.Handshaker = (*serverNet)(nil)
+	_ pointc.Dialer     = (*serverDialer)(nil)
 )
 
 type (
 	serverNet struct {
-		srv *Server
-		ip  net.IP
+		srv  *Server
+		ip   net.IP
+		peer *wgapi.PublicKey // peer is the key of the peer this net belongs to, nil for the server itself.
 	}
 	serverDialer struct {
-		d *wg.Dialer
+		d    *wg.Dialer
+		self *wg.Dialer // self dials the server's own address from it, so the replies are delivered back to the stack too.
+		srv  *Server
 	}
 )
 
@@ -113,15 +505,52 @@ func (s *serverNet) ListenPacket(addr *net.UDPAddr) (net.PacketConn, error) {
 }
 
 func (s *serverNet) Dialer(laddr net.IP, port uint16) pointc.Dialer {
-	return &serverDialer{d: s.srv.net.Dialer(laddr, port)}
+	return &serverDialer{d: s.srv.net.Dialer(laddr, port), self: s.srv.net.Dialer(s.srv.json.IP.Value(), port), srv: s.srv}
 }
 
 func (s *serverNet) LocalAddr() net.IP { return s.ip }
 
+// LastHandshake gets the last handshake with the peer. The server itself does not handshake.
+// Peers are not sent keepalives by the server, they may handshake while idle but it is up to their config.
+func (s *serverNet) LastHandshake() (pointc.Handshake, bool) {
+	if s.peer == nil {
+		return pointc.Handshake{}, false
+	}
+	last, _ := s.srv.wg.LastHandshake(*s.peer)
+	return pointc.Handshake{Last: last, Failed: s.srv.wg.LastHandshakeFailed(*s.peer)}, true
+}
+
+// WaitReady blocks until the first handshake with the peer has completed. The server itself is always ready.
+func (s *serverNet) WaitReady(ctx context.Context) error {
+	if s.peer == nil {
+		return nil
+	}
+	return s.srv.wg.WaitHandshake(ctx, *s.peer)
+}
+
 func (s *serverDialer) Dial(ctx context.Context, addr *net.TCPAddr) (net.Conn, error) {
-	return s.d.DialTCP(ctx, addr)
+	d, err := s.dialer(addr.IP)
+	if err != nil {
+		return nil, err
+	}
+	return d.DialTCP(ctx, addr)
 }
 
 func (s *serverDialer) DialPacket(addr *net.UDPAddr) (net.PacketConn, error) {
-	return s.d.DialUDP(addr)
+	d, err := s.dialer(addr.IP)
+	if err != nil {
+		return nil, err
+	}
+	return d.DialUDP(addr)
+}
+
+// dialer gets the dialer for the address. The server's own address is always allowed, so forwards and lookups can reach the server net.
+// Other addresses return [ErrNotAllowed] if they are not routed to any peer.
+func (s *serverDialer) dialer(ip net.IP) (*wg.Dialer, error) {
+	if own := s.srv.json.IP.Value(); own != nil && ip.Equal(own) {
+		return s.self, nil
+	} else if s.srv.routed(ip) {
+		return s.d, nil
+	}
+	return nil, fmt.Errorf("dial %s: %w", ip, ErrNotAllowed)
 }
@@ -0,0 +1,312 @@
+package wg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/require"
+	pointc "github.com/trymoose/point-c"
+	"github.com/trymoose/point-c/pkg/wg"
+	"github.com/trymoose/point-c/pkg/wg/wgapi"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_checkRoutes(t *testing.T) {
+	srv, _ := newTestServer(t, "10.0.0.1")
+	route := func(s string) []net.IPNet {
+		_, n, err := net.ParseCIDR(s)
+		require.NoError(t, err)
+		return []net.IPNet{*n}
+	}
+	require.NoError(t, srv.checkRoutes("gateway", route("192.168.1.0/24")))
+	require.ErrorContains(t, srv.checkRoutes("gateway", route("10.0.0.0/8")), "contains the server address")
+	require.ErrorContains(t, srv.checkRoutes("gateway", route("10.0.0.128/25")), "overlaps the subnet")
+}
+
+func TestServer_MarshalJSON(t *testing.T) {
+	private, err := wgapi.NewPrivate()
+	require.NoError(t, err)
+	privateText, err := private.MarshalText()
+	require.NoError(t, err)
+	_, public, err := wgapi.NewPrivatePublic()
+	require.NoError(t, err)
+	publicText, err := public.MarshalText()
+	require.NoError(t, err)
+	preshared, err := wgapi.NewPreshared()
+	require.NoError(t, err)
+	presharedText, err := preshared.MarshalText()
+	require.NoError(t, err)
+	file := filepath.Join(t.TempDir(), "preshared")
+	require.NoError(t, os.WriteFile(file, presharedText, 0o600))
+
+	var srv Server
+	require.NoError(t, json.Unmarshal([]byte(fmt.Sprintf(`{"Name": "server", "IP": "10.0.0.1", "Private": %q, "Peers": [{"Name": "laptop", "Public": %q, "PresharedKey": "file:%s", "IP": "10.0.0.2"}]}`, privateText, publicText, file)), &srv))
+	require.Equal(t, private, srv.json.Private.Value())
+	require.Equal(t, preshared, srv.json.Peers[0].PresharedKey.Value())
+
+	b, err := json.Marshal(&srv)
+	require.NoError(t, err)
+	require.NotContains(t, string(b), string(privateText))
+	require.NotContains(t, string(b), string(presharedText))
+	require.Contains(t, string(b), `"Private":"REDACTED"`)
+	require.Contains(t, string(b), `"PresharedKey":"file:`+file+`"`)
+	require.Contains(t, string(b), string(publicText))
+}
+
+func TestServer_Provision(t *testing.T) {
+	private, err := wgapi.NewPrivate()
+	require.NoError(t, err)
+	privateText, err := private.MarshalText()
+	require.NoError(t, err)
+	expired := time.Now().Add(-time.Hour).Format(time.RFC3339)
+
+	type peer struct{ name, ip, extra string }
+	tests := []struct {
+		name  string
+		peers []peer
+		nets  map[string]string // nets are the addresses of the nets by name.
+	}{
+		{
+			// Each peer is its own net, none of them replace the server's.
+			name:  "peers",
+			peers: []peer{{name: "laptop", ip: "10.0.0.2"}, {name: "phone", ip: "10.0.0.3"}},
+			nets:  map[string]string{"server": "10.0.0.1", "laptop": "10.0.0.2", "phone": "10.0.0.3"},
+		},
+		{
+			// An expired peer does not hold on to its address.
+			name:  "expired",
+			peers: []peer{{name: "old", ip: "10.0.0.2", extra: fmt.Sprintf(`, "expires_at": %q`, expired)}, {name: "new", ip: "10.0.0.2"}},
+			nets:  map[string]string{"server": "10.0.0.1", "new": "10.0.0.2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var peers []string
+			for _, p := range tt.peers {
+				_, public, err := wgapi.NewPrivatePublic()
+				require.NoError(t, err)
+				publicText, err := public.MarshalText()
+				require.NoError(t, err)
+				peers = append(peers, fmt.Sprintf(`{"Name": %q, "Public": %q, "IP": %q%s}`, p.name, publicText, p.ip, p.extra))
+			}
+
+			var srv Server
+			require.NoError(t, json.Unmarshal([]byte(fmt.Sprintf(`{"Name": "server", "IP": "10.0.0.1", "Private": %q, "Peers": [%s]}`, privateText, strings.Join(peers, ","))), &srv))
+			ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+			defer cancel()
+			require.NoError(t, srv.Provision(ctx))
+			defer srv.Cleanup()
+
+			nets := srv.Networks()
+			require.Len(t, nets, len(tt.nets))
+			for name, ip := range tt.nets {
+				require.Contains(t, nets, name)
+				require.Equal(t, ip, nets[name].LocalAddr().String())
+			}
+		})
+	}
+}
+
+func TestServer_Up(t *testing.T) {
+	private, err := wgapi.NewPrivate()
+	require.NoError(t, err)
+	privateText, err := private.MarshalText()
+	require.NoError(t, err)
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+
+	// provision loads a config of the server with a single peer, answering DNS queries.
+	provision := func() (*Server, wgapi.PublicKey) {
+		t.Helper()
+		_, public, err := wgapi.NewPrivatePublic()
+		require.NoError(t, err)
+		publicText, err := public.MarshalText()
+		require.NoError(t, err)
+		var srv Server
+		require.NoError(t, json.Unmarshal([]byte(fmt.Sprintf(`{"Name": "server", "IP": "10.0.0.1", "Private": %q, "DNS": {}, "Peers": [{"Name": "laptop", "Public": %q, "IP": "10.0.0.2"}]}`, privateText, publicText)), &srv))
+		require.NoError(t, srv.Provision(ctx))
+		t.Cleanup(func() { srv.Cleanup() })
+		return &srv, public
+	}
+	// peers gets the peers of the device.
+	peers := func(srv *Server) []wgapi.PublicKey {
+		t.Helper()
+		ipc, err := srv.wg.GetConfig()
+		require.NoError(t, err)
+		var peers []wgapi.PublicKey
+		for _, kv := range ipc {
+			if k, ok := kv.(wgapi.PublicKey); ok {
+				peers = append(peers, k)
+			}
+		}
+		return peers
+	}
+
+	running, runningPeer := provision()
+	require.Nil(t, running.dev.dns, "dns listening before the server is up")
+	require.NoError(t, running.Up())
+	require.NotNil(t, running.dev.dns)
+	defer running.Down()
+	require.Equal(t, []wgapi.PublicKey{runningPeer}, peers(running))
+
+	// The device is not changed until the new config is brought up, and is changed back if it is brought down first.
+	reloaded, reloadedPeer := provision()
+	require.Same(t, running.dev, reloaded.dev)
+	require.Equal(t, []wgapi.PublicKey{runningPeer}, peers(running))
+	require.NoError(t, reloaded.Up())
+	require.Equal(t, []wgapi.PublicKey{reloadedPeer}, peers(running))
+	require.NoError(t, reloaded.Down())
+	require.Equal(t, []wgapi.PublicKey{runningPeer}, peers(running))
+}
+
+func TestServer_assign(t *testing.T) {
+	_, configured, err := wgapi.NewPrivatePublic()
+	require.NoError(t, err)
+	publicText, err := configured.MarshalText()
+	require.NoError(t, err)
+	var srv Server
+	require.NoError(t, json.Unmarshal([]byte(fmt.Sprintf(`{"Name": "Server", "IP": "10.0.0.1", "Peers": [{"Name": "Laptop", "Public": %q, "IP": "10.0.0.2"}]}`, publicText)), &srv))
+	srv.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// Enrolled peers clashing with the server or configured peers are dropped, the rest keep their address.
+	enrolled := []*enrolledPeer{
+		{Name: "laptop", Public: newTestKey(t), IP: net.IPv4(10, 0, 0, 3)},
+		{Name: "phone", Public: configured, IP: net.IPv4(10, 0, 0, 4)},
+		{Name: "tablet", Public: newTestKey(t), IP: net.IPv4(10, 0, 0, 2)},
+		{Name: "desktop", Public: newTestKey(t), IP: net.IPv4(10, 0, 0, 5)},
+		{Name: "server", Public: newTestKey(t), IP: net.IPv4(10, 0, 0, 6)},
+	}
+	desktop := enrolled[3]
+	ips, err := srv.assign(caddy.Context{}, make([]string, 1), enrolled)
+	require.NoError(t, err)
+	require.Equal(t, []net.IP{net.IPv4(10, 0, 0, 2)}, ips)
+	require.Equal(t, []*enrolledPeer{nil, nil, nil, desktop, nil}, enrolled)
+}
+
+func TestListenAddrs(t *testing.T) {
+	addrs, err := listenAddrs([]string{"203.0.113.5:51820", "[2001:db8::1]:51821", "198.51.100.7", "[2001:db8::2]", "2001:db8::3"})
+	require.NoError(t, err)
+	require.Equal(t, []netip.AddrPort{
+		netip.MustParseAddrPort("203.0.113.5:51820"),
+		netip.MustParseAddrPort("[2001:db8::1]:51821"),
+		netip.MustParseAddrPort("198.51.100.7:0"),
+		netip.MustParseAddrPort("[2001:db8::2]:0"),
+		netip.MustParseAddrPort("[2001:db8::3]:0"),
+	}, addrs)
+
+	for _, addr := range []string{"", "example.com:51820", "203.0.113.5:port"} {
+		_, err := listenAddrs([]string{addr})
+		require.Error(t, err, addr)
+	}
+}
+
+func TestServerDialer_routes(t *testing.T) {
+	srv, serverPublic := newTestServer(t, "10.0.0.1")
+	ipc, err := srv.wg.GetConfig()
+	require.NoError(t, err)
+	var port wgapi.ListenPort
+	for _, kv := range ipc {
+		if p, ok := kv.(wgapi.ListenPort); ok {
+			port = p
+		}
+	}
+
+	// The gateway is a peer with the LAN 192.168.1.0/24 behind it.
+	gatewayPrivate, gatewayPublic, err := wgapi.NewPrivatePublic()
+	require.NoError(t, err)
+	_, lan, err := net.ParseCIDR("192.168.1.0/24")
+	require.NoError(t, err)
+	require.NoError(t, srv.wg.SetConfig(wgapi.IPC{gatewayPublic, wgapi.IdentitySubnet(net.IPv4(10, 0, 0, 2)), wgapi.AllowedIP(*lan)}))
+	srv.routes["gateway"] = []net.IPNet{net.IPNet(wgapi.IdentitySubnet(net.IPv4(10, 0, 0, 2))), *lan}
+
+	var gatewayNet *wg.Net
+	gateway, err := wg.New(wg.OptionNetDevice(&gatewayNet), wg.OptionConfig(wgapi.IPC{
+		gatewayPrivate,
+		serverPublic,
+		wgapi.Endpoint{IP: net.IPv4(127, 0, 0, 1), Port: int(port)},
+		wgapi.PersistentKeepalive(1),
+		wgapi.EmptySubnet,
+	}))
+	require.NoError(t, err)
+	defer gateway.Close()
+
+	// A machine in the LAN, the gateway's netstack answers for any address.
+	ln, err := gatewayNet.Listen(&net.TCPAddr{IP: net.IPv4(192, 168, 1, 5), Port: 80})
+	require.NoError(t, err)
+	defer ln.Close()
+	accepted := make(chan net.Addr, 1)
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			accepted <- c.RemoteAddr()
+			c.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	d := srv.nets["server"].Dialer(net.IPv4(10, 0, 0, 1), 0)
+	c, err := d.Dial(ctx, &net.TCPAddr{IP: net.IPv4(192, 168, 1, 5), Port: 80})
+	require.NoError(t, err)
+	defer c.Close()
+	select {
+	case addr := <-accepted:
+		require.Equal(t, "10.0.0.1", addr.(*net.TCPAddr).IP.String())
+	case <-ctx.Done():
+		t.Fatal("connection was not accepted")
+	}
+
+	_, err = d.Dial(ctx, &net.TCPAddr{IP: net.IPv4(192, 168, 2, 5), Port: 80})
+	require.ErrorIs(t, err, ErrNotAllowed)
+	_, err = d.DialPacket(&net.UDPAddr{IP: net.IPv4(192, 168, 2, 5), Port: 53})
+	require.ErrorIs(t, err, ErrNotAllowed)
+}
+
+func TestServerDialer_self(t *testing.T) {
+	srv, _ := newTestServer(t, "10.0.0.1")
+	ln, err := srv.net.Listen(&net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 80})
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			_, _ = io.Copy(c, c)
+			c.Close()
+		}
+	}()
+
+	// Forwarding to the server net dials the server's own address.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	c, err := srv.nets["server"].Dialer(net.IPv4(192, 168, 1, 50), 0).Dial(ctx, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 80})
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.SetDeadline(time.Now().Add(time.Second*5)))
+	_, err = c.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(c, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+}
+
+func TestServerNet_LastHandshake(t *testing.T) {
+	e, _ := newTestEnroll(t, "10.0.0.1", "invite")
+	_, ok := e.srv.Networks()["server"].(pointc.Handshaker).LastHandshake()
+	require.False(t, ok, "the server does not handshake")
+
+	_, err := enrollRequestFor(t, e, "invite", "laptop")
+	require.NoError(t, err)
+	h, ok := e.srv.Networks()["laptop"].(pointc.Handshaker).LastHandshake()
+	require.True(t, ok)
+	require.False(t, h.Failed)
+	require.False(t, h.Keepalive)
+	require.True(t, h.Last.IsZero(), "the peer never connected")
+}
@@ -0,0 +1,162 @@
+package wg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/trymoose/point-c/pkg/wg"
+	"github.com/trymoose/point-c/pkg/wg/wgapi"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	_ caddy.Module      = (*adminStatus)(nil)
+	_ caddy.AdminRouter = (*adminStatus)(nil)
+)
+
+func init() {
+	caddy.RegisterModule(new(adminStatus))
+}
+
+// statusPath is the admin API path of the status of the running wireguard devices.
+const statusPath = "/point-c/status"
+
+// adminStatus serves the status of the running wireguard devices on the admin API.
+type adminStatus struct{}
+
+func (*adminStatus) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.point-c",
+		New: func() caddy.Module { return new(adminStatus) },
+	}
+}
+
+func (*adminStatus) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{{Pattern: statusPath, Handler: caddy.AdminHandlerFunc(handleStatus)}}
+}
+
+type (
+	// deviceStatus is the status of a wireguard device.
+	deviceStatus struct {
+		Name       string       `json:"name"`
+		Type       string       `json:"type"`
+		ListenPort uint16       `json:"listen_port,omitempty"`
+		Peers      []peerStatus `json:"peers"`
+	}
+	// peerStatus is the status of a peer of a wireguard device.
+	peerStatus struct {
+		Public        wgapi.PublicKey `json:"public"`
+		Endpoint      string          `json:"endpoint,omitempty"`
+		AllowedIPs    []string        `json:"allowed_ips"`
+		LastHandshake *time.Time      `json:"last_handshake,omitempty"`
+		RX            uint64          `json:"rx_bytes"`
+		TX            uint64          `json:"tx_bytes"`
+	}
+)
+
+// devices are the running wireguard devices by name.
+var devices = struct {
+	sync.Mutex
+	m map[*wg.Wireguard]*device
+}{m: map[*wg.Wireguard]*device{}}
+
+// device is a running wireguard device.
+type device struct{ name, typ string }
+
+// register adds the device to the status. The returned function removes it.
+// A device shared across a config reload is registered again by the new config, the old config's function then does nothing.
+func register(dev *wg.Wireguard, name, typ string) func() {
+	devices.Lock()
+	defer devices.Unlock()
+	d := &device{name: name, typ: typ}
+	devices.m[dev] = d
+	return func() {
+		devices.Lock()
+		defer devices.Unlock()
+		if devices.m[dev] == d {
+			delete(devices.m, dev)
+		}
+	}
+}
+
+func handleStatus(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: errors.New("method not allowed")}
+	}
+	status, err := statuses()
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: err}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(status)
+}
+
+// statuses gets the status of every running device, sorted by name.
+func statuses() ([]deviceStatus, error) {
+	devices.Lock()
+	defer devices.Unlock()
+	status := make([]deviceStatus, 0, len(devices.m))
+	for dev, d := range devices.m {
+		ipc, err := dev.GetConfig()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get config of %q: %w", d.name, err)
+		}
+		s := statusOf(ipc)
+		s.Name, s.Type = d.name, d.typ
+		status = append(status, s)
+	}
+	sort.Slice(status, func(i, j int) bool { return status[i].Name < status[j].Name })
+	return status, nil
+}
+
+// statusOf builds the status of a device from its config.
+func statusOf(ipc wgapi.IPC) deviceStatus {
+	s := deviceStatus{Peers: []peerStatus{}}
+	var sec, nsec int64
+	flush := func() {
+		if len(s.Peers) > 0 && (sec != 0 || nsec != 0) {
+			t := time.Unix(sec, nsec)
+			s.Peers[len(s.Peers)-1].LastHandshake = &t
+		}
+		sec, nsec = 0, 0
+	}
+	for _, kv := range ipc {
+		var p *peerStatus
+		if len(s.Peers) > 0 {
+			p = &s.Peers[len(s.Peers)-1]
+		}
+		switch kv := kv.(type) {
+		case wgapi.ListenPort:
+			s.ListenPort = uint16(kv)
+		case wgapi.PublicKey:
+			flush()
+			s.Peers = append(s.Peers, peerStatus{Public: kv, AllowedIPs: []string{}})
+		case wgapi.Endpoint:
+			if p != nil {
+				p.Endpoint = kv.String()
+			}
+		case wgapi.AllowedIP:
+			if p != nil {
+				p.AllowedIPs = append(p.AllowedIPs, kv.String())
+			}
+		case wgapi.LastHandshakeTimeSec:
+			sec = int64(kv)
+		case wgapi.LastHandshakeTimeNSec:
+			nsec = int64(kv)
+		case wgapi.RXBytes:
+			if p != nil {
+				p.RX = uint64(kv)
+			}
+		case wgapi.TXBytes:
+			if p != nil {
+				p.TX = uint64(kv)
+			}
+		}
+	}
+	flush()
+	return s
+}
@@ -0,0 +1,40 @@
+package wg
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/require"
+	"github.com/trymoose/point-c/pkg/wg/wgapi"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandleStatus(t *testing.T) {
+	srv, _ := newTestServer(t, "10.0.0.1")
+	_, public, err := wgapi.NewPrivatePublic()
+	require.NoError(t, err)
+	_, err = srv.addPeer(context.Background(), "laptop", public, wgapi.PresharedKey{})
+	require.NoError(t, err)
+	unregister := register(srv.wg, "server", "wireguard-server")
+
+	w := httptest.NewRecorder()
+	require.NoError(t, handleStatus(w, httptest.NewRequest(http.MethodGet, statusPath, nil)))
+	var status []deviceStatus
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	require.Len(t, status, 1)
+	require.Equal(t, "server", status[0].Name)
+	require.Equal(t, "wireguard-server", status[0].Type)
+	require.NotZero(t, status[0].ListenPort)
+	require.Len(t, status[0].Peers, 1)
+	require.Equal(t, public, status[0].Peers[0].Public)
+	require.Nil(t, status[0].Peers[0].LastHandshake)
+	require.Len(t, status[0].Peers[0].AllowedIPs, 1)
+
+	unregister()
+	w = httptest.NewRecorder()
+	require.NoError(t, handleStatus(w, httptest.NewRequest(http.MethodGet, statusPath, nil)))
+	require.JSONEq(t, `[]`, w.Body.String())
+
+	require.Error(t, handleStatus(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, statusPath, nil)))
+}
@@ -17,10 +17,12 @@ func (wgk valueKey[K]) Value() K {
 }
 
 type (
-	// PrivateKey is a wireguard private key in base64 format.
-	PrivateKey = configvalues.CaddyTextUnmarshaler[wgapi.PrivateKey, valueKey[wgapi.PrivateKey], *valueKey[wgapi.PrivateKey]]
+	// PrivateKey is a wireguard private key in base64 format, or where to load it from. It is redacted when marshaled,
+	// but not by the admin API if it is given inline, see [configvalues.Secret].
+	PrivateKey = configvalues.Secret[wgapi.PrivateKey, valueKey[wgapi.PrivateKey], *valueKey[wgapi.PrivateKey]]
 	// PublicKey is a wireguard public key in base64 format.
 	PublicKey = configvalues.CaddyTextUnmarshaler[wgapi.PublicKey, valueKey[wgapi.PublicKey], *valueKey[wgapi.PublicKey]]
-	// PresharedKey is a wireguard preshared key in base64 format.
-	PresharedKey = configvalues.CaddyTextUnmarshaler[wgapi.PresharedKey, valueKey[wgapi.PresharedKey], *valueKey[wgapi.PresharedKey]]
+	// PresharedKey is a wireguard preshared key in base64 format, or where to load it from. It is redacted when marshaled,
+	// but not by the admin API if it is given inline, see [configvalues.Secret].
+	PresharedKey = configvalues.Secret[wgapi.PresharedKey, valueKey[wgapi.PresharedKey], *valueKey[wgapi.PresharedKey]]
 )
@@ -0,0 +1,470 @@
+package wg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/trymoose/point-c/pkg/wg/wgapi"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var _ caddyconfig.Adapter = (*wgquickAdapter)(nil)
+
+func init() {
+	caddyconfig.RegisterAdapter("wgquick", new(wgquickAdapter))
+}
+
+// wgquickDirective is the prefix of comments with point-c directives in wg-quick files.
+// Directives are comments so the files still work with wg-quick.
+//
+//	# point-c name <name>      names the network or peer of the section it is in
+//	# point-c type <type>      makes the interface of the section it is in a client or server network
+//	# point-c include <glob>   also loads the matching files, relative to the including file
+const wgquickDirective = "point-c"
+
+// wgquickAdapter translates wg-quick config files into a point-c app config.
+//
+// Every [Interface] becomes a network, named by a name directive, or else by its file name.
+// An interface with peers that have an Endpoint becomes a wireguard-client, any other interface becomes a wireguard-server.
+// An interface that also has a ListenPort or peers without an Endpoint could be either, like a server with a site-to-site peer,
+// so it must have a type directive.
+// Settings wg-quick applies to the host, such as DNS and PostUp, can not be honoured and produce warnings.
+type wgquickAdapter struct{}
+
+type (
+	// wgquickInterface is an [Interface] section and its peers.
+	wgquickInterface struct {
+		file, name string
+		kind       string // kind is the network type set by a type directive, client or server, empty if it is guessed.
+		line       int
+		private    string
+		listenPort string
+		addresses  []string
+		peers      []*wgquickPeer
+	}
+	// wgquickPeer is a [Peer] section.
+	wgquickPeer struct {
+		line       int
+		name       string
+		public     string
+		preshared  string
+		endpoint   string
+		keepalive  string
+		allowedIPs []string
+	}
+	// wgquickParser parses wg-quick files, collecting warnings.
+	wgquickParser struct {
+		interfaces []*wgquickInterface
+		warnings   []caddyconfig.Warning
+		seen       map[string]bool // seen are the files already parsed, so includes can not loop.
+	}
+)
+
+type (
+	// wgquickClient is the config of a [Client].
+	wgquickClient struct {
+		Type                string              `json:"type"`
+		Name                string              `json:"Name"`
+		Endpoint            string              `json:"Endpoint"`
+		IP                  string              `json:"IP"`
+		Private             string              `json:"Private"`
+		Public              string              `json:"Public"`
+		Preshared           string              `json:"Preshared,omitempty"`
+		AllowedIPs          []string            `json:"allowed_ips,omitempty"`
+		PersistentKeepalive string              `json:"persistent_keepalive"`
+		Peers               []wgquickClientPeer `json:"peers,omitempty"`
+	}
+	// wgquickClientPeer is an additional server of a [Client].
+	wgquickClientPeer struct {
+		Endpoint            string   `json:"Endpoint"`
+		Public              string   `json:"Public"`
+		Preshared           string   `json:"Preshared,omitempty"`
+		AllowedIPs          []string `json:"allowed_ips"`
+		PersistentKeepalive string   `json:"persistent_keepalive"`
+	}
+	// wgquickServer is the config of a [Server].
+	wgquickServer struct {
+		Type       string              `json:"type"`
+		Name       string              `json:"Name"`
+		IP         string              `json:"IP"`
+		ListenPort string              `json:"ListenPort,omitempty"`
+		Private    string              `json:"Private"`
+		Subnet     string              `json:"subnet,omitempty"`
+		Peers      []wgquickServerPeer `json:"Peers"`
+	}
+	// wgquickServerPeer is a peer of a [Server].
+	wgquickServerPeer struct {
+		Name         string   `json:"Name"`
+		Public       string   `json:"Public"`
+		PresharedKey string   `json:"PresharedKey,omitempty"`
+		IP           string   `json:"IP,omitempty"`
+		Routes       []string `json:"routes,omitempty"`
+	}
+)
+
+func (*wgquickAdapter) Adapt(body []byte, options map[string]any) ([]byte, []caddyconfig.Warning, error) {
+	filename, _ := options["filename"].(string)
+	p := wgquickParser{seen: map[string]bool{}}
+	if filename != "" {
+		p.seen[filepath.Clean(filename)] = true
+	}
+	if err := p.parse(filename, body); err != nil {
+		return nil, p.warnings, err
+	}
+
+	networks := make([]any, 0, len(p.interfaces))
+	names := map[string]bool{}
+	for _, iface := range p.interfaces {
+		n, err := p.network(iface)
+		if err != nil {
+			return nil, p.warnings, fmt.Errorf("%s:%d: %w", iface.file, iface.line, err)
+		} else if names[iface.name] {
+			return nil, p.warnings, fmt.Errorf("%s:%d: network %q declared twice", iface.file, iface.line, iface.name)
+		}
+		names[iface.name] = true
+		networks = append(networks, n)
+	}
+
+	var cfg struct {
+		Apps struct {
+			Pointc struct {
+				Networks []any `json:"networks"`
+			} `json:"point-c"`
+		} `json:"apps"`
+	}
+	cfg.Apps.Pointc.Networks = networks
+	b, err := json.Marshal(cfg)
+	return b, p.warnings, err
+}
+
+// parse parses a wg-quick file, adding its interfaces.
+func (p *wgquickParser) parse(filename string, body []byte) error {
+	var iface *wgquickInterface
+	var peer *wgquickPeer
+	// count is the number of interfaces in this file, networks after the first are numbered.
+	var count int
+	name := strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	if filename == "" {
+		name = "wg"
+	}
+
+	s := bufio.NewScanner(bytes.NewReader(body))
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if strings.HasPrefix(text, "#") {
+			if err := p.directive(filename, line, text, iface, peer); err != nil {
+				return err
+			}
+			continue
+		} else if text == "" {
+			continue
+		}
+
+		switch strings.ToLower(text) {
+		case "[interface]":
+			count++
+			iface = &wgquickInterface{file: filename, line: line, name: name}
+			if count > 1 {
+				iface.name = name + "-" + strconv.Itoa(count)
+			}
+			peer = nil
+			p.interfaces = append(p.interfaces, iface)
+			continue
+		case "[peer]":
+			if iface == nil {
+				return fmt.Errorf("%s:%d: [Peer] before [Interface]", filename, line)
+			}
+			peer = &wgquickPeer{line: line}
+			iface.peers = append(iface.peers, peer)
+			continue
+		}
+
+		key, value, ok := strings.Cut(text, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: invalid line %q", filename, line, text)
+		} else if iface == nil {
+			return fmt.Errorf("%s:%d: %s outside of a section", filename, line, strings.TrimSpace(key))
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if err := p.set(filename, line, key, value, iface, peer); err != nil {
+			return fmt.Errorf("%s:%d: %w", filename, line, err)
+		}
+	}
+	return s.Err()
+}
+
+// directive handles a comment, which may be a point-c directive.
+func (p *wgquickParser) directive(filename string, line int, text string, iface *wgquickInterface, peer *wgquickPeer) error {
+	fields := strings.Fields(strings.TrimPrefix(text, "#"))
+	if len(fields) == 0 || fields[0] != wgquickDirective {
+		return nil
+	} else if len(fields) != 3 {
+		return fmt.Errorf("%s:%d: directive %q must have one argument", filename, line, text)
+	}
+
+	switch fields[1] {
+	case "name":
+		if peer != nil {
+			peer.name = fields[2]
+		} else if iface != nil {
+			iface.name = fields[2]
+		} else {
+			return fmt.Errorf("%s:%d: name outside of a section", filename, line)
+		}
+	case "type":
+		if iface == nil || peer != nil {
+			return fmt.Errorf("%s:%d: type outside of an interface", filename, line)
+		} else if fields[2] != "client" && fields[2] != "server" {
+			return fmt.Errorf("%s:%d: type must be client or server, not %q", filename, line, fields[2])
+		}
+		iface.kind = fields[2]
+	case "include":
+		pattern := fields[2]
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(filename), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", filename, line, err)
+		} else if len(matches) == 0 {
+			p.warn(filename, line, "include", fmt.Sprintf("no files match %q", fields[2]))
+		}
+		for _, match := range matches {
+			if p.seen[filepath.Clean(match)] {
+				continue
+			}
+			p.seen[filepath.Clean(match)] = true
+			b, err := os.ReadFile(match)
+			if err != nil {
+				return fmt.Errorf("%s:%d: %w", filename, line, err)
+			} else if err := p.parse(match, b); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("%s:%d: unknown directive %q", filename, line, fields[1])
+	}
+	return nil
+}
+
+// set sets a key of the current section.
+func (p *wgquickParser) set(filename string, line int, key, value string, iface *wgquickInterface, peer *wgquickPeer) error {
+	k := strings.ToLower(key)
+	if peer == nil {
+		switch k {
+		case "privatekey":
+			iface.private = value
+			return checkKey[wgapi.PrivateKey](value)
+		case "listenport":
+			iface.listenPort = value
+		case "address":
+			iface.addresses = append(iface.addresses, splitList(value)...)
+		case "dns", "table", "mtu", "preup", "postup", "predown", "postdown", "saveconfig", "fwmark":
+			p.warn(filename, line, key, key+" is not supported and was ignored")
+		default:
+			p.warn(filename, line, key, "unknown key "+key+" was ignored")
+		}
+		return nil
+	}
+
+	switch k {
+	case "publickey":
+		peer.public = value
+		return checkKey[wgapi.PublicKey](value)
+	case "presharedkey":
+		peer.preshared = value
+		return checkKey[wgapi.PresharedKey](value)
+	case "endpoint":
+		peer.endpoint = value
+	case "allowedips":
+		peer.allowedIPs = append(peer.allowedIPs, splitList(value)...)
+	case "persistentkeepalive":
+		peer.keepalive = value
+	default:
+		p.warn(filename, line, key, "unknown key "+key+" was ignored")
+	}
+	return nil
+}
+
+// network translates an interface into a client or server network.
+func (p *wgquickParser) network(iface *wgquickInterface) (any, error) {
+	if iface.private == "" {
+		return nil, fmt.Errorf("interface %q has no PrivateKey", iface.name)
+	} else if len(iface.addresses) == 0 {
+		return nil, fmt.Errorf("interface %q has no Address", iface.name)
+	}
+	addr, err := parseAddress(iface.addresses[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(iface.addresses) > 1 {
+		p.warn(iface.file, iface.line, "Address", fmt.Sprintf("only the first address of %q is used", iface.name))
+	}
+
+	for _, peer := range iface.peers {
+		if peer.public == "" {
+			return nil, fmt.Errorf("peer on line %d has no PublicKey", peer.line)
+		}
+	}
+	switch iface.kind {
+	case "client":
+		return p.client(iface, addr)
+	case "server":
+		return p.server(iface, addr)
+	}
+
+	var endpoints int
+	for _, peer := range iface.peers {
+		if peer.endpoint != "" {
+			endpoints++
+		}
+	}
+	if endpoints == 0 {
+		return p.server(iface, addr)
+	} else if endpoints < len(iface.peers) || iface.listenPort != "" {
+		return nil, fmt.Errorf("interface %q has peers with an Endpoint but also a ListenPort or peers without one, add \"# %s type client\" or \"# %s type server\"", iface.name, wgquickDirective, wgquickDirective)
+	}
+	return p.client(iface, addr)
+}
+
+// client translates an interface with endpoints into a client. Peers without an endpoint are ignored.
+func (p *wgquickParser) client(iface *wgquickInterface, addr netip.Prefix) (*wgquickClient, error) {
+	if iface.listenPort != "" {
+		p.warn(iface.file, iface.line, "ListenPort", fmt.Sprintf("clients do not listen, ListenPort of %q was ignored", iface.name))
+	}
+
+	c := &wgquickClient{Type: "wireguard-client", Name: iface.name, IP: addr.Addr().String(), Private: iface.private}
+	for _, peer := range iface.peers {
+		if peer.endpoint == "" {
+			p.warn(iface.file, peer.line, "Endpoint", "peers of clients must have an endpoint, peer "+peer.public+" was ignored")
+			continue
+		} else if peer.name != "" {
+			p.warn(iface.file, peer.line, "name", "peers of clients are not named, name "+peer.name+" was ignored")
+		}
+		keepalive := peer.keepalive
+		if keepalive == "" {
+			keepalive = "off"
+		}
+
+		if c.Public == "" {
+			c.Endpoint, c.Public, c.Preshared, c.PersistentKeepalive = peer.endpoint, peer.public, peer.preshared, keepalive
+			// All addresses are routed to the server if the client has no allowed ips, so they are only left out if they route both families.
+			if !routesAll(peer.allowedIPs) {
+				c.AllowedIPs = peer.allowedIPs
+			}
+			continue
+		}
+		if len(peer.allowedIPs) == 0 {
+			return nil, fmt.Errorf("peer on line %d has no AllowedIPs", peer.line)
+		}
+		c.Peers = append(c.Peers, wgquickClientPeer{
+			Endpoint:            peer.endpoint,
+			Public:              peer.public,
+			Preshared:           peer.preshared,
+			AllowedIPs:          peer.allowedIPs,
+			PersistentKeepalive: keepalive,
+		})
+	}
+	return c, nil
+}
+
+// server translates an interface without endpoints into a server.
+// The address of a peer is its first single address allowed ip, peers without one are assigned an address from the interface's subnet.
+// The other allowed ips of a peer are routed to it.
+func (p *wgquickParser) server(iface *wgquickInterface, addr netip.Prefix) (*wgquickServer, error) {
+	s := &wgquickServer{Type: "wireguard-server", Name: iface.name, IP: addr.Addr().String(), ListenPort: iface.listenPort, Private: iface.private, Peers: []wgquickServerPeer{}}
+	if addr.Bits() < addr.Addr().BitLen() {
+		s.Subnet = addr.Masked().String()
+	}
+
+	for i, peer := range iface.peers {
+		if peer.keepalive != "" {
+			p.warn(iface.file, peer.line, "PersistentKeepalive", "PersistentKeepalive of server peers is not supported and was ignored")
+		}
+		if peer.endpoint != "" {
+			p.warn(iface.file, peer.line, "Endpoint", "Endpoint of server peers is not supported and was ignored")
+		}
+		sp := wgquickServerPeer{Name: peer.name, Public: peer.public, PresharedKey: peer.preshared}
+		if sp.Name == "" {
+			sp.Name = iface.name + "-peer" + strconv.Itoa(i+1)
+		}
+		if err := peer.addresses(&sp); err != nil {
+			return nil, err
+		}
+		if sp.IP == "" && s.Subnet == "" {
+			return nil, fmt.Errorf("peer %q has no address and %q has no subnet to assign one from", sp.Name, iface.name)
+		}
+		s.Peers = append(s.Peers, sp)
+	}
+	return s, nil
+}
+
+// addresses sets the address and routes of a server peer from the allowed ips.
+// The address is the first single address allowed ip, the other allowed ips are routes.
+func (peer *wgquickPeer) addresses(sp *wgquickServerPeer) error {
+	for _, allowed := range peer.allowedIPs {
+		prefix, err := netip.ParsePrefix(allowed)
+		if err != nil {
+			return fmt.Errorf("invalid allowed ip %q on line %d: %w", allowed, peer.line, err)
+		} else if prefix.IsSingleIP() && sp.IP == "" {
+			sp.IP = prefix.Addr().String()
+		} else {
+			sp.Routes = append(sp.Routes, prefix.Masked().String())
+		}
+	}
+	return nil
+}
+
+func (p *wgquickParser) warn(filename string, line int, directive, message string) {
+	p.warnings = append(p.warnings, caddyconfig.Warning{File: filename, Line: line, Directive: directive, Message: message})
+}
+
+// parseAddress parses an interface address, which may have a prefix length.
+func parseAddress(s string) (netip.Prefix, error) {
+	if prefix, err := netip.ParsePrefix(s); err == nil {
+		return prefix, nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid address %q", s)
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// routesAll reports whether the allowed ips route every IPv4 and IPv6 address.
+func routesAll(allowed []string) bool {
+	var v4, v6 bool
+	for _, a := range allowed {
+		if prefix, err := netip.ParsePrefix(a); err == nil && prefix.Bits() == 0 {
+			v4, v6 = v4 || prefix.Addr().Is4(), v6 || prefix.Addr().Is6()
+		}
+	}
+	return v4 && v6 || len(allowed) == 0
+}
+
+// splitList splits a comma separated list.
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// checkKey checks a key is valid base64.
+func checkKey[K wgapi.PrivateKey | wgapi.PublicKey | wgapi.PresharedKey](s string) error {
+	var k K
+	if err := any(&k).(encoding.TextUnmarshaler).UnmarshalText([]byte(s)); err != nil {
+		return fmt.Errorf("invalid key: %w", err)
+	}
+	return nil
+}
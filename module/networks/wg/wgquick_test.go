@@ -0,0 +1,197 @@
+package wg
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/stretchr/testify/require"
+	"github.com/trymoose/point-c/pkg/wg/wgapi"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testKeys(t *testing.T) (private, public, preshared string) {
+	t.Helper()
+	priv, pub, err := wgapi.NewPrivatePublic()
+	require.NoError(t, err)
+	psk, err := wgapi.NewPreshared()
+	require.NoError(t, err)
+	b1, _ := priv.MarshalText()
+	b2, _ := pub.MarshalText()
+	b3, _ := psk.MarshalText()
+	return string(b1), string(b2), string(b3)
+}
+
+// adaptNetworks adapts the file and returns its networks.
+func adaptNetworks(t *testing.T, filename, body string) ([]map[string]any, []caddyconfig.Warning, error) {
+	t.Helper()
+	b, warnings, err := new(wgquickAdapter).Adapt([]byte(body), map[string]any{"filename": filename})
+	if err != nil {
+		return nil, warnings, err
+	}
+	var cfg struct {
+		Apps struct {
+			Pointc struct {
+				Networks []map[string]any `json:"networks"`
+			} `json:"point-c"`
+		} `json:"apps"`
+	}
+	require.NoError(t, json.Unmarshal(b, &cfg))
+	return cfg.Apps.Pointc.Networks, warnings, nil
+}
+
+func TestWgquickAdapter(t *testing.T) {
+	private, public, preshared := testKeys(t)
+
+	t.Run("server", func(t *testing.T) {
+		networks, warnings, err := adaptNetworks(t, "/etc/wireguard/wg0.conf", `
+[Interface]
+PrivateKey = `+private+`
+Address = 10.0.0.1/24
+ListenPort = 51820
+PostUp = iptables -A FORWARD -i wg0 -j ACCEPT
+DNS = 1.1.1.1
+
+[Peer]
+# point-c name laptop
+PublicKey = `+public+`
+PresharedKey = `+preshared+`
+AllowedIPs = 10.0.0.2/32, 192.168.1.0/24
+
+[Peer]
+PublicKey = `+public+`
+`)
+		require.NoError(t, err)
+		require.Len(t, networks, 1)
+		n := networks[0]
+		require.Equal(t, "wireguard-server", n["type"])
+		require.Equal(t, "wg0", n["Name"])
+		require.Equal(t, "10.0.0.1", n["IP"])
+		require.Equal(t, "51820", n["ListenPort"])
+		require.Equal(t, "10.0.0.0/24", n["subnet"])
+		peers := n["Peers"].([]any)
+		require.Equal(t, map[string]any{"Name": "laptop", "Public": public, "PresharedKey": preshared, "IP": "10.0.0.2", "routes": []any{"192.168.1.0/24"}}, peers[0])
+		require.Equal(t, map[string]any{"Name": "wg0-peer2", "Public": public}, peers[1])
+
+		directives := map[string]int{}
+		for _, w := range warnings {
+			directives[w.Directive] = w.Line
+		}
+		require.Equal(t, map[string]int{"PostUp": 6, "DNS": 7}, directives)
+
+		// The network can be loaded by the server module.
+		b, err := json.Marshal(n)
+		require.NoError(t, err)
+		var srv Server
+		require.NoError(t, json.Unmarshal(b, &srv))
+		require.Equal(t, "laptop", srv.json.Peers[0].Name.Value())
+		require.Equal(t, "10.0.0.0/24", srv.json.Subnet.Value().String())
+		require.Equal(t, "192.168.1.0/24", srv.json.Peers[0].Routes[0].Value().String())
+	})
+
+	t.Run("client", func(t *testing.T) {
+		networks, warnings, err := adaptNetworks(t, "office.conf", `
+[Interface]
+# point-c name office
+PrivateKey = `+private+`
+Address = 10.0.0.2/32
+Table = off
+
+[Peer]
+PublicKey = `+public+`
+PresharedKey = `+preshared+`
+Endpoint = 127.0.0.1:51820
+AllowedIPs = 0.0.0.0/0, ::/0
+PersistentKeepalive = 25
+
+[Peer]
+PublicKey = `+public+`
+Endpoint = 127.0.0.1:51821
+AllowedIPs = 10.1.0.0/16
+AllowedIPs = 10.2.0.0/16
+`)
+		require.NoError(t, err)
+		require.Len(t, warnings, 1)
+		require.Equal(t, "Table", warnings[0].Directive)
+		require.Len(t, networks, 1)
+		n := networks[0]
+		require.Equal(t, "wireguard-client", n["type"])
+		require.Equal(t, "office", n["Name"])
+		require.Equal(t, "10.0.0.2", n["IP"])
+		require.Equal(t, "127.0.0.1:51820", n["Endpoint"])
+		require.Equal(t, "25", n["persistent_keepalive"])
+		require.NotContains(t, n, "allowed_ips")
+		require.Equal(t, []any{map[string]any{
+			"Endpoint":             "127.0.0.1:51821",
+			"Public":               public,
+			"allowed_ips":          []any{"10.1.0.0/16", "10.2.0.0/16"},
+			"persistent_keepalive": "off",
+		}}, n["peers"])
+
+		// The network can be loaded by the client module.
+		b, err := json.Marshal(n)
+		require.NoError(t, err)
+		var c Client
+		require.NoError(t, json.Unmarshal(b, &c))
+		require.Equal(t, "office", c.json.Name.Value())
+		require.Len(t, c.json.Peers, 1)
+		require.Equal(t, uint16(0), c.json.Peers[0].PersistentKeepalive.Value())
+	})
+
+	t.Run("ipv4 full tunnel", func(t *testing.T) {
+		// Only IPv4 is routed to the server, so the allowed ips are kept instead of routing every address.
+		networks, _, err := adaptNetworks(t, "office.conf", "[Interface]\nPrivateKey = "+private+"\nAddress = 10.0.0.2/32\n[Peer]\nPublicKey = "+public+"\nEndpoint = 127.0.0.1:51820\nAllowedIPs = 0.0.0.0/0\n")
+		require.NoError(t, err)
+		require.Equal(t, []any{"0.0.0.0/0"}, networks[0]["allowed_ips"])
+	})
+
+	t.Run("type", func(t *testing.T) {
+		// A server with a site-to-site peer looks like a client too.
+		body := "[Interface]\nPrivateKey = " + private + "\nAddress = 10.0.0.1/24\nListenPort = 51820\n%s[Peer]\nPublicKey = " + public + "\nEndpoint = 127.0.0.1:51821\nAllowedIPs = 10.0.0.2/32, 10.1.0.0/16\n"
+		_, _, err := adaptNetworks(t, "wg0.conf", fmt.Sprintf(body, ""))
+		require.ErrorContains(t, err, "type")
+
+		networks, warnings, err := adaptNetworks(t, "wg0.conf", fmt.Sprintf(body, "# point-c type server\n"))
+		require.NoError(t, err)
+		require.Equal(t, "wireguard-server", networks[0]["type"])
+		require.Len(t, warnings, 1)
+		require.Equal(t, "Endpoint", warnings[0].Directive)
+
+		networks, warnings, err = adaptNetworks(t, "wg0.conf", fmt.Sprintf(body, "# point-c type client\n"))
+		require.NoError(t, err)
+		require.Equal(t, "wireguard-client", networks[0]["type"])
+		require.Len(t, warnings, 1)
+		require.Equal(t, "ListenPort", warnings[0].Directive)
+	})
+
+	t.Run("include", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "wg1.conf"), []byte("[Interface]\nPrivateKey = "+private+"\nAddress = 10.1.0.1/24\n"), 0o600))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "wg2.conf"), []byte("[Interface]\nPrivateKey = "+private+"\nAddress = 10.2.0.1/24\n"), 0o600))
+		main := filepath.Join(dir, "main.conf")
+		networks, _, err := adaptNetworks(t, main, "# point-c include *.conf\n")
+		require.NoError(t, err)
+		require.Len(t, networks, 2)
+		require.Equal(t, "wg1", networks[0]["Name"])
+		require.Equal(t, "wg2", networks[1]["Name"])
+	})
+
+	for name, body := range map[string]string{
+		"peer before interface": "[Peer]\nPublicKey = " + public,
+		"invalid key":           "[Interface]\nPrivateKey = invalid\nAddress = 10.0.0.1/24",
+		"no address":            "[Interface]\nPrivateKey = " + private,
+		"no private key":        "[Interface]\nAddress = 10.0.0.1/24",
+		"invalid line":          "[Interface]\nPrivateKey",
+		"unknown directive":     "[Interface]\n# point-c unknown value",
+		"unknown type":          "[Interface]\nPrivateKey = " + private + "\nAddress = 10.0.0.1/24\n# point-c type router",
+		"type of a peer":        "[Interface]\nPrivateKey = " + private + "\nAddress = 10.0.0.1/24\n[Peer]\n# point-c type server",
+		"duplicate names":       "[Interface]\nPrivateKey = " + private + "\nAddress = 10.0.0.1/24\n# point-c name a\n[Interface]\nPrivateKey = " + private + "\nAddress = 10.0.0.1/24\n# point-c name a",
+		"peer without address":  "[Interface]\nPrivateKey = " + private + "\nAddress = 10.0.0.1\n[Peer]\nPublicKey = " + public,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := adaptNetworks(t, "wg0.conf", body)
+			require.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package configvalues
+
+import (
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Redacted is written in place of a secret when it is marshaled or logged.
+const Redacted = "REDACTED"
+
+var (
+	_ encoding.TextMarshaler = Secret[string, ValueString, *ValueString]{}
+	_ json.Marshaler         = (*Secret[string, ValueString, *ValueString])(nil)
+	_ slog.LogValuer         = Secret[string, ValueString, *ValueString]{}
+	_ fmt.Stringer           = Secret[string, ValueString, *ValueString]{}
+	_ fmt.GoStringer         = Secret[string, ValueString, *ValueString]{}
+)
+
+// Secret is like [CaddyTextUnmarshaler] but for sensitive values such as private keys.
+//
+// The text is one of:
+//
+//	file:<path>   the secret is read from the file, surrounding whitespace is removed
+//	env:<name>    the secret is read from the environment variable, surrounding whitespace is removed
+//	<secret>      the secret itself, placeholders are replaced
+//
+// Files and variables are read every time the config is loaded, so a reload picks up a changed secret.
+// The secret itself is never marshaled or logged. The file or variable it was read from is written instead, or [Redacted] if the text was the secret.
+//
+// Only marshaling the module redacts the secret. Caddy keeps the config as it was loaded, so a secret given inline is still returned
+// by GET /config/ of the admin API and written by caddy adapt. Use file: or env: for secrets in a config others may read through those.
+type Secret[V, T any, TP valueConstraint[V, T]] struct {
+	value T
+	// text is what is safe to marshal, empty if the secret was never unmarshaled.
+	text string
+}
+
+// MarshalText returns where the secret was loaded from, or [Redacted].
+func (s Secret[V, T, TP]) MarshalText() ([]byte, error) { return []byte(s.text), nil }
+
+// UnmarshalText loads the secret.
+func (s *Secret[V, T, TP]) UnmarshalText(text []byte) error {
+	source := string(text)
+	var secret string
+	switch {
+	case source == Redacted:
+		return errors.New("secret is redacted, the config must have the secret or where to load it from")
+	case strings.HasPrefix(source, "file:"):
+		b, err := os.ReadFile(caddyReplacer().ReplaceAll(strings.TrimPrefix(source, "file:"), ""))
+		if err != nil {
+			return fmt.Errorf("failed to read secret: %w", err)
+		}
+		secret = strings.TrimSpace(string(b))
+	case strings.HasPrefix(source, "env:"):
+		name := strings.TrimPrefix(source, "env:")
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return fmt.Errorf("failed to read secret: environment variable %q is not set", name)
+		}
+		secret = strings.TrimSpace(v)
+	default:
+		// Placeholders do not reveal the secret, so they are kept like files and variables.
+		if secret = caddyReplacer().ReplaceAll(source, ""); secret == source {
+			source = Redacted
+		}
+	}
+
+	if err := any(&s.value).(encoding.TextUnmarshaler).UnmarshalText([]byte(secret)); err != nil {
+		return err
+	}
+	s.text = source
+	return nil
+}
+
+// MarshalJSON marshals where the secret was loaded from, or [Redacted], as a JSON string.
+func (s *Secret[V, T, TP]) MarshalJSON() ([]byte, error) { return json.Marshal(s.text) }
+
+// UnmarshalJSON loads the secret from a JSON string.
+func (s *Secret[V, T, TP]) UnmarshalJSON(text []byte) error {
+	if str := ""; json.Unmarshal(text, &str) == nil {
+		text = []byte(str)
+	}
+	return s.UnmarshalText(text)
+}
+
+// Value returns the secret.
+func (s *Secret[V, T, TP]) Value() V {
+	return any(&s.value).(Value[V]).Value()
+}
+
+// LogValue logs where the secret was loaded from, or [Redacted].
+func (s Secret[V, T, TP]) LogValue() slog.Value { return slog.StringValue(s.text) }
+
+// String returns where the secret was loaded from, or [Redacted].
+func (s Secret[V, T, TP]) String() string { return s.text }
+
+// GoString returns where the secret was loaded from, or [Redacted].
+func (s Secret[V, T, TP]) GoString() string { return s.text }
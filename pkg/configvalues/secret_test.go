@@ -0,0 +1,77 @@
+package configvalues
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type testSecret = Secret[string, ValueString, *ValueString]
+
+func TestSecret_UnmarshalText(t *testing.T) {
+	const secret = "hunter2"
+	file := filepath.Join(t.TempDir(), "secret")
+	require.NoError(t, os.WriteFile(file, []byte(secret+"\n"), 0o600))
+	env := uuid.New().String()
+	t.Setenv(env, secret)
+
+	for _, tt := range []struct {
+		name, text, marshaled string
+	}{
+		{name: "literal", text: secret, marshaled: Redacted},
+		{name: "file", text: "file:" + file, marshaled: "file:" + file},
+		{name: "env", text: "env:" + env, marshaled: "env:" + env},
+		{name: "placeholder", text: fmt.Sprintf("{env.%s}", env), marshaled: fmt.Sprintf("{env.%s}", env)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var v testSecret
+			require.NoError(t, v.UnmarshalText([]byte(tt.text)))
+			require.Exactly(t, secret, v.Value())
+			b, err := v.MarshalText()
+			require.NoError(t, err)
+			require.Exactly(t, tt.marshaled, string(b))
+			require.Exactly(t, tt.marshaled, v.String())
+			require.Exactly(t, tt.marshaled, fmt.Sprintf("%#v", v))
+		})
+	}
+
+	t.Run("reload", func(t *testing.T) {
+		var v testSecret
+		require.NoError(t, v.UnmarshalText([]byte("file:"+file)))
+		require.NoError(t, os.WriteFile(file, []byte("changed"), 0o600))
+		require.NoError(t, v.UnmarshalText([]byte("file:"+file)))
+		require.Exactly(t, "changed", v.Value())
+	})
+
+	for _, text := range []string{"file:" + filepath.Join(t.TempDir(), "missing"), "env:" + uuid.New().String(), Redacted} {
+		t.Run("invalid "+text, func(t *testing.T) {
+			var v testSecret
+			require.Error(t, v.UnmarshalText([]byte(text)))
+		})
+	}
+}
+
+func TestSecret_JSON(t *testing.T) {
+	var v struct{ Key testSecret }
+	require.NoError(t, json.Unmarshal([]byte(`{"Key": "hunter2"}`), &v))
+	require.Exactly(t, "hunter2", v.Key.Value())
+	b, err := json.Marshal(&v)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"Key": "REDACTED"}`, string(b))
+	require.Error(t, json.Unmarshal(b, &v))
+}
+
+func TestSecret_LogValue(t *testing.T) {
+	var v testSecret
+	require.NoError(t, v.UnmarshalText([]byte("hunter2")))
+	var buf bytes.Buffer
+	slog.New(slog.NewTextHandler(&buf, nil)).Info("loaded", "key", v)
+	require.NotContains(t, buf.String(), "hunter2")
+	require.Contains(t, buf.String(), Redacted)
+}
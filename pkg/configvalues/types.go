@@ -18,6 +18,14 @@ type (
 	// IPv4 or IPv6 address representations into [net.IP].
 	IP = CaddyTextUnmarshaler[net.IP, ValueIP, *ValueIP]
 
+	// CIDR is a type alias for handling subnets in CIDR notation.
+	// It wraps the [net.IPNet] type and uses [CaddyTextUnmarshaler] for parsing.
+	CIDR = CaddyTextUnmarshaler[*net.IPNet, ValueCIDR, *ValueCIDR]
+
+	// Keepalive is a persistent keepalive interval in seconds.
+	// It is either a number of seconds, a duration like "25s", or "off", parsed by [ValueKeepalive].
+	Keepalive = CaddyTextUnmarshaler[uint16, ValueKeepalive, *ValueKeepalive]
+
 	// Hostname represents a unique hostname string.
 	// This type uses [CaddyTextUnmarshaler] with a string base type.
 	Hostname = CaddyTextUnmarshaler[string, ValueString, *ValueString]
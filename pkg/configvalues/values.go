@@ -2,9 +2,14 @@ package configvalues
 
 import (
 	"encoding/binary"
+	"fmt"
+	"github.com/caddyserver/caddy/v2"
 	"golang.org/x/exp/constraints"
+	"math"
 	"net"
 	"strconv"
+	"strings"
+	"time"
 	"unsafe"
 )
 
@@ -40,6 +45,34 @@ func (s *ValueString) Value() string {
 	return string(*s)
 }
 
+// ValueHostname handles unmarshalling hostnames.
+type ValueHostname string
+
+// UnmarshalText checks the hostname is made of dot separated labels of lowercase letters, digits, and hyphens.
+// Labels are 1 to 63 characters and do not start or end with a hyphen, the hostname is at most 253 characters.
+func (h *ValueHostname) UnmarshalText(b []byte) error {
+	name := string(b)
+	if name == "" || len(name) > 253 {
+		return fmt.Errorf("invalid hostname %q: must be 1 to 253 characters", name)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return fmt.Errorf("invalid hostname %q: labels must be 1 to 63 characters", name)
+		} else if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("invalid hostname %q: labels can not start or end with a hyphen", name)
+		} else if strings.ContainsFunc(label, func(r rune) bool { return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-') }) {
+			return fmt.Errorf("invalid hostname %q: only lowercase letters, digits, and hyphens are allowed", name)
+		}
+	}
+	*h = ValueHostname(name)
+	return nil
+}
+
+// Value returns the underlying string value of ValueHostname.
+func (h *ValueHostname) Value() string {
+	return string(*h)
+}
+
 // ValueUnsigned is a generic type for unmarshalling an unsigned number.
 // N must be an unsigned type (e.g., uint, uint32).
 type ValueUnsigned[N constraints.Unsigned] struct{ V N }
@@ -100,3 +133,48 @@ func (ip *ValueIP) UnmarshalText(text []byte) error {
 func (ip *ValueIP) Value() net.IP {
 	return net.IP(*ip)
 }
+
+// ValueCIDR handles unmarshalling a [net.IPNet] in CIDR notation.
+type ValueCIDR net.IPNet
+
+// UnmarshalText parses the text using [net.ParseCIDR]. The address is masked, so "10.0.0.1/24" becomes "10.0.0.0/24".
+func (cidr *ValueCIDR) UnmarshalText(text []byte) error {
+	_, n, err := net.ParseCIDR(string(text))
+	if err != nil {
+		return err
+	}
+	*cidr = ValueCIDR(*n)
+	return nil
+}
+
+// Value returns the underlying net.IPNet of ValueCIDR.
+func (cidr *ValueCIDR) Value() *net.IPNet {
+	return (*net.IPNet)(cidr)
+}
+
+// ValueKeepalive handles unmarshalling a persistent keepalive interval in seconds.
+type ValueKeepalive struct{ V uint16 }
+
+// UnmarshalText parses a number of seconds, a whole second duration parsed with [caddy.ParseDuration], or "off" for 0.
+func (k *ValueKeepalive) UnmarshalText(text []byte) error {
+	s := string(text)
+	if s == "off" {
+		k.V = 0
+		return nil
+	} else if n, err := strconv.ParseUint(s, 10, 16); err == nil {
+		k.V = uint16(n)
+		return nil
+	}
+
+	d, err := caddy.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid keepalive %q: %w", s, err)
+	} else if d < 0 || d%time.Second != 0 || d > math.MaxUint16*time.Second {
+		return fmt.Errorf("keepalive %q must be whole seconds between 0 and %d", s, math.MaxUint16)
+	}
+	k.V = uint16(d / time.Second)
+	return nil
+}
+
+// Value returns the underlying number of seconds of ValueKeepalive.
+func (k *ValueKeepalive) Value() uint16 { return k.V }
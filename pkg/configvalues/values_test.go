@@ -1,10 +1,12 @@
 package configvalues
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/exp/constraints"
 	"net"
+	"strings"
 	"testing"
 )
 
@@ -46,6 +48,18 @@ func TestValueString(t *testing.T) {
 	require.Exactly(t, testStr, vs.Value())
 }
 
+func TestValueHostname(t *testing.T) {
+	for _, name := range []string{"server", "app-server", "a.b", "peer-1.example", strings.Repeat("a", 63)} {
+		var vh ValueHostname
+		require.NoError(t, vh.UnmarshalText([]byte(name)), name)
+		require.Exactly(t, name, vh.Value())
+	}
+	for _, name := range []string{"", ".", "..", "a..b", ".a", "a.", "Server", "app_server", "-a", "a-", "a b", "a/b", strings.Repeat("a", 64)} {
+		var vh ValueHostname
+		require.Error(t, vh.UnmarshalText([]byte(name)), name)
+	}
+}
+
 func TestValueUnsigned(t *testing.T) {
 	testValueUnsigned[uint](t)
 	testValueUnsigned[uint8](t)
@@ -123,3 +137,50 @@ func TestValueUDPAddr(t *testing.T) {
 		require.Exactly(t, addr, vu.Value())
 	})
 }
+
+func TestValueCIDR(t *testing.T) {
+	t.Run("invalid subnet", func(t *testing.T) {
+		var vc ValueCIDR
+		require.Error(t, vc.UnmarshalText([]byte("10.0.0.1")))
+	})
+
+	t.Run("ipv4", func(t *testing.T) {
+		var vc ValueCIDR
+		require.NoError(t, vc.UnmarshalText([]byte("10.0.0.1/24")))
+		require.Equal(t, "10.0.0.0/24", vc.Value().String())
+	})
+
+	t.Run("ipv6", func(t *testing.T) {
+		var vc ValueCIDR
+		require.NoError(t, vc.UnmarshalText([]byte("fd00::1/64")))
+		require.Equal(t, "fd00::/64", vc.Value().String())
+	})
+}
+
+func TestValueKeepalive(t *testing.T) {
+	tests := []struct {
+		json     string
+		expected uint16
+		wantErr  bool
+	}{
+		{json: `25`, expected: 25},
+		{json: `"off"`, expected: 0},
+		{json: `0`, expected: 0},
+		{json: `"1m"`, expected: 60},
+		{json: `"1.5s"`, wantErr: true},
+		{json: `"-1s"`, wantErr: true},
+		{json: `"forever"`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.json, func(t *testing.T) {
+			var k Keepalive
+			err := json.Unmarshal([]byte(tt.json), &k)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, k.Value())
+		})
+	}
+}
@@ -1,6 +1,14 @@
 package wg
 
-import "golang.zx2c4.com/wireguard/conn"
+import (
+	"errors"
+	"fmt"
+	"golang.zx2c4.com/wireguard/conn"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+)
 
 type Bind = conn.Bind
 
@@ -8,3 +16,225 @@ type Bind = conn.Bind
 func DefaultBind() Bind {
 	return conn.NewDefaultBind()
 }
+
+var (
+	_ Bind          = (*AddrBind)(nil)
+	_ Bind          = (*socketBind)(nil)
+	_ conn.Endpoint = (*socketEndpoint)(nil)
+)
+
+// AddrBind is a [Bind] that only listens on the given host addresses, so the port can be shared with other programs listening on other addresses.
+// Addresses without a port use the port the device listens on. Without any addresses it listens on every address like [DefaultBind].
+type AddrBind struct {
+	mu    sync.RWMutex
+	addrs []netip.AddrPort
+	bind  Bind // bind is the open bind, nil if it is closed.
+	batch int  // batch is the batch size of the default bind, which can not change while the device runs.
+}
+
+// NewAddrBind creates a bind listening on the addresses.
+func NewAddrBind(addrs ...netip.AddrPort) *AddrBind {
+	return &AddrBind{addrs: slices.Clone(addrs), batch: DefaultBind().BatchSize()}
+}
+
+// Addrs gets the addresses the bind listens on once opened.
+func (b *AddrBind) Addrs() []netip.AddrPort {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return slices.Clone(b.addrs)
+}
+
+// SetAddrs changes the addresses the bind listens on. They are used the next time it is opened, see [Wireguard.UpdateBind].
+func (b *AddrBind) SetAddrs(addrs ...netip.AddrPort) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.addrs = slices.Clone(addrs)
+}
+
+func (b *AddrBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.bind != nil {
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+
+	bind := DefaultBind()
+	if len(b.addrs) > 0 {
+		bind = &socketBind{addrs: b.addrs}
+	}
+	fns, port, err := bind.Open(port)
+	if err != nil {
+		return nil, 0, err
+	}
+	b.bind = bind
+	return fns, port, nil
+}
+
+func (b *AddrBind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.bind == nil {
+		return nil
+	}
+	err := b.bind.Close()
+	b.bind = nil
+	return err
+}
+
+func (b *AddrBind) SetMark(mark uint32) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.bind == nil {
+		return nil
+	}
+	return b.bind.SetMark(mark)
+}
+
+func (b *AddrBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.bind == nil {
+		return net.ErrClosed
+	}
+	// Endpoints received while listening on addresses are still used after changing to the default bind.
+	if e, ok := ep.(*socketEndpoint); ok {
+		if _, ok := b.bind.(*socketBind); !ok {
+			ep = &e.StdNetEndpoint
+		}
+	}
+	return b.bind.Send(bufs, ep)
+}
+
+func (*AddrBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	addr, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil, err
+	}
+	return &conn.StdNetEndpoint{AddrPort: addr}, nil
+}
+
+func (b *AddrBind) BatchSize() int { return b.batch }
+
+type (
+	// socketBind listens on a UDP socket per address.
+	socketBind struct {
+		addrs []netip.AddrPort
+		mu    sync.RWMutex
+		conns []*net.UDPConn
+	}
+	// socketEndpoint is an endpoint received on a socket. Replies are sent from the same socket, so the peer sees the address it sent to.
+	socketEndpoint struct {
+		conn.StdNetEndpoint
+		conn *net.UDPConn
+	}
+)
+
+func (b *socketBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.conns) > 0 {
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+
+	fns := make([]conn.ReceiveFunc, 0, len(b.addrs))
+	for _, addr := range b.addrs {
+		addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+		if addr.Port() == 0 {
+			addr = netip.AddrPortFrom(addr.Addr(), port)
+		}
+		network := "udp6"
+		if addr.Addr().Is4() {
+			network = "udp4"
+		}
+		c, err := net.ListenUDP(network, net.UDPAddrFromAddrPort(addr))
+		if err != nil {
+			err = fmt.Errorf("failed to listen on %s: %w", addr, err)
+			for _, c := range b.conns {
+				err = errors.Join(err, c.Close())
+			}
+			b.conns = nil
+			return nil, 0, err
+		}
+		// A random port is chosen by the first socket, the other sockets use the same port.
+		if port == 0 {
+			port = c.LocalAddr().(*net.UDPAddr).AddrPort().Port()
+		}
+		b.conns = append(b.conns, c)
+		fns = append(fns, b.receive(c))
+	}
+	return fns, port, nil
+}
+
+// receive reads packets from a socket.
+func (b *socketBind) receive(c *net.UDPConn) conn.ReceiveFunc {
+	return func(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		n, addr, err := c.ReadFromUDPAddrPort(packets[0])
+		if err != nil {
+			return 0, err
+		}
+		sizes[0] = n
+		eps[0] = &socketEndpoint{StdNetEndpoint: conn.StdNetEndpoint{AddrPort: netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())}, conn: c}
+		return 1, nil
+	}
+}
+
+func (b *socketBind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var err error
+	for _, c := range b.conns {
+		err = errors.Join(err, c.Close())
+	}
+	b.conns = nil
+	return err
+}
+
+// SetMark does nothing, marks are not supported when listening on addresses.
+func (*socketBind) SetMark(uint32) error { return nil }
+
+func (b *socketBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	var dst netip.AddrPort
+	var via *net.UDPConn
+	switch e := ep.(type) {
+	case *socketEndpoint:
+		dst, via = e.AddrPort, e.conn
+	case *conn.StdNetEndpoint:
+		dst = e.AddrPort
+	default:
+		return conn.ErrWrongEndpointType
+	}
+
+	c, err := b.socket(dst, via)
+	if err != nil {
+		return err
+	}
+	for _, buf := range bufs {
+		if _, err := c.WriteToUDPAddrPort(buf, dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// socket gets the socket to send to dst from. The socket the peer was heard on is used if it is still open, otherwise the first socket of the same address family.
+func (b *socketBind) socket(dst netip.AddrPort, via *net.UDPConn) (*net.UDPConn, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if len(b.conns) == 0 {
+		return nil, net.ErrClosed
+	} else if via != nil && slices.Contains(b.conns, via) {
+		return via, nil
+	}
+	is4 := dst.Addr().Unmap().Is4()
+	for _, c := range b.conns {
+		if c.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap().Is4() == is4 {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("no address to send to %s from", dst)
+}
+
+func (*socketBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	return (*AddrBind)(nil).ParseEndpoint(s)
+}
+func (*socketBind) BatchSize() int { return 1 }
@@ -1,11 +1,130 @@
 package wg
 
 import (
+	"context"
 	"github.com/stretchr/testify/require"
+	"github.com/trymoose/point-c/pkg/wg/wgapi"
 	"golang.zx2c4.com/wireguard/conn"
+	"net"
+	"net/netip"
 	"testing"
+	"time"
 )
 
 func TestDefaultBind(t *testing.T) {
 	require.IsType(t, conn.NewDefaultBind(), DefaultBind())
 }
+
+func TestAddrBind(t *testing.T) {
+	serverPrivate, serverPublic, err := wgapi.NewPrivatePublic()
+	require.NoError(t, err)
+	serverIP, clientIP := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+
+	bind := NewAddrBind(netip.MustParseAddrPort("127.0.0.1:0"))
+	var serverNet *Net
+	server, err := New(OptionNetDevice(&serverNet), OptionBind(bind), OptionConfig(wgapi.IPC{serverPrivate}))
+	require.NoError(t, err)
+	t.Cleanup(func() { server.Close() })
+	port := listenPort(t, server)
+	require.NotZero(t, port)
+
+	// Only the configured address is used, so another program can use the port on other addresses.
+	other, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: int(port)})
+	require.NoError(t, err)
+	require.NoError(t, other.Close())
+
+	ln, err := serverNet.Listen(&net.TCPAddr{IP: serverIP, Port: 80})
+	require.NoError(t, err)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+
+	// dial connects to the server from a new client. Every client has its own key, so the sessions of earlier clients do not interfere.
+	dial := func(t *testing.T, endpoint string) {
+		t.Helper()
+		clientPrivate, clientPublic, err := wgapi.NewPrivatePublic()
+		require.NoError(t, err)
+		require.NoError(t, server.SetConfig(wgapi.IPC{clientPublic, wgapi.IdentitySubnet(clientIP)}))
+
+		var clientNet *Net
+		client, err := New(OptionNetDevice(&clientNet), OptionConfig(wgapi.IPC{
+			clientPrivate,
+			serverPublic,
+			wgapi.Endpoint(*net.UDPAddrFromAddrPort(netip.MustParseAddrPort(endpoint))),
+			wgapi.IdentitySubnet(serverIP),
+		}))
+		require.NoError(t, err)
+		defer client.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+		defer cancel()
+		c, err := clientNet.Dialer(clientIP, 0).DialTCP(ctx, &net.TCPAddr{IP: serverIP, Port: 80})
+		require.NoError(t, err)
+		require.NoError(t, c.Close())
+	}
+
+	t.Run("listen", func(t *testing.T) {
+		dial(t, netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), port).String())
+	})
+
+	t.Run("update", func(t *testing.T) {
+		bind.SetAddrs(netip.MustParseAddrPort("127.0.0.2:0"))
+		require.NoError(t, server.UpdateBind())
+		require.Equal(t, port, listenPort(t, server))
+		require.Equal(t, []netip.AddrPort{netip.MustParseAddrPort("127.0.0.2:0")}, bind.Addrs())
+		dial(t, netip.AddrPortFrom(netip.MustParseAddr("127.0.0.2"), port).String())
+	})
+}
+
+func listenPort(t *testing.T, dev *Wireguard) uint16 {
+	t.Helper()
+	ipc, err := dev.GetConfig()
+	require.NoError(t, err)
+	for _, kv := range ipc {
+		if p, ok := kv.(wgapi.ListenPort); ok {
+			return uint16(p)
+		}
+	}
+	return 0
+}
+
+func TestWireguard_Up(t *testing.T) {
+	private, err := wgapi.NewPrivate()
+	require.NoError(t, err)
+	free, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	addr := free.LocalAddr().(*net.UDPAddr).AddrPort()
+	require.NoError(t, free.Close())
+
+	var n *Net
+	dev, err := New(OptionNetDevice(&n), OptionBind(NewAddrBind(addr)), OptionConfig(wgapi.IPC{private}), OptionDown())
+	require.NoError(t, err)
+	t.Cleanup(func() { dev.Close() })
+
+	// bound reports whether the device is listening on the address.
+	bound := func() bool {
+		t.Helper()
+		c, err := net.ListenUDP("udp4", net.UDPAddrFromAddrPort(addr))
+		if err != nil {
+			return true
+		}
+		require.NoError(t, c.Close())
+		return false
+	}
+
+	require.False(t, bound(), "device listens before it is up")
+	require.NoError(t, dev.Up())
+	require.True(t, bound(), "device does not listen once up")
+	require.NoError(t, dev.Up())
+	require.NoError(t, dev.Down())
+	require.False(t, bound(), "device listens after it is down")
+	require.NoError(t, dev.Up())
+	require.True(t, bound(), "device does not listen once up again")
+}
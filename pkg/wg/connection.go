@@ -3,9 +3,11 @@ package wg
 
 import (
 	"errors"
+	"fmt"
 	"github.com/trymoose/point-c/pkg/wg/wgapi"
 	"github.com/trymoose/point-c/pkg/wg/wglog"
 	"golang.zx2c4.com/wireguard/device"
+	"sync"
 	"sync/atomic"
 )
 
@@ -14,6 +16,8 @@ type Wireguard struct {
 	dev     *device.Device
 	close   atomic.Pointer[error]
 	closers []func() error
+	set     sync.Mutex // set serializes [Wireguard.SetConfig] so a rollback does not undo another call.
+	events  *events
 }
 
 // New allows the creating of a new wireguard interface.
@@ -35,8 +39,11 @@ func New(opts ...option) (_ *Wireguard, err error) {
 		o.closer = append(o.closer, o.bind.Close)
 	}
 
-	c := &Wireguard{dev: device.NewDevice(o.tun, o.bind, wglog.Multi(o.loggers...))}
+	ev := newEvents()
+	o.closer = append(o.closer, ev.Close)
+	c := &Wireguard{dev: device.NewDevice(o.tun, o.bind, wglog.Multi(append(o.loggers, ev.logger())...)), events: ev}
 	defer func() { c.closers = o.closer }()
+	ev.start(c.dev)
 	o.closer = append(o.closer, func() error { c.dev.Close(); return nil })
 
 	if o.cfg != nil {
@@ -45,8 +52,10 @@ func New(opts ...option) (_ *Wireguard, err error) {
 		}
 	}
 
-	if err := c.dev.Up(); err != nil {
-		return nil, err
+	if !o.down {
+		if err := c.dev.Up(); err != nil {
+			return nil, err
+		}
 	}
 	o.closer = append(o.closer, c.dev.Down)
 
@@ -64,10 +73,73 @@ func (c *Wireguard) GetConfig() (wgapi.IPC, error) {
 }
 
 // SetConfig performs an IPC set=1 operation.
+// The configuration is checked with [wgapi.Validate] first, so invalid configurations are rejected without changing the device.
+// If the device fails to apply the configuration, it is restored to the configuration it had before the call.
+// Errors from the device are returned as an [*wgapi.IPCError].
 func (c *Wireguard) SetConfig(cfg wgapi.Configurable) error {
-	return c.dev.IpcSetOperation(cfg.WGConfig())
+	ipc, err := wgapi.Validate(cfg)
+	if err != nil {
+		return err
+	}
+	c.set.Lock()
+	defer c.set.Unlock()
+
+	// The peers are only known once the configuration is applied, but before the events the device sent while applying it are delivered.
+	pending := c.events.pending(ipc)
+	applied := false
+	defer func() { pending.finish(applied) }()
+
+	snapshot, err := c.GetConfig()
+	if err != nil {
+		return fmt.Errorf("failed to snapshot config: %w", err)
+	}
+
+	if err := c.ipcSet(ipc); err != nil {
+		if rerr := c.restore(snapshot); rerr != nil {
+			return errors.Join(err, fmt.Errorf("failed to restore config: %w", rerr))
+		}
+		return err
+	}
+	applied = true
+	c.events.removed(ipc)
+	return nil
 }
 
+// restore changes the device back to the snapshot with the smallest change possible, leaving peers that were not changed connected.
+func (c *Wireguard) restore(snapshot wgapi.IPC) error {
+	current, err := c.GetConfig()
+	if err != nil {
+		return err
+	}
+	ipc, err := wgapi.Diff(current, snapshot)
+	if err != nil {
+		return err
+	}
+	return c.ipcSet(ipc)
+}
+
+// ipcSet applies the IPC to the device, converting errors to [*wgapi.IPCError].
+func (c *Wireguard) ipcSet(ipc wgapi.IPC) error {
+	err := c.dev.IpcSetOperation(ipc.WGConfig())
+	var ipcErr *device.IPCError
+	if errors.As(err, &ipcErr) {
+		return &wgapi.IPCError{Errno: wgapi.Errno(ipcErr.ErrorCode()), Err: ipcErr.Unwrap()}
+	}
+	return err
+}
+
+// Up brings the interface up, opening its [Bind]. Bringing up an interface that is up does nothing.
+func (c *Wireguard) Up() error { return c.dev.Up() }
+
+// Down brings the interface down, closing its [Bind]. The configuration is kept, so it can be brought up again.
+func (c *Wireguard) Down() error { return c.dev.Down() }
+
+// Bind gets the bind the device sends and receives encrypted packets with.
+func (c *Wireguard) Bind() Bind { return c.dev.Bind() }
+
+// UpdateBind closes the sockets of the device and opens them again, so changes to its [Bind] such as [AddrBind.SetAddrs] take effect.
+func (c *Wireguard) UpdateBind() error { return c.dev.BindUpdate() }
+
 // Close closes the wireguard server/client, rendering it unusable in the future.
 func (c *Wireguard) Close() (err error) {
 	if c.close.CompareAndSwap(nil, &err) {
@@ -2,7 +2,9 @@ package wg_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"github.com/stretchr/testify/require"
 	"github.com/trymoose/point-c/pkg/wg"
 	"github.com/trymoose/point-c/pkg/wg/wgapi"
 	"github.com/trymoose/point-c/pkg/wg/wgapi/wgconfig"
@@ -11,8 +13,10 @@ import (
 	"golang.zx2c4.com/wireguard/conn"
 	"golang.zx2c4.com/wireguard/conn/bindtest"
 	"golang.zx2c4.com/wireguard/device"
+	"io"
 	"math"
 	"net"
+	"slices"
 	"testing"
 	"time"
 )
@@ -165,3 +169,151 @@ func testLogger(t testing.TB) *device.Logger {
 		},
 	}
 }
+
+// failBind rejects a single endpoint so a set operation can fail partway through.
+type failBind struct {
+	conn.Bind
+	fail string
+}
+
+func (b *failBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	if s == b.fail {
+		return nil, errors.New("endpoint rejected")
+	}
+	return b.Bind.ParseEndpoint(s)
+}
+
+func TestWireguard_SetConfig(t *testing.T) {
+	binds := bindtest.NewChannelBinds()
+	defer binds[0].Close()
+	bind := &failBind{Bind: binds[0], fail: "127.0.0.1:2"}
+
+	private, err := wgapi.NewPrivate()
+	require.NoError(t, err)
+	_, peer1, err := wgapi.NewPrivatePublic()
+	require.NoError(t, err)
+	_, peer2, err := wgapi.NewPrivatePublic()
+	require.NoError(t, err)
+	_, peer3, err := wgapi.NewPrivatePublic()
+	require.NoError(t, err)
+
+	initial := wgapi.IPC{
+		private,
+		peer1,
+		wgapi.IdentitySubnet(net.IPv4(10, 0, 0, 2)),
+	}
+
+	var n *wg.Net
+	dev, err := wg.New(wg.OptionNetDevice(&n), wg.OptionBind(bind), wg.OptionConfig(initial))
+	require.NoError(t, err)
+	defer dev.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	events := dev.SubscribeChan(ctx, 16, wg.FilterPeers(peer2, peer3))
+
+	requireConfig := func(t *testing.T, expected wgapi.Configurable) {
+		t.Helper()
+		current, err := dev.GetConfig()
+		require.NoError(t, err)
+		diff, err := wgapi.Diff(current, expected)
+		require.NoError(t, err)
+		require.Empty(t, diff, "device config changed")
+	}
+
+	t.Run("invalid config is not applied", func(t *testing.T) {
+		err := dev.SetConfig(wgapi.IPC{
+			peer1,
+			wgapi.Remove{},
+			peer2,
+			wgapi.IdentitySubnet(net.IPv4(10, 0, 0, 3)),
+			peer2,
+		})
+		var lineErr *wgapi.LineError
+		require.ErrorAs(t, err, &lineErr)
+		require.Equal(t, 5, lineErr.Line)
+		require.ErrorIs(t, err, &wgapi.IPCError{Errno: wgapi.ErrnoInvalid})
+		requireConfig(t, initial)
+	})
+
+	t.Run("failed config is rolled back", func(t *testing.T) {
+		err := dev.SetConfig(wgapi.IPC{
+			peer1,
+			wgapi.UpdateOnly{},
+			wgapi.ReplaceAllowedIPs{},
+			wgapi.IdentitySubnet(net.IPv4(10, 0, 0, 4)),
+			peer2,
+			wgapi.IdentitySubnet(net.IPv4(10, 0, 0, 3)),
+			peer3,
+			wgapi.Endpoint{IP: net.IPv4(127, 0, 0, 1), Port: 2},
+		})
+		require.ErrorIs(t, err, &wgapi.IPCError{Errno: wgapi.ErrnoInvalid})
+		requireConfig(t, initial)
+	})
+
+	t.Run("valid config is applied", func(t *testing.T) {
+		cfg := wgapi.IPC{
+			peer2,
+			wgapi.IdentitySubnet(net.IPv4(10, 0, 0, 3)),
+		}
+		require.NoError(t, dev.SetConfig(cfg))
+		requireConfig(t, append(slices.Clone(initial), cfg...))
+
+		// Events are delivered in order, so the events of the failed config would come first.
+		select {
+		case e := <-events:
+			require.Equal(t, wg.PeerStarted, e.Type)
+		case <-ctx.Done():
+			t.Fatal("no peer started event")
+		}
+		select {
+		case e := <-events:
+			t.Fatalf("unexpected event %s", e.Type)
+		default:
+		}
+	})
+}
+
+func TestNet_AddLocal(t *testing.T) {
+	ns, err := wg.NewDefaultNetstack()
+	require.NoError(t, err)
+	defer ns.Close()
+	n := ns.Net()
+	local := net.IPv4(10, 0, 0, 1)
+	n.AddLocal(local)
+
+	ln, err := n.Listen(&net.TCPAddr{IP: local, Port: 80})
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			defer c.Close()
+			_, _ = c.Write([]byte("hello"))
+		}
+	}()
+
+	// Nothing reads the packets going out of the stack, the dial only succeeds if they are delivered back to it.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	c, err := n.Dialer(local, 0).DialTCP(ctx, &net.TCPAddr{IP: local, Port: 80})
+	require.NoError(t, err)
+	defer c.Close()
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(c, buf)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buf))
+
+	// Once removed the packets go out of the stack again, they are read and dropped so nothing answers.
+	n.RemoveLocal(local)
+	go func() {
+		bufs, sizes := [][]byte{make([]byte, 1500)}, make([]int, 1)
+		for {
+			if _, err := ns.Read(bufs, sizes, 0); err != nil {
+				return
+			}
+		}
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	_, err = n.Dialer(local, 0).DialTCP(ctx, &net.TCPAddr{IP: local, Port: 80})
+	require.Error(t, err)
+}
@@ -0,0 +1,528 @@
+package wg
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/trymoose/point-c/pkg/wg/wgapi"
+	"github.com/trymoose/point-c/pkg/wg/wglog"
+	"github.com/trymoose/point-c/pkg/wg/wglog/wgevents"
+	"golang.zx2c4.com/wireguard/device"
+	"slices"
+	"sync"
+	"time"
+)
+
+// PeerEventType is a transition in the lifecycle of a peer.
+type PeerEventType uint8
+
+const (
+	PeerStarted        PeerEventType = iota + 1 // PeerStarted is sent when a peer starts, either when the device comes up or the peer is added to a running device.
+	PeerStopped                                 // PeerStopped is sent when a peer stops, either when the device goes down or the peer is removed.
+	HandshakeCompleted                          // HandshakeCompleted is sent when a handshake with a peer completes and new keys are in use.
+	HandshakeFailing                            // HandshakeFailing is sent when a handshake went unanswered and is being retried.
+	HandshakeFailed                             // HandshakeFailed is sent when the device gives up on a handshake after too many attempts.
+	KeysExpired                                 // KeysExpired is sent when the keys of a peer expire without a new handshake.
+)
+
+func (t PeerEventType) String() string {
+	switch t {
+	case PeerStarted:
+		return "peer started"
+	case PeerStopped:
+		return "peer stopped"
+	case HandshakeCompleted:
+		return "handshake completed"
+	case HandshakeFailing:
+		return "handshake failing"
+	case HandshakeFailed:
+		return "handshake failed"
+	case KeysExpired:
+		return "keys expired"
+	default:
+		return fmt.Sprintf("PeerEventType(%d)", uint8(t))
+	}
+}
+
+// PeerEvent is a lifecycle transition of a peer.
+type PeerEvent struct {
+	Type    PeerEventType
+	Peer    wgapi.PublicKey
+	Time    time.Time // Time is when the device logged the event.
+	Attempt int       // Attempt is the handshake attempt for [HandshakeFailing] and [HandshakeFailed].
+}
+
+// EventFilter selects the events a subscriber receives. An event is received if it is selected by all filters.
+type EventFilter func(PeerEvent) bool
+
+// FilterTypes selects events of the given types.
+func FilterTypes(types ...PeerEventType) EventFilter {
+	return func(e PeerEvent) bool { return slices.Contains(types, e.Type) }
+}
+
+// FilterPeers selects events of the given peers.
+func FilterPeers(peers ...wgapi.PublicKey) EventFilter {
+	return func(e PeerEvent) bool { return slices.Contains(peers, e.Peer) }
+}
+
+// Subscribe calls fn for each peer event selected by the filters until the returned function is called.
+// Events are delivered in order from a single goroutine, so fn should not block for long.
+// The device is never blocked by a subscriber, events are queued until they are delivered.
+func (c *Wireguard) Subscribe(fn func(PeerEvent), filters ...EventFilter) (unsubscribe func()) {
+	return c.events.subscribe(fn, filters)
+}
+
+// SubscribeChan sends the peer events selected by the filters on the returned channel.
+// The channel has a buffer of the given size and is closed when ctx is done or the device is closed.
+// A full channel delays the delivery of events to all subscribers.
+func (c *Wireguard) SubscribeChan(ctx context.Context, size int, filters ...EventFilter) <-chan PeerEvent {
+	ch := make(chan PeerEvent, size)
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(c.events.ctx, cancel)
+
+	var mu sync.Mutex
+	closed := false
+	unsubscribe := c.Subscribe(func(e PeerEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		if closed {
+			return
+		}
+		select {
+		case ch <- e:
+		case <-ctx.Done():
+		}
+	}, filters...)
+
+	context.AfterFunc(ctx, func() {
+		stop()
+		unsubscribe()
+		mu.Lock()
+		defer mu.Unlock()
+		closed = true
+		close(ch)
+	})
+	return ch
+}
+
+type (
+	// events turns the log of a device into [PeerEvent] and delivers them to subscribers.
+	events struct {
+		ctx    context.Context
+		cancel context.CancelFunc
+		dev    *device.Device
+
+		mu     sync.Mutex
+		queue  []any // queue holds [logged] from the device, [pending] from [events.pending], [forget] from [events.removed], and [confirmed] from [events.confirm].
+		signal chan struct{}
+		subs   []*subscriber
+		peers  map[string]wgapi.PublicKey    // peers maps the abbreviation used by the device log to the key of known peers.
+		last   map[wgapi.PublicKey]time.Time // last is the time of the last handshake with each peer.
+		failed map[wgapi.PublicKey]bool      // failed is the peers the device gave up a handshake with since their last handshake.
+	}
+	// forget is queued after peers are removed, so the events the device sent while removing them are still delivered.
+	forget []wgapi.PublicKey
+	// pending is queued before a configuration is applied. Delivery waits until it is finished, then its peers are known if it was applied.
+	pending struct {
+		ipc     wgapi.IPC
+		applied bool          // applied is set before done is closed.
+		done    chan struct{} // done is closed once the configuration was applied or failed.
+	}
+	// logged is an event from the device with the time it was logged.
+	logged struct {
+		ev wgevents.Event
+		at time.Time
+	}
+	// confirmed is queued once the initiator used the keys of a handshake response.
+	confirmed struct {
+		peer wgapi.PublicKey
+		at   time.Time
+	}
+	// subscriber is a single call to [Wireguard.Subscribe].
+	subscriber struct {
+		fn      func(PeerEvent)
+		filters []EventFilter
+	}
+)
+
+func newEvents() *events {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &events{
+		ctx:    ctx,
+		cancel: cancel,
+		signal: make(chan struct{}, 1),
+		peers:  map[string]wgapi.PublicKey{},
+		last:   map[wgapi.PublicKey]time.Time{},
+		failed: map[wgapi.PublicKey]bool{},
+	}
+}
+
+// logger creates the logger the device sends its events through.
+func (e *events) logger() *wglog.Logger {
+	return wgevents.Events(e.push)
+}
+
+// start begins delivering events for the device.
+func (e *events) start(dev *device.Device) {
+	e.dev = dev
+	go e.run()
+}
+
+// Close stops the delivery of events.
+func (e *events) Close() error {
+	e.cancel()
+	return nil
+}
+
+// pending queues a configuration that is about to be applied. [pending.finish] must be called once it was applied or failed.
+func (e *events) pending(ipc wgapi.IPC) *pending {
+	p := &pending{ipc: ipc, done: make(chan struct{})}
+	e.mu.Lock()
+	e.queue = append(e.queue, p)
+	e.mu.Unlock()
+	e.notify()
+	return p
+}
+
+// finish lets the events queued after the configuration be delivered.
+func (p *pending) finish(applied bool) {
+	p.applied = applied
+	close(p.done)
+}
+
+// known records the peers of a configuration so they can be found from the log of the device.
+func (e *events) known(ipc wgapi.IPC) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, kv := range ipc {
+		if pk, ok := kv.(wgapi.PublicKey); ok {
+			e.peers[abbreviate(pk)] = pk
+		}
+	}
+}
+
+// removed forgets the peers a configuration removed once it has been applied.
+func (e *events) removed(ipc wgapi.IPC) {
+	var gone forget
+	keep := map[wgapi.PublicKey]bool{}
+	replace := false
+	var pk wgapi.PublicKey
+	for _, kv := range ipc {
+		switch kv := kv.(type) {
+		case wgapi.ReplacePeers:
+			replace = true
+		case wgapi.PublicKey:
+			pk = kv
+			keep[pk] = true
+		case wgapi.Remove:
+			delete(keep, pk)
+			gone = append(gone, pk)
+		}
+	}
+
+	e.mu.Lock()
+	if replace {
+		for _, known := range e.peers {
+			if !keep[known] && !slices.Contains(gone, known) {
+				gone = append(gone, known)
+			}
+		}
+	}
+	if len(gone) == 0 {
+		e.mu.Unlock()
+		return
+	}
+	e.queue = append(e.queue, gone)
+	e.mu.Unlock()
+	e.notify()
+}
+
+// abbreviate returns the name of the peer used in the log, the same as [device.Peer.String].
+func abbreviate(pk wgapi.PublicKey) string {
+	s := base64.StdEncoding.EncodeToString(pk[:])
+	return "peer(" + s[0:4] + "…" + s[39:43] + ")"
+}
+
+// push queues an event from the device. It is called by the device, so it must never block.
+func (e *events) push(ev wgevents.Event) {
+	switch ev.(type) {
+	case *wgevents.EventPeerStarting, *wgevents.EventPeerStopping,
+		*wgevents.EventReceivedHandshakeResponse, *wgevents.EventSendingHandshakeResponse,
+		*wgevents.EventRetryingHandshake, *wgevents.EventHandshakeDidNotComplete,
+		*wgevents.EventRemovingAllKeys:
+	default:
+		return
+	}
+
+	e.mu.Lock()
+	e.queue = append(e.queue, logged{ev: ev, at: time.Now()})
+	e.mu.Unlock()
+	e.notify()
+}
+
+// notify wakes [events.run] without blocking.
+func (e *events) notify() {
+	select {
+	case e.signal <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers queued events until the device is closed.
+func (e *events) run() {
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-e.signal:
+		}
+
+		e.mu.Lock()
+		queue := e.queue
+		e.queue = nil
+		e.mu.Unlock()
+		for _, ev := range queue {
+			e.handle(ev)
+		}
+	}
+}
+
+// handle translates a device event and delivers it.
+func (e *events) handle(ev any) {
+	now := time.Now()
+	if l, ok := ev.(logged); ok {
+		ev, now = l.ev, l.at
+	}
+	switch ev := ev.(type) {
+	case *wgevents.EventPeerStarting:
+		e.emit(ev.Peer, PeerEvent{Type: PeerStarted, Time: now})
+	case *wgevents.EventPeerStopping:
+		e.emit(ev.Peer, PeerEvent{Type: PeerStopped, Time: now})
+	case *wgevents.EventRetryingHandshake:
+		e.emit(ev.Peer, PeerEvent{Type: HandshakeFailing, Time: now, Attempt: int(ev.Try)})
+	case *wgevents.EventHandshakeDidNotComplete:
+		if pk, ok := e.peer(ev.Peer); ok {
+			e.mu.Lock()
+			e.failed[pk] = true
+			e.mu.Unlock()
+		}
+		e.emit(ev.Peer, PeerEvent{Type: HandshakeFailed, Time: now, Attempt: ev.Attempts})
+	case *wgevents.EventRemovingAllKeys:
+		e.emit(ev.Peer, PeerEvent{Type: KeysExpired, Time: now})
+	case *wgevents.EventReceivedHandshakeResponse:
+		if pk, ok := e.peer(ev.Peer); ok {
+			e.handshake(pk, now)
+		}
+	case *wgevents.EventSendingHandshakeResponse:
+		// The handshake is only complete for the responder once the initiator confirms it, see [events.confirm].
+		// The event is logged before the response is sent, so the initiator can only confirm it after now.
+		if pk, ok := e.peer(ev.Peer); ok {
+			go e.confirm(pk, now)
+		}
+	case confirmed:
+		e.handshake(ev.peer, ev.at)
+	case *pending:
+		select {
+		case <-ev.done:
+		case <-e.ctx.Done():
+			return
+		}
+		if ev.applied {
+			e.known(ev.ipc)
+		}
+	case forget:
+		e.mu.Lock()
+		for _, pk := range ev {
+			delete(e.peers, abbreviate(pk))
+			delete(e.last, pk)
+			delete(e.failed, pk)
+		}
+		e.mu.Unlock()
+	}
+}
+
+// peer finds the key of a peer from the device.
+func (e *events) peer(p *device.Peer) (wgapi.PublicKey, bool) {
+	if p == nil {
+		return wgapi.PublicKey{}, false
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	pk, ok := e.peers[p.String()]
+	return pk, ok
+}
+
+// emit delivers an event for a peer of the device.
+func (e *events) emit(p *device.Peer, ev PeerEvent) {
+	pk, ok := e.peer(p)
+	if !ok {
+		return
+	}
+	ev.Peer = pk
+	e.deliver(ev)
+}
+
+// deliver sends an event to the subscribers that selected it.
+func (e *events) deliver(ev PeerEvent) {
+	e.mu.Lock()
+	subs := slices.Clone(e.subs)
+	e.mu.Unlock()
+
+	for _, s := range subs {
+		if s.selects(ev) {
+			s.fn(ev)
+		}
+	}
+}
+
+// selects reports whether the event passes all filters of the subscriber.
+func (s *subscriber) selects(ev PeerEvent) bool {
+	for _, f := range s.filters {
+		if !f(ev) {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *events) subscribe(fn func(PeerEvent), filters []EventFilter) func() {
+	s := &subscriber{fn: fn, filters: slices.Clone(filters)}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.ctx.Err() != nil {
+		return func() {}
+	}
+	e.subs = append(e.subs, s)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			e.mu.Lock()
+			defer e.mu.Unlock()
+			e.subs = slices.DeleteFunc(e.subs, func(sub *subscriber) bool { return sub == s })
+		})
+	}
+}
+
+// handshake records a completed handshake with a peer and delivers it.
+func (e *events) handshake(pk wgapi.PublicKey, now time.Time) {
+	e.mu.Lock()
+	e.last[pk] = now
+	delete(e.failed, pk)
+	e.mu.Unlock()
+	e.deliver(PeerEvent{Type: HandshakeCompleted, Peer: pk, Time: now})
+}
+
+// confirmInterval is how often [events.confirm] checks the device for the confirmation of a handshake response.
+const confirmInterval = 50 * time.Millisecond
+
+// confirm waits for the initiator to confirm a handshake response by sending its first packet with the new keys, queueing [confirmed] once it did.
+// A response the initiator rejected, like one with a different preshared key, is never confirmed.
+// The device does not log the confirmation, so its last handshake time is checked until the initiator would have retried the handshake.
+func (e *events) confirm(pk wgapi.PublicKey, sent time.Time) {
+	t := time.NewTicker(confirmInterval)
+	defer t.Stop()
+	deadline := time.NewTimer(device.RekeyTimeout)
+	defer deadline.Stop()
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-deadline.C:
+			return
+		case <-t.C:
+		}
+
+		if last, ok := e.deviceHandshake(pk); ok && !last.Before(sent) {
+			e.mu.Lock()
+			e.queue = append(e.queue, confirmed{peer: pk, at: last})
+			e.mu.Unlock()
+			e.notify()
+			return
+		}
+	}
+}
+
+// deviceHandshake gets the last handshake of the peer from the device.
+func (e *events) deviceHandshake(pk wgapi.PublicKey) (time.Time, bool) {
+	var get wgapi.IPCGet
+	if err := e.dev.IpcGetOperation(&get); err != nil {
+		return time.Time{}, false
+	}
+	ipc, err := get.Value()
+	if err != nil {
+		return time.Time{}, false
+	}
+	var peer wgapi.PublicKey
+	var sec, nsec int64
+	for _, kv := range ipc {
+		switch kv := kv.(type) {
+		case wgapi.PublicKey:
+			peer = kv
+		case wgapi.LastHandshakeTimeSec:
+			if peer == pk {
+				sec = int64(kv)
+			}
+		case wgapi.LastHandshakeTimeNSec:
+			if peer == pk {
+				nsec = int64(kv)
+			}
+		}
+	}
+	// The device reports a zero time if there was no handshake.
+	if sec == 0 && nsec == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(sec, nsec), true
+}
+
+// lastHandshake gets the time of the last handshake seen with the peer.
+func (e *events) lastHandshake(pk wgapi.PublicKey) (time.Time, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	last, ok := e.last[pk]
+	return last, ok
+}
+
+// lastHandshakeFailed reports whether the device gave up a handshake with the peer since the last handshake.
+func (e *events) lastHandshakeFailed(pk wgapi.PublicKey) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.failed[pk]
+}
+
+// LastHandshake gets the time of the last handshake with the peer seen since the device was created.
+// It is read from the events of the device, so unlike [Wireguard.GetConfig] it is cheap enough to call on every dial.
+func (c *Wireguard) LastHandshake(peer wgapi.PublicKey) (time.Time, bool) {
+	return c.events.lastHandshake(peer)
+}
+
+// LastHandshakeFailed reports whether the device gave up on a handshake with the peer, see [HandshakeFailed], since the last handshake completed.
+func (c *Wireguard) LastHandshakeFailed(peer wgapi.PublicKey) bool {
+	return c.events.lastHandshakeFailed(peer)
+}
+
+// WaitHandshake blocks until a handshake with the peer has completed or ctx is done.
+// It returns right away if a handshake already completed.
+// A handshake is only started when there is traffic for the peer, so a peer without a persistent keepalive may need something sent to it first.
+func (c *Wireguard) WaitHandshake(ctx context.Context, peer wgapi.PublicKey) error {
+	done := make(chan struct{})
+	var once sync.Once
+	unsubscribe := c.Subscribe(func(PeerEvent) { once.Do(func() { close(done) }) }, FilterTypes(HandshakeCompleted), FilterPeers(peer))
+	defer unsubscribe()
+
+	if _, ok := c.events.lastHandshake(peer); ok {
+		return nil
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.events.ctx.Done():
+		return errClosed
+	}
+}
+
+// errClosed is returned when waiting on a device that was closed.
+var errClosed = errors.New("wireguard closed")
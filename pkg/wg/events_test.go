@@ -0,0 +1,268 @@
+package wg_test
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"github.com/trymoose/point-c/pkg/wg"
+	"github.com/trymoose/point-c/pkg/wg/wgapi"
+	"github.com/trymoose/point-c/pkg/wg/wglog/wgevents"
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/device"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPeerEventType_String(t *testing.T) {
+	require.Equal(t, "handshake completed", wg.HandshakeCompleted.String())
+	require.Equal(t, "keys expired", wg.KeysExpired.String())
+	require.Equal(t, "PeerEventType(0)", wg.PeerEventType(0).String())
+}
+
+func TestEventFilters(t *testing.T) {
+	_, peer1, err := wgapi.NewPrivatePublic()
+	require.NoError(t, err)
+	_, peer2, err := wgapi.NewPrivatePublic()
+	require.NoError(t, err)
+
+	e := wg.PeerEvent{Type: wg.PeerStarted, Peer: peer1}
+	require.True(t, wg.FilterTypes(wg.PeerStarted, wg.PeerStopped)(e))
+	require.False(t, wg.FilterTypes(wg.HandshakeCompleted)(e))
+	require.True(t, wg.FilterPeers(peer2, peer1)(e))
+	require.False(t, wg.FilterPeers(peer2)(e))
+}
+
+func TestWireguard_Subscribe(t *testing.T) {
+	binds := bindtest.NewChannelBinds()
+	defer binds[0].Close()
+	defer binds[1].Close()
+
+	serverPrivate, serverPublic, err := wgapi.NewPrivatePublic()
+	require.NoError(t, err)
+	clientPrivate, clientPublic, err := wgapi.NewPrivatePublic()
+	require.NoError(t, err)
+	_, other, err := wgapi.NewPrivatePublic()
+	require.NoError(t, err)
+
+	var serverNet, clientNet *wg.Net
+	server, err := wg.New(wg.OptionNetDevice(&serverNet), wg.OptionBind(binds[0]), wg.OptionConfig(wgapi.IPC{
+		serverPrivate,
+		clientPublic,
+		wgapi.IdentitySubnet(net.IPv4(10, 0, 0, 2)),
+	}))
+	require.NoError(t, err)
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	serverEvents := server.SubscribeChan(ctx, 16, wg.FilterPeers(clientPublic))
+
+	client, err := wg.New(wg.OptionNetDevice(&clientNet), wg.OptionBind(binds[1]), wg.OptionConfig(wgapi.IPC{
+		clientPrivate,
+		serverPublic,
+		wgapi.Endpoint{IP: net.IPv4(127, 0, 0, 1), Port: 2}, // The server side of the channel binds.
+		wgapi.IdentitySubnet(net.IPv4(10, 0, 0, 1)),
+	}))
+	require.NoError(t, err)
+	defer client.Close()
+
+	clientEvents := make(chan wg.PeerEvent, 16)
+	unsubscribe := client.Subscribe(func(e wg.PeerEvent) { clientEvents <- e }, wg.FilterTypes(wg.HandshakeCompleted, wg.PeerStarted, wg.PeerStopped))
+	defer unsubscribe()
+
+	next := func(t *testing.T, ch <-chan wg.PeerEvent, typ wg.PeerEventType) wg.PeerEvent {
+		t.Helper()
+		for {
+			select {
+			case e, ok := <-ch:
+				require.True(t, ok, "events closed")
+				if e.Type == typ {
+					return e
+				}
+			case <-ctx.Done():
+				t.Fatalf("no %s event", typ)
+			}
+		}
+	}
+
+	t.Run("handshake completed", func(t *testing.T) {
+		require.NoError(t, client.SetConfig(wgapi.IPC{serverPublic, wgapi.UpdateOnly{}, wgapi.PersistentKeepalive(1)}))
+		e := next(t, clientEvents, wg.HandshakeCompleted)
+		require.Equal(t, serverPublic, e.Peer)
+		e = next(t, serverEvents, wg.HandshakeCompleted)
+		require.Equal(t, clientPublic, e.Peer)
+		require.False(t, e.Time.IsZero())
+	})
+
+	t.Run("peer started and stopped", func(t *testing.T) {
+		require.NoError(t, client.SetConfig(wgapi.IPC{other, wgapi.IdentitySubnet(net.IPv4(10, 0, 0, 3))}))
+		require.Equal(t, other, next(t, clientEvents, wg.PeerStarted).Peer)
+		require.NoError(t, client.SetConfig(wgapi.IPC{other, wgapi.Remove{}}))
+		require.Equal(t, other, next(t, clientEvents, wg.PeerStopped).Peer)
+	})
+
+	t.Run("channel closed", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		ch := client.SubscribeChan(ctx, 0)
+		cancel()
+		for range ch {
+		}
+
+		ch = server.SubscribeChan(context.Background(), 0)
+		require.NoError(t, server.Close())
+		for range ch {
+		}
+	})
+}
+
+func TestWireguard_Subscribe_rejectedResponse(t *testing.T) {
+	binds := bindtest.NewChannelBinds()
+	defer binds[0].Close()
+	defer binds[1].Close()
+
+	serverPrivate, serverPublic, err := wgapi.NewPrivatePublic()
+	require.NoError(t, err)
+	clientPrivate, clientPublic, err := wgapi.NewPrivatePublic()
+	require.NoError(t, err)
+	serverPreshared, err := wgapi.NewPreshared()
+	require.NoError(t, err)
+	clientPreshared, err := wgapi.NewPreshared()
+	require.NoError(t, err)
+
+	// The preshared keys differ, so the client rejects every response of the server.
+	responses := make(chan struct{}, 16)
+	var serverNet, clientNet *wg.Net
+	server, err := wg.New(wg.OptionNetDevice(&serverNet), wg.OptionBind(binds[0]), wg.OptionLogger(wgevents.Events(func(e wgevents.Event) {
+		if _, ok := e.(*wgevents.EventSendingHandshakeResponse); ok {
+			select {
+			case responses <- struct{}{}:
+			default:
+			}
+		}
+	})), wg.OptionConfig(wgapi.IPC{
+		serverPrivate,
+		clientPublic,
+		serverPreshared,
+		wgapi.IdentitySubnet(net.IPv4(10, 0, 0, 2)),
+	}))
+	require.NoError(t, err)
+	defer server.Close()
+	completed := make(chan wg.PeerEvent, 1)
+	unsubscribe := server.Subscribe(func(e wg.PeerEvent) {
+		select {
+		case completed <- e:
+		default:
+		}
+	}, wg.FilterTypes(wg.HandshakeCompleted))
+	defer unsubscribe()
+
+	client, err := wg.New(wg.OptionNetDevice(&clientNet), wg.OptionBind(binds[1]), wg.OptionConfig(wgapi.IPC{
+		clientPrivate,
+		serverPublic,
+		clientPreshared,
+		wgapi.Endpoint{IP: net.IPv4(127, 0, 0, 1), Port: 2},
+		wgapi.PersistentKeepalive(1),
+		wgapi.IdentitySubnet(net.IPv4(10, 0, 0, 1)),
+	}))
+	require.NoError(t, err)
+	defer client.Close()
+
+	select {
+	case <-responses:
+	case <-time.After(time.Second * 10):
+		t.Fatal("server did not respond to the handshake")
+	}
+	select {
+	case e := <-completed:
+		t.Fatalf("rejected handshake completed at %s", e.Time)
+	case <-time.After(time.Millisecond * 500):
+	}
+	_, ok := server.LastHandshake(clientPublic)
+	require.False(t, ok)
+	_, ok = client.LastHandshake(serverPublic)
+	require.False(t, ok)
+}
+
+func TestWireguard_WaitHandshake(t *testing.T) {
+	binds := bindtest.NewChannelBinds()
+	defer binds[0].Close()
+	defer binds[1].Close()
+
+	serverPrivate, serverPublic, err := wgapi.NewPrivatePublic()
+	require.NoError(t, err)
+	clientPrivate, clientPublic, err := wgapi.NewPrivatePublic()
+	require.NoError(t, err)
+	_, other, err := wgapi.NewPrivatePublic()
+	require.NoError(t, err)
+
+	var serverNet, clientNet *wg.Net
+	server, err := wg.New(wg.OptionNetDevice(&serverNet), wg.OptionBind(binds[0]), wg.OptionConfig(wgapi.IPC{
+		serverPrivate,
+		clientPublic,
+		wgapi.IdentitySubnet(net.IPv4(10, 0, 0, 2)),
+		other,
+		wgapi.IdentitySubnet(net.IPv4(10, 0, 0, 3)),
+	}))
+	require.NoError(t, err)
+	defer server.Close()
+
+	client, err := wg.New(wg.OptionNetDevice(&clientNet), wg.OptionBind(binds[1]), wg.OptionConfig(wgapi.IPC{
+		clientPrivate,
+		serverPublic,
+		wgapi.Endpoint{IP: net.IPv4(127, 0, 0, 1), Port: 2},
+		wgapi.PersistentKeepalive(1),
+		wgapi.IdentitySubnet(net.IPv4(10, 0, 0, 1)),
+	}))
+	require.NoError(t, err)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+	require.NoError(t, client.WaitHandshake(ctx, serverPublic))
+	require.NoError(t, server.WaitHandshake(ctx, clientPublic))
+	// Already completed.
+	require.NoError(t, client.WaitHandshake(ctx, serverPublic))
+
+	t.Run("last handshake", func(t *testing.T) {
+		last, ok := server.LastHandshake(clientPublic)
+		require.True(t, ok)
+		require.WithinDuration(t, time.Now(), last, time.Second*10)
+		_, ok = server.LastHandshake(other)
+		require.False(t, ok)
+
+		require.NoError(t, client.SetConfig(wgapi.IPC{serverPublic, wgapi.Remove{}}))
+		require.Eventually(t, func() bool {
+			_, ok := client.LastHandshake(serverPublic)
+			return !ok
+		}, time.Second*5, time.Millisecond*10)
+	})
+
+	t.Run("handshake failed", func(t *testing.T) {
+		require.False(t, server.LastHandshakeFailed(clientPublic))
+		require.True(t, server.LogPeerEvent(clientPublic, func(p *device.Peer) wgevents.Event {
+			return &wgevents.EventHandshakeDidNotComplete{Peer: p, Attempts: 20}
+		}))
+		require.Eventually(t, func() bool { return server.LastHandshakeFailed(clientPublic) }, time.Second*5, time.Millisecond*10)
+
+		// A completed handshake clears the failure.
+		require.True(t, server.LogPeerEvent(clientPublic, func(p *device.Peer) wgevents.Event {
+			return &wgevents.EventReceivedHandshakeResponse{Peer: p}
+		}))
+		require.Eventually(t, func() bool { return !server.LastHandshakeFailed(clientPublic) }, time.Second*5, time.Millisecond*10)
+		require.False(t, server.LastHandshakeFailed(other))
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+		defer cancel()
+		require.ErrorIs(t, server.WaitHandshake(ctx, other), context.DeadlineExceeded)
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		errs := make(chan error, 1)
+		go func() { errs <- server.WaitHandshake(context.Background(), other) }()
+		time.Sleep(time.Millisecond * 50)
+		require.NoError(t, server.Close())
+		require.Error(t, <-errs)
+	})
+}
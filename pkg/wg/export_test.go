@@ -0,0 +1,39 @@
+package wg
+
+import (
+	"github.com/trymoose/point-c/pkg/wg/wgapi"
+	"github.com/trymoose/point-c/pkg/wg/wglog/wgevents"
+	"golang.zx2c4.com/wireguard/device"
+	"time"
+)
+
+// LogPeerEvent sends an event of the peer as if the device logged it, so tests do not wait for the timers of the device.
+// It reports whether the device has the peer.
+func (c *Wireguard) LogPeerEvent(peer wgapi.PublicKey, ev func(*device.Peer) wgevents.Event) bool {
+	p := c.dev.LookupPeer(device.NoisePublicKey(peer))
+	if p == nil {
+		return false
+	}
+	c.events.push(ev(p))
+	return true
+}
+
+// LogPeerEventAt is [Wireguard.LogPeerEvent] for an event the device logged at the given time.
+func (c *Wireguard) LogPeerEventAt(peer wgapi.PublicKey, at time.Time, ev func(*device.Peer) wgevents.Event) bool {
+	p := c.dev.LookupPeer(device.NoisePublicKey(peer))
+	if p == nil {
+		return false
+	}
+	c.events.mu.Lock()
+	c.events.queue = append(c.events.queue, logged{ev: ev(p), at: at})
+	c.events.mu.Unlock()
+	c.events.notify()
+	return true
+}
+
+// Subscribers gets the number of subscribers to the events of the device, so tests can wait for one before sending events.
+func (c *Wireguard) Subscribers() int {
+	c.events.mu.Lock()
+	defer c.events.mu.Unlock()
+	return len(c.events.subs)
+}
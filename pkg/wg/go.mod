@@ -6,6 +6,7 @@ toolchain go1.21.3
 
 require (
 	github.com/stretchr/testify v1.8.4
+	github.com/trymoose/point-c/pkg/wg/wglog/wgevents v0.0.0-20231122005956-2f42edbf6ca1
 	golang.org/x/exp v0.0.0-20230725093048-515e97ebf090
 	golang.zx2c4.com/wireguard v0.0.0-20231022001213-2e0774f246fb
 	golang.zx2c4.com/wireguard/wgctrl v0.0.0-20230429144221-925a1e7659e6
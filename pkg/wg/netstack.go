@@ -18,6 +18,7 @@ import (
 	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
 	"net"
+	"net/netip"
 	"os"
 	"slices"
 	"sync"
@@ -46,6 +47,8 @@ type Netstack struct {
 	closeErr   error
 	done       chan struct{}
 	read       chan []byte
+	loop       chan []byte // loop is the packets sent to an address of the stack itself, they are delivered back to the stack.
+	local      sync.Map    // local is the addresses of the stack itself, added with [Net.AddLocal].
 	defaultNIC tcpip.NICID
 	mtu        int
 }
@@ -79,8 +82,10 @@ func NewNetstack(mtu int, batchSize int, channelSize int) (*Netstack, error) {
 		batchSize: batchSize,
 		done:      make(chan struct{}),
 		read:      make(chan []byte),
+		loop:      make(chan []byte, channelSize),
 	}
 	d.ep.AddNotify((*writeNotify)(d))
+	go d.loopback()
 
 	// Wireguard-go does this
 	var enableSACK tcpip.TCPSACKEnabled = true
@@ -129,12 +134,47 @@ func (w *writeNotify) WriteNotify() {
 
 	view := slices.Clone(pkt.ToView().AsSlice())
 	pkt.DecRef()
+	if w.isLocal(view) {
+		// The stack itself may be writing, so the packet is delivered from another goroutine. Like a full queue on a real link, it is dropped if the loop is full.
+		select {
+		case w.loop <- view:
+		default:
+		}
+		return
+	}
 	select {
 	case <-w.done:
 	case w.read <- view:
 	}
 }
 
+// isLocal reports whether the packet is sent to an address of the stack itself.
+func (w *writeNotify) isLocal(p []byte) bool {
+	var dst netip.Addr
+	switch {
+	case len(p) >= header.IPv4MinimumSize && p[0]>>4 == 4:
+		dst = netip.AddrFrom4([4]byte(p[16:20]))
+	case len(p) >= header.IPv6MinimumSize && p[0]>>4 == 6:
+		dst = netip.AddrFrom16([16]byte(p[24:40]))
+	default:
+		return false
+	}
+	_, ok := w.local.Load(dst)
+	return ok
+}
+
+// loopback delivers the packets sent to an address of the stack back to the stack.
+func (d *Netstack) loopback() {
+	for {
+		select {
+		case <-d.done:
+			return
+		case p := <-d.loop:
+			_, _ = d.Write([][]byte{p}, 0)
+		}
+	}
+}
+
 // File implements [tun.Device.File] and always returns nil
 func (d *Netstack) File() *os.File { return nil }
 
@@ -255,3 +295,18 @@ func (d *Dialer) DialUDP(addr *net.UDPAddr) (net.PacketConn, error) {
 		Port: uint16(addr.Port),
 	}, ipv4.ProtocolNumber)
 }
+
+// AddLocal adds an address of the stack itself. Packets sent to it are delivered back to the stack instead of going out of the tunnel,
+// so dialing it from the address reaches listeners on the stack.
+func (n *Net) AddLocal(ip net.IP) {
+	if addr, ok := netip.AddrFromSlice(ip); ok {
+		n.local.Store(addr.Unmap(), struct{}{})
+	}
+}
+
+// RemoveLocal removes an address added with [Net.AddLocal], packets sent to it go out of the tunnel again.
+func (n *Net) RemoveLocal(ip net.IP) {
+	if addr, ok := netip.AddrFromSlice(ip); ok {
+		n.local.Delete(addr.Unmap())
+	}
+}
@@ -15,6 +15,7 @@ type (
 		loggers []*wglog.Logger     // loggers is a slice of Logger instances for logging purposes.
 		cfg     *wgapi.Configurable // cfg is an initial IPC configuration.
 		closer  []func() error      // closer is the resources that need to be cleaned up.
+		down    bool                // down leaves the device down after [New].
 	}
 )
 
@@ -76,6 +77,9 @@ func OptionConfig(cfg wgapi.Configurable) option {
 	return func(o *options) error { o.cfg = &cfg; return nil }
 }
 
+// OptionDown leaves the interface down after [New], so nothing is listened on until [Wireguard.Up] is called.
+func OptionDown() option { return func(o *options) error { o.down = true; return nil } }
+
 // OptionNetDevice initializes a userspace networking stack.
 // Note: The pointer *p becomes valid and usable only if the [New] function successfully
 // completes without returning an error. In case of errors, *p should not be considered reliable.
@@ -0,0 +1,145 @@
+package wg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/trymoose/point-c/pkg/wg/wgapi"
+	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Resolver looks up the addresses of a host. [*net.Resolver] is a Resolver.
+type Resolver interface {
+	LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error)
+}
+
+var _ Resolver = (*net.Resolver)(nil)
+
+// EndpointResolver keeps the endpoint of a peer pointed at the current address of a hostname, for peers behind dynamic DNS.
+type EndpointResolver struct {
+	Peer     wgapi.PublicKey // Peer is the peer whose endpoint is updated.
+	Endpoint string          // Endpoint is the host:port of the peer.
+	Interval time.Duration   // Interval is the time between resolutions. If 0 the endpoint is only resolved after failed handshakes.
+	Resolver Resolver        // Resolver looks up the host. [net.DefaultResolver] is used if nil.
+	OnError  func(error)     // OnError is called with errors from resolving or updating the endpoint. It may be nil.
+}
+
+// ResolveEndpoint re-resolves the endpoint of a peer until ctx is done or the device is closed.
+// The endpoint is resolved every [EndpointResolver.Interval] and every time a handshake with the peer fails.
+// If the resolved address is different from the peer's endpoint it is set with [Wireguard.SetConfig].
+// A host with many addresses is tried one address at a time, moving to the next address after each failed handshake,
+// so an address the bind can not reach, like an IPv6 address without IPv6 connectivity, is not stuck with.
+// An endpoint with an IP address instead of a hostname never changes, so ResolveEndpoint returns right away.
+func (c *Wireguard) ResolveEndpoint(ctx context.Context, r EndpointResolver) error {
+	host, port, err := splitEndpoint(r.Endpoint)
+	if err != nil {
+		return err
+	} else if _, err := netip.ParseAddr(host); err == nil {
+		return nil
+	}
+	if r.Resolver == nil {
+		r.Resolver = net.DefaultResolver
+	}
+
+	failed := make(chan struct{}, 1)
+	unsubscribe := c.Subscribe(func(PeerEvent) {
+		select {
+		case failed <- struct{}{}:
+		default:
+		}
+	}, FilterTypes(HandshakeFailing, HandshakeFailed), FilterPeers(r.Peer))
+	defer unsubscribe()
+
+	var tick <-chan time.Time
+	if r.Interval > 0 {
+		t := time.NewTicker(r.Interval)
+		defer t.Stop()
+		tick = t.C
+	}
+
+	for {
+		var next bool
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.events.ctx.Done():
+			return errClosed
+		case <-tick:
+		case <-failed:
+			next = true
+		}
+
+		if err := c.resolveEndpoint(ctx, r, host, port, next); err != nil && r.OnError != nil {
+			r.OnError(err)
+		}
+	}
+}
+
+// resolveEndpoint resolves the host once, updating the peer if its endpoint is not one of the host's addresses.
+// If next is set the peer is moved to the address after its endpoint, since the endpoint failed to handshake.
+func (c *Wireguard) resolveEndpoint(ctx context.Context, r EndpointResolver, host string, port uint16, next bool) error {
+	addrs, err := r.Resolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %q: %w", host, err)
+	} else if len(addrs) == 0 {
+		return fmt.Errorf("no addresses found for %q", host)
+	}
+
+	current, ok, err := c.endpoint(r.Peer)
+	if err != nil {
+		return fmt.Errorf("failed to get endpoint: %w", err)
+	} else if !ok {
+		return errors.New("peer not found")
+	}
+	// A host with many addresses may resolve in a different order every time, so only update if the current address is gone or failed.
+	i := slices.IndexFunc(addrs, func(a netip.Addr) bool { return net.IP(a.Unmap().AsSlice()).Equal(current.IP) })
+	if current.Port != int(port) {
+		i = -1
+	}
+	if i >= 0 && (!next || len(addrs) == 1) {
+		return nil
+	}
+
+	// i is -1 if the current address is gone, so the first address is used.
+	endpoint := wgapi.Endpoint{IP: addrs[(i+1)%len(addrs)].Unmap().AsSlice(), Port: int(port)}
+	return c.SetConfig(wgapi.IPC{r.Peer, wgapi.UpdateOnly{}, endpoint})
+}
+
+// endpoint gets the current endpoint of the peer. The endpoint is empty if it is not set.
+func (c *Wireguard) endpoint(peer wgapi.PublicKey) (endpoint wgapi.Endpoint, found bool, err error) {
+	ipc, err := c.GetConfig()
+	if err != nil {
+		return wgapi.Endpoint{}, false, err
+	}
+	for _, kv := range ipc {
+		switch kv := kv.(type) {
+		case wgapi.PublicKey:
+			if found {
+				return endpoint, true, nil
+			}
+			found = kv == peer
+		case wgapi.Endpoint:
+			if found {
+				endpoint = kv
+			}
+		}
+	}
+	return endpoint, found, nil
+}
+
+// splitEndpoint splits a host:port endpoint.
+func splitEndpoint(endpoint string) (string, uint16, error) {
+	host, p, err := net.SplitHostPort(endpoint)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.ParseUint(p, 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port %q: %w", p, err)
+	}
+	return host, uint16(port), nil
+}
@@ -0,0 +1,184 @@
+package wg_test
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"github.com/trymoose/point-c/pkg/wg"
+	"github.com/trymoose/point-c/pkg/wg/wgapi"
+	"github.com/trymoose/point-c/pkg/wg/wglog/wgevents"
+	"golang.zx2c4.com/wireguard/device"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeResolver resolves hosts from a map so endpoints can be tested offline.
+type fakeResolver struct {
+	mu      sync.Mutex
+	hosts   map[string][]netip.Addr
+	lookups int
+}
+
+func (r *fakeResolver) LookupNetIP(_ context.Context, _, host string) ([]netip.Addr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups++
+	addrs, ok := r.hosts[host]
+	if !ok {
+		return nil, errors.New("host not found")
+	}
+	return addrs, nil
+}
+
+func (r *fakeResolver) set(host string, addrs ...netip.Addr) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hosts[host] = addrs
+}
+
+func (r *fakeResolver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lookups
+}
+
+// resolveDevice creates a device with a single peer using the endpoint. A real bind is used so endpoints keep their addresses.
+func resolveDevice(t *testing.T, endpoint wgapi.Endpoint, keepalive wgapi.PersistentKeepalive) (*wg.Wireguard, wgapi.PublicKey) {
+	t.Helper()
+	private, err := wgapi.NewPrivate()
+	require.NoError(t, err)
+	_, peer, err := wgapi.NewPrivatePublic()
+	require.NoError(t, err)
+
+	var n *wg.Net
+	dev, err := wg.New(wg.OptionNetDevice(&n), wg.OptionConfig(wgapi.IPC{
+		private,
+		peer,
+		endpoint,
+		keepalive,
+		wgapi.IdentitySubnet(net.IPv4(10, 0, 0, 2)),
+	}))
+	require.NoError(t, err)
+	t.Cleanup(func() { dev.Close() })
+	return dev, peer
+}
+
+// requireEndpoint waits for the peer's endpoint to become the expected address.
+func requireEndpoint(t *testing.T, dev *wg.Wireguard, peer wgapi.PublicKey, expected string, timeout time.Duration) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		ipc, err := dev.GetConfig()
+		require.NoError(t, err)
+		var found bool
+		for _, kv := range ipc {
+			switch kv := kv.(type) {
+			case wgapi.PublicKey:
+				found = kv == peer
+			case wgapi.Endpoint:
+				if found && kv.String() == expected {
+					return true
+				}
+			}
+		}
+		return false
+	}, timeout, time.Millisecond*10)
+}
+
+func TestWireguard_ResolveEndpoint(t *testing.T) {
+	t.Run("interval", func(t *testing.T) {
+		dev, peer := resolveDevice(t, wgapi.Endpoint{IP: net.IPv4(127, 0, 0, 1), Port: 51820}, 0)
+		r := &fakeResolver{hosts: map[string][]netip.Addr{"wg.example": {netip.MustParseAddr("127.0.0.1")}}}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		errs := make(chan error, 1)
+		go func() {
+			errs <- dev.ResolveEndpoint(ctx, wg.EndpointResolver{Peer: peer, Endpoint: "wg.example:51820", Interval: time.Millisecond * 10, Resolver: r})
+		}()
+
+		require.Eventually(t, func() bool { return r.count() > 1 }, time.Second*5, time.Millisecond*10)
+		requireEndpoint(t, dev, peer, "127.0.0.1:51820", time.Second)
+
+		r.set("wg.example", netip.MustParseAddr("127.0.0.2"))
+		requireEndpoint(t, dev, peer, "127.0.0.2:51820", time.Second*5)
+
+		// The current address is kept while the host still resolves to it.
+		r.set("wg.example", netip.MustParseAddr("127.0.0.3"), netip.MustParseAddr("127.0.0.2"))
+		lookups := r.count()
+		require.Eventually(t, func() bool { return r.count() > lookups+1 }, time.Second*5, time.Millisecond*10)
+		requireEndpoint(t, dev, peer, "127.0.0.2:51820", time.Second)
+
+		cancel()
+		require.ErrorIs(t, <-errs, context.Canceled)
+	})
+
+	t.Run("handshake failure", func(t *testing.T) {
+		dev, peer := resolveDevice(t, wgapi.Endpoint{IP: net.IPv4(127, 0, 0, 1), Port: 9}, 0)
+		r := &fakeResolver{hosts: map[string][]netip.Addr{"wg.example": {netip.MustParseAddr("127.0.0.2")}}}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go dev.ResolveEndpoint(ctx, wg.EndpointResolver{Peer: peer, Endpoint: "wg.example:9", Resolver: r})
+		require.Eventually(t, func() bool { return dev.Subscribers() == 1 }, time.Second*5, time.Millisecond)
+		require.Zero(t, r.count(), "resolved before the handshake failed")
+
+		// The event is sent directly instead of waiting for the rekey timers of the device.
+		require.True(t, dev.LogPeerEvent(peer, func(p *device.Peer) wgevents.Event {
+			return &wgevents.EventRetryingHandshake{Peer: p, Timeout: 5, Try: 2}
+		}))
+		requireEndpoint(t, dev, peer, "127.0.0.2:9", time.Second*5)
+	})
+
+	t.Run("next address", func(t *testing.T) {
+		dev, peer := resolveDevice(t, wgapi.Endpoint{IP: net.IPv4(127, 0, 0, 2), Port: 9}, 0)
+		r := &fakeResolver{hosts: map[string][]netip.Addr{"wg.example": {netip.MustParseAddr("::1"), netip.MustParseAddr("127.0.0.2"), netip.MustParseAddr("127.0.0.3")}}}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go dev.ResolveEndpoint(ctx, wg.EndpointResolver{Peer: peer, Endpoint: "wg.example:9", Resolver: r})
+		require.Eventually(t, func() bool { return dev.Subscribers() == 1 }, time.Second*5, time.Millisecond)
+
+		// Each failed handshake moves to the next address, wrapping around to the first.
+		for _, expected := range []string{"127.0.0.3:9", "[::1]:9", "127.0.0.2:9"} {
+			require.True(t, dev.LogPeerEvent(peer, func(p *device.Peer) wgevents.Event {
+				return &wgevents.EventRetryingHandshake{Peer: p, Timeout: 5, Try: 2}
+			}))
+			requireEndpoint(t, dev, peer, expected, time.Second*5)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		dev, peer := resolveDevice(t, wgapi.Endpoint{IP: net.IPv4(127, 0, 0, 1), Port: 51820}, 0)
+		r := &fakeResolver{hosts: map[string][]netip.Addr{}}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		errs := make(chan error, 1)
+		go dev.ResolveEndpoint(ctx, wg.EndpointResolver{
+			Peer:     peer,
+			Endpoint: "missing.example:51820",
+			Interval: time.Millisecond * 10,
+			Resolver: r,
+			OnError: func(err error) {
+				select {
+				case errs <- err:
+				default:
+				}
+			},
+		})
+		require.ErrorContains(t, <-errs, "host not found")
+	})
+
+	t.Run("ip address", func(t *testing.T) {
+		dev, peer := resolveDevice(t, wgapi.Endpoint{IP: net.IPv4(127, 0, 0, 1), Port: 51820}, 0)
+		require.NoError(t, dev.ResolveEndpoint(context.Background(), wg.EndpointResolver{Peer: peer, Endpoint: "127.0.0.1:51820"}))
+	})
+
+	t.Run("invalid endpoint", func(t *testing.T) {
+		dev, peer := resolveDevice(t, wgapi.Endpoint{IP: net.IPv4(127, 0, 0, 1), Port: 51820}, 0)
+		require.Error(t, dev.ResolveEndpoint(context.Background(), wg.EndpointResolver{Peer: peer, Endpoint: "wg.example"}))
+	})
+}
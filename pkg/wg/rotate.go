@@ -0,0 +1,377 @@
+package wg
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/trymoose/point-c/pkg/wg/wgapi"
+	"net"
+	"sync"
+	"time"
+)
+
+// rotationTimeout limits how long a single rotation over the control channel may take.
+const rotationTimeout = time.Second * 30
+
+// PresharedRotation periodically replaces the preshared key of a peer with a new one agreed on with the peer.
+//
+// The new key is agreed on over a control channel inside the tunnel, so only the peer can take part, and every message is authenticated with the current preshared key.
+// Both sides contribute randomness and derive the new key from the current key.
+// The responder, see [Wireguard.ServePresharedRotation], applies the key first and the initiator applies it once the responder confirms.
+// The current sessions keep working until the next handshake, which is the first to use the new key.
+//
+// If either side misses the switch the initiator can not know which key the responder has, so until a handshake with its current key completes it keeps the other key around.
+// Every failing handshake swaps between the two keys, which stops once both sides have the same key again.
+//
+// Rotated keys only live in the device. To survive a restart of either side, keep the keys given to [PresharedRotation.OnKeys] and [Wireguard.ServePresharedRotation],
+// configure the device with the current key, and pass the fallback back in [PresharedRotation.Fallback].
+type PresharedRotation struct {
+	Peer     wgapi.PublicKey                             // Peer is the peer whose preshared key is rotated.
+	Interval time.Duration                               // Interval is the time between rotations.
+	Dial     func(ctx context.Context) (net.Conn, error) // Dial connects to the control channel of the peer through the tunnel.
+	OnError  func(error)                                 // OnError is called with errors from rotations. It may be nil.
+	// Fallback is another key the responder may have, such as one kept from before a restart. It is swapped in like the other key of an unconfirmed rotation. It may be nil.
+	Fallback *wgapi.PresharedKey
+	// OnKeys is called with the key of the peer and the other key the responder may have whenever either changes. The fallback is nil once a handshake confirms the key. It may be nil.
+	OnKeys func(current wgapi.PresharedKey, fallback *wgapi.PresharedKey)
+}
+
+type (
+	// rotationMessage is a message on the rotation control channel.
+	rotationMessage struct {
+		Type  rotationStep `json:"type"`
+		Nonce []byte       `json:"nonce,omitempty"`
+		MAC   []byte       `json:"mac"`
+	}
+	// rotationStep is the type of a [rotationMessage].
+	rotationStep string
+)
+
+const (
+	rotationPropose rotationStep = "propose" // rotationPropose starts a rotation with the initiator's nonce.
+	rotationAccept  rotationStep = "accept"  // rotationAccept answers with the responder's nonce.
+	rotationCommit  rotationStep = "commit"  // rotationCommit proves the initiator derived the new key, the responder applies it.
+	rotationApplied rotationStep = "applied" // rotationApplied tells the initiator the responder has the new key.
+)
+
+// RotatePresharedKey rotates the preshared key of a peer every [PresharedRotation.Interval] until ctx is done or the device is closed.
+// No new rotation is started while the key of the last one is unconfirmed.
+func (c *Wireguard) RotatePresharedKey(ctx context.Context, r PresharedRotation) error {
+	if r.Interval <= 0 {
+		return errors.New("rotation interval must be positive")
+	} else if r.Dial == nil {
+		return errors.New("rotation has no dialer")
+	}
+	onError := func(err error) {
+		if r.OnError != nil {
+			r.OnError(err)
+		}
+	}
+	onKeys := func(current wgapi.PresharedKey, fallback *wgapi.PresharedKey) {
+		if r.OnKeys != nil {
+			r.OnKeys(current, fallback)
+		}
+	}
+
+	handshakes := make(chan PeerEvent, 1)
+	unsubscribe := c.Subscribe(func(e PeerEvent) {
+		select {
+		case handshakes <- e:
+		default:
+		}
+	}, FilterTypes(HandshakeCompleted, HandshakeFailing, HandshakeFailed), FilterPeers(r.Peer))
+	defer unsubscribe()
+
+	t := time.NewTicker(r.Interval)
+	defer t.Stop()
+
+	// fallback is the other key the responder may have, nil once a handshake completes.
+	// since is when the current key was set, only a handshake completed after it was done with the current key.
+	fallback, since := r.Fallback, time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.events.ctx.Done():
+			return errClosed
+		case e := <-handshakes:
+			// A handshake is only completed once the peer accepted it, which it only does if it has the same key.
+			if fallback == nil || (e.Type == HandshakeCompleted && e.Time.Before(since)) {
+				continue
+			}
+			current, err := c.presharedKey(r.Peer)
+			if err != nil {
+				onError(err)
+			} else if e.Type == HandshakeCompleted {
+				fallback = nil
+				onKeys(current, nil)
+			} else if err := c.SetConfig(wgapi.IPC{r.Peer, wgapi.UpdateOnly{}, *fallback}); err != nil {
+				onError(fmt.Errorf("failed to fall back to other preshared key: %w", err))
+			} else {
+				next := *fallback
+				fallback, since = &current, time.Now()
+				onKeys(next, fallback)
+			}
+		case <-t.C:
+			if fallback != nil {
+				continue
+			}
+			old, next, committed, err := c.initiateRotation(ctx, r)
+			if err != nil {
+				onError(err)
+			}
+			if committed {
+				since = time.Now()
+				// The responder may have applied the new key without the initiator knowing, so keep whichever key is not in use.
+				current := old
+				if key, cerr := c.presharedKey(r.Peer); cerr == nil && key == next {
+					current, fallback = next, &old
+				} else {
+					fallback = &next
+				}
+				onKeys(current, fallback)
+			}
+		}
+	}
+}
+
+// initiateRotation runs a single rotation as the initiator.
+// committed is true once the responder may have applied the new key.
+func (c *Wireguard) initiateRotation(ctx context.Context, r PresharedRotation) (old, next wgapi.PresharedKey, committed bool, err error) {
+	ctx, cancel := context.WithTimeout(ctx, rotationTimeout)
+	defer cancel()
+	if old, err = c.presharedKey(r.Peer); err != nil {
+		return
+	}
+
+	conn, err := r.Dial(ctx)
+	if err != nil {
+		return old, next, false, fmt.Errorf("failed to connect to rotation control channel: %w", err)
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	enc, dec := json.NewEncoder(conn), json.NewDecoder(conn)
+
+	local, err := rotationNonce()
+	if err != nil {
+		return
+	}
+	if err = enc.Encode(rotationMessage{Type: rotationPropose, Nonce: local, MAC: rotationMAC(old, rotationPropose, local)}); err != nil {
+		return
+	}
+	var accept rotationMessage
+	if err = readRotation(dec, &accept, old, rotationAccept, local); err != nil {
+		return
+	}
+
+	next = deriveRotation(old, local, accept.Nonce)
+	if err = enc.Encode(rotationMessage{Type: rotationCommit, MAC: rotationMAC(next, rotationCommit)}); err != nil {
+		return
+	}
+	committed = true
+	var applied rotationMessage
+	if err = readRotation(dec, &applied, next, rotationApplied); err != nil {
+		return
+	}
+	if err = c.SetConfig(wgapi.IPC{r.Peer, wgapi.UpdateOnly{}, next}); err != nil {
+		err = fmt.Errorf("failed to apply rotated preshared key: %w", err)
+	}
+	return
+}
+
+// ServePresharedRotation answers preshared key rotations of peers until ctx is done, the device is closed, or the listener fails.
+// The listener should be on the device's own [Net], the peer of a connection is the peer whose allowed ips contain the remote address.
+// onRotate is called with the old and new key of a peer once the new key is applied. Either callback may be nil.
+func (c *Wireguard) ServePresharedRotation(ctx context.Context, ln net.Listener, onError func(error), onRotate func(peer wgapi.PublicKey, old, next wgapi.PresharedKey)) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(c.events.ctx, cancel)
+	defer stop()
+	context.AfterFunc(ctx, func() { ln.Close() })
+
+	// Rotations are answered one at a time so the key of a peer is never changed twice at once.
+	var mu sync.Mutex
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if c.events.ctx.Err() != nil {
+				return errClosed
+			} else if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			mu.Lock()
+			defer mu.Unlock()
+			if err := c.respondRotation(ctx, conn, onRotate); err != nil && onError != nil {
+				onError(err)
+			}
+		}()
+	}
+}
+
+// respondRotation runs a single rotation as the responder.
+func (c *Wireguard) respondRotation(ctx context.Context, conn net.Conn, onRotate func(peer wgapi.PublicKey, old, next wgapi.PresharedKey)) error {
+	ctx, cancel := context.WithTimeout(ctx, rotationTimeout)
+	defer cancel()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("invalid remote address %s", conn.RemoteAddr())
+	}
+	peer, ok, err := c.peerOf(addr.IP)
+	if err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("no peer for address %s", addr.IP)
+	}
+	enc, dec := json.NewEncoder(conn), json.NewDecoder(conn)
+
+	var propose rotationMessage
+	if err := readRotation(dec, &propose, peer.preshared, rotationPropose); err != nil {
+		return err
+	}
+	local, err := rotationNonce()
+	if err != nil {
+		return err
+	}
+	if err := enc.Encode(rotationMessage{Type: rotationAccept, Nonce: local, MAC: rotationMAC(peer.preshared, rotationAccept, propose.Nonce, local)}); err != nil {
+		return err
+	}
+
+	next := deriveRotation(peer.preshared, propose.Nonce, local)
+	var commit rotationMessage
+	if err := readRotation(dec, &commit, next, rotationCommit); err != nil {
+		return err
+	}
+	if err := c.SetConfig(wgapi.IPC{peer.public, wgapi.UpdateOnly{}, next}); err != nil {
+		return fmt.Errorf("failed to apply rotated preshared key: %w", err)
+	}
+	if onRotate != nil {
+		onRotate(peer.public, peer.preshared, next)
+	}
+	return enc.Encode(rotationMessage{Type: rotationApplied, MAC: rotationMAC(next, rotationApplied)})
+}
+
+// readRotation reads a message of the given type and checks it was authenticated with the key.
+// For a message with a nonce, the nonce is appended to the authenticated data.
+func readRotation(dec *json.Decoder, m *rotationMessage, key wgapi.PresharedKey, step rotationStep, data ...[]byte) error {
+	if err := dec.Decode(m); err != nil {
+		return fmt.Errorf("failed to read %s: %w", step, err)
+	} else if m.Type != step {
+		return fmt.Errorf("expected %s got %q", step, m.Type)
+	}
+	if m.Nonce != nil {
+		if len(m.Nonce) != sha256.Size {
+			return fmt.Errorf("invalid %s nonce", step)
+		}
+		data = append(data, m.Nonce)
+	}
+	if !hmac.Equal(m.MAC, rotationMAC(key, step, data...)) {
+		return fmt.Errorf("%s is not authenticated by the current preshared key", step)
+	}
+	return nil
+}
+
+// rotationMAC authenticates the step and data with the key.
+func rotationMAC(key wgapi.PresharedKey, step rotationStep, data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte(step))
+	for _, d := range data {
+		if d != nil {
+			mac.Write(d)
+		}
+	}
+	return mac.Sum(nil)
+}
+
+// deriveRotation derives the next preshared key from the current key and the nonces of both sides.
+func deriveRotation(key wgapi.PresharedKey, initiator, responder []byte) wgapi.PresharedKey {
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte("point-c preshared rotation"))
+	mac.Write(initiator)
+	mac.Write(responder)
+	var next wgapi.PresharedKey
+	copy(next[:], mac.Sum(nil))
+	return next
+}
+
+// rotationNonce generates a random nonce.
+func rotationNonce() ([]byte, error) {
+	b := make([]byte, sha256.Size)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// peerState is the keys and allowed ips of a peer.
+type peerState struct {
+	public    wgapi.PublicKey
+	preshared wgapi.PresharedKey
+	allowed   []net.IPNet
+}
+
+// peers gets the keys and allowed ips of every peer.
+func (c *Wireguard) peers() ([]*peerState, error) {
+	ipc, err := c.GetConfig()
+	if err != nil {
+		return nil, err
+	}
+	var peers []*peerState
+	for _, kv := range ipc {
+		switch kv := kv.(type) {
+		case wgapi.PublicKey:
+			peers = append(peers, &peerState{public: kv})
+		case wgapi.PresharedKey:
+			if len(peers) > 0 {
+				peers[len(peers)-1].preshared = kv
+			}
+		case wgapi.AllowedIP:
+			if len(peers) > 0 {
+				peers[len(peers)-1].allowed = append(peers[len(peers)-1].allowed, net.IPNet(kv))
+			}
+		}
+	}
+	return peers, nil
+}
+
+// presharedKey gets the current preshared key of the peer.
+func (c *Wireguard) presharedKey(peer wgapi.PublicKey) (wgapi.PresharedKey, error) {
+	peers, err := c.peers()
+	if err != nil {
+		return wgapi.PresharedKey{}, err
+	}
+	for _, p := range peers {
+		if p.public == peer {
+			return p.preshared, nil
+		}
+	}
+	return wgapi.PresharedKey{}, errors.New("peer not found")
+}
+
+// peerOf finds the peer traffic from the address is routed to, the peer with the most specific allowed ip containing it.
+func (c *Wireguard) peerOf(ip net.IP) (peer *peerState, found bool, err error) {
+	peers, err := c.peers()
+	if err != nil {
+		return nil, false, err
+	}
+	best := -1
+	for _, p := range peers {
+		for _, n := range p.allowed {
+			if ones, _ := n.Mask.Size(); n.Contains(ip) && ones > best {
+				peer, best = p, ones
+			}
+		}
+	}
+	return peer, peer != nil, nil
+}
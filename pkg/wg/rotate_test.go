@@ -0,0 +1,181 @@
+package wg_test
+
+import (
+	"context"
+	"github.com/stretchr/testify/require"
+	"github.com/trymoose/point-c/pkg/wg"
+	"github.com/trymoose/point-c/pkg/wg/wgapi"
+	"github.com/trymoose/point-c/pkg/wg/wglog/wgevents"
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/device"
+	"net"
+	"testing"
+	"time"
+)
+
+// presharedKey gets the preshared key the device has for the peer.
+func presharedKey(t *testing.T, dev *wg.Wireguard, peer wgapi.PublicKey) wgapi.PresharedKey {
+	t.Helper()
+	ipc, err := dev.GetConfig()
+	require.NoError(t, err)
+	var found bool
+	for _, kv := range ipc {
+		switch kv := kv.(type) {
+		case wgapi.PublicKey:
+			found = kv == peer
+		case wgapi.PresharedKey:
+			if found {
+				return kv
+			}
+		}
+	}
+	t.Fatalf("peer %s not found", peer)
+	return wgapi.PresharedKey{}
+}
+
+func TestWireguard_RotatePresharedKey(t *testing.T) {
+	binds := bindtest.NewChannelBinds()
+	defer binds[0].Close()
+	defer binds[1].Close()
+
+	serverPrivate, serverPublic, err := wgapi.NewPrivatePublic()
+	require.NoError(t, err)
+	clientPrivate, clientPublic, err := wgapi.NewPrivatePublic()
+	require.NoError(t, err)
+	preshared, err := wgapi.NewPreshared()
+	require.NoError(t, err)
+
+	var serverNet, clientNet *wg.Net
+	server, err := wg.New(wg.OptionNetDevice(&serverNet), wg.OptionBind(binds[0]), wg.OptionConfig(wgapi.IPC{
+		serverPrivate,
+		clientPublic,
+		preshared,
+		wgapi.IdentitySubnet(net.IPv4(10, 0, 0, 2)),
+	}))
+	require.NoError(t, err)
+	defer server.Close()
+
+	client, err := wg.New(wg.OptionNetDevice(&clientNet), wg.OptionBind(binds[1]), wg.OptionConfig(wgapi.IPC{
+		clientPrivate,
+		serverPublic,
+		preshared,
+		wgapi.Endpoint{IP: net.IPv4(127, 0, 0, 1), Port: 2},
+		wgapi.PersistentKeepalive(1),
+		wgapi.IdentitySubnet(net.IPv4(10, 0, 0, 1)),
+	}))
+	require.NoError(t, err)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	require.NoError(t, client.WaitHandshake(ctx, serverPublic))
+
+	control := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 51821}
+	ln, err := serverNet.Listen(control)
+	require.NoError(t, err)
+	serverErrs := make(chan error, 1)
+	serverRotated := make(chan wgapi.PresharedKey, 16)
+	go server.ServePresharedRotation(ctx, ln, sendError(serverErrs), func(peer wgapi.PublicKey, old, next wgapi.PresharedKey) {
+		if peer == clientPublic {
+			serverRotated <- next
+		}
+	})
+
+	clientErrs := make(chan error, 1)
+	clientKeys := make(chan wgapi.PresharedKey, 16)
+	rotationCtx, cancelRotation := context.WithCancel(ctx)
+	defer cancelRotation()
+	go client.RotatePresharedKey(rotationCtx, wg.PresharedRotation{
+		Peer:     serverPublic,
+		Interval: time.Millisecond * 100,
+		Dial: func(ctx context.Context) (net.Conn, error) {
+			return clientNet.Dialer(net.IPv4(10, 0, 0, 2), 0).DialTCP(ctx, control)
+		},
+		OnError: sendError(clientErrs),
+		OnKeys:  func(current wgapi.PresharedKey, _ *wgapi.PresharedKey) { clientKeys <- current },
+	})
+
+	// The first rotation is stopped from starting another until a handshake confirms it.
+	var rotated wgapi.PresharedKey
+	select {
+	case rotated = <-clientKeys:
+	case <-ctx.Done():
+		t.Fatal("client did not rotate")
+	}
+	require.NotEqual(t, preshared, rotated)
+	require.Equal(t, rotated, <-serverRotated)
+	require.Equal(t, rotated, presharedKey(t, server, clientPublic))
+	require.Eventually(t, func() bool {
+		return presharedKey(t, client, serverPublic) == rotated
+	}, time.Second*10, time.Millisecond*10)
+	cancelRotation()
+
+	select {
+	case err := <-serverErrs:
+		require.NoError(t, err)
+	case err := <-clientErrs:
+		require.NoError(t, err)
+	default:
+	}
+
+	t.Run("restart", func(t *testing.T) {
+		// The client comes back with the configured key, the rotated key it kept is its fallback.
+		require.NoError(t, client.Close())
+		client, err := wg.New(wg.OptionNetDevice(&clientNet), wg.OptionBind(binds[1]), wg.OptionConfig(wgapi.IPC{
+			clientPrivate,
+			serverPublic,
+			preshared,
+			wgapi.Endpoint{IP: net.IPv4(127, 0, 0, 1), Port: 2},
+			wgapi.IdentitySubnet(net.IPv4(10, 0, 0, 1)),
+		}))
+		require.NoError(t, err)
+		defer client.Close()
+
+		type keys struct {
+			current  wgapi.PresharedKey
+			fallback *wgapi.PresharedKey
+		}
+		changed := make(chan keys, 16)
+		go client.RotatePresharedKey(ctx, wg.PresharedRotation{
+			Peer:     serverPublic,
+			Interval: time.Hour,
+			Dial:     func(ctx context.Context) (net.Conn, error) { return nil, net.ErrClosed },
+			Fallback: &rotated,
+			OnKeys:   func(current wgapi.PresharedKey, fallback *wgapi.PresharedKey) { changed <- keys{current, fallback} },
+		})
+		require.Eventually(t, func() bool { return client.Subscribers() == 1 }, time.Second*5, time.Millisecond)
+
+		// The events are sent directly instead of waiting for the rekey timers of the device.
+		failing := func(p *device.Peer) wgevents.Event {
+			return &wgevents.EventRetryingHandshake{Peer: p, Timeout: 5, Try: 2}
+		}
+		completed := func(p *device.Peer) wgevents.Event { return &wgevents.EventReceivedHandshakeResponse{Peer: p} }
+		before := time.Now()
+		require.True(t, client.LogPeerEvent(serverPublic, failing))
+		require.Equal(t, keys{rotated, &preshared}, <-changed)
+		require.Equal(t, rotated, presharedKey(t, client, serverPublic))
+
+		// A handshake from before the key was swapped does not confirm it, so the next failure swaps back.
+		require.True(t, client.LogPeerEventAt(serverPublic, before, completed))
+		require.True(t, client.LogPeerEvent(serverPublic, failing))
+		require.Equal(t, keys{preshared, &rotated}, <-changed)
+
+		require.True(t, client.LogPeerEvent(serverPublic, completed))
+		require.Equal(t, keys{preshared, nil}, <-changed)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		require.Error(t, client.RotatePresharedKey(ctx, wg.PresharedRotation{Peer: serverPublic}))
+		require.Error(t, client.RotatePresharedKey(ctx, wg.PresharedRotation{Peer: serverPublic, Interval: time.Second}))
+	})
+}
+
+// sendError sends the error if the channel is not full.
+func sendError(errs chan<- error) func(error) {
+	return func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+}
@@ -140,3 +140,38 @@ const (
 	// ErrnoUnknown references [ipc.IpcErrorUnknown].
 	ErrnoUnknown = Errno(int64(ipc.IpcErrorUnknown))
 )
+
+// IPCError is returned when an IPC operation fails with a non-zero [Errno].
+type IPCError struct {
+	Errno Errno // Errno is the errno reported for the operation.
+	Err   error // Err is the cause of the error if known.
+}
+
+func (e *IPCError) Error() string {
+	name, ok := errnoNames[e.Errno]
+	if !ok {
+		name = "unrecognized"
+	}
+	msg := fmt.Sprintf("ipc error %s (%s)", e.Errno, name)
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *IPCError) Unwrap() error { return e.Err }
+
+// Is reports whether target is an [*IPCError] with the same [Errno].
+func (e *IPCError) Is(target error) bool {
+	t, ok := target.(*IPCError)
+	return ok && t.Errno == e.Errno
+}
+
+var errnoNames = map[Errno]string{
+	ErrnoNone:      "none",
+	ErrnoIO:        "io",
+	ErrnoProtocol:  "protocol",
+	ErrnoInvalid:   "invalid",
+	ErrnoPortInUse: "port in use",
+	ErrnoUnknown:   "unknown",
+}
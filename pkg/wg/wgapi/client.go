@@ -0,0 +1,147 @@
+package wgapi
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SocketDirectory is the directory wireguard-go and the wireguard tools place UAPI sockets in.
+const SocketDirectory = "/var/run/wireguard"
+
+// SocketPath returns the path of the UAPI socket for the named interface.
+func SocketPath(name string) string { return filepath.Join(SocketDirectory, name+".sock") }
+
+// Client performs IPC operations on an external wireguard device over its UAPI socket as documented by [wireguard cross-platform documentation].
+// Operations are serialized, so a client may be shared.
+//
+// [wireguard cross-platform documentation]: https://www.wireguard.com/xplatform/
+type Client struct {
+	mu   sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// Dial connects to the UAPI unix socket at path.
+func Dial(ctx context.Context, path string) (*Client, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn), nil
+}
+
+// NewClient creates a [Client] that communicates over conn. The client takes ownership of conn.
+func NewClient(conn net.Conn) *Client {
+	return &Client{conn: conn, rd: bufio.NewReader(conn)}
+}
+
+// Close closes the underlying connection.
+func (c *Client) Close() error { return c.conn.Close() }
+
+// Get performs a get=1 operation and returns the device's configuration.
+// The trailing errno is not included in the returned [IPC].
+func (c *Client) Get(ctx context.Context) (IPC, error) {
+	return c.do(ctx, Get{}, nil)
+}
+
+// Set performs a set=1 operation with the given configuration.
+// The configuration must not contain the set=1 key itself.
+func (c *Client) Set(ctx context.Context, cfg Configurable) error {
+	_, err := c.do(ctx, Set{}, cfg.WGConfig())
+	return err
+}
+
+// aLongTimeAgo is used to unblock pending reads and writes when a context is canceled.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// do writes the operation followed by body and a terminating blank line, then reads the response up to and including the errno.
+// The request is written while the response is read since a device may reply before it has consumed the whole request.
+// If the exchange fails midway the stream can no longer be trusted, so the connection is closed.
+func (c *Client) do(ctx context.Context, op IPCKeyValue, body io.Reader) (_ IPC, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	canceled := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() { defer close(canceled); c.conn.SetDeadline(aLongTimeAgo) })
+	defer func() {
+		if !stop() {
+			<-canceled
+			c.conn.SetDeadline(time.Time{})
+		}
+	}()
+
+	defer func() {
+		var ipcErr *IPCError
+		if err != nil && !errors.As(err, &ipcErr) {
+			c.conn.Close()
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				err = ctxErr
+			}
+		}
+	}()
+
+	req := []io.Reader{IPC{op}.WGConfig()}
+	if body != nil {
+		req = append(req, body)
+	}
+	written := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(c.conn, io.MultiReader(append(req, strings.NewReader("\n"))...))
+		written <- err
+	}()
+
+	ipc, err := c.response()
+	if err != nil {
+		var ipcErr *IPCError
+		if errors.As(err, &ipcErr) {
+			select {
+			case <-written:
+			default:
+				// The rest of the rejected request would be read as new operations.
+				c.conn.Close()
+			}
+		}
+		return nil, err
+	}
+	return ipc, <-written
+}
+
+// response reads a response up to its terminating blank line and checks its errno.
+func (c *Client) response() (IPC, error) {
+	var get IPCGet
+	for {
+		line, err := c.rd.ReadBytes('\n')
+		if err != nil {
+			return nil, err
+		}
+		get.Write(line)
+		if len(line) == 1 {
+			break
+		}
+	}
+
+	ipc, err := get.Value()
+	if err != nil {
+		return nil, err
+	}
+	if len(ipc) == 0 {
+		return nil, errors.New("response did not contain an errno")
+	}
+	errno, ok := ipc[len(ipc)-1].(Errno)
+	if !ok {
+		return nil, fmt.Errorf("response ended with %q, expected %q", ipc[len(ipc)-1].Key(), ErrnoNone.Key())
+	}
+	if errno != ErrnoNone {
+		return nil, &IPCError{Errno: errno}
+	}
+	return ipc[:len(ipc)-1], nil
+}
@@ -0,0 +1,221 @@
+package wgapi_test
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"github.com/trymoose/point-c/pkg/wg"
+	"github.com/trymoose/point-c/pkg/wg/wgapi"
+	"github.com/trymoose/point-c/pkg/wg/wglog"
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"golang.zx2c4.com/wireguard/device"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeUAPI is an in-process UAPI server that records each request and replies with canned responses.
+type fakeUAPI struct {
+	requests  chan string
+	responses chan string
+}
+
+func newFakeUAPI(t testing.TB, conn net.Conn) *fakeUAPI {
+	t.Helper()
+	f := &fakeUAPI{requests: make(chan string, 1), responses: make(chan string, 1)}
+	go func() {
+		defer conn.Close()
+		rd := bufio.NewReader(conn)
+		for {
+			var req strings.Builder
+			for {
+				line, err := rd.ReadString('\n')
+				if err != nil {
+					return
+				}
+				req.WriteString(line)
+				if line == "\n" {
+					break
+				}
+			}
+			f.requests <- req.String()
+			if _, err := io.WriteString(conn, <-f.responses); err != nil {
+				return
+			}
+		}
+	}()
+	return f
+}
+
+func newFakeClient(t testing.TB) (*wgapi.Client, *fakeUAPI) {
+	t.Helper()
+	c1, c2 := net.Pipe()
+	client := wgapi.NewClient(c1)
+	t.Cleanup(func() { client.Close() })
+	return client, newFakeUAPI(t, c2)
+}
+
+func TestClient_Get(t *testing.T) {
+	client, srv := newFakeClient(t)
+	srv.responses <- exampleGet + "\n"
+
+	ipc, err := client.Get(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, "get=1\n\n", <-srv.requests)
+
+	var get wgapi.IPCGet
+	_, err = io.WriteString(&get, exampleGet)
+	require.NoError(t, err)
+	expected, err := get.Value()
+	require.NoError(t, err)
+	require.Equal(t, expected[:len(expected)-1], ipc)
+}
+
+func TestClient_Set(t *testing.T) {
+	client, srv := newFakeClient(t)
+	srv.responses <- "errno=0\n\n"
+
+	cfg := wgapi.IPC{
+		wgapi.ListenPort(12912),
+		wgapi.ReplacePeers{},
+	}
+	require.NoError(t, client.Set(context.Background(), cfg))
+	require.Equal(t, "set=1\nlisten_port=12912\nreplace_peers=true\n\n", <-srv.requests)
+}
+
+func TestClient_Errno(t *testing.T) {
+	for _, errno := range []wgapi.Errno{wgapi.ErrnoIO, wgapi.ErrnoProtocol, wgapi.ErrnoInvalid, wgapi.ErrnoPortInUse, wgapi.ErrnoUnknown} {
+		t.Run(errno.String(), func(t *testing.T) {
+			client, srv := newFakeClient(t)
+			srv.responses <- "errno=" + errno.String() + "\n\n"
+			err := client.Set(context.Background(), wgapi.IPC{wgapi.ListenPort(1)})
+			<-srv.requests
+
+			var ipcErr *wgapi.IPCError
+			require.ErrorAs(t, err, &ipcErr)
+			require.Equal(t, errno, ipcErr.Errno)
+			require.ErrorIs(t, err, &wgapi.IPCError{Errno: errno})
+		})
+	}
+}
+
+func TestClient_MalformedResponse(t *testing.T) {
+	t.Run("missing errno", func(t *testing.T) {
+		client, srv := newFakeClient(t)
+		srv.responses <- "listen_port=1\n\n"
+		_, err := client.Get(context.Background())
+		require.Error(t, err)
+		<-srv.requests
+	})
+
+	t.Run("empty response", func(t *testing.T) {
+		client, srv := newFakeClient(t)
+		srv.responses <- "\n"
+		_, err := client.Get(context.Background())
+		require.Error(t, err)
+		<-srv.requests
+	})
+
+	t.Run("invalid key", func(t *testing.T) {
+		client, srv := newFakeClient(t)
+		srv.responses <- "foo=bar\nerrno=0\n\n"
+		_, err := client.Get(context.Background())
+		require.Error(t, err)
+		<-srv.requests
+	})
+}
+
+func TestClient_Context(t *testing.T) {
+	client, srv := newFakeClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+
+	// No response is queued so the server never replies.
+	_, err := client.Get(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	<-srv.requests
+
+	_, err = client.Get(context.Background())
+	require.ErrorIs(t, err, io.ErrClosedPipe)
+}
+
+func TestDial(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wg0.sock")
+	ln, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	defer ln.Close()
+
+	srvs := make(chan *fakeUAPI, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			close(srvs)
+			return
+		}
+		srvs <- newFakeUAPI(t, c)
+	}()
+
+	client, err := wgapi.Dial(context.Background(), path)
+	require.NoError(t, err)
+	defer client.Close()
+
+	srv := <-srvs
+	require.NotNil(t, srv)
+	srv.responses <- "errno=0\n\n"
+	ipc, err := client.Get(context.Background())
+	require.NoError(t, err)
+	require.Empty(t, ipc)
+	require.Equal(t, "get=1\n\n", <-srv.requests)
+}
+
+func TestSocketPath(t *testing.T) {
+	require.Equal(t, "/var/run/wireguard/wg0.sock", wgapi.SocketPath("wg0"))
+}
+
+// TestClient_Device checks the client against the UAPI handler of a real wireguard-go device.
+func TestClient_Device(t *testing.T) {
+	tun, err := wg.NewDefaultNetstack()
+	require.NoError(t, err)
+	binds := bindtest.NewChannelBinds()
+	defer binds[0].Close()
+	dev := device.NewDevice(tun, binds[0], wglog.Noop())
+	defer dev.Close()
+
+	c1, c2 := net.Pipe()
+	go dev.IpcHandle(c2)
+	client := wgapi.NewClient(c1)
+	defer client.Close()
+
+	private, public, err := wgapi.NewPrivatePublic()
+	require.NoError(t, err)
+	_, peer, err := wgapi.NewPrivatePublic()
+	require.NoError(t, err)
+	require.NoError(t, client.Set(context.Background(), wgapi.IPC{
+		private,
+		wgapi.ReplacePeers{},
+		peer,
+		wgapi.IdentitySubnet(net.IPv4(192, 168, 4, 4)),
+	}))
+
+	ipc, err := client.Get(context.Background())
+	require.NoError(t, err)
+	var gotPrivate, gotPeer bool
+	for _, kv := range ipc {
+		switch kv := kv.(type) {
+		case wgapi.PrivateKey:
+			gotPrivate = kv == private
+		case wgapi.PublicKey:
+			gotPeer = kv == peer
+			require.NotEqual(t, public, kv)
+		}
+	}
+	require.True(t, gotPrivate, "private key not returned")
+	require.True(t, gotPeer, "peer not returned")
+
+	err = client.Set(context.Background(), wgapi.IPC{wgapi.UpdateOnly{}})
+	require.True(t, errors.Is(err, &wgapi.IPCError{Errno: wgapi.ErrnoInvalid}), "got %v", err)
+}
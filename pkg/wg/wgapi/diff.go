@@ -0,0 +1,217 @@
+package wgapi
+
+import (
+	"fmt"
+	"io"
+	"slices"
+)
+
+// Diff computes the IPC set operation that changes a device configured with old into one configured with new.
+// Both configurations are read as a description of the device's state, so a peer with [Remove] is treated as absent and [ReplacePeers], [UpdateOnly] and values only present in a get operation are ignored.
+// Peers missing from new are removed, peers missing from old are added, and peers present in both are updated with [UpdateOnly] and only the values that changed.
+// Allowed IPs are compared as a set and are only replaced with [ReplaceAllowedIPs] if that set changed.
+//
+// Some values can not be unset through the IPC. An endpoint or private key missing from new is left as is, and a listen port of 0 in new keeps the current port.
+// A missing persistent keepalive or fwmark is treated as 0.
+//
+// The returned [IPC] does not include the [Set] key and is empty if nothing changed.
+func Diff(old, new Configurable) (IPC, error) {
+	o, err := parseConfig(old)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse old config: %w", err)
+	}
+	n, err := parseConfig(new)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse new config: %w", err)
+	}
+
+	var ipc IPC
+	if n.private != nil && (o.private == nil || *o.private != *n.private) {
+		ipc = append(ipc, *n.private)
+	}
+	if n.listenPort != 0 && n.listenPort != o.listenPort {
+		ipc = append(ipc, n.listenPort)
+	}
+	if n.fwmark != o.fwmark {
+		ipc = append(ipc, n.fwmark)
+	}
+
+	for _, op := range o.peers {
+		if _, ok := n.peer(op.public); !ok {
+			ipc = append(ipc, op.public, Remove{})
+		}
+	}
+
+	for _, np := range n.peers {
+		op, ok := o.peer(np.public)
+		if !ok {
+			ipc = append(ipc, np.create()...)
+		} else {
+			ipc = append(ipc, op.update(np)...)
+		}
+	}
+	return ipc, nil
+}
+
+type (
+	// config is the state of a device described by an [IPC].
+	config struct {
+		private    *PrivateKey
+		listenPort ListenPort
+		fwmark     FWMark
+		peers      []*peerConfig
+	}
+	// peerConfig is the state of a single peer described by an [IPC].
+	peerConfig struct {
+		public     PublicKey
+		preshared  PresharedKey
+		endpoint   *Endpoint
+		keepalive  PersistentKeepalive
+		allowedIPs []AllowedIP
+		remove     bool
+	}
+)
+
+// parseConfig reads a configuration into the state it describes.
+func parseConfig(c Configurable) (*config, error) {
+	ipc, err := readIPC(c.WGConfig())
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg config
+	var peer *peerConfig
+	for i, kv := range ipc {
+		if public, ok := kv.(PublicKey); ok {
+			// A removed peer may be declared again, it is then added anew with the later declaration.
+			if prev, ok := cfg.peer(public); ok && !prev.remove {
+				return nil, fmt.Errorf("line %d, peer %s declared twice", i+1, kv)
+			} else if ok {
+				cfg.peers = slices.DeleteFunc(cfg.peers, func(p *peerConfig) bool { return p == prev })
+			}
+			peer = &peerConfig{public: public}
+			cfg.peers = append(cfg.peers, peer)
+		} else if peer == nil {
+			if !cfg.set(kv) {
+				return nil, fmt.Errorf("line %d, key %q is not valid outside of a peer", i+1, kv.Key())
+			}
+		} else if !peer.set(kv) {
+			return nil, fmt.Errorf("line %d, key %q is not valid inside of a peer", i+1, kv.Key())
+		}
+	}
+
+	cfg.peers = slices.DeleteFunc(cfg.peers, func(p *peerConfig) bool { return p.remove })
+	return &cfg, nil
+}
+
+// set applies a device level key. False is returned if the key is not valid for a device.
+func (cfg *config) set(kv IPCKeyValue) bool {
+	switch kv := kv.(type) {
+	case PrivateKey:
+		cfg.private = &kv
+	case ListenPort:
+		cfg.listenPort = kv
+	case FWMark:
+		cfg.fwmark = kv
+	case ReplacePeers, Set, Get, Errno:
+	default:
+		return false
+	}
+	return true
+}
+
+// set applies a peer level key. False is returned if the key is not valid for a peer.
+func (p *peerConfig) set(kv IPCKeyValue) bool {
+	switch kv := kv.(type) {
+	case PresharedKey:
+		p.preshared = kv
+	case Endpoint:
+		p.endpoint = &kv
+	case PersistentKeepalive:
+		p.keepalive = kv
+	case AllowedIP:
+		p.allowedIPs = append(p.allowedIPs, kv)
+	case ReplaceAllowedIPs:
+		p.allowedIPs = nil
+	case Remove:
+		p.remove = true
+	case UpdateOnly, ProtocolVersion, LastHandshakeTimeSec, LastHandshakeTimeNSec, RXBytes, TXBytes, Errno:
+	default:
+		return false
+	}
+	return true
+}
+
+// readIPC parses the 'key=value\n' lines of a configuration.
+func readIPC(r io.Reader) (IPC, error) {
+	var get IPCGet
+	if _, err := io.Copy(&get, r); err != nil {
+		return nil, err
+	}
+	return get.Value()
+}
+
+// peer gets a peer by its public key.
+func (cfg *config) peer(public PublicKey) (*peerConfig, bool) {
+	i := slices.IndexFunc(cfg.peers, func(p *peerConfig) bool { return p.public == public })
+	if i < 0 {
+		return nil, false
+	}
+	return cfg.peers[i], true
+}
+
+// create returns the IPC needed to add this peer to a device.
+func (p *peerConfig) create() IPC {
+	ipc := IPC{p.public}
+	if p.preshared != (PresharedKey{}) {
+		ipc = append(ipc, p.preshared)
+	}
+	if p.endpoint != nil {
+		ipc = append(ipc, *p.endpoint)
+	}
+	if p.keepalive != 0 {
+		ipc = append(ipc, p.keepalive)
+	}
+	for _, ip := range p.allowedIPs {
+		ipc = append(ipc, ip)
+	}
+	return ipc
+}
+
+// update returns the IPC needed to change this peer into n. If nothing changed the IPC is empty.
+func (p *peerConfig) update(n *peerConfig) IPC {
+	var ipc IPC
+	if p.preshared != n.preshared {
+		ipc = append(ipc, n.preshared)
+	}
+	if n.endpoint != nil && (p.endpoint == nil || p.endpoint.String() != n.endpoint.String()) {
+		ipc = append(ipc, *n.endpoint)
+	}
+	if p.keepalive != n.keepalive {
+		ipc = append(ipc, n.keepalive)
+	}
+	if !sameAllowedIPs(p.allowedIPs, n.allowedIPs) {
+		ipc = append(ipc, ReplaceAllowedIPs{})
+		for _, ip := range n.allowedIPs {
+			ipc = append(ipc, ip)
+		}
+	}
+
+	if len(ipc) == 0 {
+		return nil
+	}
+	return append(IPC{n.public, UpdateOnly{}}, ipc...)
+}
+
+// sameAllowedIPs reports whether a and b contain the same subnets, ignoring order and duplicates.
+func sameAllowedIPs(a, b []AllowedIP) bool {
+	set := func(ips []AllowedIP) []string {
+		s := make([]string, len(ips))
+		for i, ip := range ips {
+			s[i] = ip.String()
+		}
+		slices.Sort(s)
+		return slices.Compact(s)
+	}
+	return slices.Equal(set(a), set(b))
+}
@@ -0,0 +1,415 @@
+package wgapi_test
+
+import (
+	"github.com/stretchr/testify/require"
+	"github.com/trymoose/point-c/pkg/wg"
+	"github.com/trymoose/point-c/pkg/wg/wgapi"
+	"golang.zx2c4.com/wireguard/conn/bindtest"
+	"io"
+	"strings"
+	"testing"
+)
+
+const (
+	diffPrivate1 = "e84b5a6d2717c1003a13b431570353dbaca9146cf150c5f8575680feba52027a"
+	diffPrivate2 = "1881a2cea4ed1d3cbb6c5e1c9e3c6bb4b2b3b1ef4bd7a9c6e0e1b2bb3ac9a55a"
+	diffPeer1    = "b85996fecc9c7f1fc6d2572a76eda11d59bcd20be8e543b15ce4bd85a8e75a33"
+	diffPeer2    = "58402e695ba1772b1cc9309755f043251ea77fdcf10fbe63989ceb7e19321376"
+	diffPeer3    = "662e14fd594556f522604703340351258903b64f35553763f19426ab2a515c58"
+	diffPSK1     = "188515093e952f5f22e865cef3012e72f8b5f0b598ac0309d5dacce3b70fcf52"
+	diffPSK2     = "e818b58db5274087fcc1be5dc728cf53d3b5726b4cef6b9bab8f8f8c2452c25c"
+	diffNoPSK    = "0000000000000000000000000000000000000000000000000000000000000000"
+)
+
+// diffConfig is a configuration written as 'key=value\n' lines.
+type diffConfig string
+
+func (c diffConfig) WGConfig() io.Reader { return strings.NewReader(string(c)) }
+
+func TestDiff(t *testing.T) {
+	base := diffConfig(`private_key=` + diffPrivate1 + `
+listen_port=51820
+public_key=` + diffPeer1 + `
+preshared_key=` + diffPSK1 + `
+endpoint=1.1.1.1:51820
+persistent_keepalive_interval=25
+allowed_ip=10.0.0.2/32
+allowed_ip=10.1.0.0/16
+public_key=` + diffPeer2 + `
+preshared_key=` + diffPSK2 + `
+allowed_ip=10.0.0.3/32
+`)
+
+	tests := []struct {
+		name     string
+		old, new diffConfig
+		expected string
+	}{
+		{
+			name: "identical",
+			old:  base,
+			new:  base,
+		},
+		{
+			name: "empty",
+		},
+		{
+			name: "from empty",
+			new:  base,
+			expected: `private_key=` + diffPrivate1 + `
+listen_port=51820
+public_key=` + diffPeer1 + `
+preshared_key=` + diffPSK1 + `
+endpoint=1.1.1.1:51820
+persistent_keepalive_interval=25
+allowed_ip=10.0.0.2/32
+allowed_ip=10.1.0.0/16
+public_key=` + diffPeer2 + `
+preshared_key=` + diffPSK2 + `
+allowed_ip=10.0.0.3/32
+`,
+		},
+		{
+			name: "to empty",
+			old:  base,
+			expected: `public_key=` + diffPeer1 + `
+remove=true
+public_key=` + diffPeer2 + `
+remove=true
+`,
+		},
+		{
+			name:     "private key changed",
+			old:      base,
+			new:      diffConfig(strings.Replace(string(base), diffPrivate1, diffPrivate2, 1)),
+			expected: "private_key=" + diffPrivate2 + "\n",
+		},
+		{
+			name: "private key missing",
+			old:  base,
+			new:  diffConfig(strings.Replace(string(base), "private_key="+diffPrivate1+"\n", "", 1)),
+		},
+		{
+			name:     "listen port changed",
+			old:      base,
+			new:      diffConfig(strings.Replace(string(base), "listen_port=51820", "listen_port=1234", 1)),
+			expected: "listen_port=1234\n",
+		},
+		{
+			name: "listen port zero",
+			old:  base,
+			new:  diffConfig(strings.Replace(string(base), "listen_port=51820", "listen_port=0", 1)),
+		},
+		{
+			name:     "fwmark set",
+			old:      base,
+			new:      diffConfig(strings.Replace(string(base), "listen_port=51820\n", "listen_port=51820\nfwmark=7\n", 1)),
+			expected: "fwmark=7\n",
+		},
+		{
+			name:     "fwmark cleared",
+			old:      diffConfig(strings.Replace(string(base), "listen_port=51820\n", "listen_port=51820\nfwmark=7\n", 1)),
+			new:      base,
+			expected: "fwmark=0\n",
+		},
+		{
+			name: "peer added",
+			old:  base,
+			new: base + `public_key=` + diffPeer3 + `
+preshared_key=` + diffPSK1 + `
+endpoint=[abcd:23::33]:51820
+persistent_keepalive_interval=10
+allowed_ip=10.0.0.4/32
+`,
+			expected: `public_key=` + diffPeer3 + `
+preshared_key=` + diffPSK1 + `
+endpoint=[abcd:23::33]:51820
+persistent_keepalive_interval=10
+allowed_ip=10.0.0.4/32
+`,
+		},
+		{
+			name: "peer added without preshared key",
+			old:  base,
+			new: base + `public_key=` + diffPeer3 + `
+preshared_key=` + diffNoPSK + `
+allowed_ip=10.0.0.4/32
+`,
+			expected: `public_key=` + diffPeer3 + `
+allowed_ip=10.0.0.4/32
+`,
+		},
+		{
+			name: "peer removed",
+			old:  base,
+			new: diffConfig(`private_key=` + diffPrivate1 + `
+listen_port=51820
+public_key=` + diffPeer2 + `
+preshared_key=` + diffPSK2 + `
+allowed_ip=10.0.0.3/32
+`),
+			expected: `public_key=` + diffPeer1 + `
+remove=true
+`,
+		},
+		{
+			name: "peer removed with remove",
+			old:  base,
+			new: base + `public_key=` + diffPeer3 + `
+remove=true
+`,
+		},
+		{
+			name: "preshared key changed",
+			old:  base,
+			new:  diffConfig(strings.Replace(string(base), diffPSK2, diffPSK1, 1)),
+			expected: `public_key=` + diffPeer2 + `
+update_only=true
+preshared_key=` + diffPSK1 + `
+`,
+		},
+		{
+			name: "preshared key cleared",
+			old:  base,
+			new:  diffConfig(strings.Replace(string(base), diffPSK2, diffNoPSK, 1)),
+			expected: `public_key=` + diffPeer2 + `
+update_only=true
+preshared_key=` + diffNoPSK + `
+`,
+		},
+		{
+			name: "endpoint changed",
+			old:  base,
+			new:  diffConfig(strings.Replace(string(base), "endpoint=1.1.1.1:51820", "endpoint=2.2.2.2:51820", 1)),
+			expected: `public_key=` + diffPeer1 + `
+update_only=true
+endpoint=2.2.2.2:51820
+`,
+		},
+		{
+			name: "endpoint missing",
+			old:  base,
+			new:  diffConfig(strings.Replace(string(base), "endpoint=1.1.1.1:51820\n", "", 1)),
+		},
+		{
+			name: "keepalive changed",
+			old:  base,
+			new:  diffConfig(strings.Replace(string(base), "persistent_keepalive_interval=25", "persistent_keepalive_interval=5", 1)),
+			expected: `public_key=` + diffPeer1 + `
+update_only=true
+persistent_keepalive_interval=5
+`,
+		},
+		{
+			name: "keepalive missing",
+			old:  base,
+			new:  diffConfig(strings.Replace(string(base), "persistent_keepalive_interval=25\n", "", 1)),
+			expected: `public_key=` + diffPeer1 + `
+update_only=true
+persistent_keepalive_interval=0
+`,
+		},
+		{
+			name: "allowed ip added",
+			old:  base,
+			new:  diffConfig(strings.Replace(string(base), "allowed_ip=10.0.0.3/32\n", "allowed_ip=10.0.0.3/32\nallowed_ip=10.2.0.0/16\n", 1)),
+			expected: `public_key=` + diffPeer2 + `
+update_only=true
+replace_allowed_ips=true
+allowed_ip=10.0.0.3/32
+allowed_ip=10.2.0.0/16
+`,
+		},
+		{
+			name: "allowed ip removed",
+			old:  base,
+			new:  diffConfig(strings.Replace(string(base), "allowed_ip=10.1.0.0/16\n", "", 1)),
+			expected: `public_key=` + diffPeer1 + `
+update_only=true
+replace_allowed_ips=true
+allowed_ip=10.0.0.2/32
+`,
+		},
+		{
+			name: "allowed ips reordered",
+			old:  base,
+			new:  diffConfig(strings.Replace(string(base), "allowed_ip=10.0.0.2/32\nallowed_ip=10.1.0.0/16\n", "allowed_ip=10.1.0.0/16\nallowed_ip=10.0.0.2/32\nallowed_ip=10.1.0.0/16\n", 1)),
+		},
+		{
+			name: "replace allowed ips",
+			old:  base,
+			new:  diffConfig(strings.Replace(string(base), "allowed_ip=10.0.0.3/32\n", "allowed_ip=10.0.0.4/32\nreplace_allowed_ips=true\nallowed_ip=10.0.0.3/32\n", 1)),
+		},
+		{
+			name: "multiple changes",
+			old:  base,
+			new: diffConfig(`private_key=` + diffPrivate1 + `
+listen_port=51821
+public_key=` + diffPeer3 + `
+allowed_ip=10.0.0.4/32
+public_key=` + diffPeer1 + `
+preshared_key=` + diffPSK2 + `
+endpoint=1.1.1.1:51820
+persistent_keepalive_interval=25
+allowed_ip=10.0.0.2/32
+`),
+			expected: `listen_port=51821
+public_key=` + diffPeer2 + `
+remove=true
+public_key=` + diffPeer3 + `
+allowed_ip=10.0.0.4/32
+public_key=` + diffPeer1 + `
+update_only=true
+preshared_key=` + diffPSK2 + `
+replace_allowed_ips=true
+allowed_ip=10.0.0.2/32
+`,
+		},
+		{
+			name: "removed and declared again",
+			old:  base,
+			new: diffConfig(`private_key=` + diffPrivate1 + `
+listen_port=51820
+public_key=` + diffPeer1 + `
+remove=true
+public_key=` + diffPeer2 + `
+preshared_key=` + diffPSK2 + `
+allowed_ip=10.0.0.3/32
+public_key=` + diffPeer1 + `
+allowed_ip=10.0.0.2/32
+`),
+			expected: `public_key=` + diffPeer1 + `
+update_only=true
+preshared_key=` + diffNoPSK + `
+persistent_keepalive_interval=0
+replace_allowed_ips=true
+allowed_ip=10.0.0.2/32
+`,
+		},
+		{
+			name: "set operation",
+			old:  base,
+			new:  "set=1\nreplace_peers=true\n" + base,
+		},
+		{
+			name: "get operation",
+			old: diffConfig(`private_key=` + diffPrivate1 + `
+listen_port=51820
+public_key=` + diffPeer1 + `
+preshared_key=` + diffPSK1 + `
+protocol_version=1
+endpoint=1.1.1.1:51820
+last_handshake_time_sec=1700000000
+last_handshake_time_nsec=12
+tx_bytes=38333
+rx_bytes=2224
+persistent_keepalive_interval=25
+allowed_ip=10.1.0.0/16
+allowed_ip=10.0.0.2/32
+public_key=` + diffPeer2 + `
+preshared_key=` + diffPSK2 + `
+protocol_version=1
+last_handshake_time_sec=0
+last_handshake_time_nsec=0
+tx_bytes=0
+rx_bytes=0
+persistent_keepalive_interval=0
+allowed_ip=10.0.0.3/32
+errno=0
+`),
+			new: base,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ipc, err := wgapi.Diff(tt.old, tt.new)
+			require.NoError(t, err)
+			b, err := io.ReadAll(ipc.WGConfig())
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, string(b))
+		})
+	}
+}
+
+func TestDiff_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  diffConfig
+		line string // line is the line the error is reported on, if it is about a line.
+	}{
+		{name: "peer key outside of peer", cfg: "allowed_ip=10.0.0.2/32\n", line: "line 1,"},
+		{name: "device key inside of peer", cfg: "public_key=" + diffPeer1 + "\nlisten_port=1\n", line: "line 2,"},
+		{name: "duplicate peer", cfg: "public_key=" + diffPeer1 + "\npublic_key=" + diffPeer1 + "\n", line: "line 2,"},
+		{name: "malformed", cfg: "listen_port\n"},
+		{name: "no trailing newline", cfg: "listen_port=1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := wgapi.Diff(tt.cfg, diffConfig(""))
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tt.line)
+			_, err = wgapi.Diff(diffConfig(""), tt.cfg)
+			require.Error(t, err)
+		})
+	}
+}
+
+// TestDiff_Device applies diffs to a running device and checks that it ends up in the same state as the new configuration.
+// Endpoints are left out since the test bind does not preserve them.
+func TestDiff_Device(t *testing.T) {
+	binds := bindtest.NewChannelBinds()
+	defer binds[0].Close()
+	var n *wg.Net
+	dev, err := wg.New(wg.OptionNetDevice(&n), wg.OptionBind(binds[0]))
+	require.NoError(t, err)
+	defer dev.Close()
+
+	configs := []diffConfig{
+		`private_key=` + diffPrivate1 + `
+public_key=` + diffPeer1 + `
+preshared_key=` + diffPSK1 + `
+allowed_ip=10.0.0.2/32
+public_key=` + diffPeer2 + `
+allowed_ip=10.0.0.3/32
+`,
+		`private_key=` + diffPrivate1 + `
+public_key=` + diffPeer1 + `
+preshared_key=` + diffPSK2 + `
+persistent_keepalive_interval=25
+allowed_ip=10.0.0.2/32
+allowed_ip=10.1.0.0/16
+public_key=` + diffPeer3 + `
+allowed_ip=10.0.0.3/32
+`,
+		`private_key=` + diffPrivate2 + `
+public_key=` + diffPeer3 + `
+allowed_ip=10.0.0.4/32
+`,
+	}
+
+	for _, cfg := range configs {
+		current, err := dev.GetConfig()
+		require.NoError(t, err)
+		ipc, err := wgapi.Diff(current, cfg)
+		require.NoError(t, err)
+		require.NoError(t, dev.SetConfig(ipc))
+
+		current, err = dev.GetConfig()
+		require.NoError(t, err)
+		ipc, err = wgapi.Diff(current, cfg)
+		require.NoError(t, err)
+		require.Empty(t, ipc)
+	}
+
+	// Applying a diff leaves the peers that did not change alone.
+	current, err := dev.GetConfig()
+	require.NoError(t, err)
+	ipc, err := wgapi.Diff(current, configs[2]+`public_key=`+diffPeer1+`
+allowed_ip=10.0.0.2/32
+`)
+	require.NoError(t, err)
+	require.NotContains(t, ipc, mustParseKey[wgapi.PublicKey](t, diffPeer3))
+	require.NoError(t, dev.SetConfig(ipc))
+}
@@ -0,0 +1,181 @@
+package wgapi
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/trymoose/point-c/pkg/wg/wgapi/internal/parser"
+)
+
+// LineError is an error found on a line of an IPC operation. Lines are counted from 1.
+type LineError struct {
+	Line int    // Line is the line the error was found on.
+	Key  string // Key is the key on the line, if it could be read.
+	Err  error  // Err describes the problem.
+}
+
+func (e *LineError) Error() string {
+	if e.Key == "" {
+		return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+	}
+	return fmt.Sprintf("line %d, key %q: %v", e.Line, e.Key, e.Err)
+}
+
+func (e *LineError) Unwrap() error { return e.Err }
+
+// Validate checks a set operation before it is given to a device, so it can be rejected before any of it is applied.
+// The configuration must not contain the [Set] key itself.
+//
+// Device keys must come before the first peer and may only appear once, and peer keys must come after the [PublicKey] of the peer they configure.
+// [UpdateOnly] must come before any other value of its peer, [ReplaceAllowedIPs] must come before the peer's first [AllowedIP], and a peer can not be configured after [Remove].
+// A peer may only be declared once, a peer value may only be set once, and an allowed IP may only belong to one peer.
+// Values only returned by a get operation are not allowed.
+//
+// Errors are an [*IPCError] wrapping a [*LineError].
+// Malformed lines have the [ErrnoProtocol] errno, the other errors have [ErrnoInvalid] like they would from wireguard-go.
+// On success the parsed configuration is returned.
+func Validate(c Configurable) (IPC, error) {
+	v := validator{
+		device:  map[string]int{},
+		peers:   map[PublicKey]int{},
+		allowed: map[string]int{},
+	}
+	sc := bufio.NewScanner(c.WGConfig())
+	sc.Split(parser.ScanLines)
+	for sc.Scan() {
+		v.line++
+		if err := v.validate(sc.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, &IPCError{Errno: ErrnoProtocol, Err: &LineError{Line: v.line + 1, Err: err}}
+	}
+	return v.ipc, nil
+}
+
+type (
+	// validator holds the state of a configuration being validated.
+	validator struct {
+		ipc     IPC
+		line    int
+		end     bool              // end is set after the blank line ending the operation.
+		device  map[string]int    // device is the line each device key was set on.
+		peers   map[PublicKey]int // peers is the line each peer was declared on.
+		allowed map[string]int    // allowed is the line each allowed IP was added on.
+		peer    *validatorPeer    // peer is the peer being configured, nil before the first peer.
+	}
+	// validatorPeer holds the state of the peer being validated.
+	validatorPeer struct {
+		keys    map[string]int // keys is the line each value of the peer was set on.
+		removed bool
+	}
+)
+
+var (
+	errMalformed    = errors.New("malformed line, expected key=value")
+	errAfterEnd     = errors.New("data after the blank line ending the operation")
+	errGetOnly      = errors.New("only valid in a get operation")
+	errOperation    = errors.New("operation keys are not part of the configuration")
+	errDeviceInPeer = errors.New("device keys must come before the first peer")
+	errPeerNoPeer   = errors.New("peer keys must come after a public_key")
+	errUpdateOnly   = errors.New("must come before the other values of the peer")
+	errReplaceIPs   = errors.New("must come before the first allowed_ip of the peer")
+	errRemoved      = errors.New("peer has already been removed")
+)
+
+// validate checks a single line, adding it to the parsed configuration.
+func (v *validator) validate(line []byte) error {
+	if v.end {
+		return v.errorf(ErrnoProtocol, "", errAfterEnd)
+	}
+	if len(line) == 0 {
+		v.end = true
+		return nil
+	}
+
+	k, val, ok := bytes.Cut(line, kvCutChar)
+	if !ok {
+		return v.errorf(ErrnoProtocol, "", errMalformed)
+	}
+	key := string(k)
+	p, ok := parsers[key]
+	if !ok {
+		return v.errorf(ErrnoInvalid, key, errors.New("unknown key"))
+	}
+	kv, err := p(val)
+	if err != nil {
+		return v.errorf(ErrnoInvalid, key, err)
+	}
+
+	switch kv := kv.(type) {
+	case Set, Get:
+		return v.errorf(ErrnoInvalid, key, errOperation)
+	case Errno, RXBytes, TXBytes, LastHandshakeTimeSec, LastHandshakeTimeNSec:
+		return v.errorf(ErrnoInvalid, key, errGetOnly)
+	case PrivateKey, ListenPort, FWMark, ReplacePeers:
+		if v.peer != nil {
+			return v.errorf(ErrnoInvalid, key, errDeviceInPeer)
+		} else if l, ok := v.device[key]; ok {
+			return v.errorf(ErrnoInvalid, key, fmt.Errorf("already set on line %d", l))
+		}
+		v.device[key] = v.line
+	case PublicKey:
+		if l, ok := v.peers[kv]; ok {
+			return v.errorf(ErrnoInvalid, key, fmt.Errorf("peer already declared on line %d", l))
+		}
+		v.peers[kv] = v.line
+		v.peer = &validatorPeer{keys: map[string]int{}}
+	default:
+		if err := v.validatePeer(kv); err != nil {
+			return v.errorf(ErrnoInvalid, key, err)
+		}
+	}
+
+	v.ipc = append(v.ipc, kv)
+	return nil
+}
+
+// validatePeer checks a key that configures the current peer.
+func (v *validator) validatePeer(kv IPCKeyValue) error {
+	if v.peer == nil {
+		return errPeerNoPeer
+	} else if v.peer.removed {
+		return errRemoved
+	}
+
+	key := kv.Key()
+	switch kv := kv.(type) {
+	case UpdateOnly:
+		if len(v.peer.keys) > 0 {
+			return errUpdateOnly
+		}
+	case Remove:
+		v.peer.removed = true
+	case ReplaceAllowedIPs:
+		if _, ok := v.peer.keys[AllowedIP{}.Key()]; ok {
+			return errReplaceIPs
+		}
+	case AllowedIP:
+		ip := kv.String()
+		if l, ok := v.allowed[ip]; ok {
+			return fmt.Errorf("allowed ip %s already added on line %d", ip, l)
+		}
+		v.allowed[ip] = v.line
+		// Allowed IPs may be repeated with different values.
+		v.peer.keys[key] = v.line
+		return nil
+	}
+
+	if l, ok := v.peer.keys[key]; ok {
+		return fmt.Errorf("already set on line %d", l)
+	}
+	v.peer.keys[key] = v.line
+	return nil
+}
+
+// errorf creates an [*IPCError] for the current line.
+func (v *validator) errorf(errno Errno, key string, err error) error {
+	return &IPCError{Errno: errno, Err: &LineError{Line: v.line, Key: key, Err: err}}
+}
@@ -0,0 +1,85 @@
+package wgapi_test
+
+import (
+	"github.com/stretchr/testify/require"
+	"github.com/trymoose/point-c/pkg/wg/wgapi"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		ipc, err := wgapi.Validate(diffConfig(`private_key=` + diffPrivate1 + `
+listen_port=51820
+fwmark=0
+replace_peers=true
+public_key=` + diffPeer1 + `
+preshared_key=` + diffPSK1 + `
+protocol_version=1
+replace_allowed_ips=true
+allowed_ip=10.0.0.2/32
+allowed_ip=10.1.0.0/16
+endpoint=1.1.1.1:51820
+persistent_keepalive_interval=25
+public_key=` + diffPeer2 + `
+update_only=true
+allowed_ip=10.0.0.3/32
+public_key=` + diffPeer3 + `
+remove=true
+`))
+		require.NoError(t, err)
+		require.Len(t, ipc, 17)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		ipc, err := wgapi.Validate(diffConfig(""))
+		require.NoError(t, err)
+		require.Empty(t, ipc)
+	})
+
+	t.Run("blank line ends operation", func(t *testing.T) {
+		ipc, err := wgapi.Validate(diffConfig("listen_port=1\n\n"))
+		require.NoError(t, err)
+		require.Len(t, ipc, 1)
+	})
+
+	tests := []struct {
+		name  string
+		cfg   string
+		line  int
+		errno wgapi.Errno
+	}{
+		{name: "malformed", cfg: "listen_port=1\nlisten_port\n", line: 2, errno: wgapi.ErrnoProtocol},
+		{name: "no trailing newline", cfg: "listen_port=1\nfwmark=1", line: 2, errno: wgapi.ErrnoProtocol},
+		{name: "data after end", cfg: "listen_port=1\n\nfwmark=1\n", line: 3, errno: wgapi.ErrnoProtocol},
+		{name: "unknown key", cfg: "foo=bar\n", line: 1, errno: wgapi.ErrnoInvalid},
+		{name: "invalid value", cfg: "listen_port=abc\n", line: 1, errno: wgapi.ErrnoInvalid},
+		{name: "invalid constant", cfg: "replace_peers=false\n", line: 1, errno: wgapi.ErrnoInvalid},
+		{name: "set key", cfg: "set=1\nlisten_port=1\n", line: 1, errno: wgapi.ErrnoInvalid},
+		{name: "get key", cfg: "get=1\n", line: 1, errno: wgapi.ErrnoInvalid},
+		{name: "get only", cfg: "public_key=" + diffPeer1 + "\ntx_bytes=1\n", line: 2, errno: wgapi.ErrnoInvalid},
+		{name: "errno", cfg: "errno=0\n", line: 1, errno: wgapi.ErrnoInvalid},
+		{name: "duplicate device key", cfg: "listen_port=1\nfwmark=1\nlisten_port=2\n", line: 3, errno: wgapi.ErrnoInvalid},
+		{name: "device key in peer", cfg: "public_key=" + diffPeer1 + "\nlisten_port=1\n", line: 2, errno: wgapi.ErrnoInvalid},
+		{name: "peer key outside of peer", cfg: "listen_port=1\nallowed_ip=10.0.0.2/32\n", line: 2, errno: wgapi.ErrnoInvalid},
+		{name: "duplicate peer", cfg: "public_key=" + diffPeer1 + "\npublic_key=" + diffPeer2 + "\npublic_key=" + diffPeer1 + "\n", line: 3, errno: wgapi.ErrnoInvalid},
+		{name: "duplicate peer value", cfg: "public_key=" + diffPeer1 + "\nendpoint=1.1.1.1:1\nendpoint=1.1.1.1:2\n", line: 3, errno: wgapi.ErrnoInvalid},
+		{name: "duplicate allowed ip in peer", cfg: "public_key=" + diffPeer1 + "\nallowed_ip=10.0.0.2/32\nallowed_ip=10.0.0.2/32\n", line: 3, errno: wgapi.ErrnoInvalid},
+		{name: "duplicate allowed ip across peers", cfg: "public_key=" + diffPeer1 + "\nallowed_ip=10.0.0.0/24\npublic_key=" + diffPeer2 + "\nallowed_ip=10.0.0.1/24\n", line: 4, errno: wgapi.ErrnoInvalid},
+		{name: "update only after values", cfg: "public_key=" + diffPeer1 + "\nallowed_ip=10.0.0.2/32\nupdate_only=true\n", line: 3, errno: wgapi.ErrnoInvalid},
+		{name: "replace allowed ips after allowed ip", cfg: "public_key=" + diffPeer1 + "\nallowed_ip=10.0.0.2/32\nreplace_allowed_ips=true\n", line: 3, errno: wgapi.ErrnoInvalid},
+		{name: "value after remove", cfg: "public_key=" + diffPeer1 + "\nremove=true\nallowed_ip=10.0.0.2/32\n", line: 3, errno: wgapi.ErrnoInvalid},
+		{name: "invalid protocol version", cfg: "public_key=" + diffPeer1 + "\nprotocol_version=2\n", line: 2, errno: wgapi.ErrnoInvalid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := wgapi.Validate(diffConfig(tt.cfg))
+			var ipcErr *wgapi.IPCError
+			require.ErrorAs(t, err, &ipcErr)
+			require.Equal(t, tt.errno, ipcErr.Errno)
+			var lineErr *wgapi.LineError
+			require.ErrorAs(t, err, &lineErr)
+			require.Equal(t, tt.line, lineErr.Line, err.Error())
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package wgconfig
 
 import (
+	"errors"
+	"fmt"
 	"github.com/trymoose/point-c/pkg/wg/wgapi"
 	"io"
 	"net"
@@ -14,6 +16,16 @@ type Client struct {
 	Endpoint            net.UDPAddr        // Endpoint is the address and port of the wireguard server
 	PersistentKeepalive *uint16            // PersistentKeepalive is the interval (0 to disable, nil is ignored)
 	AllowedIPs          []net.IPNet        // AllowedIPs are the addresses allowed to communicate in the tunnel.
+	Peers               []*ClientPeer      // Peers are additional servers the client connects to.
+}
+
+// ClientPeer is an additional server of a [Client].
+type ClientPeer struct {
+	Public              wgapi.PublicKey    // Public is the server's public key
+	PreShared           wgapi.PresharedKey // PreShared is the key shared between the peer and server (required)
+	Endpoint            net.UDPAddr        // Endpoint is the address and port of the wireguard server
+	PersistentKeepalive *uint16            // PersistentKeepalive is the interval (0 to disable, nil is ignored)
+	AllowedIPs          []net.IPNet        // AllowedIPs are the addresses routed to this server. They can not overlap with other servers.
 }
 
 func (cfg *Client) WGConfig() io.Reader {
@@ -34,9 +46,54 @@ func (cfg *Client) WGConfig() io.Reader {
 			wgapi.AllowedIP(allowed),
 		}.WGConfig())
 	}
+
+	for _, peer := range cfg.Peers {
+		conf = io.MultiReader(conf, peer.WGConfig())
+	}
 	return conf
 }
 
+func (cfg *ClientPeer) WGConfig() io.Reader {
+	ipc := wgapi.IPC{
+		cfg.Public,
+		wgapi.Endpoint(cfg.Endpoint),
+		cfg.PreShared,
+	}
+	if cfg.PersistentKeepalive != nil {
+		ipc = append(ipc, wgapi.PersistentKeepalive(*cfg.PersistentKeepalive))
+	}
+	for _, allowed := range cfg.AllowedIPs {
+		ipc = append(ipc, wgapi.AllowedIP(allowed))
+	}
+	return ipc.WGConfig()
+}
+
+// CheckAllowedIPs checks the allowed ips of the servers do not overlap, so traffic is not silently routed to a different server.
+func (cfg *Client) CheckAllowedIPs() error {
+	type server struct {
+		public  wgapi.PublicKey
+		allowed []net.IPNet
+	}
+	servers := []server{{public: cfg.Public, allowed: cfg.AllowedIPs}}
+	for _, peer := range cfg.Peers {
+		servers = append(servers, server{public: peer.Public, allowed: peer.AllowedIPs})
+	}
+
+	var errs []error
+	for i, srv := range servers {
+		for _, other := range servers[:i] {
+			for _, a := range srv.allowed {
+				for _, b := range other.allowed {
+					if a.Contains(b.IP) || b.Contains(a.IP) {
+						errs = append(errs, fmt.Errorf("allowed ip %s of server %s overlaps %s of server %s", &a, srv.public, &b, other.public))
+					}
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
 // AllowAllIPs clears [Client.AllowedIPs] and sets it to [EmptySubnet].
 func (cfg *Client) AllowAllIPs() { cfg.AllowedIPs = []net.IPNet{net.IPNet(wgapi.EmptySubnet)} }
 
@@ -0,0 +1,34 @@
+package wgconfig_test
+
+import (
+	"github.com/stretchr/testify/require"
+	"github.com/trymoose/point-c/pkg/wg/wgapi"
+	"github.com/trymoose/point-c/pkg/wg/wgapi/wgconfig"
+	"net"
+	"testing"
+)
+
+func TestClient_CheckAllowedIPs(t *testing.T) {
+	subnet := func(s string) net.IPNet {
+		_, n, err := net.ParseCIDR(s)
+		require.NoError(t, err)
+		return *n
+	}
+	key := func() wgapi.PublicKey {
+		_, pk, err := wgapi.NewPrivatePublic()
+		require.NoError(t, err)
+		return pk
+	}
+
+	cfg := wgconfig.Client{Public: key(), AllowedIPs: []net.IPNet{subnet("10.0.0.0/24")}}
+	cfg.Peers = append(cfg.Peers, &wgconfig.ClientPeer{Public: key(), AllowedIPs: []net.IPNet{subnet("10.1.0.0/24")}})
+	require.NoError(t, cfg.CheckAllowedIPs())
+
+	cfg.Peers = append(cfg.Peers, &wgconfig.ClientPeer{Public: key(), AllowedIPs: []net.IPNet{subnet("10.0.0.128/25")}})
+	require.ErrorContains(t, cfg.CheckAllowedIPs(), "overlaps 10.0.0.0/24")
+
+	// Routing every address to the primary server overlaps any other server.
+	cfg.Peers = cfg.Peers[:1]
+	cfg.AllowAllIPs()
+	require.ErrorContains(t, cfg.CheckAllowedIPs(), "10.1.0.0/24 of server")
+}
@@ -1,6 +1,8 @@
 package wgconfig
 
 import (
+	"errors"
+	"fmt"
 	"github.com/trymoose/point-c/pkg/wg/wgapi"
 	"io"
 	"net"
@@ -40,14 +42,32 @@ func (cfg *Server) DefaultListenPort() {
 }
 
 // AddPeer adds a peer with the given public and preshared keys. AllowedIPs is set to the [IdentitySubnet] of the given ip.
-func (cfg *Server) AddPeer(publicKey wgapi.PublicKey, preShared wgapi.PresharedKey, ip net.IP) {
+// Subnets are routed to the peer as well, for networks behind the peer such as the LAN of a gateway.
+func (cfg *Server) AddPeer(publicKey wgapi.PublicKey, preShared wgapi.PresharedKey, ip net.IP, subnets ...net.IPNet) {
 	cfg.Peers = append(cfg.Peers, &Peer{
 		Public:     publicKey,
 		PreShared:  preShared,
-		AllowedIPs: []net.IPNet{net.IPNet(wgapi.IdentitySubnet(ip))},
+		AllowedIPs: append([]net.IPNet{net.IPNet(wgapi.IdentitySubnet(ip))}, subnets...),
 	})
 }
 
+// CheckAllowedIPs returns an error if the allowed ips of two peers overlap, since an address can only be routed to one peer.
+func (cfg *Server) CheckAllowedIPs() error {
+	var errs []error
+	for i, peer := range cfg.Peers {
+		for _, other := range cfg.Peers[:i] {
+			for _, a := range peer.AllowedIPs {
+				for _, b := range other.AllowedIPs {
+					if a.Contains(b.IP) || b.Contains(a.IP) {
+						errs = append(errs, fmt.Errorf("allowed ip %s of peer %s overlaps %s of peer %s", &a, peer.Public, &b, other.Public))
+					}
+				}
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
 func (cfg *Peer) WGConfig() io.Reader {
 	return append(wgapi.IPC{
 		cfg.Public,
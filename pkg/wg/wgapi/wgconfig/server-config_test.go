@@ -0,0 +1,35 @@
+package wgconfig_test
+
+import (
+	"github.com/stretchr/testify/require"
+	"github.com/trymoose/point-c/pkg/wg/wgapi"
+	"github.com/trymoose/point-c/pkg/wg/wgapi/wgconfig"
+	"net"
+	"testing"
+)
+
+func TestServer_CheckAllowedIPs(t *testing.T) {
+	subnet := func(s string) net.IPNet {
+		_, n, err := net.ParseCIDR(s)
+		require.NoError(t, err)
+		return *n
+	}
+	key := func() wgapi.PublicKey {
+		_, pk, err := wgapi.NewPrivatePublic()
+		require.NoError(t, err)
+		return pk
+	}
+
+	var cfg wgconfig.Server
+	cfg.AddPeer(key(), wgapi.PresharedKey{}, net.IPv4(10, 0, 0, 2), subnet("192.168.1.0/24"))
+	cfg.AddPeer(key(), wgapi.PresharedKey{}, net.IPv4(10, 0, 0, 3), subnet("192.168.2.0/24"), subnet("172.16.0.0/12"))
+	require.Len(t, cfg.Peers[1].AllowedIPs, 3)
+	require.NoError(t, cfg.CheckAllowedIPs())
+
+	cfg.AddPeer(key(), wgapi.PresharedKey{}, net.IPv4(192, 168, 1, 5))
+	require.ErrorContains(t, cfg.CheckAllowedIPs(), "overlaps 192.168.1.0/24")
+
+	cfg.Peers = cfg.Peers[:2]
+	cfg.AddPeer(key(), wgapi.PresharedKey{}, net.IPv4(10, 0, 0, 4), subnet("172.16.5.0/24"))
+	require.ErrorContains(t, cfg.CheckAllowedIPs(), "172.16.5.0/24")
+}
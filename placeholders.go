@@ -0,0 +1,45 @@
+package point_c
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"net/http"
+)
+
+var (
+	_ caddy.Provisioner           = (*Placeholders)(nil)
+	_ caddy.Module                = (*Placeholders)(nil)
+	_ caddyhttp.MiddlewareHandler = (*Placeholders)(nil)
+)
+
+// Placeholders adds the {pointc.net.<name>.ip} placeholders to requests, so handlers after it can refer to peers by name.
+//
+//	{
+//	  "handler": "point-c"
+//	}
+type Placeholders struct {
+	replace caddy.ReplacerFunc
+}
+
+func (*Placeholders) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.point-c",
+		New: func() caddy.Module { return new(Placeholders) },
+	}
+}
+
+func (p *Placeholders) Provision(ctx caddy.Context) error {
+	m, err := ctx.App("point-c")
+	if err != nil {
+		return err
+	}
+	p.replace = m.(*Pointc).Replace
+	return nil
+}
+
+func (p *Placeholders) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		repl.Map(p.replace)
+	}
+	return next.ServeHTTP(w, r)
+}
@@ -3,11 +3,15 @@ package point_c
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"net"
+	"slices"
+	"sync"
+	"time"
 )
 
 var (
@@ -42,8 +46,50 @@ type (
 		// DialPacket dials a remote address with the UDP protocol.
 		DialPacket(*net.UDPAddr) (net.PacketConn, error)
 	}
+	// Lifecycle is implemented by a [Network] that uses resources of the host, like a tunnel listening on a UDP port.
+	// The network is created when provisioned but does not use the host until it is brought up, so a config that fails to load does not disturb the running one.
+	Lifecycle interface {
+		// Up brings the network up. Networks are brought up in the order they are declared when the point-c app starts.
+		Up() error
+		// Down brings the network down. Networks are brought down in reverse order when the point-c app stops.
+		Down() error
+	}
+	// Composite is implemented by a [Network] built from nets declared by other networks, like a group failing over between tunnels.
+	Composite interface {
+		// LookupMembers is called once every network is provisioned, to look up the nets it is built from.
+		LookupMembers(NetLookup) error
+	}
+	// Ready is implemented by a [Net] that may not carry traffic right away, like a tunnel waiting for its first handshake.
+	Ready interface {
+		// WaitReady blocks until the net can carry traffic or the context is done.
+		WaitReady(context.Context) error
+	}
+	// Handshaker is implemented by a [Net] that keeps its tunnel alive with handshakes, so its health can be judged by its handshakes.
+	Handshaker interface {
+		// LastHandshake gets the handshakes of the net. ok is false if the net does not handshake, like the server end of a tunnel.
+		LastHandshake() (h Handshake, ok bool)
+	}
+	// Handshake is the state of the handshakes of a [Handshaker].
+	Handshake struct {
+		Last   time.Time // Last is when the last handshake completed, zero if none did.
+		Failed bool      // Failed reports whether every handshake since Last was given up on.
+		// Keepalive reports whether the tunnel handshakes while idle. Handshakes only happen when there is traffic otherwise,
+		// so the age of Last does not tell whether the tunnel works.
+		Keepalive bool
+	}
 )
 
+// WaitReady waits up to timeout for the net to be ready. Nets that do not implement [Ready] are always ready, and a timeout of 0 does not wait.
+func WaitReady(ctx context.Context, n Net, timeout time.Duration) error {
+	r, ok := n.(Ready)
+	if !ok || timeout <= 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return r.WaitReady(ctx)
+}
+
 type NetLookup interface {
 	Lookup(string) (Net, bool)
 }
@@ -53,6 +99,10 @@ type Pointc struct {
 	NetworksRaw []json.RawMessage `json:"networks,omitempty" caddy:"namespace=point-c.net inline_key=type"`
 	networks    []Network
 	net         map[string]Net
+
+	mu      sync.Mutex
+	started bool
+	up      []Lifecycle // up is the networks that were brought up, in the order they were.
 }
 
 func (*Pointc) CaddyModule() caddy.ModuleInfo {
@@ -73,7 +123,7 @@ func (wg *Pointc) Provision(ctx caddy.Context) error {
 			return fmt.Errorf("invalid raw module slice %T", val)
 		}
 
-		wg.networks = make([]Network, len(wg.NetworksRaw))
+		wg.networks = make([]Network, len(raw))
 		for i, v := range raw {
 			wg.networks[i] = v.(Network)
 		}
@@ -87,17 +137,73 @@ func (wg *Pointc) Provision(ctx caddy.Context) error {
 				wg.net[name] = nn
 			}
 		}
+
+		for _, n := range wg.networks {
+			if c, ok := n.(Composite); ok {
+				if err := c.LookupMembers(wg); err != nil {
+					return err
+				}
+			}
+		}
 	}
 	return nil
 }
 
-func (*Pointc) Start() error { return nil }
-func (*Pointc) Stop() error  { return nil }
+// Start brings up the networks implementing [Lifecycle]. If one fails the networks already up are brought down again.
+// Caddy starts apps in no particular order, so apps and modules using the networks call Start before they use them.
+// Starting an app that was started does nothing.
+func (wg *Pointc) Start() error {
+	wg.mu.Lock()
+	defer wg.mu.Unlock()
+	if wg.started {
+		return nil
+	}
 
-// Lookup gets a [Net] by its declared name.
+	for _, n := range wg.networks {
+		l, ok := n.(Lifecycle)
+		if !ok {
+			continue
+		}
+		if err := l.Up(); err != nil {
+			return errors.Join(fmt.Errorf("failed to bring network up: %w", err), wg.down())
+		}
+		wg.up = append(wg.up, l)
+	}
+	wg.started = true
+	return nil
+}
+
+// Stop brings down the networks brought up by [Pointc.Start], in reverse order.
+func (wg *Pointc) Stop() error {
+	wg.mu.Lock()
+	defer wg.mu.Unlock()
+	wg.started = false
+	return wg.down()
+}
+
+// down brings down the networks that are up.
+func (wg *Pointc) down() (err error) {
+	slices.Reverse(wg.up)
+	for _, l := range wg.up {
+		if derr := l.Down(); derr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to bring network down: %w", derr))
+		}
+	}
+	wg.up = nil
+	return
+}
+
+// Lookup gets a [Net] by its declared name. Nets added while running, such as enrolled peers, are found too.
 func (wg *Pointc) Lookup(name string) (Net, bool) {
-	n, ok := wg.net[name]
-	return n, ok
+	if n, ok := wg.net[name]; ok {
+		return n, true
+	}
+	for _, n := range wg.networks {
+		if nn, ok := n.Networks()[name]; ok {
+			return nn, true
+		}
+	}
+	return nil, false
 }
 
 // UnmarshalCaddyfile unmarshals a submodules from a caddyfile.
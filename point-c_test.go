@@ -3,6 +3,7 @@ package point_c_test
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
@@ -11,6 +12,7 @@ import (
 	pointc "github.com/trymoose/point-c"
 	"github.com/trymoose/point-c/internal/test_helpers"
 	"testing"
+	"time"
 )
 
 func (t *TestNetwork) CaddyModule() caddy.ModuleInfo {
@@ -59,6 +61,77 @@ func TestPointc_StartStop(t *testing.T) {
 	require.NoError(t, app.Stop())
 }
 
+// lifecycleNetwork is a [pointc.Lifecycle] network that records when it is brought up and down.
+type lifecycleNetwork struct {
+	id     caddy.ModuleID
+	name   string
+	events *[]string
+	fail   bool // fail fails to bring the network up.
+}
+
+// newLifecycleNetwork registers a network module, returning the type to use in the point-c config.
+func newLifecycleNetwork(name string, events *[]string, fail bool) string {
+	typ := "test-lifecycle-" + uuid.New().String()
+	caddy.RegisterModule(&lifecycleNetwork{id: caddy.ModuleID("point-c.net." + typ), name: name, events: events, fail: fail})
+	return typ
+}
+
+func (n *lifecycleNetwork) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{ID: n.id, New: func() caddy.Module { return n }}
+}
+
+func (n *lifecycleNetwork) Networks() map[string]pointc.Net { return map[string]pointc.Net{} }
+
+func (n *lifecycleNetwork) Up() error {
+	*n.events = append(*n.events, "up "+n.name)
+	if n.fail {
+		return errors.New("failed")
+	}
+	return nil
+}
+
+func (n *lifecycleNetwork) Down() error {
+	*n.events = append(*n.events, "down "+n.name)
+	return nil
+}
+
+func TestPointc_Lifecycle(t *testing.T) {
+	load := func(t *testing.T, types ...string) caddy.App {
+		t.Helper()
+		var cfg struct {
+			Networks []map[string]string `json:"networks"`
+		}
+		for _, typ := range types {
+			cfg.Networks = append(cfg.Networks, map[string]string{"type": typ})
+		}
+		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.TODO()})
+		t.Cleanup(cancel)
+		v, err := ctx.LoadModuleByID("point-c", json.RawMessage(test_helpers.JSONMarshal[[]byte](t, cfg)))
+		require.NoError(t, err)
+		return v.(caddy.App)
+	}
+
+	t.Run("order", func(t *testing.T) {
+		var events []string
+		app := load(t, newLifecycleNetwork("a", &events, false), newLifecycleNetwork("b", &events, false))
+		require.Empty(t, events, "networks brought up when provisioned")
+		require.NoError(t, app.Start())
+		require.NoError(t, app.Start())
+		require.Equal(t, []string{"up a", "up b"}, events)
+		require.NoError(t, app.Stop())
+		require.Equal(t, []string{"up a", "up b", "down b", "down a"}, events)
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		var events []string
+		app := load(t, newLifecycleNetwork("a", &events, false), newLifecycleNetwork("b", &events, true), newLifecycleNetwork("c", &events, false))
+		require.Error(t, app.Start())
+		require.Equal(t, []string{"up a", "up b", "down a"}, events)
+		require.NoError(t, app.Stop())
+		require.Equal(t, []string{"up a", "up b", "down a"}, events)
+	})
+}
+
 func TestPointc_Lookup(t *testing.T) {
 	t.Run("not exists", func(t *testing.T) {
 		ctx, cancel := caddy.NewContext(caddy.Context{Context: context.TODO()})
@@ -136,7 +209,45 @@ func TestPointc_UnmarshalCaddyfile(t *testing.T) {
 			} else {
 				require.NoError(t, err, "UnmarshalCaddyfile()")
 			}
-			require.JSONEq(t, test_helpers.JSONMarshal[string](t, pc), tt.json, "caddyfile != json")
+			require.JSONEq(t, test_helpers.JSONMarshal[string](t, &pc), tt.json, "caddyfile != json")
 		})
 	}
 }
+
+// readyNet is a [pointc.Net] that is ready once ready is closed.
+type readyNet struct {
+	pointc.Net
+	ready chan struct{}
+}
+
+func (n *readyNet) WaitReady(ctx context.Context) error {
+	select {
+	case <-n.ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestWaitReady(t *testing.T) {
+	t.Run("not ready", func(t *testing.T) {
+		n := &readyNet{ready: make(chan struct{})}
+		require.ErrorIs(t, pointc.WaitReady(context.Background(), n, time.Millisecond*10), context.DeadlineExceeded)
+	})
+
+	t.Run("ready", func(t *testing.T) {
+		n := &readyNet{ready: make(chan struct{})}
+		close(n.ready)
+		require.NoError(t, pointc.WaitReady(context.Background(), n, time.Second))
+	})
+
+	t.Run("no timeout", func(t *testing.T) {
+		n := &readyNet{ready: make(chan struct{})}
+		require.NoError(t, pointc.WaitReady(context.Background(), n, 0))
+	})
+
+	t.Run("not implemented", func(t *testing.T) {
+		var n pointc.Net
+		require.NoError(t, pointc.WaitReady(context.Background(), n, time.Second))
+	})
+}
@@ -0,0 +1,107 @@
+package point_c
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var _ Resolver = (*Pointc)(nil)
+
+// Domain is the domain point-c network names may be written under, app-server and app-server.pointc are the same net.
+const Domain = "pointc"
+
+// Resolver maps point-c network names to addresses, so modules can refer to peers by name instead of by ip.
+type Resolver interface {
+	// Resolve gets the address of a net by its name.
+	Resolve(host string) (net.IP, error)
+	// DialContext dials an address like app-server.pointc:8080 through the net it names, like [net.Dialer.DialContext].
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Resolve gets the address of a net by its name, with or without the [Domain].
+func (wg *Pointc) Resolve(host string) (net.IP, error) {
+	n, err := wg.resolve(host)
+	if err != nil {
+		return nil, err
+	}
+	return n.LocalAddr(), nil
+}
+
+// resolve gets the net of a hostname, failing if it has no address.
+func (wg *Pointc) resolve(host string) (Net, error) {
+	name := strings.TrimSuffix(strings.TrimSuffix(host, "."), "."+Domain)
+	n, ok := wg.Lookup(name)
+	if !ok {
+		return nil, &net.DNSError{Err: "no such point-c net", Name: host, IsNotFound: true}
+	} else if n.LocalAddr() == nil {
+		return nil, &net.DNSError{Err: "point-c net has no address", Name: host, IsNotFound: true}
+	}
+	return n, nil
+}
+
+// nameOf gets the name of the net with the address, such as the peer a connection came from.
+func (wg *Pointc) nameOf(ip net.IP) (string, bool) {
+	for _, n := range wg.networks {
+		for name, nn := range n.Networks() {
+			if nn.LocalAddr().Equal(ip) {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// DialContext dials an address like app-server.pointc:8080 through the net it names.
+// The network is one of tcp, tcp4, tcp6, udp, udp4, or udp6.
+func (wg *Pointc) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, service, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	n, err := wg.resolve(host)
+	if err != nil {
+		return nil, err
+	}
+	port, err := net.LookupPort(network, service)
+	if err != nil {
+		return nil, err
+	}
+
+	d := n.Dialer(nil, 0)
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return d.Dial(ctx, &net.TCPAddr{IP: n.LocalAddr(), Port: port})
+	case "udp", "udp4", "udp6":
+		pc, err := d.DialPacket(&net.UDPAddr{IP: n.LocalAddr(), Port: port})
+		if err != nil {
+			return nil, err
+		}
+		c, ok := pc.(net.Conn)
+		if !ok {
+			pc.Close()
+			return nil, fmt.Errorf("point-c net %q does not support connected udp", host)
+		}
+		return c, nil
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+}
+
+// Replace is a [github.com/caddyserver/caddy/v2.ReplacerFunc] for the {pointc.net.<name>.ip} placeholders.
+func (wg *Pointc) Replace(key string) (any, bool) {
+	name, ok := strings.CutPrefix(key, "pointc.net.")
+	if !ok {
+		return nil, false
+	}
+	name, ok = strings.CutSuffix(name, ".ip")
+	if !ok {
+		return nil, false
+	}
+	ip, err := wg.Resolve(name)
+	if err != nil {
+		return nil, false
+	}
+	return ip.String(), true
+}
@@ -0,0 +1,90 @@
+package point_c_test
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+	pointc "github.com/trymoose/point-c"
+	"net"
+	"testing"
+)
+
+// staticNetwork is a network module with a fixed set of nets.
+type staticNetwork struct {
+	id   caddy.ModuleID
+	nets map[string]pointc.Net
+}
+
+func (n *staticNetwork) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{ID: n.id, New: func() caddy.Module { return n }}
+}
+
+func (n *staticNetwork) Networks() map[string]pointc.Net { return n.nets }
+
+// dialNet is a [pointc.Net] that records the address dialed and answers with a pipe.
+type dialNet struct {
+	pointc.Net
+	ip     net.IP
+	dialed chan *net.TCPAddr
+}
+
+func (n *dialNet) LocalAddr() net.IP                   { return n.ip }
+func (n *dialNet) Dialer(net.IP, uint16) pointc.Dialer { return n }
+
+func (n *dialNet) Dial(_ context.Context, addr *net.TCPAddr) (net.Conn, error) {
+	n.dialed <- addr
+	c, _ := net.Pipe()
+	return c, nil
+}
+
+func (n *dialNet) DialPacket(*net.UDPAddr) (net.PacketConn, error) { return nil, net.ErrClosed }
+
+func TestPointc_Resolve(t *testing.T) {
+	server := &dialNet{ip: net.IPv4(10, 0, 0, 2), dialed: make(chan *net.TCPAddr, 1)}
+	typ := "test-static-" + uuid.New().String()
+	caddy.RegisterModule(&staticNetwork{
+		id:   caddy.ModuleID("point-c.net." + typ),
+		nets: map[string]pointc.Net{"app-server": server, "no-addr": &dialNet{}},
+	})
+
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.TODO()})
+	defer cancel()
+	v, err := ctx.LoadModuleByID("point-c", json.RawMessage(`{"networks": [{"type": "`+typ+`"}]}`))
+	require.NoError(t, err)
+	pc := v.(*pointc.Pointc)
+
+	t.Run("resolve", func(t *testing.T) {
+		for _, host := range []string{"app-server", "app-server.pointc", "app-server.pointc."} {
+			ip, err := pc.Resolve(host)
+			require.NoError(t, err, host)
+			require.True(t, server.ip.Equal(ip), host)
+		}
+		for _, host := range []string{"missing", "missing.pointc", "no-addr"} {
+			_, err := pc.Resolve(host)
+			var dnsErr *net.DNSError
+			require.ErrorAs(t, err, &dnsErr, host)
+			require.True(t, dnsErr.IsNotFound, host)
+		}
+	})
+
+	t.Run("dial", func(t *testing.T) {
+		c, err := pc.DialContext(context.Background(), "tcp", "app-server.pointc:8080")
+		require.NoError(t, err)
+		require.NoError(t, c.Close())
+		require.Equal(t, &net.TCPAddr{IP: server.ip, Port: 8080}, <-server.dialed)
+
+		_, err = pc.DialContext(context.Background(), "tcp", "missing.pointc:8080")
+		require.Error(t, err)
+		_, err = pc.DialContext(context.Background(), "unix", "app-server.pointc:8080")
+		require.Error(t, err)
+	})
+
+	t.Run("placeholders", func(t *testing.T) {
+		repl := caddy.NewReplacer()
+		repl.Map(pc.Replace)
+		require.Equal(t, "http://10.0.0.2:8080", repl.ReplaceAll("http://{pointc.net.app-server.ip}:8080", ""))
+		require.Equal(t, "", repl.ReplaceAll("{pointc.net.missing.ip}", ""))
+	})
+}